@@ -2,13 +2,16 @@ module github.com/orgs/accanto-systems/lm-operator
 
 require (
 	github.com/NYTimes/gziphandler v1.0.1 // indirect
+	github.com/Shopify/sarama v1.23.1
 	github.com/blang/semver v3.5.1+incompatible // indirect
 	github.com/go-logr/logr v0.1.0
 	github.com/go-openapi/spec v0.19.0
 	github.com/go-resty/resty/v2 v2.0.0
+	github.com/gocql/gocql v0.0.0-20190810123941-df4b9cc33030
 	github.com/gorilla/mux v1.7.3
 	github.com/kenjones-cisco/mergo v0.0.0-20161024152414-0149f50ea824 // indirect
 	github.com/operator-framework/operator-sdk v0.10.1-0.20190809033248-9d6ffddcd86f
+	github.com/prometheus/client_golang v0.9.3
 	github.com/sglover/toscalib v0.5.0
 	github.com/spf13/pflag v1.0.3
 	gopkg.in/yaml.v2 v2.2.2
@@ -1,7 +1,11 @@
 package v1alpha1
 
 import (
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -15,6 +19,155 @@ type ServiceDescriptorSpec struct {
 	// Add custom validation using kubebuilder tags: https://book-v1.book.kubebuilder.io/beyond_basics/generating_crd.html
 	JVMOptions string `json:"JVMOptions"`
 	Version    string `json:"Version"`
+	// number of replicas, overriding the number for the deployment type
+	Replicas       *int32                `json:"replicas,omitempty"`
+	Service        KubernetesServiceSpec `json:"service,omitempty"`
+	Probes         ProbesSpec            `json:"probes,omitempty"`
+	Scheduling     SchedulingSpec        `json:"scheduling,omitempty"`
+	Autoscaling    AutoscalingSpec       `json:"autoscaling,omitempty"`
+	Storage        StorageSpec           `json:"storage,omitempty"`
+	PodSecurity    PodSecuritySpec       `json:"podSecurity,omitempty"`
+	ServiceAccount ServiceAccountSpec    `json:"serviceAccount,omitempty"`
+	// partial pod template strategically merged into the one the operator builds, such as extra env, volumes or sidecars
+	PodTemplate *runtime.RawExtension `json:"podTemplate,omitempty"`
+}
+
+// PodSecuritySpec defines the security context of the pods of ALM MicroServices. Set on a MicroService, each field
+// overrides the one set for all of them.
+// +k8s:openapi-gen=true
+type PodSecuritySpec struct {
+	// run the pods with the settings of the restricted Pod Security Standard (defaults to false)
+	Restricted *bool `json:"restricted,omitempty"`
+	// user, group and filesystem group of the pods (default to 1000)
+	RunAsUser  *int64 `json:"runAsUser,omitempty"`
+	RunAsGroup *int64 `json:"runAsGroup,omitempty"`
+	FSGroup    *int64 `json:"fsGroup,omitempty"`
+	// mount the root filesystem of the containers read only (defaults to true)
+	ReadOnlyRootFilesystem *bool `json:"readOnlyRootFilesystem,omitempty"`
+	// paths an emptyDir is mounted at, in addition to /tmp and the MicroService's own writable paths
+	WritablePaths []string `json:"writablePaths,omitempty"`
+}
+
+// NetworkPoliciesSpec defines the NetworkPolicies that restrict the traffic of the LM pods to what LM needs
+// +k8s:openapi-gen=true
+type NetworkPoliciesSpec struct {
+	// deny traffic to and from the LM pods other than that between the MicroServices, from the ingress controller and to
+	// the backing services
+	Enabled bool `json:"enabled,omitempty"`
+	// pods or namespaces of the ingress controller allowed to reach the exposed MicroServices (any source if not set)
+	IngressControllerPeers []networkingv1.NetworkPolicyPeer `json:"ingressControllerPeers,omitempty"`
+	// pods, namespaces or IP blocks of Cassandra, Kafka, Elasticsearch and Vault (any destination on their ports if not set)
+	BackendPeers []networkingv1.NetworkPolicyPeer `json:"backendPeers,omitempty"`
+	// pods, namespaces or IP blocks of Kibana, reached on port 443 (the backendPeers if not set, Kibana is not allowed if
+	// neither is set)
+	KibanaPeers []networkingv1.NetworkPolicyPeer `json:"kibanaPeers,omitempty"`
+	// traffic allowed to every LM pod in addition, such as scraping by Prometheus
+	ExtraIngress []networkingv1.NetworkPolicyIngressRule `json:"extraIngress,omitempty"`
+	// traffic allowed from every LM pod in addition, such as to an LDAP server
+	ExtraEgress []networkingv1.NetworkPolicyEgressRule `json:"extraEgress,omitempty"`
+}
+
+// TrustedCASpec references the PEM encoded certificates of CAs the LM JVMs trust, such as a corporate CA issuing the
+// certificates of Vault, LDAP or Kafka
+// +k8s:openapi-gen=true
+type TrustedCASpec struct {
+	// ConfigMap holding the certificates
+	ConfigMap string `json:"configMap,omitempty"`
+	// Secret holding the certificates, instead of a ConfigMap
+	Secret string `json:"secret,omitempty"`
+	// key of the certificates in the ConfigMap or Secret (defaults to ca.crt)
+	Key string `json:"key,omitempty"`
+}
+
+// ServiceAccountSpec defines the ServiceAccount the pods of an ALM MicroService run as
+// +k8s:openapi-gen=true
+type ServiceAccountSpec struct {
+	// create the ServiceAccount (defaults to true), otherwise it must already exist
+	Create *bool `json:"create,omitempty"`
+	// defaults to <ALM name>-<MicroService>
+	Name string `json:"name,omitempty"`
+	// mount an API token in the pods (defaults to false)
+	AutomountServiceAccountToken *bool `json:"automountServiceAccountToken,omitempty"`
+	// annotations added to a created ServiceAccount, such as those binding it to a cloud IAM role
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// StorageSpec defines the persistent volume of an ALM MicroService run as a StatefulSet
+// +k8s:openapi-gen=true
+type StorageSpec struct {
+	// give each replica a PersistentVolumeClaim, mounted at mountPath
+	Enabled bool `json:"enabled,omitempty"`
+	// defaults to the cluster's default storage class
+	StorageClassName string `json:"storageClassName,omitempty"`
+	// defaults to 10Gi, claims are expanded when it is increased if the storage class allows it
+	Size string `json:"size,omitempty"`
+	// defaults to /var/lm/logs
+	MountPath string `json:"mountPath,omitempty"`
+}
+
+// AutoscalingSpec defines the HorizontalPodAutoscaler of a stateless ALM MicroService
+// +k8s:openapi-gen=true
+type AutoscalingSpec struct {
+	// scale the MicroService with a HorizontalPodAutoscaler instead of a fixed number of replicas
+	Enabled bool `json:"enabled,omitempty"`
+	// defaults to the number of replicas for the deployment type
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+	MaxReplicas int32  `json:"maxReplicas,omitempty"`
+	// average CPU utilization, as a percentage of the CPU requested, to scale at (defaults to 80 unless metrics are set)
+	TargetCPUUtilizationPercentage *int32 `json:"targetCPUUtilizationPercentage,omitempty"`
+	// metrics to scale on, such as custom or external metrics, in addition to the CPU target
+	Metrics []autoscalingv2beta2.MetricSpec `json:"metrics,omitempty"`
+}
+
+// SchedulingSpec defines where the pods of ALM MicroServices are scheduled. Set on a MicroService, each field overrides
+// the one set for all of them.
+// +k8s:openapi-gen=true
+type SchedulingSpec struct {
+	NodeSelector map[string]string   `json:"nodeSelector,omitempty"`
+	Tolerations  []corev1.Toleration `json:"tolerations,omitempty"`
+	// replaces the operator's default anti-affinity, which spreads the replicas of a MicroService across nodes and zones
+	Affinity          *corev1.Affinity `json:"affinity,omitempty"`
+	PriorityClassName string           `json:"priorityClassName,omitempty"`
+}
+
+// ProbesSpec tunes the health checks of an ALM MicroService
+// +k8s:openapi-gen=true
+type ProbesSpec struct {
+	// restarts the service when it stops responding
+	Liveness ProbeSpec `json:"liveness,omitempty"`
+	// removes the service from its Service's endpoints until it is ready
+	Readiness ProbeSpec `json:"readiness,omitempty"`
+	// how long the JVM is given to start before the liveness probe applies (folded into the liveness probe's delay
+	// before Kubernetes 1.18)
+	Startup ProbeSpec `json:"startup,omitempty"`
+}
+
+// ProbeSpec tunes a single health check, unset fields keep the operator's defaults
+// +k8s:openapi-gen=true
+type ProbeSpec struct {
+	// run the probe (defaults to true)
+	Enabled *bool `json:"enabled,omitempty"`
+	// path of the health endpoint (defaults to /management/info for liveness and startup, /management/health for readiness)
+	Path                string `json:"path,omitempty"`
+	InitialDelaySeconds int32  `json:"initialDelaySeconds,omitempty"`
+	PeriodSeconds       int32  `json:"periodSeconds,omitempty"`
+	TimeoutSeconds      int32  `json:"timeoutSeconds,omitempty"`
+	FailureThreshold    int32  `json:"failureThreshold,omitempty"`
+}
+
+// KubernetesServiceSpec defines the Kubernetes Service an ALM MicroService is reached through
+// +k8s:openapi-gen=true
+type KubernetesServiceSpec struct {
+	// ClusterIP (default), NodePort or LoadBalancer
+	Type string `json:"type,omitempty"`
+	// fixed node port of the http port with the NodePort and LoadBalancer types (allocated by Kubernetes if not set)
+	NodePort int32 `json:"nodePort,omitempty"`
+	// annotations added to the Service, such as those configuring a cloud load balancer
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// ports exposed in addition to the http port
+	ExtraPorts []corev1.ServicePort `json:"extraPorts,omitempty"`
+	// client IP ranges allowed to reach a LoadBalancer Service
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
 }
 
 // NimrodDescriptorSpec defines the desired state of the Nimrod ALM MicroService
@@ -29,6 +182,17 @@ type NimrodDescriptorSpec struct {
 	ThemesConfigMap string `json:"ThemesConfigMap"`
 	// lm-locales
 	LocalesConfigMap string `json:"LocalesConfigMap"`
+	// number of replicas, overriding the number for the deployment type
+	Replicas       *int32                `json:"replicas,omitempty"`
+	Service        KubernetesServiceSpec `json:"service,omitempty"`
+	Probes         ProbesSpec            `json:"probes,omitempty"`
+	Scheduling     SchedulingSpec        `json:"scheduling,omitempty"`
+	Autoscaling    AutoscalingSpec       `json:"autoscaling,omitempty"`
+	Storage        StorageSpec           `json:"storage,omitempty"`
+	PodSecurity    PodSecuritySpec       `json:"podSecurity,omitempty"`
+	ServiceAccount ServiceAccountSpec    `json:"serviceAccount,omitempty"`
+	// partial pod template strategically merged into the one the operator builds, such as extra env, volumes or sidecars
+	PodTemplate *runtime.RawExtension `json:"podTemplate,omitempty"`
 }
 
 // ConfiguratorDescriptorSpec defines the desired state of the Configurator ALM MicroService
@@ -39,6 +203,192 @@ type ConfiguratorDescriptorSpec struct {
 	// Add custom validation using kubebuilder tags: https://book-v1.book.kubebuilder.io/beyond_basics/generating_crd.html
 	JVMOptions string `json:"JVMOptions"`
 	Run        bool   `json:"Run"`
+	// number of retries before the configurator Job is considered failed (defaults to 2)
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+	// maximum time in seconds the configurator Job may run for (defaults to 1800)
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+	// number of lines of a failed configurator pod's log to report (defaults to 50)
+	FailureLogLines *int64 `json:"failureLogLines,omitempty"`
+	// stages to enable or skip, stages that are not listed are run
+	Stages         []ConfiguratorStageSpec `json:"stages,omitempty"`
+	PodSecurity    PodSecuritySpec         `json:"podSecurity,omitempty"`
+	ServiceAccount ServiceAccountSpec      `json:"serviceAccount,omitempty"`
+}
+
+// ConfiguratorStageSpec enables or skips a single stage of the LM configurator
+// +k8s:openapi-gen=true
+type ConfiguratorStageSpec struct {
+	// one of kafkaTopics, janusgraphSchema, certificates, ldap or configImport
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// KafkaSpec defines how LM's Kafka topics are managed
+// +k8s:openapi-gen=true
+type KafkaSpec struct {
+	// create and reconcile LM's Kafka topics from the operator instead of the configurator
+	ManageTopics bool `json:"manageTopics,omitempty"`
+	// Kafka bootstrap brokers (defaults to foundation-kafka:9092)
+	Brokers []string `json:"brokers,omitempty"`
+	// Kafka protocol version (defaults to 2.0.0)
+	Version string `json:"version,omitempty"`
+	// number of partitions for each LM topic (defaults to 1)
+	Partitions int32 `json:"partitions,omitempty"`
+	// replication factor for each LM topic (defaults to 1)
+	ReplicationFactor int16 `json:"replicationFactor,omitempty"`
+}
+
+// CassandraSpec defines how LM's Cassandra keyspaces and role are managed
+// +k8s:openapi-gen=true
+type CassandraSpec struct {
+	// create LM's keyspaces and reconcile their replication from the operator
+	ManageKeyspaces bool `json:"manageKeyspaces,omitempty"`
+	// create a dedicated Cassandra role for this ALM and pass it to the configurator
+	ManageRole bool `json:"manageRole,omitempty"`
+	// name of the Cassandra role (defaults to lm_<namespace>_<ALM name>)
+	RoleName string `json:"roleName,omitempty"`
+	// Cassandra contact points (defaults to foundation-cassandra)
+	Hosts []string `json:"hosts,omitempty"`
+	// Cassandra native protocol port (defaults to 9042)
+	Port int32 `json:"port,omitempty"`
+	// name of a Secret with the username and password of a Cassandra superuser
+	AdminSecret string `json:"adminSecret,omitempty"`
+	// SimpleStrategy (default) or NetworkTopologyStrategy
+	ReplicationStrategy string `json:"replicationStrategy,omitempty"`
+	// replication factor used with SimpleStrategy (defaults to 1)
+	ReplicationFactor int32 `json:"replicationFactor,omitempty"`
+	// replication factor per datacenter used with NetworkTopologyStrategy
+	DatacenterReplicationFactors map[string]int32 `json:"datacenterReplicationFactors,omitempty"`
+}
+
+// ElasticsearchSpec defines how LM's Elasticsearch index templates and lifecycle policies are managed
+// +k8s:openapi-gen=true
+type ElasticsearchSpec struct {
+	// install LM's index templates and lifecycle policies from the operator
+	ManageIndices bool `json:"manageIndices,omitempty"`
+	// Elasticsearch REST endpoint (defaults to http://foundation-elasticsearch-client:9200)
+	URL string `json:"url,omitempty"`
+	// name of a Secret with the username and password used to call Elasticsearch
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+	// name of the Secret holding the CA certificate Elasticsearch's TLS certificate is signed by (the system CAs if not set)
+	CASecret string `json:"caSecret,omitempty"`
+	// key of the CA certificate in the CA Secret (defaults to ca.crt)
+	CAKey string `json:"caKey,omitempty"`
+	// call Elasticsearch without verifying its TLS certificate
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// number of primary shards for LM indices (defaults to 3 for ha, otherwise 1)
+	Shards int32 `json:"shards,omitempty"`
+	// number of replicas for LM indices (defaults to 1 for ha, otherwise 0)
+	Replicas *int32 `json:"replicas,omitempty"`
+	// size at which the lm-logs index is rolled over (defaults to 5gb)
+	RolloverMaxSize string `json:"rolloverMaxSize,omitempty"`
+	// age at which the lm-logs index is rolled over (defaults to 1d)
+	RolloverMaxAge string `json:"rolloverMaxAge,omitempty"`
+	// age at which rolled over lm-logs indices are deleted (defaults to 30d)
+	Retention string `json:"retention,omitempty"`
+}
+
+// VaultSpec defines how LM services authenticate with Vault
+// +k8s:openapi-gen=true
+type VaultSpec struct {
+	// authenticate LM pods with Vault's Kubernetes auth method instead of a static token
+	KubernetesAuth bool `json:"kubernetesAuth,omitempty"`
+	// Vault address (defaults to https://vault:8200)
+	Address string `json:"address,omitempty"`
+	// path the Kubernetes auth method is mounted at (defaults to kubernetes)
+	AuthPath string `json:"authPath,omitempty"`
+	// Vault role bound to the ServiceAccounts of conductor and the LM configurator (defaults to <ALM name>-lm)
+	Role string `json:"role,omitempty"`
+	// Vault policies granted to the role (defaults to lm)
+	Policies []string `json:"policies,omitempty"`
+	// Kubernetes API address Vault uses to review service account tokens (defaults to https://kubernetes.default.svc)
+	KubernetesHost string `json:"kubernetesHost,omitempty"`
+	// name of a Secret with a token key holding a Vault token allowed to configure the auth method
+	AdminSecret string `json:"adminSecret,omitempty"`
+	// name of the Secret holding the static LM token used without Kubernetes auth (defaults to vault-token)
+	TokenSecret string `json:"tokenSecret,omitempty"`
+	// key of the static LM token in the token Secret (defaults to lmToken)
+	TokenKey string `json:"tokenKey,omitempty"`
+	// name of the Secret holding the CA certificate Vault's TLS certificate is signed by (defaults to vault-cert)
+	CASecret string `json:"caSecret,omitempty"`
+	// key of the CA certificate in the CA Secret (defaults to ca.crt)
+	CAKey string `json:"caKey,omitempty"`
+	// call Vault without verifying its TLS certificate when there is no CA Secret
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// create the KV mount, paths and policy LM expects and store the generated LM credentials in Vault
+	ManageSecrets bool `json:"manageSecrets,omitempty"`
+	// path of the KV version 2 secret engine used by LM (defaults to secret)
+	SecretsMount string `json:"secretsMount,omitempty"`
+	// path within the secret engine under which LM's secrets are stored (defaults to lm)
+	SecretsPath string `json:"secretsPath,omitempty"`
+}
+
+// CertManagerSpec defines how LM's TLS certificates are requested from cert-manager
+// +k8s:openapi-gen=true
+type CertManagerSpec struct {
+	// request LM's certificates from cert-manager instead of generating them in the configurator
+	Enabled bool `json:"enabled,omitempty"`
+	// name of the cert-manager Issuer or ClusterIssuer that signs LM's certificates
+	IssuerName string `json:"issuerName,omitempty"`
+	// Issuer (default) or ClusterIssuer
+	IssuerKind string `json:"issuerKind,omitempty"`
+	// requested lifetime of the certificates, such as 2160h (defaults to the issuer's)
+	Duration string `json:"duration,omitempty"`
+	// how long before expiry the certificates are renewed, such as 360h (defaults to the issuer's)
+	RenewBefore string `json:"renewBefore,omitempty"`
+}
+
+// CertificateMonitoringSpec defines how the certificates LM services use are monitored
+// +k8s:openapi-gen=true
+type CertificateMonitoringSpec struct {
+	// check the expiry of the certificates in LM's certificate Secrets
+	Enabled bool `json:"enabled,omitempty"`
+	// raise a warning when a certificate expires within each of these numbers of days (defaults to 30, 7 and 1)
+	WarningDays []int32 `json:"warningDays,omitempty"`
+	// restart the LM services that mount a certificate Secret, one at a time, when its content changes
+	RestartOnChange bool `json:"restartOnChange,omitempty"`
+}
+
+// IngressSpec defines how an LM service is exposed outside the cluster
+// +k8s:openapi-gen=true
+type IngressSpec struct {
+	// create an Ingress for the service (defaults to true for ishtar and nimrod and false for brent)
+	Enabled *bool `json:"enabled,omitempty"`
+	// host the service is exposed on (defaults to app.lm for ishtar, ui.lm for nimrod and brent.lm for brent)
+	Host string `json:"host,omitempty"`
+	// path the service is exposed on (defaults to /)
+	Path string `json:"path,omitempty"`
+	// ingress class of the ingress controller that serves the Ingress
+	IngressClassName string `json:"ingressClassName,omitempty"`
+	// Secret holding the TLS certificate for the host (defaults to <service>-tls)
+	TLSSecret string `json:"tlsSecret,omitempty"`
+	// annotations added to the Ingress, overriding the operator's defaults
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// GatewayReference identifies the Gateway API Gateway that LM's HTTPRoutes attach to
+// +k8s:openapi-gen=true
+type GatewayReference struct {
+	Name string `json:"name,omitempty"`
+	// defaults to the namespace of the ALM
+	Namespace string `json:"namespace,omitempty"`
+	// listener of the Gateway to attach to (defaults to all of them)
+	SectionName string `json:"sectionName,omitempty"`
+}
+
+// IngressesSpec defines how the LM services exposed outside the cluster are published
+// +k8s:openapi-gen=true
+type IngressesSpec struct {
+	// Ingress (networking.k8s.io/v1), LegacyIngress (extensions/v1beta1), Route (OpenShift) or HTTPRoute (Gateway API),
+	// detected from the APIs the cluster serves if not set
+	Strategy string           `json:"strategy,omitempty"`
+	Gateway  GatewayReference `json:"gateway,omitempty"`
+	// copy the certificate and private key of the TLS Secrets into Routes, where anyone who can read Routes can read
+	// the key. Routes use the router's default certificate otherwise.
+	InlineRouteCertificates bool        `json:"inlineRouteCertificates,omitempty"`
+	Ishtar                  IngressSpec `json:"ishtar,omitempty"`
+	Nimrod                  IngressSpec `json:"nimrod,omitempty"`
+	Brent                   IngressSpec `json:"brent,omitempty"`
 }
 
 // ALMSpec defines the desired state of ALM
@@ -54,6 +404,18 @@ type ALMSpec struct {
 	DockerRepo             string                     `json:"dockerRepo"`
 	Release                string                     `json:"release"`
 	Configurator           ConfiguratorDescriptorSpec `json:"configurator"`
+	Kafka                  KafkaSpec                  `json:"kafka,omitempty"`
+	Cassandra              CassandraSpec              `json:"cassandra,omitempty"`
+	Elasticsearch          ElasticsearchSpec          `json:"elasticsearch,omitempty"`
+	Vault                  VaultSpec                  `json:"vault,omitempty"`
+	CertManager            CertManagerSpec            `json:"certManager,omitempty"`
+	CertificateMonitoring  CertificateMonitoringSpec  `json:"certificateMonitoring,omitempty"`
+	Ingress                IngressesSpec              `json:"ingress,omitempty"`
+	Scheduling             SchedulingSpec             `json:"scheduling,omitempty"`
+	PodSecurity            PodSecuritySpec            `json:"podSecurity,omitempty"`
+	NetworkPolicies        NetworkPoliciesSpec        `json:"networkPolicies,omitempty"`
+	PodTemplate            *runtime.RawExtension      `json:"podTemplate,omitempty"`
+	TrustedCA              TrustedCASpec              `json:"trustedCA,omitempty"`
 	Conductor              ServiceDescriptorSpec      `json:"conductor"`
 	Apollo                 ServiceDescriptorSpec      `json:"apollo"`
 	Galileo                ServiceDescriptorSpec      `json:"galileo"`
@@ -73,7 +435,135 @@ type ALMStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "operator-sdk generate k8s" to regenerate code after modifying this file
 	// Add custom validation using kubebuilder tags: https://book-v1.book.kubebuilder.io/beyond_basics/generating_crd.html
-	IshtarHealthy bool `json:"ishtarHealthy"`
+	IshtarHealthy bool                `json:"ishtarHealthy"`
+	Configurator  ConfiguratorStatus  `json:"configurator,omitempty"`
+	Kafka         KafkaStatus         `json:"kafka,omitempty"`
+	Cassandra     CassandraStatus     `json:"cassandra,omitempty"`
+	Elasticsearch ElasticsearchStatus `json:"elasticsearch,omitempty"`
+	Vault         VaultStatus         `json:"vault,omitempty"`
+	Certificates  CertificatesStatus  `json:"certificates,omitempty"`
+	// the API LM services are exposed outside the cluster with
+	Exposure   string         `json:"exposure,omitempty"`
+	Conditions []ALMCondition `json:"conditions,omitempty"`
+}
+
+// ALMConditionType is the type of an ALM condition
+type ALMConditionType string
+
+const (
+	// ALMReferencesResolved is true when the ConfigMaps and Secrets the spec refers to exist
+	ALMReferencesResolved ALMConditionType = "ReferencesResolved"
+)
+
+// ALMCondition describes an aspect of the observed state of an ALM
+// +k8s:openapi-gen=true
+type ALMCondition struct {
+	Type   ALMConditionType       `json:"type"`
+	Status corev1.ConditionStatus `json:"status"`
+	// when the status last changed
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	Reason             string      `json:"reason,omitempty"`
+	Message            string      `json:"message,omitempty"`
+}
+
+// CertificatesStatus defines the observed state of LM's TLS certificates
+// +k8s:openapi-gen=true
+type CertificatesStatus struct {
+	// true when every certificate requested from cert-manager has been issued
+	Ready bool `json:"ready"`
+	// certificates that have not been issued yet
+	Pending []string `json:"pending,omitempty"`
+	// Secrets holding the certificates LM services use
+	Secrets []CertificateSecretStatus `json:"secrets,omitempty"`
+	// LM services waiting to be restarted, in order, after a certificate Secret changed
+	PendingRestarts []string `json:"pendingRestarts,omitempty"`
+	// value of the restart annotation set on the pods of restarted services
+	RestartRevision string `json:"restartRevision,omitempty"`
+}
+
+// CertificateSecretStatus defines the observed state of a Secret holding certificates
+// +k8s:openapi-gen=true
+type CertificateSecretStatus struct {
+	Name string `json:"name"`
+	// hash of the Secret's data, used to detect changes
+	Hash string `json:"hash"`
+	// subject and expiry of the certificate in the Secret that expires first
+	Subject  string       `json:"subject,omitempty"`
+	NotAfter *metav1.Time `json:"notAfter,omitempty"`
+	// smallest warning threshold, in days, that has been reported for the certificate
+	WarnedDays *int32 `json:"warnedDays,omitempty"`
+}
+
+// VaultStatus defines the observed state of LM's Vault authentication
+// +k8s:openapi-gen=true
+type VaultStatus struct {
+	// true when Vault is reachable and the Kubernetes auth role for LM is configured
+	KubernetesAuthReady bool `json:"kubernetesAuthReady"`
+	// the Vault role LM pods log in with
+	Role string `json:"role,omitempty"`
+	// why Kubernetes auth is not ready
+	AuthMessage string `json:"authMessage,omitempty"`
+	// true when LM's secret engine, policy and credentials exist in Vault
+	SecretsReady bool `json:"secretsReady,omitempty"`
+	// why LM's secrets are not ready
+	SecretsMessage string `json:"secretsMessage,omitempty"`
+	// value of the rotate annotation that was last acted on
+	LastRotation string `json:"lastRotation,omitempty"`
+}
+
+// ElasticsearchStatus defines the observed state of LM's index templates and lifecycle policies
+// +k8s:openapi-gen=true
+type ElasticsearchStatus struct {
+	// true when every LM index template and lifecycle policy has been installed
+	IndicesReady bool `json:"indicesReady"`
+	// hash of the templates and policies that were last installed
+	AppliedHash string `json:"appliedHash,omitempty"`
+	// why the templates, policies or lm-logs alias are not ready
+	Message string `json:"message,omitempty"`
+}
+
+// CassandraStatus defines the observed state of LM's Cassandra keyspaces and role
+// +k8s:openapi-gen=true
+type CassandraStatus struct {
+	// true when every LM keyspace exists with the configured replication
+	KeyspacesReady bool `json:"keyspacesReady"`
+	// hash of the replication last set on the keyspaces
+	KeyspacesHash string `json:"keyspacesHash,omitempty"`
+	// the Cassandra role created for this ALM
+	Role string `json:"role,omitempty"`
+	// hash of the password and grants last set on the role
+	RoleHash string `json:"roleHash,omitempty"`
+	// why the keyspaces or role could not be reconciled
+	Message string `json:"message,omitempty"`
+}
+
+// KafkaStatus defines the observed state of LM's Kafka topics
+// +k8s:openapi-gen=true
+type KafkaStatus struct {
+	// true when every LM topic exists and matches the catalogue
+	TopicsReady bool `json:"topicsReady"`
+	// differences between the topic catalogue and Kafka that the operator cannot reconcile
+	Drift []string `json:"drift,omitempty"`
+	// why the topics could not be reconciled
+	Message string `json:"message,omitempty"`
+}
+
+// ConfiguratorStatus defines the observed state of the LM configurator Job
+// +k8s:openapi-gen=true
+type ConfiguratorStatus struct {
+	// Running, Succeeded or Failed
+	Phase string `json:"phase,omitempty"`
+	// name of the configurator Job the phase refers to
+	JobName string `json:"jobName,omitempty"`
+	Message string `json:"message,omitempty"`
+	// tail of the failed configurator pod's log, with credentials masked
+	FailureLog string `json:"failureLog,omitempty"`
+	// value of the retry annotation that was last acted on
+	LastRetry string `json:"lastRetry,omitempty"`
+	// stages the configurator Job has completed
+	CompletedStages []string `json:"completedStages,omitempty"`
+	// stages the configurator Job was asked to skip
+	SkippedStages []string `json:"skippedStages,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
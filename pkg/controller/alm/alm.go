@@ -9,6 +9,7 @@ import (
 
 type serviceDeploymentInfo struct {
 	serviceName    string
+	instance       string
 	imageName      string
 	imageVersion   string
 	port           int32
@@ -20,6 +21,17 @@ type serviceDeploymentInfo struct {
 	memoryRequests string
 	memoryLimits   string
 	heap           string
+	serviceSpec    comv1alpha1.KubernetesServiceSpec
+	probes         comv1alpha1.ProbesSpec
+	scheduling     comv1alpha1.SchedulingSpec
+	autoscaling    comv1alpha1.AutoscalingSpec
+	storage        storageSettings
+	podSecurity    podSecuritySettings
+	serviceAccount serviceAccountSettings
+	podTemplate    []byte
+	trustedCA      trustedCASettings
+	// the cluster runs startup probes
+	startupProbes bool
 }
 
 type nimrodServiceDeploymentInfo struct {
@@ -30,7 +42,11 @@ type nimrodServiceDeploymentInfo struct {
 
 type configuratorDeploymentInfo struct {
 	serviceDeploymentInfo
-	run bool
+	run                   bool
+	backoffLimit          int32
+	activeDeadlineSeconds int64
+	failureLogLines       int64
+	stages                []string
 }
 
 type deploymentInfo struct {
@@ -48,95 +64,325 @@ type deploymentInfo struct {
 	brent        serviceDeploymentInfo
 }
 
+// overrideReplicas sets the number of replicas of an LM service to the number in the spec, if set
+func overrideReplicas(service *serviceDeploymentInfo, replicas *int32) {
+	if replicas != nil {
+		service.numReplicas = *replicas
+	}
+}
+
+// servicePointers returns the LM services, to be changed in place
+func (d *deploymentInfo) servicePointers() []*serviceDeploymentInfo {
+	return []*serviceDeploymentInfo{&d.conductor, &d.apollo, &d.galileo, &d.talledega, &d.daytona, &d.relay, &d.watchtower,
+		&d.doki, &d.nimrod.serviceDeploymentInfo, &d.ishtar, &d.brent}
+}
+
+// services returns the LM services in the order they are installed
+func (d deploymentInfo) services() []serviceDeploymentInfo {
+	return []serviceDeploymentInfo{d.conductor, d.apollo, d.galileo, d.talledega, d.daytona, d.relay, d.watchtower, d.doki,
+		d.nimrod.serviceDeploymentInfo, d.ishtar, d.brent}
+}
+
 func createDeploymentInfo(instance *comv1alpha1.ALM, reqLogger logr.Logger) (deploymentInfo, error) {
 	lmRelease, err := getLMRelease(instance.Spec.Release, reqLogger)
 	if err != nil {
 		return deploymentInfo{}, err
 	}
 
+	trustedCA, err := getTrustedCASettings(instance.Spec.TrustedCA)
+	if err != nil {
+		return deploymentInfo{}, err
+	}
+	if err := validateStorage(instance); err != nil {
+		return deploymentInfo{}, err
+	}
+
 	deploymentInfo := deploymentInfo{}
-	deploymentInfo.configurator.serviceName = "lm-configurator"
+	deploymentInfo.configurator.serviceName = lmConfiguratorService
+	deploymentInfo.configurator.instance = instance.Name
 	deploymentInfo.configurator.imageName = "lm-configurator"
 	deploymentInfo.configurator.imageVersion = lmRelease.Configurator.Version
 	deploymentInfo.configurator.numReplicas = int32(1)
 	deploymentInfo.configurator.run = instance.Spec.Configurator.Run
+	deploymentInfo.configurator.backoffLimit = int32(2)
+	if instance.Spec.Configurator.BackoffLimit != nil {
+		deploymentInfo.configurator.backoffLimit = *instance.Spec.Configurator.BackoffLimit
+	}
+	deploymentInfo.configurator.activeDeadlineSeconds = int64(1800)
+	if instance.Spec.Configurator.ActiveDeadlineSeconds != nil {
+		deploymentInfo.configurator.activeDeadlineSeconds = *instance.Spec.Configurator.ActiveDeadlineSeconds
+	}
+	deploymentInfo.configurator.failureLogLines = int64(50)
+	if instance.Spec.Configurator.FailureLogLines != nil {
+		deploymentInfo.configurator.failureLogLines = *instance.Spec.Configurator.FailureLogLines
+	}
+	deploymentInfo.configurator.podSecurity = getPodSecuritySettings(lmConfiguratorService, instance.Spec.PodSecurity, instance.Spec.Configurator.PodSecurity)
+	deploymentInfo.configurator.serviceAccount = getServiceAccountSettings(instance, lmConfiguratorService)
+	deploymentInfo.configurator.trustedCA = trustedCA
+	deploymentInfo.configurator.stages, err = selectConfiguratorStages(instance.Spec.Configurator.Stages)
+	if err != nil {
+		return deploymentInfo, err
+	}
+	if instance.Spec.Kafka.ManageTopics {
+		// the operator creates the topics itself
+		deploymentInfo.configurator.stages = removeStage(deploymentInfo.configurator.stages, "kafkaTopics")
+	}
+	if instance.Spec.CertManager.Enabled {
+		// certificates are requested from cert-manager instead
+		deploymentInfo.configurator.stages = removeStage(deploymentInfo.configurator.stages, "certificates")
+	}
 
 	deploymentInfo.conductor.serviceName = "conductor"
+	deploymentInfo.conductor.instance = instance.Name
 	deploymentInfo.conductor.port = 8761
 	deploymentInfo.conductor.targetPort = 8761
 	deploymentInfo.conductor.nodePort = -1
 	deploymentInfo.conductor.imageName = "conductor"
 	deploymentInfo.conductor.imageVersion = lmRelease.Conductor.Version
+	deploymentInfo.conductor.serviceSpec = instance.Spec.Conductor.Service
+	deploymentInfo.conductor.probes = instance.Spec.Conductor.Probes
+	deploymentInfo.conductor.autoscaling = instance.Spec.Conductor.Autoscaling
+	deploymentInfo.conductor.scheduling = getSchedulingSettings(instance.Spec.Scheduling, instance.Spec.Conductor.Scheduling)
+	deploymentInfo.conductor.podSecurity = getPodSecuritySettings("conductor", instance.Spec.PodSecurity, instance.Spec.Conductor.PodSecurity)
+	deploymentInfo.conductor.serviceAccount = getServiceAccountSettings(instance, "conductor")
+	deploymentInfo.conductor.trustedCA = trustedCA
+	deploymentInfo.conductor.podTemplate, err = getPodTemplatePatch("conductor", instance.Spec.PodTemplate, instance.Spec.Conductor.PodTemplate)
+	if err != nil {
+		return deploymentInfo, err
+	}
+	deploymentInfo.conductor.storage, err = getStorageSettings("conductor", instance.Spec.Conductor.Storage)
+	if err != nil {
+		return deploymentInfo, err
+	}
+	if instance.Spec.Conductor.Service.NodePort > 0 {
+		deploymentInfo.conductor.nodePort = instance.Spec.Conductor.Service.NodePort
+	}
 
 	deploymentInfo.apollo.serviceName = "apollo"
+	deploymentInfo.apollo.instance = instance.Name
 	deploymentInfo.apollo.port = 8282
 	deploymentInfo.apollo.targetPort = 8282
 	deploymentInfo.apollo.nodePort = -1
 	deploymentInfo.apollo.imageName = "apollo"
 	deploymentInfo.apollo.imageVersion = lmRelease.Apollo.Version
+	deploymentInfo.apollo.serviceSpec = instance.Spec.Apollo.Service
+	deploymentInfo.apollo.probes = instance.Spec.Apollo.Probes
+	deploymentInfo.apollo.autoscaling = instance.Spec.Apollo.Autoscaling
+	deploymentInfo.apollo.scheduling = getSchedulingSettings(instance.Spec.Scheduling, instance.Spec.Apollo.Scheduling)
+	deploymentInfo.apollo.podSecurity = getPodSecuritySettings("apollo", instance.Spec.PodSecurity, instance.Spec.Apollo.PodSecurity)
+	deploymentInfo.apollo.serviceAccount = getServiceAccountSettings(instance, "apollo")
+	deploymentInfo.apollo.trustedCA = trustedCA
+	deploymentInfo.apollo.podTemplate, err = getPodTemplatePatch("apollo", instance.Spec.PodTemplate, instance.Spec.Apollo.PodTemplate)
+	if err != nil {
+		return deploymentInfo, err
+	}
+	if instance.Spec.Apollo.Service.NodePort > 0 {
+		deploymentInfo.apollo.nodePort = instance.Spec.Apollo.Service.NodePort
+	}
 
 	deploymentInfo.galileo.serviceName = "galileo"
+	deploymentInfo.galileo.instance = instance.Name
 	deploymentInfo.galileo.port = 8283
 	deploymentInfo.galileo.targetPort = 8283
 	deploymentInfo.galileo.nodePort = -1
 	deploymentInfo.galileo.imageName = "galileo"
 	deploymentInfo.galileo.imageVersion = lmRelease.Galileo.Version
+	deploymentInfo.galileo.serviceSpec = instance.Spec.Galileo.Service
+	deploymentInfo.galileo.probes = instance.Spec.Galileo.Probes
+	deploymentInfo.galileo.autoscaling = instance.Spec.Galileo.Autoscaling
+	deploymentInfo.galileo.scheduling = getSchedulingSettings(instance.Spec.Scheduling, instance.Spec.Galileo.Scheduling)
+	deploymentInfo.galileo.podSecurity = getPodSecuritySettings("galileo", instance.Spec.PodSecurity, instance.Spec.Galileo.PodSecurity)
+	deploymentInfo.galileo.serviceAccount = getServiceAccountSettings(instance, "galileo")
+	deploymentInfo.galileo.trustedCA = trustedCA
+	deploymentInfo.galileo.podTemplate, err = getPodTemplatePatch("galileo", instance.Spec.PodTemplate, instance.Spec.Galileo.PodTemplate)
+	if err != nil {
+		return deploymentInfo, err
+	}
+	deploymentInfo.galileo.storage, err = getStorageSettings("galileo", instance.Spec.Galileo.Storage)
+	if err != nil {
+		return deploymentInfo, err
+	}
+	if instance.Spec.Galileo.Service.NodePort > 0 {
+		deploymentInfo.galileo.nodePort = instance.Spec.Galileo.Service.NodePort
+	}
 
 	deploymentInfo.talledega.serviceName = "talledega"
+	deploymentInfo.talledega.instance = instance.Name
 	deploymentInfo.talledega.port = 8287
 	deploymentInfo.talledega.targetPort = 8287
 	deploymentInfo.talledega.nodePort = -1
 	deploymentInfo.talledega.imageName = "talledega"
 	deploymentInfo.talledega.imageVersion = lmRelease.Talledega.Version
+	deploymentInfo.talledega.serviceSpec = instance.Spec.Talledega.Service
+	deploymentInfo.talledega.probes = instance.Spec.Talledega.Probes
+	deploymentInfo.talledega.autoscaling = instance.Spec.Talledega.Autoscaling
+	deploymentInfo.talledega.scheduling = getSchedulingSettings(instance.Spec.Scheduling, instance.Spec.Talledega.Scheduling)
+	deploymentInfo.talledega.podSecurity = getPodSecuritySettings("talledega", instance.Spec.PodSecurity, instance.Spec.Talledega.PodSecurity)
+	deploymentInfo.talledega.serviceAccount = getServiceAccountSettings(instance, "talledega")
+	deploymentInfo.talledega.trustedCA = trustedCA
+	deploymentInfo.talledega.podTemplate, err = getPodTemplatePatch("talledega", instance.Spec.PodTemplate, instance.Spec.Talledega.PodTemplate)
+	if err != nil {
+		return deploymentInfo, err
+	}
+	if instance.Spec.Talledega.Service.NodePort > 0 {
+		deploymentInfo.talledega.nodePort = instance.Spec.Talledega.Service.NodePort
+	}
 
 	deploymentInfo.daytona.serviceName = "daytona"
+	deploymentInfo.daytona.instance = instance.Name
 	deploymentInfo.daytona.port = 8281
 	deploymentInfo.daytona.targetPort = 8281
 	deploymentInfo.daytona.nodePort = -1
 	deploymentInfo.daytona.imageName = "daytona"
 	deploymentInfo.daytona.imageVersion = lmRelease.Daytona.Version
+	deploymentInfo.daytona.serviceSpec = instance.Spec.Daytona.Service
+	deploymentInfo.daytona.probes = instance.Spec.Daytona.Probes
+	deploymentInfo.daytona.autoscaling = instance.Spec.Daytona.Autoscaling
+	deploymentInfo.daytona.scheduling = getSchedulingSettings(instance.Spec.Scheduling, instance.Spec.Daytona.Scheduling)
+	deploymentInfo.daytona.podSecurity = getPodSecuritySettings("daytona", instance.Spec.PodSecurity, instance.Spec.Daytona.PodSecurity)
+	deploymentInfo.daytona.serviceAccount = getServiceAccountSettings(instance, "daytona")
+	deploymentInfo.daytona.trustedCA = trustedCA
+	deploymentInfo.daytona.podTemplate, err = getPodTemplatePatch("daytona", instance.Spec.PodTemplate, instance.Spec.Daytona.PodTemplate)
+	if err != nil {
+		return deploymentInfo, err
+	}
+	if instance.Spec.Daytona.Service.NodePort > 0 {
+		deploymentInfo.daytona.nodePort = instance.Spec.Daytona.Service.NodePort
+	}
 
 	deploymentInfo.nimrod.serviceName = "nimrod"
+	deploymentInfo.nimrod.instance = instance.Name
 	deploymentInfo.nimrod.port = 8290
 	deploymentInfo.nimrod.targetPort = 8290
 	deploymentInfo.nimrod.nodePort = -1
 	deploymentInfo.nimrod.imageName = "nimrod"
 	deploymentInfo.nimrod.imageVersion = lmRelease.Nimrod.Version
+	deploymentInfo.nimrod.themesConfigMap = instance.Spec.Nimrod.ThemesConfigMap
+	deploymentInfo.nimrod.localesConfigMap = instance.Spec.Nimrod.LocalesConfigMap
+	deploymentInfo.nimrod.serviceSpec = instance.Spec.Nimrod.Service
+	deploymentInfo.nimrod.probes = instance.Spec.Nimrod.Probes
+	deploymentInfo.nimrod.autoscaling = instance.Spec.Nimrod.Autoscaling
+	deploymentInfo.nimrod.scheduling = getSchedulingSettings(instance.Spec.Scheduling, instance.Spec.Nimrod.Scheduling)
+	deploymentInfo.nimrod.podSecurity = getPodSecuritySettings("nimrod", instance.Spec.PodSecurity, instance.Spec.Nimrod.PodSecurity)
+	deploymentInfo.nimrod.serviceAccount = getServiceAccountSettings(instance, "nimrod")
+	deploymentInfo.nimrod.trustedCA = trustedCA
+	deploymentInfo.nimrod.podTemplate, err = getPodTemplatePatch("nimrod", instance.Spec.PodTemplate, instance.Spec.Nimrod.PodTemplate)
+	if err != nil {
+		return deploymentInfo, err
+	}
+	if instance.Spec.Nimrod.Service.NodePort > 0 {
+		deploymentInfo.nimrod.nodePort = instance.Spec.Nimrod.Service.NodePort
+	}
 
 	deploymentInfo.ishtar.serviceName = "ishtar"
+	deploymentInfo.ishtar.instance = instance.Name
 	deploymentInfo.ishtar.port = 8280
 	deploymentInfo.ishtar.targetPort = 8280
 	deploymentInfo.ishtar.nodePort = -1
 	deploymentInfo.ishtar.imageName = "ishtar"
 	deploymentInfo.ishtar.imageVersion = lmRelease.Ishtar.Version
+	deploymentInfo.ishtar.serviceSpec = instance.Spec.Ishtar.Service
+	deploymentInfo.ishtar.probes = instance.Spec.Ishtar.Probes
+	deploymentInfo.ishtar.autoscaling = instance.Spec.Ishtar.Autoscaling
+	deploymentInfo.ishtar.scheduling = getSchedulingSettings(instance.Spec.Scheduling, instance.Spec.Ishtar.Scheduling)
+	deploymentInfo.ishtar.podSecurity = getPodSecuritySettings("ishtar", instance.Spec.PodSecurity, instance.Spec.Ishtar.PodSecurity)
+	deploymentInfo.ishtar.serviceAccount = getServiceAccountSettings(instance, "ishtar")
+	deploymentInfo.ishtar.trustedCA = trustedCA
+	deploymentInfo.ishtar.podTemplate, err = getPodTemplatePatch("ishtar", instance.Spec.PodTemplate, instance.Spec.Ishtar.PodTemplate)
+	if err != nil {
+		return deploymentInfo, err
+	}
+	if instance.Spec.Ishtar.Service.NodePort > 0 {
+		deploymentInfo.ishtar.nodePort = instance.Spec.Ishtar.Service.NodePort
+	}
 
 	deploymentInfo.relay.serviceName = "relay"
+	deploymentInfo.relay.instance = instance.Name
 	deploymentInfo.relay.port = 8285
 	deploymentInfo.relay.targetPort = 8285
 	deploymentInfo.relay.nodePort = -1
 	deploymentInfo.relay.imageName = "relay"
 	deploymentInfo.relay.imageVersion = lmRelease.Relay.Version
+	deploymentInfo.relay.serviceSpec = instance.Spec.Relay.Service
+	deploymentInfo.relay.probes = instance.Spec.Relay.Probes
+	deploymentInfo.relay.autoscaling = instance.Spec.Relay.Autoscaling
+	deploymentInfo.relay.scheduling = getSchedulingSettings(instance.Spec.Scheduling, instance.Spec.Relay.Scheduling)
+	deploymentInfo.relay.podSecurity = getPodSecuritySettings("relay", instance.Spec.PodSecurity, instance.Spec.Relay.PodSecurity)
+	deploymentInfo.relay.serviceAccount = getServiceAccountSettings(instance, "relay")
+	deploymentInfo.relay.trustedCA = trustedCA
+	deploymentInfo.relay.podTemplate, err = getPodTemplatePatch("relay", instance.Spec.PodTemplate, instance.Spec.Relay.PodTemplate)
+	if err != nil {
+		return deploymentInfo, err
+	}
+	if instance.Spec.Relay.Service.NodePort > 0 {
+		deploymentInfo.relay.nodePort = instance.Spec.Relay.Service.NodePort
+	}
 
 	deploymentInfo.watchtower.serviceName = "watchtower"
+	deploymentInfo.watchtower.instance = instance.Name
 	deploymentInfo.watchtower.port = 8284
 	deploymentInfo.watchtower.targetPort = 8284
 	deploymentInfo.watchtower.nodePort = -1
 	deploymentInfo.watchtower.imageName = "watchtower"
 	deploymentInfo.watchtower.imageVersion = lmRelease.Watchtower.Version
+	deploymentInfo.watchtower.serviceSpec = instance.Spec.Watchtower.Service
+	deploymentInfo.watchtower.probes = instance.Spec.Watchtower.Probes
+	deploymentInfo.watchtower.autoscaling = instance.Spec.Watchtower.Autoscaling
+	deploymentInfo.watchtower.scheduling = getSchedulingSettings(instance.Spec.Scheduling, instance.Spec.Watchtower.Scheduling)
+	deploymentInfo.watchtower.podSecurity = getPodSecuritySettings("watchtower", instance.Spec.PodSecurity, instance.Spec.Watchtower.PodSecurity)
+	deploymentInfo.watchtower.serviceAccount = getServiceAccountSettings(instance, "watchtower")
+	deploymentInfo.watchtower.trustedCA = trustedCA
+	deploymentInfo.watchtower.podTemplate, err = getPodTemplatePatch("watchtower", instance.Spec.PodTemplate, instance.Spec.Watchtower.PodTemplate)
+	if err != nil {
+		return deploymentInfo, err
+	}
+	if instance.Spec.Watchtower.Service.NodePort > 0 {
+		deploymentInfo.watchtower.nodePort = instance.Spec.Watchtower.Service.NodePort
+	}
 
 	deploymentInfo.doki.serviceName = "doki"
+	deploymentInfo.doki.instance = instance.Name
 	deploymentInfo.doki.port = 8288
 	deploymentInfo.doki.targetPort = 8288
 	deploymentInfo.doki.nodePort = -1
 	deploymentInfo.doki.imageName = "doki"
 	deploymentInfo.doki.imageVersion = lmRelease.Doki.Version
+	deploymentInfo.doki.serviceSpec = instance.Spec.Doki.Service
+	deploymentInfo.doki.probes = instance.Spec.Doki.Probes
+	deploymentInfo.doki.autoscaling = instance.Spec.Doki.Autoscaling
+	deploymentInfo.doki.scheduling = getSchedulingSettings(instance.Spec.Scheduling, instance.Spec.Doki.Scheduling)
+	deploymentInfo.doki.podSecurity = getPodSecuritySettings("doki", instance.Spec.PodSecurity, instance.Spec.Doki.PodSecurity)
+	deploymentInfo.doki.serviceAccount = getServiceAccountSettings(instance, "doki")
+	deploymentInfo.doki.trustedCA = trustedCA
+	deploymentInfo.doki.podTemplate, err = getPodTemplatePatch("doki", instance.Spec.PodTemplate, instance.Spec.Doki.PodTemplate)
+	if err != nil {
+		return deploymentInfo, err
+	}
+	if instance.Spec.Doki.Service.NodePort > 0 {
+		deploymentInfo.doki.nodePort = instance.Spec.Doki.Service.NodePort
+	}
 
 	deploymentInfo.brent.serviceName = "brent"
+	deploymentInfo.brent.instance = instance.Name
 	deploymentInfo.brent.port = 8291
 	deploymentInfo.brent.targetPort = 8291
 	deploymentInfo.brent.nodePort = -1
 	deploymentInfo.brent.imageName = "brent"
 	deploymentInfo.brent.imageVersion = lmRelease.Brent.Version
+	deploymentInfo.brent.serviceSpec = instance.Spec.Brent.Service
+	deploymentInfo.brent.probes = instance.Spec.Brent.Probes
+	deploymentInfo.brent.autoscaling = instance.Spec.Brent.Autoscaling
+	deploymentInfo.brent.scheduling = getSchedulingSettings(instance.Spec.Scheduling, instance.Spec.Brent.Scheduling)
+	deploymentInfo.brent.podSecurity = getPodSecuritySettings("brent", instance.Spec.PodSecurity, instance.Spec.Brent.PodSecurity)
+	deploymentInfo.brent.serviceAccount = getServiceAccountSettings(instance, "brent")
+	deploymentInfo.brent.trustedCA = trustedCA
+	deploymentInfo.brent.podTemplate, err = getPodTemplatePatch("brent", instance.Spec.PodTemplate, instance.Spec.Brent.PodTemplate)
+	if err != nil {
+		return deploymentInfo, err
+	}
+	if instance.Spec.Brent.Service.NodePort > 0 {
+		deploymentInfo.brent.nodePort = instance.Spec.Brent.Service.NodePort
+	}
 
 	if strings.ToLower(instance.Spec.DeploymentType) == "ha" {
 		deploymentInfo.conductor.numReplicas = int32(3)
@@ -360,5 +606,23 @@ func createDeploymentInfo(instance *comv1alpha1.ALM, reqLogger logr.Logger) (dep
 		deploymentInfo.brent.heap = "1G"
 	}
 
+	overrideReplicas(&deploymentInfo.conductor, instance.Spec.Conductor.Replicas)
+	overrideReplicas(&deploymentInfo.apollo, instance.Spec.Apollo.Replicas)
+	overrideReplicas(&deploymentInfo.galileo, instance.Spec.Galileo.Replicas)
+	overrideReplicas(&deploymentInfo.talledega, instance.Spec.Talledega.Replicas)
+	overrideReplicas(&deploymentInfo.daytona, instance.Spec.Daytona.Replicas)
+	overrideReplicas(&deploymentInfo.nimrod.serviceDeploymentInfo, instance.Spec.Nimrod.Replicas)
+	overrideReplicas(&deploymentInfo.ishtar, instance.Spec.Ishtar.Replicas)
+	overrideReplicas(&deploymentInfo.relay, instance.Spec.Relay.Replicas)
+	overrideReplicas(&deploymentInfo.watchtower, instance.Spec.Watchtower.Replicas)
+	overrideReplicas(&deploymentInfo.doki, instance.Spec.Doki.Replicas)
+	overrideReplicas(&deploymentInfo.brent, instance.Spec.Brent.Replicas)
+
+	for _, service := range []*serviceDeploymentInfo{&deploymentInfo.apollo, &deploymentInfo.talledega, &deploymentInfo.daytona,
+		&deploymentInfo.relay, &deploymentInfo.watchtower, &deploymentInfo.doki, &deploymentInfo.nimrod.serviceDeploymentInfo,
+		&deploymentInfo.ishtar, &deploymentInfo.brent} {
+		applyAutoscaling(service)
+	}
+
 	return deploymentInfo, nil
 }
@@ -10,13 +10,15 @@ import (
 	"github.com/go-logr/logr"
 	resty "github.com/go-resty/resty/v2"
 	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
-	v1beta1 "k8s.io/api/apps/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
-	extv1beta1 "k8s.io/api/extensions/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -29,8 +31,13 @@ import (
 
 var log = logf.Log.WithName("controller_alm")
 
+// backingServicesRetryPeriod is how soon Kafka, Cassandra, Elasticsearch and Vault are reconciled again after failing
+const backingServicesRetryPeriod = 30 * time.Second
+
 func int32Ptr(i int32) *int32 { return &i }
 
+func int64Ptr(i int64) *int64 { return &i }
+
 /**
 * USER ACTION REQUIRED: This is a scaffold file intended for the user to modify with their own Controller
 * business logic.  Delete these comments after modifying this file.*
@@ -47,7 +54,18 @@ func newReconciler(mgr manager.Manager) reconcile.Reconciler {
 	client := resty.New()
 	client.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
 	client.SetTimeout(2 * time.Minute)
-	return &ReconcileALM{client: mgr.GetClient(), scheme: mgr.GetScheme(), ishtar: NewIshtar(client)}
+	return &ReconcileALM{
+		client:        mgr.GetClient(),
+		kubeClient:    kubernetes.NewForConfigOrDie(mgr.GetConfig()),
+		dynamicClient: dynamic.NewForConfigOrDie(mgr.GetConfig()),
+		recorder:      mgr.GetRecorder("alm-controller"),
+		scheme:        mgr.GetScheme(),
+		ishtar:        NewIshtar(client),
+		restClient:    client,
+		// Kafka admin clients are created per reconcile so broker changes in the spec are picked up
+		newTopicAdmin: newSaramaTopicAdmin,
+		newCQLSession: newGocqlSession,
+	}
 }
 
 // add adds a new Controller to mgr with r as the reconcile.Reconciler
@@ -82,7 +100,7 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
-	err = c.Watch(&source.Kind{Type: &extv1beta1.Deployment{}}, &handler.EnqueueRequestForOwner{
+	err = c.Watch(&source.Kind{Type: &appsv1.Deployment{}}, &handler.EnqueueRequestForOwner{
 		IsController: true,
 		OwnerType:    &comv1alpha1.ALM{},
 	})
@@ -98,7 +116,34 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
-	err = c.Watch(&source.Kind{Type: &v1beta1.StatefulSet{}}, &handler.EnqueueRequestForOwner{
+	err = c.Watch(&source.Kind{Type: &appsv1.StatefulSet{}}, &handler.EnqueueRequestForOwner{
+		IsController: true,
+		OwnerType:    &comv1alpha1.ALM{},
+	})
+	if err != nil {
+		return err
+	}
+
+	// ConfigMaps and Secrets, both those the ALM owns and those named in its spec, so that changes to them reach the
+	// pods consuming them and missing ones are reported as soon as they are created
+	if err := indexReferences(mgr); err != nil {
+		return err
+	}
+
+	err = c.Watch(&source.Kind{Type: &corev1.ConfigMap{}}, &handler.EnqueueRequestForOwner{
+		IsController: true,
+		OwnerType:    &comv1alpha1.ALM{},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(&source.Kind{Type: &corev1.ConfigMap{}}, enqueueReferencingALMs(mgr.GetClient(), configMapReferencesIndex))
+	if err != nil {
+		return err
+	}
+
+	err = c.Watch(&source.Kind{Type: &corev1.Secret{}}, &handler.EnqueueRequestForOwner{
 		IsController: true,
 		OwnerType:    &comv1alpha1.ALM{},
 	})
@@ -106,6 +151,11 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
+	err = c.Watch(&source.Kind{Type: &corev1.Secret{}}, enqueueReferencingALMs(mgr.GetClient(), secretReferencesIndex))
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -118,7 +168,18 @@ type ReconcileALM struct {
 	// that reads objects from the cache and writes to the apiserver
 	ishtar *Ishtar
 	client client.Client
-	scheme *runtime.Scheme
+	// restClient is shared by the REST APIs the operator calls, such as Elasticsearch
+	restClient *resty.Client
+	// kubeClient is used for requests the split client does not support, such as reading pod logs
+	kubeClient kubernetes.Interface
+	// dynamicClient is used for resources whose types are not compiled into the operator
+	dynamicClient dynamic.Interface
+	recorder      record.EventRecorder
+	scheme        *runtime.Scheme
+	// newTopicAdmin connects to Kafka, it can be replaced with an in-memory topicAdmin
+	newTopicAdmin func(brokers []string, version string) (topicAdmin, error)
+	// newCQLSession connects to Cassandra, it can be replaced with an in-memory cqlSession
+	newCQLSession func(hosts []string, port int, username string, password string) (cqlSession, error)
 }
 
 // Reconcile reads that state of the cluster for a ALM object and makes changes based on the state read
@@ -139,6 +200,7 @@ func (r *ReconcileALM) Reconcile(request reconcile.Request) (reconcile.Result, e
 		if errors.IsNotFound(err) {
 			// Request object not found, could have been deleted after reconcile request.
 			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
+			deleteCertificateExpiries(request.NamespacedName)
 			// Return and don't requeue
 			return reconcile.Result{}, nil
 		}
@@ -146,10 +208,95 @@ func (r *ReconcileALM) Reconcile(request reconcile.Request) (reconcile.Result, e
 		return reconcile.Result{}, err
 	}
 
-	return r.createALM(request, instance, reqLogger)
+	// failures of the backing services are recorded in the status and retried sooner, without holding up the
+	// rest of the reconcile. A new ALM is only installed once they succeed, as LM depends on them.
+	backingServicesReady := true
+	if instance.Spec.Kafka.ManageTopics && r.kafkaTopics(instance, reqLogger) != nil {
+		backingServicesReady = false
+	}
+
+	if instance.Spec.Cassandra.ManageKeyspaces || instance.Spec.Cassandra.ManageRole {
+		if r.cassandra(instance, reqLogger) != nil {
+			backingServicesReady = false
+		}
+	}
+
+	if err := r.serviceAccounts(instance, reqLogger); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	if instance.Spec.Vault.KubernetesAuth && r.vault(instance, reqLogger) != nil {
+		backingServicesReady = false
+	}
+
+	if instance.Spec.Vault.ManageSecrets && r.vaultSecrets(instance, reqLogger) != nil {
+		backingServicesReady = false
+	}
+
+	if instance.Spec.CertManager.Enabled {
+		ready, err := r.certificates(instance, reqLogger)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if !ready {
+			// LM services mount the certificates, so wait for them to be issued
+			return reconcile.Result{RequeueAfter: certificatesPollPeriod}, nil
+		}
+	}
+
+	if instance.Spec.Elasticsearch.ManageIndices && r.elasticsearch(instance, reqLogger) != nil {
+		backingServicesReady = false
+	}
+
+	resolved, err := r.references(instance, reqLogger)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if !resolved {
+		// picked up again by the watches once the missing ConfigMaps and Secrets are created
+		return reconcile.Result{}, nil
+	}
+
+	if err := r.adoptWorkloads(instance, reqLogger); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	result, err := r.createALM(request, instance, backingServicesReady, reqLogger)
+	if err != nil {
+		return result, err
+	}
+
+	if !backingServicesReady {
+		result = requeueWithin(result, backingServicesRetryPeriod)
+	} else if instance.Spec.Kafka.ManageTopics {
+		// check the topics for drift periodically
+		result = requeueWithin(result, kafkaTopicsResyncPeriod)
+	}
+
+	if instance.Spec.CertificateMonitoring.Enabled {
+		period, err := r.certificateMonitoring(instance, reqLogger)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		result = requeueWithin(result, period)
+	}
+
+	return result, nil
+}
+
+// requeueWithin makes sure the request is processed again within period, keeping any earlier requeue
+func requeueWithin(result reconcile.Result, period time.Duration) reconcile.Result {
+	if result.Requeue && result.RequeueAfter == 0 {
+		return result
+	}
+	if result.RequeueAfter == 0 || period < result.RequeueAfter {
+		result.RequeueAfter = period
+	}
+
+	return result
 }
 
-func (r *ReconcileALM) createALM(request reconcile.Request, instance *comv1alpha1.ALM, reqLogger logr.Logger) (reconcile.Result, error) {
+func (r *ReconcileALM) createALM(request reconcile.Request, instance *comv1alpha1.ALM, backingServicesReady bool, reqLogger logr.Logger) (reconcile.Result, error) {
 	// we assume that the presence of Daytona means that ALM has been deployed
 	// TODO use service name
 	found, err := r.deploymentByNameExists(instance, "daytona")
@@ -173,14 +320,28 @@ func (r *ReconcileALM) createALM(request reconcile.Request, instance *comv1alpha
 		deploymentInfo, err := createDeploymentInfo(instance, reqLogger)
 		if err != nil {
 			reqLogger.Error(err, fmt.Sprintf("Failed to get release information"))
+			r.recorder.Event(instance, corev1.EventTypeWarning, "InvalidSpec", err.Error())
+			return reconcile.Result{}, err
+		}
+		if err := r.detectServerFeatures(&deploymentInfo); err != nil {
 			return reconcile.Result{}, err
 		}
 
 		s, _ := json.MarshalIndent(deploymentInfo, "", "\t")
 		reqLogger.Info(fmt.Sprintf("Creating ALM with deployment info %s", string(s)))
 
+		// in place before the LM configurator runs, so that its traffic is restricted too
+		if err := r.networkPolicies(instance, deploymentInfo, reqLogger); err != nil {
+			return reconcile.Result{}, err
+		}
+
 		if found == nil {
 			// no configurator
+			if !backingServicesReady {
+				// requeued by the caller once they are retried
+				reqLogger.Info(fmt.Sprintf("Waiting for the backing services before installing release %s", instance.Name), "Namespace", instance.Namespace)
+				return reconcile.Result{}, nil
+			}
 
 			var result reconcile.Result
 			if deploymentInfo.configurator.run {
@@ -199,12 +360,9 @@ func (r *ReconcileALM) createALM(request reconcile.Request, instance *comv1alpha
 		}
 
 		if found.Status.Succeeded > 0 {
-			r.addSecretReference(instance.Namespace, "lm-certs", instance, reqLogger)
-			r.addSecretReference(instance.Namespace, "lm-client-credentials", instance, reqLogger)
-			r.addSecretReference(instance.Namespace, "lm-keystore", instance, reqLogger)
-			r.addSecretReference(instance.Namespace, "nimrod-tls", instance, reqLogger)
-			r.addSecretReference(instance.Namespace, "brent-tls", instance, reqLogger)
-			r.addSecretReference(instance.Namespace, "ishtar-tls", instance, reqLogger)
+			if err := r.setConfiguratorPhase(instance, found, configuratorPhaseSucceeded, reqLogger); err != nil {
+				return reconcile.Result{}, err
+			}
 
 			// lm-configurator has completed
 			reqLogger.Info("LM-configurator complete %s, creating LM microservices", "Namespace", instance.Namespace, "Name", lmConfiguratorName)
@@ -213,7 +371,17 @@ func (r *ReconcileALM) createALM(request reconcile.Request, instance *comv1alpha
 			if result.Requeue {
 				return reconcile.Result{}, err
 			}
+			if result.RequeueAfter > 0 {
+				return result, err
+			}
+		} else if condition := jobFailed(found); condition != nil {
+			// the lm-configurator Job has exhausted its retries or exceeded its deadline
+			return r.handleConfiguratorFailure(instance, found, condition, deploymentInfo.configurator, reqLogger)
 		} else {
+			if err := r.setConfiguratorPhase(instance, found, configuratorPhaseRunning, reqLogger); err != nil {
+				return reconcile.Result{}, err
+			}
+
 			// re-queue because the lm-configurator Job is not complete
 			s, _ := json.MarshalIndent(found.Status, "", "\t")
 			reqLogger.Info(fmt.Sprintf("LM-configurator not complete %s, re-queuing", string(s)), "Namespace", instance.Namespace, "Name", lmConfiguratorName)
@@ -221,9 +389,23 @@ func (r *ReconcileALM) createALM(request reconcile.Request, instance *comv1alpha
 		}
 	}
 
-	// nothing to do, don't re-queue
 	reqLogger.Info(fmt.Sprintf("Daytona exists for release %s", instance.Name), "Namespace", instance.Namespace)
 
+	// apply changes to the spec, such as the number of replicas, to the installed LM services
+	deploymentInfo, err := createDeploymentInfo(instance, reqLogger)
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to get release information"))
+		r.recorder.Event(instance, corev1.EventTypeWarning, "InvalidSpec", err.Error())
+		return reconcile.Result{}, err
+	}
+	if err := r.detectServerFeatures(&deploymentInfo); err != nil {
+		return reconcile.Result{}, err
+	}
+	result, err := r.createMicroservices(deploymentInfo, request, instance, reqLogger)
+	if result.Requeue || result.RequeueAfter > 0 {
+		return result, err
+	}
+
 	status, err := r.ishtar.Health(reqLogger)
 	if err != nil {
 		return reconcile.Result{Requeue: true}, err
@@ -301,11 +483,12 @@ func (r *ReconcileALM) createLMConfigurator(request reconcile.Request, deploymen
 		if err != nil && errors.IsNotFound(err) {
 			reqLogger.Info(fmt.Sprintf("Creating a new %s LM Config Import ConfigMap", serviceDeploymentInfo.serviceName), "Namespace", cr.Namespace, "Name", lmConfigImportCmName)
 
-			lmConfigImportCm, err := buildLmConfigImportCm(cr.Namespace, lmConfigImportCmName)
+			lmConfigImportCm, err := buildLmConfigImportCm(cr.Namespace, lmConfigImportCmName, getElasticsearchSettings(cr))
 			if err != nil {
 				reqLogger.Error(err, fmt.Sprintf("Failed to create a new %s LM Config Import ConfigMap", serviceDeploymentInfo.serviceName), "Namespace", cr.Namespace, "Name", lmConfigImportCmName)
 				return reconcile.Result{}, err
 			}
+			lmConfigImportCm.Labels = lmLabels(deploymentInfo.configurator.serviceDeploymentInfo)
 
 			if err := controllerutil.SetControllerReference(cr, lmConfigImportCm, r.scheme); err != nil {
 				reqLogger.Error(err, fmt.Sprintf("Failed to set parent of %s LM Config Import ConfigMap", serviceDeploymentInfo.serviceName), "Namespace", cr.Namespace, "Name", lmConfigImportCmName)
@@ -327,14 +510,18 @@ func (r *ReconcileALM) createLMConfigurator(request reconcile.Request, deploymen
 
 		reqLogger.Info(fmt.Sprintf("Creating a new %s Job", serviceDeploymentInfo.serviceName), "Namespace", cr.Namespace, "Name", lmConfiguratorName)
 
-		job := buildJob(cr, deploymentInfo.configurator, cr.Spec.DockerRepo, cr.Namespace, lmConfiguratorName, lmConfiguratorCMName, lmConfigImportCmName)
+		job, err := buildJob(cr, deploymentInfo.configurator, cr.Spec.DockerRepo, cr.Namespace, lmConfiguratorName, lmConfiguratorCMName, lmConfigImportCmName)
+		if err != nil {
+			reqLogger.Error(err, fmt.Sprintf("Failed to build %s Job", serviceDeploymentInfo.serviceName), "Namespace", cr.Namespace, "Name", lmConfiguratorName)
+			return reconcile.Result{}, err
+		}
 
 		if err := controllerutil.SetControllerReference(cr, job, r.scheme); err != nil {
 			reqLogger.Error(err, fmt.Sprintf("Failed to set parent for new %s Job", "lm-configurator"), "Namespace", cr.Namespace, "Name", lmConfiguratorName)
 			return reconcile.Result{}, err
 		}
 
-		err = r.client.Create(context.TODO(), job)
+		err = r.createJob(job, deploymentInfo.configurator.serviceDeploymentInfo)
 		if err != nil {
 			reqLogger.Error(err, fmt.Sprintf("Failed to create a new %s Job", "lm-configurator"), "Namespace", cr.Namespace, "Name", lmConfiguratorName)
 			return reconcile.Result{}, err
@@ -342,17 +529,18 @@ func (r *ReconcileALM) createLMConfigurator(request reconcile.Request, deploymen
 
 		reqLogger.Info(fmt.Sprintf("Created a new %s Job", "lm-configurator"), "Namespace", cr.Namespace, "Name", lmConfiguratorName)
 
+		if err := r.setConfiguratorPhase(cr, job, configuratorPhaseRunning, reqLogger); err != nil {
+			return reconcile.Result{}, err
+		}
+
 		// Created successfully - don't requeue
 		return reconcile.Result{}, nil
 	}
 
 	if found.Status.Succeeded > 0 {
-		r.addSecretReference(cr.Namespace, "lm-certs", cr, reqLogger)
-		r.addSecretReference(cr.Namespace, "lm-client-credentials", cr, reqLogger)
-		r.addSecretReference(cr.Namespace, "lm-keystore", cr, reqLogger)
-		r.addSecretReference(cr.Namespace, "nimrod-tls", cr, reqLogger)
-		r.addSecretReference(cr.Namespace, "brent-tls", cr, reqLogger)
-		r.addSecretReference(cr.Namespace, "ishtar-tls", cr, reqLogger)
+		if err := r.setConfiguratorPhase(cr, found, configuratorPhaseSucceeded, reqLogger); err != nil {
+			return reconcile.Result{}, err
+		}
 
 		// lm-configurator has completed
 
@@ -363,6 +551,11 @@ func (r *ReconcileALM) createLMConfigurator(request reconcile.Request, deploymen
 		if result.Requeue {
 			return reconcile.Result{}, err
 		}
+		if result.RequeueAfter > 0 {
+			return result, err
+		}
+	} else if condition := jobFailed(found); condition != nil {
+		return r.handleConfiguratorFailure(cr, found, condition, serviceDeploymentInfo, reqLogger)
 	} else {
 		// re-queue because the lm-configurator Job is not complete
 		s, _ := json.MarshalIndent(found.Status, "", "\t")
@@ -373,16 +566,6 @@ func (r *ReconcileALM) createLMConfigurator(request reconcile.Request, deploymen
 	return reconcile.Result{}, nil
 }
 
-func (r *ReconcileALM) addSecretReference(namespace string, secretName string, cr *comv1alpha1.ALM, reqLogger logr.Logger) {
-	foundSecret := &corev1.Secret{}
-	err := r.client.Get(context.TODO(), types.NamespacedName{Name: secretName, Namespace: namespace}, foundSecret)
-	if err == nil && foundSecret != nil {
-		if err := controllerutil.SetControllerReference(cr, foundSecret, r.scheme); err != nil {
-			reqLogger.Error(err, fmt.Sprintf("Failed to set parent for secret %s", secretName), "Namespace", namespace, "Name", secretName)
-		}
-	}
-}
-
 func (r *ReconcileALM) createMicroservices(deploymentInfo deploymentInfo, request reconcile.Request, instance *comv1alpha1.ALM, reqLogger logr.Logger) (reconcile.Result, error) {
 	conductorResult, conductorErr := r.installConductor(instance, deploymentInfo.conductor, reqLogger)
 	if conductorResult.Requeue {
@@ -439,5 +622,36 @@ func (r *ReconcileALM) createMicroservices(deploymentInfo deploymentInfo, reques
 		return brentResult, brentErr
 	}
 
+	if err := r.ingresses(instance, reqLogger); err != nil {
+		return reconcile.Result{Requeue: true}, err
+	}
+
+	scaling, err := r.updateWorkloads(instance, deploymentInfo, reqLogger)
+	if err != nil {
+		reqLogger.Error(err, "Failed to update LM services", "Namespace", instance.Namespace)
+		return reconcile.Result{Requeue: true}, err
+	}
+
+	if err := r.workloadsNewerFields(instance, deploymentInfo, reqLogger); err != nil {
+		return reconcile.Result{Requeue: true}, err
+	}
+
+	if err := r.podDisruptionBudgets(instance, deploymentInfo, reqLogger); err != nil {
+		return reconcile.Result{Requeue: true}, err
+	}
+
+	if err := r.horizontalPodAutoscalers(instance, deploymentInfo, reqLogger); err != nil {
+		return reconcile.Result{Requeue: true}, err
+	}
+
+	if err := r.networkPolicies(instance, deploymentInfo, reqLogger); err != nil {
+		return reconcile.Result{Requeue: true}, err
+	}
+
+	if scaling {
+		// StatefulSets are scaled a replica at a time
+		return reconcile.Result{RequeueAfter: rolloutPollPeriod}, nil
+	}
+
 	return reconcile.Result{}, nil
 }
@@ -56,7 +56,6 @@ func (r *ReconcileALM) installApollo(cr *comv1alpha1.ALM, service serviceDeploym
 	cmName := fmt.Sprintf("%s-%s-cm", cr.Name, service.serviceName)
 
 	// Check if this Deployment already exists
-	// deploymentName := fmt.Sprintf("%s-%s", cr.Name, service.serviceName)
 	deploymentName := service.serviceName
 	found, err := r.deploymentExists(cr, service)
 	if err != nil {
@@ -95,6 +94,7 @@ func (r *ReconcileALM) installApollo(cr *comv1alpha1.ALM, service serviceDeploym
 				ObjectMeta: metav1.ObjectMeta{
 					Namespace: cr.Namespace,
 					Name:      cmName,
+					Labels:    lmLabels(service),
 				},
 				Data: data,
 			}
@@ -134,7 +134,7 @@ func (r *ReconcileALM) installApollo(cr *comv1alpha1.ALM, service serviceDeploym
 					Name: "lm-keystore",
 					VolumeSource: corev1.VolumeSource{
 						Secret: &corev1.SecretVolumeSource{
-							SecretName: "lm-keystore",
+							SecretName: lmKeystoreSecretName(cr),
 						},
 					},
 				})
@@ -150,7 +150,7 @@ func (r *ReconcileALM) installApollo(cr *comv1alpha1.ALM, service serviceDeploym
 				})
 		}
 
-		deployment := buildDeployment(cr.Namespace, deploymentName, cr, service,
+		deployment, err := buildDeployment(cr.Namespace, deploymentName, cr, service,
 			[]corev1.VolumeMount{
 				{
 					Name:      "lm-certs",
@@ -167,12 +167,21 @@ func (r *ReconcileALM) installApollo(cr *comv1alpha1.ALM, service serviceDeploym
 					},
 				},
 			})
+		if err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to build a new %s Deployment", service.serviceName), "Namespace", cr.Namespace, "Name", deploymentName, "Error", err)
+			r.recorder.Event(cr, corev1.EventTypeWarning, "InvalidPodTemplate", err.Error())
+			return reconcile.Result{}, err
+		}
+
+		if _, err := r.applyConfigChecksum(cr, &deployment.Spec.Template); err != nil {
+			return reconcile.Result{}, err
+		}
 
 		if err := controllerutil.SetControllerReference(cr, deployment, r.scheme); err != nil {
 			return reconcile.Result{}, err
 		}
 
-		err = r.client.Create(context.TODO(), deployment)
+		err = r.writeWorkload(cr, deployment, service, true)
 		if err != nil {
 			reqLogger.Info(fmt.Sprintf("Failed to create a new %s Deployment", service.serviceName), "Namespace", cr.Namespace, "Name", deploymentName, "Error", err)
 			return reconcile.Result{}, err
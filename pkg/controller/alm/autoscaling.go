@@ -0,0 +1,174 @@
+package alm
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// defaultTargetCPUUtilization is the average CPU utilization, as a percentage of the CPU requested, autoscaled LM
+// services are scaled at unless other metrics are set
+const defaultTargetCPUUtilization = int32(80)
+
+// HorizontalPodAutoscalers are served by autoscaling/v2 from Kubernetes 1.23 and by autoscaling/v2beta2 before 1.26,
+// with the same spec
+var (
+	horizontalPodAutoscalerResource       = schema.GroupVersionResource{Group: "autoscaling", Version: "v2", Resource: "horizontalpodautoscalers"}
+	legacyHorizontalPodAutoscalerResource = schema.GroupVersionResource{Group: "autoscaling", Version: "v2beta2", Resource: "horizontalpodautoscalers"}
+)
+
+// autoscaled returns true if the replicas of an LM service are managed by a HorizontalPodAutoscaler rather than the
+// operator. LM services run as StatefulSets are not autoscaled.
+func autoscaled(service serviceDeploymentInfo) bool {
+	return service.autoscaling.Enabled && !containsString(lmStatefulServices, service.serviceName)
+}
+
+// applyAutoscaling starts an autoscaled LM service with its minimum number of replicas
+func applyAutoscaling(service *serviceDeploymentInfo) {
+	if autoscaled(*service) && service.autoscaling.MinReplicas != nil {
+		service.numReplicas = *service.autoscaling.MinReplicas
+	}
+}
+
+func horizontalPodAutoscalerSpec(service serviceDeploymentInfo) (map[string]interface{}, error) {
+	settings := service.autoscaling
+	if settings.MaxReplicas < service.numReplicas || settings.MaxReplicas < 1 {
+		return nil, fmt.Errorf("autoscaling.maxReplicas of %s must be at least its minimum number of replicas, %d", service.serviceName, service.numReplicas)
+	}
+
+	metrics := settings.Metrics
+	if settings.TargetCPUUtilizationPercentage != nil || len(metrics) == 0 {
+		target := defaultTargetCPUUtilization
+		if settings.TargetCPUUtilizationPercentage != nil {
+			target = *settings.TargetCPUUtilizationPercentage
+		}
+		metrics = append([]autoscalingv2beta2.MetricSpec{
+			{
+				Type: autoscalingv2beta2.ResourceMetricSourceType,
+				Resource: &autoscalingv2beta2.ResourceMetricSource{
+					Name: corev1.ResourceCPU,
+					Target: autoscalingv2beta2.MetricTarget{
+						Type:               autoscalingv2beta2.UtilizationMetricType,
+						AverageUtilization: &target,
+					},
+				},
+			},
+		}, metrics...)
+	}
+
+	return normalise(map[string]interface{}{
+		"scaleTargetRef": map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"name":       service.serviceName,
+		},
+		"minReplicas": service.numReplicas,
+		"maxReplicas": settings.MaxReplicas,
+		"metrics":     metrics,
+	})
+}
+
+// horizontalPodAutoscalerResourceServed returns the newest HorizontalPodAutoscaler API the cluster serves
+func (r *ReconcileALM) horizontalPodAutoscalerResourceServed() (schema.GroupVersionResource, error) {
+	served, err := r.servesResource(horizontalPodAutoscalerResource)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	if served {
+		return horizontalPodAutoscalerResource, nil
+	}
+
+	return legacyHorizontalPodAutoscalerResource, nil
+}
+
+// horizontalPodAutoscaler creates or updates the HorizontalPodAutoscaler of an autoscaled LM service, or deletes it
+// once autoscaling is disabled
+func (r *ReconcileALM) horizontalPodAutoscaler(cr *comv1alpha1.ALM, resource schema.GroupVersionResource, service serviceDeploymentInfo, reqLogger logr.Logger) error {
+	name := service.serviceName
+	autoscalers := r.dynamicClient.Resource(resource).Namespace(cr.Namespace)
+	found, err := autoscalers.Get(name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+
+	if !autoscaled(service) {
+		if service.autoscaling.Enabled {
+			reqLogger.Info(fmt.Sprintf("Autoscaling is not supported for %s, which runs as a StatefulSet", name), "Namespace", cr.Namespace, "Name", name)
+		}
+		if !exists || !metav1.IsControlledBy(found, cr) {
+			return nil
+		}
+
+		reqLogger.Info(fmt.Sprintf("Deleting %s HorizontalPodAutoscaler", name), "Namespace", cr.Namespace, "Name", name)
+		err := autoscalers.Delete(name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	spec, err := horizontalPodAutoscalerSpec(service)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		reqLogger.Info(fmt.Sprintf("Creating a new %s HorizontalPodAutoscaler", name), "Namespace", cr.Namespace, "Name", name)
+
+		desired := &unstructured.Unstructured{}
+		desired.SetAPIVersion(resource.GroupVersion().String())
+		desired.SetKind("HorizontalPodAutoscaler")
+		desired.SetNamespace(cr.Namespace)
+		desired.SetName(name)
+		desired.SetLabels(lmLabels(service))
+		desired.Object["spec"] = spec
+		if err := controllerutil.SetControllerReference(cr, desired, r.scheme); err != nil {
+			return err
+		}
+
+		if _, err := autoscalers.Create(desired, metav1.CreateOptions{}); err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to create a new %s HorizontalPodAutoscaler", name), "Namespace", cr.Namespace, "Name", name, "Error", err)
+			return err
+		}
+		return nil
+	}
+
+	if !metav1.IsControlledBy(found, cr) || containsValues(found.Object["spec"], spec) {
+		return nil
+	}
+
+	reqLogger.Info(fmt.Sprintf("Updating %s HorizontalPodAutoscaler", name), "Namespace", cr.Namespace, "Name", name)
+	found.Object["spec"] = spec
+	if _, err := autoscalers.Update(found, metav1.UpdateOptions{}); err != nil {
+		reqLogger.Info(fmt.Sprintf("Failed to update %s HorizontalPodAutoscaler", name), "Namespace", cr.Namespace, "Name", name, "Error", err)
+		return err
+	}
+
+	return nil
+}
+
+// horizontalPodAutoscalers keeps a HorizontalPodAutoscaler for each autoscaled LM service
+func (r *ReconcileALM) horizontalPodAutoscalers(cr *comv1alpha1.ALM, deploymentInfo deploymentInfo, reqLogger logr.Logger) error {
+	resource, err := r.horizontalPodAutoscalerResourceServed()
+	if err != nil {
+		return err
+	}
+
+	for _, service := range deploymentInfo.services() {
+		if err := r.horizontalPodAutoscaler(cr, resource, service, reqLogger); err != nil {
+			reqLogger.Error(err, fmt.Sprintf("Failed to reconcile %s HorizontalPodAutoscaler", service.serviceName), "Namespace", cr.Namespace)
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,442 @@
+package alm
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/gocql/gocql"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// lmKeyspaces are the Cassandra keyspaces used by LM services
+var lmKeyspaces = []string{"ishtar", "nimrod", "apollo", "galileo", "brent", "talledega"}
+
+// cqlSession is the subset of a Cassandra session used to manage LM's keyspaces and role. It can be
+// replaced with an in-memory implementation.
+type cqlSession interface {
+	Exec(statement string) error
+	// Replication returns the replication options of a keyspace, or nil if the keyspace does not exist
+	Replication(keyspace string) (map[string]string, error)
+	Close()
+}
+
+type gocqlSession struct {
+	session *gocql.Session
+}
+
+// newGocqlSession connects to Cassandra, authenticating if a username is given
+func newGocqlSession(hosts []string, port int, username string, password string) (cqlSession, error) {
+	cluster := gocql.NewCluster(hosts...)
+	cluster.Port = port
+	cluster.Consistency = gocql.Quorum
+	cluster.Timeout = 30 * time.Second
+	if username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: username,
+			Password: password,
+		}
+	}
+
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return &gocqlSession{session: session}, nil
+}
+
+func (s *gocqlSession) Exec(statement string) error {
+	return s.session.Query(statement).Exec()
+}
+
+func (s *gocqlSession) Replication(keyspace string) (map[string]string, error) {
+	replication := make(map[string]string)
+	err := s.session.Query("SELECT replication FROM system_schema.keyspaces WHERE keyspace_name = ?", keyspace).Scan(&replication)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return replication, nil
+}
+
+func (s *gocqlSession) Close() {
+	s.session.Close()
+}
+
+type cassandraSettings struct {
+	hosts       []string
+	port        int
+	adminSecret string
+	replication map[string]string
+}
+
+func getCassandraSettings(cr *comv1alpha1.ALM) cassandraSettings {
+	settings := cassandraSettings{
+		hosts:       []string{"foundation-cassandra"},
+		port:        9042,
+		adminSecret: cr.Spec.Cassandra.AdminSecret,
+	}
+
+	if len(cr.Spec.Cassandra.Hosts) > 0 {
+		settings.hosts = cr.Spec.Cassandra.Hosts
+	}
+	if cr.Spec.Cassandra.Port > 0 {
+		settings.port = int(cr.Spec.Cassandra.Port)
+	}
+
+	if cr.Spec.Cassandra.ReplicationStrategy == "NetworkTopologyStrategy" {
+		settings.replication = map[string]string{"class": "NetworkTopologyStrategy"}
+		for dc, factor := range cr.Spec.Cassandra.DatacenterReplicationFactors {
+			settings.replication[dc] = strconv.Itoa(int(factor))
+		}
+	} else {
+		replicationFactor := int32(1)
+		if cr.Spec.Cassandra.ReplicationFactor > 0 {
+			replicationFactor = cr.Spec.Cassandra.ReplicationFactor
+		}
+		settings.replication = map[string]string{
+			"class":              "SimpleStrategy",
+			"replication_factor": strconv.Itoa(int(replicationFactor)),
+		}
+	}
+
+	return settings
+}
+
+// validateReplication checks that the replication of LM's keyspaces can be rendered as valid CQL
+func validateReplication(cr *comv1alpha1.ALM) error {
+	if cr.Spec.Cassandra.ReplicationStrategy != "NetworkTopologyStrategy" {
+		return nil
+	}
+
+	for _, factor := range cr.Spec.Cassandra.DatacenterReplicationFactors {
+		if factor > 0 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("NetworkTopologyStrategy needs a replication factor of at least 1 for one datacenter in cassandra.datacenterReplicationFactors")
+}
+
+// cassandraRoleName is the Cassandra role created for an ALM. Roles are shared by every namespace using the
+// Cassandra cluster, so the default includes the namespace.
+func cassandraRoleName(cr *comv1alpha1.ALM) string {
+	if cr.Spec.Cassandra.RoleName != "" {
+		return cr.Spec.Cassandra.RoleName
+	}
+
+	return fmt.Sprintf("lm_%s_%s", strings.Replace(cr.Namespace, "-", "_", -1), strings.Replace(cr.Name, "-", "_", -1))
+}
+
+// cassandraCredentialsSecretName is the Secret holding the credentials of the ALM's Cassandra role
+func cassandraCredentialsSecretName(cr *comv1alpha1.ALM) string {
+	return fmt.Sprintf("%s-cassandra-credentials", cr.Name)
+}
+
+// cqlString quotes a CQL string literal
+func cqlString(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// cqlReplication renders replication options as a CQL map literal
+func cqlReplication(replication map[string]string) string {
+	var keys []string
+	for k := range replication {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var entries []string
+	for _, k := range keys {
+		entries = append(entries, fmt.Sprintf("%s: %s", cqlString(k), cqlString(replication[k])))
+	}
+
+	return "{" + strings.Join(entries, ", ") + "}"
+}
+
+// sameReplication compares replication options, ignoring the package of the strategy class
+// that Cassandra reports (org.apache.cassandra.locator.SimpleStrategy)
+func sameReplication(actual map[string]string, expected map[string]string) bool {
+	normalised := make(map[string]string)
+	for k, v := range actual {
+		if k == "class" {
+			v = v[strings.LastIndex(v, ".")+1:]
+		}
+		normalised[k] = v
+	}
+
+	return reflect.DeepEqual(normalised, expected)
+}
+
+// reconcileKeyspaces creates missing LM keyspaces and alters the replication of existing ones. It returns the
+// keyspaces whose replication was changed, which need a repair.
+func reconcileKeyspaces(session cqlSession, replication map[string]string, reqLogger logr.Logger) ([]string, error) {
+	var altered []string
+	for _, keyspace := range lmKeyspaces {
+		actual, err := session.Replication(keyspace)
+		if err != nil {
+			return nil, err
+		}
+
+		if actual == nil {
+			reqLogger.Info(fmt.Sprintf("Creating Cassandra keyspace %s", keyspace), "Replication", cqlReplication(replication))
+			if err := session.Exec(fmt.Sprintf("CREATE KEYSPACE IF NOT EXISTS %s WITH replication = %s", keyspace, cqlReplication(replication))); err != nil {
+				return nil, fmt.Errorf("Failed to create Cassandra keyspace %s: %s", keyspace, err)
+			}
+		} else if !sameReplication(actual, replication) {
+			reqLogger.Info(fmt.Sprintf("Altering replication of Cassandra keyspace %s", keyspace), "Replication", cqlReplication(replication))
+			if err := session.Exec(fmt.Sprintf("ALTER KEYSPACE %s WITH replication = %s", keyspace, cqlReplication(replication))); err != nil {
+				return nil, fmt.Errorf("Failed to alter Cassandra keyspace %s: %s", keyspace, err)
+			}
+			altered = append(altered, keyspace)
+		}
+	}
+
+	return altered, nil
+}
+
+// reconcileRole creates the ALM's Cassandra role, sets its password and grants it access to LM's keyspaces
+func reconcileRole(session cqlSession, role string, password string, reqLogger logr.Logger) error {
+	reqLogger.Info(fmt.Sprintf("Reconciling Cassandra role %s", role))
+	if err := session.Exec(fmt.Sprintf("CREATE ROLE IF NOT EXISTS %s WITH PASSWORD = %s AND LOGIN = true", cqlString(role), cqlString(password))); err != nil {
+		return fmt.Errorf("Failed to create Cassandra role %s: %s", role, err)
+	}
+
+	// the role may pre-date the credentials Secret
+	if err := session.Exec(fmt.Sprintf("ALTER ROLE %s WITH PASSWORD = %s", cqlString(role), cqlString(password))); err != nil {
+		return fmt.Errorf("Failed to set password of Cassandra role %s: %s", role, err)
+	}
+
+	for _, keyspace := range lmKeyspaces {
+		if err := session.Exec(fmt.Sprintf("GRANT ALL PERMISSIONS ON KEYSPACE %s TO %s", keyspace, cqlString(role))); err != nil {
+			return fmt.Errorf("Failed to grant Cassandra role %s access to keyspace %s: %s", role, keyspace, err)
+		}
+	}
+
+	return nil
+}
+
+// cassandraRoleHash identifies the password and grants of a role, so that they are only set again when they change
+func cassandraRoleHash(role string, password string) string {
+	return cassandraHash(append([]string{role, password}, lmKeyspaces...))
+}
+
+// cassandraKeyspacesHash identifies the keyspaces and their replication, so that they are only checked again when they change
+func cassandraKeyspacesHash(replication map[string]string) string {
+	return cassandraHash(append([]string{cqlReplication(replication)}, lmKeyspaces...))
+}
+
+func cassandraHash(values []string) string {
+	h := fnv.New64a()
+	for _, value := range values {
+		h.Write([]byte(value))
+		h.Write([]byte{0})
+	}
+
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// generatePassword returns a random password safe to use in CQL and environment variables
+func generatePassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// cassandraCredentials returns the credentials of the ALM's Cassandra role, creating the Secret that holds them if necessary
+func (r *ReconcileALM) cassandraCredentials(cr *comv1alpha1.ALM, reqLogger logr.Logger) (string, string, error) {
+	secretName := cassandraCredentialsSecretName(cr)
+	secret := &corev1.Secret{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: secretName, Namespace: cr.Namespace}, secret)
+	if err == nil {
+		// the role of an existing Secret is kept, such as one named before the namespace was part of the default,
+		// unless another one is configured
+		username := string(secret.Data["username"])
+		if cr.Spec.Cassandra.RoleName != "" && cr.Spec.Cassandra.RoleName != username {
+			reqLogger.Info(fmt.Sprintf("Changing Cassandra role from %s to %s", username, cr.Spec.Cassandra.RoleName), "Namespace", cr.Namespace, "Name", secretName)
+			secret.Data["username"] = []byte(cr.Spec.Cassandra.RoleName)
+			if err := r.client.Update(context.TODO(), secret); err != nil {
+				return "", "", err
+			}
+			username = cr.Spec.Cassandra.RoleName
+		}
+
+		return username, string(secret.Data["password"]), nil
+	} else if !errors.IsNotFound(err) {
+		return "", "", err
+	}
+
+	reqLogger.Info("Creating a new Cassandra credentials Secret", "Namespace", cr.Namespace, "Name", secretName)
+
+	password, err := generatePassword()
+	if err != nil {
+		return "", "", err
+	}
+
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: cr.Namespace,
+			Name:      secretName,
+			Labels:    almLabels(cr),
+		},
+		Data: map[string][]byte{
+			"username": []byte(cassandraRoleName(cr)),
+			"password": []byte(password),
+		},
+	}
+
+	if err := controllerutil.SetControllerReference(cr, secret, r.scheme); err != nil {
+		return "", "", err
+	}
+
+	if err := r.client.Create(context.TODO(), secret); err != nil {
+		reqLogger.Info("Failed to create a new Cassandra credentials Secret", "Namespace", cr.Namespace, "Name", secretName, "Error", err)
+		return "", "", err
+	}
+
+	return cassandraRoleName(cr), password, nil
+}
+
+// secretCredentials reads the username and password keys of a Secret, if one is configured
+func (r *ReconcileALM) secretCredentials(cr *comv1alpha1.ALM, secretName string) (string, string, error) {
+	if secretName == "" {
+		return "", "", nil
+	}
+
+	secret := &corev1.Secret{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: secretName, Namespace: cr.Namespace}, secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(secret.Data["username"]), string(secret.Data["password"]), nil
+}
+
+// secretValue reads a single key of a Secret, if one is configured
+func (r *ReconcileALM) secretValue(cr *comv1alpha1.ALM, secretName string, key string) (string, error) {
+	if secretName == "" {
+		return "", nil
+	}
+
+	secret := &corev1.Secret{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: secretName, Namespace: cr.Namespace}, secret)
+	if err != nil {
+		return "", err
+	}
+
+	return string(secret.Data[key]), nil
+}
+
+// cassandra reconciles LM's keyspaces and the ALM's Cassandra role and records the outcome in the ALM status
+func (r *ReconcileALM) cassandra(cr *comv1alpha1.ALM, reqLogger logr.Logger) error {
+	status, err := r.reconcileCassandra(cr, getCassandraSettings(cr), reqLogger)
+	if err != nil {
+		// keep the role last set, so that it is only set again once its credentials change
+		status = comv1alpha1.CassandraStatus{
+			Role:     cr.Status.Cassandra.Role,
+			RoleHash: cr.Status.Cassandra.RoleHash,
+			Message:  err.Error(),
+		}
+	}
+	if reflect.DeepEqual(status, cr.Status.Cassandra) {
+		return err
+	}
+
+	if err != nil {
+		r.recorder.Event(cr, corev1.EventTypeWarning, "CassandraFailed", err.Error())
+	}
+
+	cr.Status.Cassandra = status
+	if err := r.client.Status().Update(context.TODO(), cr); err != nil {
+		reqLogger.Error(err, "Failed to update ALM status.")
+		return err
+	}
+
+	return err
+}
+
+func (r *ReconcileALM) reconcileCassandra(cr *comv1alpha1.ALM, settings cassandraSettings, reqLogger logr.Logger) (comv1alpha1.CassandraStatus, error) {
+	status := comv1alpha1.CassandraStatus{}
+
+	if cr.Spec.Cassandra.ManageKeyspaces {
+		if err := validateReplication(cr); err != nil {
+			return status, err
+		}
+		status.KeyspacesReady = true
+		status.KeyspacesHash = cassandraKeyspacesHash(settings.replication)
+	}
+
+	var rolePassword string
+	if cr.Spec.Cassandra.ManageRole {
+		role, password, err := r.cassandraCredentials(cr, reqLogger)
+		if err != nil {
+			reqLogger.Error(err, "Failed to get Cassandra credentials")
+			return status, fmt.Errorf("Failed to get Cassandra credentials: %s", err)
+		}
+
+		status.Role = role
+		status.RoleHash = cassandraRoleHash(role, password)
+		rolePassword = password
+	}
+
+	// only connect to Cassandra when the keyspaces or role need setting
+	keyspacesChanged := cr.Spec.Cassandra.ManageKeyspaces && status.KeyspacesHash != cr.Status.Cassandra.KeyspacesHash
+	roleChanged := cr.Spec.Cassandra.ManageRole && status.RoleHash != cr.Status.Cassandra.RoleHash
+	if !keyspacesChanged && !roleChanged {
+		return status, nil
+	}
+
+	username, password, err := r.secretCredentials(cr, settings.adminSecret)
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to read Cassandra admin Secret %s", settings.adminSecret), "Namespace", cr.Namespace)
+		return status, fmt.Errorf("Failed to read Cassandra admin Secret %s: %s", settings.adminSecret, err)
+	}
+
+	session, err := r.newCQLSession(settings.hosts, settings.port, username, password)
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to connect to Cassandra %s", strings.Join(settings.hosts, ",")))
+		return status, fmt.Errorf("Failed to connect to Cassandra %s: %s", strings.Join(settings.hosts, ","), err)
+	}
+	defer session.Close()
+
+	if keyspacesChanged {
+		altered, err := reconcileKeyspaces(session, settings.replication, reqLogger)
+		if err != nil {
+			reqLogger.Error(err, "Failed to reconcile Cassandra keyspaces")
+			return status, fmt.Errorf("Failed to reconcile Cassandra keyspaces: %s", err)
+		}
+
+		for _, keyspace := range altered {
+			r.recorder.Event(cr, corev1.EventTypeWarning, "CassandraRepairRequired",
+				fmt.Sprintf("Replication of keyspace %s changed to %s, run 'nodetool repair -full %s' on every Cassandra node", keyspace, cqlReplication(settings.replication), keyspace))
+		}
+	}
+
+	if roleChanged {
+		if err := reconcileRole(session, status.Role, rolePassword, reqLogger); err != nil {
+			reqLogger.Error(err, "Failed to reconcile Cassandra role")
+			return status, fmt.Errorf("Failed to reconcile Cassandra role %s: %s", status.Role, err)
+		}
+	}
+
+	return status, nil
+}
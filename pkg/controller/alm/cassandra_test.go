@@ -0,0 +1,234 @@
+package alm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// memoryCQLSession is an in-memory stand-in for a Cassandra session that records the statements it is given
+type memoryCQLSession struct {
+	keyspaces  map[string]map[string]string
+	statements []string
+}
+
+func (s *memoryCQLSession) Exec(statement string) error {
+	s.statements = append(s.statements, statement)
+	return nil
+}
+
+func (s *memoryCQLSession) Replication(keyspace string) (map[string]string, error) {
+	return s.keyspaces[keyspace], nil
+}
+
+func (s *memoryCQLSession) Close() {
+}
+
+// executed returns the statements starting with prefix
+func (s *memoryCQLSession) executed(prefix string) []string {
+	var statements []string
+	for _, statement := range s.statements {
+		if strings.HasPrefix(statement, prefix) {
+			statements = append(statements, statement)
+		}
+	}
+
+	return statements
+}
+
+func TestCQLReplication(t *testing.T) {
+	got := cqlReplication(map[string]string{"class": "NetworkTopologyStrategy", "dc1": "3", "dc'2": "1"})
+	want := "{'class': 'NetworkTopologyStrategy', 'dc''2': '1', 'dc1': '3'}"
+	if got != want {
+		t.Errorf("cqlReplication() = %s, want %s", got, want)
+	}
+}
+
+func TestReconcileKeyspaces(t *testing.T) {
+	replication := map[string]string{"class": "SimpleStrategy", "replication_factor": "3"}
+	session := &memoryCQLSession{keyspaces: map[string]map[string]string{
+		"ishtar": {"class": "org.apache.cassandra.locator.SimpleStrategy", "replication_factor": "3"},
+		"nimrod": {"class": "org.apache.cassandra.locator.SimpleStrategy", "replication_factor": "1"},
+	}}
+
+	altered, err := reconcileKeyspaces(session, replication, log)
+	if err != nil {
+		t.Fatalf("reconcileKeyspaces() error = %v", err)
+	}
+	if len(altered) != 1 || altered[0] != "nimrod" {
+		t.Errorf("altered = %v, want nimrod", altered)
+	}
+	if created := session.executed("CREATE KEYSPACE"); len(created) != len(lmKeyspaces)-2 {
+		t.Errorf("created = %v, want the missing keyspaces", created)
+	}
+}
+
+func TestCassandraRoleSetOnlyWhenChanged(t *testing.T) {
+	cr := almForTest()
+	cr.Spec.Cassandra.ManageRole = true
+	credentials := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: cassandraCredentialsSecretName(cr), Namespace: cr.Namespace},
+		Data:       map[string][]byte{"username": []byte("lm_awesome"), "password": []byte("first")},
+	}
+	r, _ := reconcilerForTest(t, cr, credentials)
+	session := &memoryCQLSession{}
+	r.newCQLSession = func(hosts []string, port int, username string, password string) (cqlSession, error) {
+		return session, nil
+	}
+
+	if err := r.cassandra(cr, log); err != nil {
+		t.Fatalf("cassandra() error = %v", err)
+	}
+	if len(session.executed("ALTER ROLE")) != 1 || len(session.executed("GRANT")) != len(lmKeyspaces) {
+		t.Errorf("statements = %v, want the password set and the keyspaces granted", session.statements)
+	}
+	if cr.Status.Cassandra.Role != "lm_awesome" || cr.Status.Cassandra.RoleHash != cassandraRoleHash("lm_awesome", "first") {
+		t.Errorf("status = %+v, want the role and its hash", cr.Status.Cassandra)
+	}
+
+	session.statements = nil
+	if err := r.cassandra(cr, log); err != nil || len(session.statements) != 0 {
+		t.Errorf("cassandra() = %v, %v, want an unchanged role left alone", session.statements, err)
+	}
+
+	credentials.Data["password"] = []byte("second")
+	if err := r.client.Update(context.TODO(), credentials); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.cassandra(cr, log); err != nil || len(session.executed("ALTER ROLE")) != 1 {
+		t.Errorf("cassandra() = %v, %v, want the new password set", session.statements, err)
+	}
+}
+
+func TestCassandraFailureRecorded(t *testing.T) {
+	cr := almForTest()
+	cr.Spec.Cassandra.ManageKeyspaces = true
+	cr.Status.Cassandra = comv1alpha1.CassandraStatus{KeyspacesReady: true, Role: "lm_awesome", RoleHash: "hash"}
+	r, recorder := reconcilerForTest(t, cr)
+	r.newCQLSession = func(hosts []string, port int, username string, password string) (cqlSession, error) {
+		return nil, fmt.Errorf("no hosts available")
+	}
+
+	if err := r.cassandra(cr, log); err == nil {
+		t.Fatal("cassandra() error = nil, want the connection failure")
+	}
+	status := cr.Status.Cassandra
+	if status.KeyspacesReady || status.RoleHash != "hash" || !strings.Contains(status.Message, "no hosts available") {
+		t.Errorf("status = %+v, want the failure recorded and the role kept", status)
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "CassandraFailed") {
+		t.Errorf("event = %s, want CassandraFailed", event)
+	}
+}
+
+func TestValidateReplication(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		factors  map[string]int32
+		valid    bool
+	}{
+		{name: "simple", strategy: "SimpleStrategy", valid: true},
+		{name: "default", valid: true},
+		{name: "datacenters", strategy: "NetworkTopologyStrategy", factors: map[string]int32{"dc1": 3, "dc2": 0}, valid: true},
+		{name: "no datacenters", strategy: "NetworkTopologyStrategy"},
+		{name: "no replicas", strategy: "NetworkTopologyStrategy", factors: map[string]int32{"dc1": 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := almForTest()
+			cr.Spec.Cassandra.ReplicationStrategy = tt.strategy
+			cr.Spec.Cassandra.DatacenterReplicationFactors = tt.factors
+			if err := validateReplication(cr); (err == nil) != tt.valid {
+				t.Errorf("validateReplication() error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestCassandraRoleName(t *testing.T) {
+	cr := almForTest()
+	cr.Name = "my-alm"
+	if got := cassandraRoleName(cr); got != "lm_lm_my_alm" {
+		t.Errorf("cassandraRoleName() = %s, want the namespace and name", got)
+	}
+
+	cr.Spec.Cassandra.RoleName = "lm_shared"
+	if got := cassandraRoleName(cr); got != "lm_shared" {
+		t.Errorf("cassandraRoleName() = %s, want the configured role", got)
+	}
+}
+
+func TestCassandraCredentialsKeepExistingRole(t *testing.T) {
+	cr := almForTest()
+	credentials := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: cassandraCredentialsSecretName(cr), Namespace: cr.Namespace},
+		Data:       map[string][]byte{"username": []byte("lm_awesome"), "password": []byte("first")},
+	}
+	r, _ := reconcilerForTest(t, cr, credentials)
+
+	if role, _, err := r.cassandraCredentials(cr, log); err != nil || role != "lm_awesome" {
+		t.Errorf("cassandraCredentials() = %s, %v, want the role of the existing Secret", role, err)
+	}
+
+	cr.Spec.Cassandra.RoleName = "lm_renamed"
+	role, password, err := r.cassandraCredentials(cr, log)
+	if err != nil || role != "lm_renamed" || password != "first" {
+		t.Errorf("cassandraCredentials() = %s, %s, %v, want the configured role with the same password", role, password, err)
+	}
+	if err := r.client.Get(context.TODO(), types.NamespacedName{Name: credentials.Name, Namespace: cr.Namespace}, credentials); err != nil {
+		t.Fatal(err)
+	}
+	if string(credentials.Data["username"]) != "lm_renamed" {
+		t.Errorf("username = %s, want the Secret updated", credentials.Data["username"])
+	}
+}
+
+func TestCassandraKeyspacesCheckedOnlyWhenChanged(t *testing.T) {
+	cr := almForTest()
+	cr.Spec.Cassandra.ManageKeyspaces = true
+	r, _ := reconcilerForTest(t, cr)
+	connections := 0
+	session := &memoryCQLSession{}
+	r.newCQLSession = func(hosts []string, port int, username string, password string) (cqlSession, error) {
+		connections++
+		return session, nil
+	}
+
+	if err := r.cassandra(cr, log); err != nil || connections != 1 {
+		t.Fatalf("cassandra() = %d connections, %v, want the keyspaces created", connections, err)
+	}
+	if !cr.Status.Cassandra.KeyspacesReady || cr.Status.Cassandra.KeyspacesHash == "" {
+		t.Errorf("status = %+v, want the keyspaces and their hash", cr.Status.Cassandra)
+	}
+
+	if err := r.cassandra(cr, log); err != nil || connections != 1 {
+		t.Errorf("cassandra() = %d connections, %v, want unchanged keyspaces left alone", connections, err)
+	}
+
+	cr.Spec.Cassandra.ReplicationFactor = 3
+	if err := r.cassandra(cr, log); err != nil || connections != 2 {
+		t.Errorf("cassandra() = %d connections, %v, want the new replication checked", connections, err)
+	}
+}
+
+func TestCassandraInvalidReplication(t *testing.T) {
+	cr := almForTest()
+	cr.Spec.Cassandra.ManageKeyspaces = true
+	cr.Spec.Cassandra.ReplicationStrategy = "NetworkTopologyStrategy"
+	r, _ := reconcilerForTest(t, cr)
+	r.newCQLSession = func(hosts []string, port int, username string, password string) (cqlSession, error) {
+		t.Fatal("connected to Cassandra with an invalid replication")
+		return nil, nil
+	}
+
+	if err := r.cassandra(cr, log); err == nil || cr.Status.Cassandra.Message == "" {
+		t.Errorf("cassandra() error = %v, status = %+v, want the replication rejected", err, cr.Status.Cassandra)
+	}
+}
@@ -0,0 +1,375 @@
+package alm
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// certificateMonitoringPeriod is how often the certificates are checked for expiry
+	certificateMonitoringPeriod = time.Hour
+	// rolloutPollPeriod is how often a restarted service is checked while waiting for its rollout to finish
+	rolloutPollPeriod = 15 * time.Second
+	// certificatesRevisionAnnotation is set on the pod template of an LM service to restart it after a certificate Secret changed
+	certificatesRevisionAnnotation = "com.accantosystems.stratoss/certificates-revision"
+)
+
+// defaultCertificateWarningDays are the days before expiry at which a certificate is reported, unless set in the spec
+var defaultCertificateWarningDays = []int32{30, 7, 1}
+
+var certificateExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "lm_certificate_expiry_timestamp_seconds",
+	Help: "Expiry of the first certificate to expire in an LM certificate Secret, in seconds since the epoch",
+}, []string{"namespace", "alm", "secret"})
+
+// reportedCertificates are the Secrets each ALM has an expiry recorded for, so that they can be deleted with the ALM
+var reportedCertificates = struct {
+	sync.Mutex
+	secrets map[types.NamespacedName]map[string]bool
+}{secrets: map[types.NamespacedName]map[string]bool{}}
+
+func init() {
+	// served with the controller-runtime metrics on the operator's metrics port
+	metrics.Registry.MustRegister(certificateExpiry)
+}
+
+// setCertificateExpiry records the expiry of the certificates in an ALM's Secret
+func setCertificateExpiry(cr *comv1alpha1.ALM, secret string, expiry time.Time) {
+	reportedCertificates.Lock()
+	defer reportedCertificates.Unlock()
+
+	alm := types.NamespacedName{Namespace: cr.Namespace, Name: cr.Name}
+	if reportedCertificates.secrets[alm] == nil {
+		reportedCertificates.secrets[alm] = map[string]bool{}
+	}
+	reportedCertificates.secrets[alm][secret] = true
+	certificateExpiry.WithLabelValues(cr.Namespace, cr.Name, secret).Set(float64(expiry.Unix()))
+}
+
+// deleteCertificateExpiry deletes the expiry recorded for an ALM's Secret
+func deleteCertificateExpiry(cr *comv1alpha1.ALM, secret string) {
+	reportedCertificates.Lock()
+	defer reportedCertificates.Unlock()
+
+	alm := types.NamespacedName{Namespace: cr.Namespace, Name: cr.Name}
+	delete(reportedCertificates.secrets[alm], secret)
+	if len(reportedCertificates.secrets[alm]) == 0 {
+		delete(reportedCertificates.secrets, alm)
+	}
+	certificateExpiry.DeleteLabelValues(cr.Namespace, cr.Name, secret)
+}
+
+// deleteCertificateExpiries deletes the expiry recorded for all Secrets of a deleted ALM
+func deleteCertificateExpiries(alm types.NamespacedName) {
+	reportedCertificates.Lock()
+	defer reportedCertificates.Unlock()
+
+	for secret := range reportedCertificates.secrets[alm] {
+		certificateExpiry.DeleteLabelValues(alm.Namespace, alm.Name, secret)
+	}
+	delete(reportedCertificates.secrets, alm)
+}
+
+// certificateSecretNames returns the Secrets holding the certificates and keystores LM services and ingresses use
+func certificateSecretNames(cr *comv1alpha1.ALM) []string {
+	names := []string{"lm-certs"}
+	for _, ingress := range []ingressSettings{getNimrodIngressSettings(cr), getIshtarIngressSettings(cr), getBrentIngressSettings(cr)} {
+		if !containsString(names, ingress.tlsSecret) {
+			names = append(names, ingress.tlsSecret)
+		}
+	}
+	if keystore := lmKeystoreSecretName(cr); !containsString(names, keystore) {
+		names = append(names, keystore)
+	}
+
+	return names
+}
+
+// secretHash identifies the content of a Secret, so that changes can be detected
+func secretHash(secret *corev1.Secret) string {
+	var keys []string
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := fnv.New64a()
+	for _, key := range keys {
+		h.Write([]byte(key))
+		h.Write(secret.Data[key])
+	}
+
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// firstExpiringCertificate returns the PEM encoded certificate in the Secret that expires first, or nil if the Secret
+// holds no PEM certificates (a keystore, for example)
+func firstExpiringCertificate(secret *corev1.Secret) (*x509.Certificate, error) {
+	var first *x509.Certificate
+	for key, data := range secret.Data {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse certificate in %s: %s", key, err)
+			}
+			if first == nil || certificate.NotAfter.Before(first.NotAfter) {
+				first = certificate
+			}
+		}
+	}
+
+	return first, nil
+}
+
+// expiryThreshold returns the smallest of the warning thresholds, in days, that a certificate expiring at notAfter has
+// crossed, or 0 if it has expired. It returns false if no threshold has been crossed.
+func expiryThreshold(notAfter time.Time, now time.Time, warningDays []int32) (int32, bool) {
+	remaining := notAfter.Sub(now)
+	if remaining <= 0 {
+		return 0, true
+	}
+
+	var threshold int32
+	crossed := false
+	for _, days := range warningDays {
+		if remaining <= time.Duration(days)*24*time.Hour && (!crossed || days < threshold) {
+			threshold = days
+			crossed = true
+		}
+	}
+
+	return threshold, crossed
+}
+
+// certificatesRevision identifies the content of all of the certificate Secrets
+func certificatesRevision(secrets []comv1alpha1.CertificateSecretStatus) string {
+	h := fnv.New64a()
+	for _, secret := range secrets {
+		h.Write([]byte(secret.Name))
+		h.Write([]byte(secret.Hash))
+	}
+
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// servicesMounting returns the LM services, in restart order, whose pods mount any of the Secrets or are already
+// waiting to be restarted
+func (r *ReconcileALM) servicesMounting(cr *comv1alpha1.ALM, secretNames []string, pending []string) ([]string, error) {
+	var services []string
+	for _, name := range lmServices {
+		if containsString(pending, name) {
+			services = append(services, name)
+			continue
+		}
+
+		workload, err := r.workload(cr, name)
+		if err != nil {
+			return nil, err
+		}
+		if workload != nil && workload.mountsSecret(secretNames) {
+			services = append(services, name)
+		}
+	}
+
+	return services, nil
+}
+
+// restartServices restarts the pending services one at a time, moving on to the next once the previous one has rolled
+// out. It returns the services that are still to be restarted.
+func (r *ReconcileALM) restartServices(cr *comv1alpha1.ALM, pending []string, revision string, reqLogger logr.Logger) ([]string, error) {
+	for len(pending) > 0 {
+		name := pending[0]
+		workload, err := r.workload(cr, name)
+		if err != nil {
+			return pending, err
+		}
+
+		if workload == nil {
+			pending = pending[1:]
+			continue
+		}
+
+		if workload.template().Annotations[certificatesRevisionAnnotation] != revision {
+			reqLogger.Info(fmt.Sprintf("Restarting %s to pick up changed certificates", name), "Namespace", cr.Namespace, "Name", name)
+			workload.restart(revision)
+			if err := r.updateWorkload(workload); err != nil {
+				reqLogger.Info(fmt.Sprintf("Failed to restart %s", name), "Namespace", cr.Namespace, "Name", name, "Error", err)
+				return pending, err
+			}
+
+			return pending, nil
+		}
+
+		if !workload.rolledOut() {
+			reqLogger.Info(fmt.Sprintf("Waiting for %s to restart", name), "Namespace", cr.Namespace, "Name", name)
+			return pending, nil
+		}
+
+		reqLogger.Info(fmt.Sprintf("Restarted %s", name), "Namespace", cr.Namespace, "Name", name)
+		pending = pending[1:]
+	}
+
+	return nil, nil
+}
+
+// certificateSecret reads a certificate Secret, records the expiry of its certificates and reports the ones that are
+// about to expire. It returns nil if the Secret does not exist.
+func (r *ReconcileALM) certificateSecret(cr *comv1alpha1.ALM, name string, previous *comv1alpha1.CertificateSecretStatus, warningDays []int32, reqLogger logr.Logger) (*comv1alpha1.CertificateSecretStatus, error) {
+	secret := &corev1.Secret{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, secret)
+	if err != nil && errors.IsNotFound(err) {
+		// created later, by the LM configurator or cert-manager
+		deleteCertificateExpiry(cr, name)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	status := &comv1alpha1.CertificateSecretStatus{
+		Name: name,
+		Hash: secretHash(secret),
+	}
+	if previous != nil && previous.Hash == status.Hash {
+		// a changed Secret holds new certificates, which are reported again
+		status.WarnedDays = previous.WarnedDays
+	}
+
+	certificate, err := firstExpiringCertificate(secret)
+	if err != nil {
+		reqLogger.Info(fmt.Sprintf("Failed to read certificates in Secret %s", name), "Namespace", cr.Namespace, "Name", name, "Error", err)
+	}
+	if certificate == nil {
+		deleteCertificateExpiry(cr, name)
+		return status, nil
+	}
+
+	notAfter := metav1.NewTime(certificate.NotAfter)
+	status.Subject = certificate.Subject.String()
+	status.NotAfter = &notAfter
+	setCertificateExpiry(cr, name, certificate.NotAfter)
+
+	threshold, crossed := expiryThreshold(certificate.NotAfter, time.Now(), warningDays)
+	if crossed && (status.WarnedDays == nil || threshold < *status.WarnedDays) {
+		if threshold == 0 {
+			r.recorder.Event(cr, corev1.EventTypeWarning, "CertificateExpired",
+				fmt.Sprintf("Certificate %s in Secret %s expired at %s", status.Subject, name, certificate.NotAfter.Format(time.RFC3339)))
+		} else {
+			r.recorder.Event(cr, corev1.EventTypeWarning, "CertificateExpiring",
+				fmt.Sprintf("Certificate %s in Secret %s expires at %s, within %d days", status.Subject, name, certificate.NotAfter.Format(time.RFC3339), threshold))
+		}
+		status.WarnedDays = &threshold
+	}
+
+	return status, nil
+}
+
+// certificateMonitoring checks the expiry of the certificates in LM's certificate Secrets and, when enabled, restarts the
+// services that mount a Secret whose content changed. The outcome is recorded in the ALM status. It returns how long to
+// wait before checking again.
+func (r *ReconcileALM) certificateMonitoring(cr *comv1alpha1.ALM, reqLogger logr.Logger) (time.Duration, error) {
+	warningDays := cr.Spec.CertificateMonitoring.WarningDays
+	if len(warningDays) == 0 {
+		warningDays = defaultCertificateWarningDays
+	}
+
+	status := *cr.Status.Certificates.DeepCopy()
+	previous := make(map[string]*comv1alpha1.CertificateSecretStatus)
+	for i := range status.Secrets {
+		previous[status.Secrets[i].Name] = &status.Secrets[i]
+	}
+
+	var secrets []comv1alpha1.CertificateSecretStatus
+	var changed []string
+	for _, name := range certificateSecretNames(cr) {
+		secret, err := r.certificateSecret(cr, name, previous[name], warningDays, reqLogger)
+		if err != nil {
+			reqLogger.Error(err, fmt.Sprintf("Failed to check certificates in Secret %s", name), "Namespace", cr.Namespace)
+			return 0, err
+		}
+		if secret == nil {
+			continue
+		}
+
+		if last, ok := previous[name]; ok && last.Hash != secret.Hash {
+			changed = append(changed, name)
+		}
+		secrets = append(secrets, *secret)
+	}
+	status.Secrets = secrets
+
+	var err error
+	if !cr.Spec.CertificateMonitoring.RestartOnChange {
+		status.PendingRestarts = nil
+		status.RestartRevision = ""
+	} else {
+		if len(changed) > 0 {
+			status.PendingRestarts, err = r.servicesMounting(cr, changed, status.PendingRestarts)
+			if err != nil {
+				reqLogger.Error(err, "Failed to find LM services mounting the changed certificates", "Namespace", cr.Namespace)
+				return 0, err
+			}
+			status.RestartRevision = certificatesRevision(secrets)
+			r.recorder.Event(cr, corev1.EventTypeNormal, "CertificatesChanged",
+				fmt.Sprintf("Certificate Secrets %v changed, restarting %v", changed, status.PendingRestarts))
+		}
+
+		// the status is recorded even if a restart fails, so that the change is not lost
+		status.PendingRestarts, err = r.restartServices(cr, status.PendingRestarts, status.RestartRevision, reqLogger)
+		if err != nil {
+			reqLogger.Error(err, "Failed to restart LM services", "Namespace", cr.Namespace)
+		}
+	}
+
+	if !reflect.DeepEqual(status, cr.Status.Certificates) {
+		cr.Status.Certificates = status
+		if err := r.client.Status().Update(context.TODO(), cr); err != nil {
+			reqLogger.Error(err, "Failed to update ALM status.")
+			return 0, err
+		}
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(status.PendingRestarts) > 0 {
+		return rolloutPollPeriod, nil
+	}
+
+	return certificateMonitoringPeriod, nil
+}
@@ -0,0 +1,26 @@
+package alm
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestDeleteCertificateExpiries(t *testing.T) {
+	cr := almForTest()
+	alm := types.NamespacedName{Namespace: cr.Namespace, Name: cr.Name}
+	expiry := time.Now().Add(24 * time.Hour)
+
+	setCertificateExpiry(cr, "lm-certs", expiry)
+	setCertificateExpiry(cr, "nimrod-tls", expiry)
+	deleteCertificateExpiry(cr, "nimrod-tls")
+	if secrets := reportedCertificates.secrets[alm]; len(secrets) != 1 || !secrets["lm-certs"] {
+		t.Errorf("reported = %v, want only lm-certs", secrets)
+	}
+
+	deleteCertificateExpiries(alm)
+	if secrets, reported := reportedCertificates.secrets[alm]; reported {
+		t.Errorf("reported = %v, want nothing left for the deleted ALM", secrets)
+	}
+}
@@ -0,0 +1,322 @@
+package alm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/go-logr/logr"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// certificatesPollPeriod is how often cert-manager Certificates are checked while waiting for them to be issued
+	certificatesPollPeriod = 15 * time.Second
+
+	// lmKeystorePassword is the keystore password LM services use unless the LM credentials are managed in Vault
+	lmKeystorePassword = "keypass"
+)
+
+var certificateResource = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+
+// lmCertificate is a certificate LM services mount, identified by the Secret it is issued to
+type lmCertificate struct {
+	secretName string
+	commonName string
+	dnsNames   []string
+	keystores  bool
+}
+
+// serviceDNSNames returns the names a service can be reached by inside the cluster
+func serviceDNSNames(namespace string, services ...string) []string {
+	var names []string
+	for _, service := range services {
+		names = append(names,
+			service,
+			fmt.Sprintf("%s.%s", service, namespace),
+			fmt.Sprintf("%s.%s.svc", service, namespace),
+			fmt.Sprintf("%s.%s.svc.cluster.local", service, namespace))
+	}
+
+	return names
+}
+
+// statefulPodDNSNames returns wildcards matching the pods of the LM services run as StatefulSets, which peers reach
+// through the headless Services governing them
+func statefulPodDNSNames() []string {
+	var names []string
+	for _, service := range lmStatefulServices {
+		names = append(names, fmt.Sprintf("*.%s", headlessServiceName(service)))
+	}
+
+	return names
+}
+
+// lmCertificates returns the certificates the configurator would otherwise generate
+func lmCertificates(cr *comv1alpha1.ALM) []lmCertificate {
+	services := []string{"conductor", "apollo", "galileo", "talledega", "daytona", "nimrod", "ishtar", "relay", "watchtower", "doki", "brent"}
+	nimrod := getNimrodIngressSettings(cr)
+	ishtar := getIshtarIngressSettings(cr)
+	brent := getBrentIngressSettings(cr)
+
+	brentDNSNames := serviceDNSNames(cr.Namespace, "brent")
+	if brent.enabled {
+		brentDNSNames = append(brentDNSNames, brent.host)
+	}
+
+	return []lmCertificate{
+		{
+			secretName: "lm-certs",
+			dnsNames:   append(serviceDNSNames(cr.Namespace, append(services, statefulPodDNSNames()...)...), nimrod.host, ishtar.host),
+			keystores:  true,
+		},
+		{
+			secretName: nimrod.tlsSecret,
+			commonName: nimrod.host,
+			dnsNames:   []string{nimrod.host},
+		},
+		{
+			secretName: ishtar.tlsSecret,
+			commonName: ishtar.host,
+			dnsNames:   []string{ishtar.host},
+		},
+		{
+			secretName: brent.tlsSecret,
+			commonName: "brent",
+			dnsNames:   brentDNSNames,
+		},
+	}
+}
+
+// lmKeystoreSecretName is the Secret holding the JKS and PKCS12 keystores LM services mount at /var/lm/keystore
+func lmKeystoreSecretName(cr *comv1alpha1.ALM) string {
+	if cr.Spec.CertManager.Enabled {
+		// cert-manager adds the keystores to the certificate's own Secret
+		return "lm-certs"
+	}
+
+	return "lm-keystore"
+}
+
+// keystorePasswordRef returns the Secret and key holding the keystore password
+func keystorePasswordRef(cr *comv1alpha1.ALM) (string, string) {
+	if cr.Spec.Vault.ManageSecrets {
+		return lmCredentialsSecretName(cr), "securityKeyStorePassword"
+	}
+
+	return fmt.Sprintf("%s-keystore-password", cr.Name), "password"
+}
+
+// certificateSpec returns the cert-manager Certificate spec for a certificate
+func certificateSpec(cr *comv1alpha1.ALM, certificate lmCertificate) (map[string]interface{}, error) {
+	issuerKind := cr.Spec.CertManager.IssuerKind
+	if issuerKind == "" {
+		issuerKind = "Issuer"
+	}
+
+	spec := map[string]interface{}{
+		"secretName": certificate.secretName,
+		"dnsNames":   certificate.dnsNames,
+		"issuerRef": map[string]interface{}{
+			"name":  cr.Spec.CertManager.IssuerName,
+			"kind":  issuerKind,
+			"group": "cert-manager.io",
+		},
+	}
+	if certificate.commonName != "" {
+		spec["commonName"] = certificate.commonName
+	}
+	if cr.Spec.CertManager.Duration != "" {
+		spec["duration"] = cr.Spec.CertManager.Duration
+	}
+	if cr.Spec.CertManager.RenewBefore != "" {
+		spec["renewBefore"] = cr.Spec.CertManager.RenewBefore
+	}
+	if certificate.keystores {
+		passwordSecret, passwordKey := keystorePasswordRef(cr)
+		passwordRef := map[string]interface{}{
+			"name": passwordSecret,
+			"key":  passwordKey,
+		}
+		spec["keystores"] = map[string]interface{}{
+			"jks":    map[string]interface{}{"create": true, "passwordSecretRef": passwordRef},
+			"pkcs12": map[string]interface{}{"create": true, "passwordSecretRef": passwordRef},
+		}
+	}
+
+	// round trip through JSON so the spec compares equal to one read back from the API server
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	var normalised map[string]interface{}
+	if err := json.Unmarshal(raw, &normalised); err != nil {
+		return nil, err
+	}
+
+	return normalised, nil
+}
+
+// certificateSpecKeys are the Certificate spec fields managed by the operator
+var certificateSpecKeys = []string{"secretName", "commonName", "dnsNames", "issuerRef", "duration", "renewBefore", "keystores"}
+
+// certificateSpecChanged compares the fields managed by the operator, ignoring any defaults cert-manager adds
+func certificateSpecChanged(found map[string]interface{}, desired map[string]interface{}) bool {
+	for _, key := range certificateSpecKeys {
+		if !reflect.DeepEqual(found[key], desired[key]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// certificateReady returns true if the Certificate has a Ready condition that is True
+func certificateReady(certificate *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(certificate.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if ok && condition["type"] == "Ready" && condition["status"] == "True" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keystorePassword creates the Secret holding LM's default keystore password if the LM credentials are not managed in Vault
+func (r *ReconcileALM) keystorePassword(cr *comv1alpha1.ALM, reqLogger logr.Logger) error {
+	if cr.Spec.Vault.ManageSecrets {
+		return nil
+	}
+
+	secretName, secretKey := keystorePasswordRef(cr)
+	found := &corev1.Secret{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: secretName, Namespace: cr.Namespace}, found)
+	if err == nil {
+		return nil
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+
+	reqLogger.Info("Creating a new keystore password Secret", "Namespace", cr.Namespace, "Name", secretName)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: cr.Namespace,
+			Name:      secretName,
+			Labels:    almLabels(cr),
+		},
+		Data: map[string][]byte{
+			secretKey: []byte(lmKeystorePassword),
+		},
+	}
+
+	if err := controllerutil.SetControllerReference(cr, secret, r.scheme); err != nil {
+		return err
+	}
+
+	return r.client.Create(context.TODO(), secret)
+}
+
+// certificate creates or updates the cert-manager Certificate for one of LM's certificates and returns true once it is issued
+func (r *ReconcileALM) certificate(cr *comv1alpha1.ALM, certificate lmCertificate, reqLogger logr.Logger) (bool, error) {
+	name := fmt.Sprintf("%s-%s", cr.Name, certificate.secretName)
+	spec, err := certificateSpec(cr, certificate)
+	if err != nil {
+		return false, err
+	}
+
+	certificates := r.dynamicClient.Resource(certificateResource).Namespace(cr.Namespace)
+	found, err := certificates.Get(name, metav1.GetOptions{})
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info("Creating a new Certificate", "Namespace", cr.Namespace, "Name", name, "Secret", certificate.secretName)
+
+		desired := &unstructured.Unstructured{}
+		desired.SetAPIVersion("cert-manager.io/v1")
+		desired.SetKind("Certificate")
+		desired.SetNamespace(cr.Namespace)
+		desired.SetName(name)
+		desired.SetLabels(almLabels(cr))
+		desired.Object["spec"] = spec
+		if err := controllerutil.SetControllerReference(cr, desired, r.scheme); err != nil {
+			return false, err
+		}
+
+		if _, err := certificates.Create(desired, metav1.CreateOptions{}); err != nil {
+			reqLogger.Info("Failed to create a new Certificate", "Namespace", cr.Namespace, "Name", name, "Error", err)
+			return false, err
+		}
+
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	foundSpec, _, _ := unstructured.NestedMap(found.Object, "spec")
+	if certificateSpecChanged(foundSpec, spec) {
+		reqLogger.Info("Updating Certificate", "Namespace", cr.Namespace, "Name", name, "Secret", certificate.secretName)
+		for _, key := range certificateSpecKeys {
+			delete(foundSpec, key)
+			if value, ok := spec[key]; ok {
+				foundSpec[key] = value
+			}
+		}
+		found.Object["spec"] = foundSpec
+		if _, err := certificates.Update(found, metav1.UpdateOptions{}); err != nil {
+			reqLogger.Info("Failed to update Certificate", "Namespace", cr.Namespace, "Name", name, "Error", err)
+			return false, err
+		}
+
+		// cert-manager re-issues the certificate for the new spec
+		return false, nil
+	}
+
+	return certificateReady(found), nil
+}
+
+// certificates requests LM's certificates from cert-manager and returns true once all of them have been issued.
+// The outcome is recorded in the ALM status.
+func (r *ReconcileALM) certificates(cr *comv1alpha1.ALM, reqLogger logr.Logger) (bool, error) {
+	if err := r.keystorePassword(cr, reqLogger); err != nil {
+		reqLogger.Error(err, "Failed to create keystore password Secret", "Namespace", cr.Namespace)
+		return false, err
+	}
+
+	var pending []string
+	for _, certificate := range lmCertificates(cr) {
+		ready, err := r.certificate(cr, certificate, reqLogger)
+		if err != nil {
+			reqLogger.Error(err, fmt.Sprintf("Failed to request %s certificate from cert-manager", certificate.secretName), "Namespace", cr.Namespace)
+			return false, err
+		}
+		if !ready {
+			pending = append(pending, certificate.secretName)
+		}
+	}
+
+	status := *cr.Status.Certificates.DeepCopy()
+	status.Ready = len(pending) == 0
+	status.Pending = pending
+	if !reflect.DeepEqual(status, cr.Status.Certificates) {
+		cr.Status.Certificates = status
+		if err := r.client.Status().Update(context.TODO(), cr); err != nil {
+			reqLogger.Error(err, "Failed to update ALM status.")
+			return false, err
+		}
+	}
+
+	if len(pending) > 0 {
+		reqLogger.Info(fmt.Sprintf("Waiting for cert-manager to issue certificates %v", pending), "Namespace", cr.Namespace)
+	}
+
+	return len(pending) == 0, nil
+}
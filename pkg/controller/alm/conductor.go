@@ -16,10 +16,15 @@ import (
 )
 
 func (r *ReconcileALM) installConductor(cr *comv1alpha1.ALM, service serviceDeploymentInfo, reqLogger logr.Logger) (reconcile.Result, error) {
+	// the StatefulSet's governing Service must exist for its pods to be given DNS names
+	if err := r.headlessService(cr, service, reqLogger); err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to create %s Service", headlessServiceName(service.serviceName)), "Namespace", cr.Namespace)
+		return reconcile.Result{}, err
+	}
+
 	cmName := fmt.Sprintf("%s-%s-cm", cr.Name, service.serviceName)
 
 	// Check if this Statefulset already exists
-	// statefulsetName := fmt.Sprintf("%s-%s", cr.Name, service.serviceName)
 	statefulsetName := service.serviceName
 	found, err := r.statefulsetExists(cr, service)
 	if err != nil {
@@ -54,13 +59,27 @@ func (r *ReconcileALM) installConductor(cr *comv1alpha1.ALM, service serviceDepl
 				}
 			}
 
-			// data["spring_cloud_vault_host"] = {{ .Values.app.config.configServer.vault.host }}
-			// data["spring_cloud_config_server_vault_host"] = {{ .Values.app.config.configServer.vault.host }}
+			vaultSettings := getVaultSettings(cr)
+			vaultScheme, vaultHost, vaultPort := vaultSettings.endpoint()
+			data["spring_cloud_vault_scheme"] = vaultScheme
+			data["spring_cloud_vault_host"] = vaultHost
+			data["spring_cloud_vault_port"] = vaultPort
+			data["spring_cloud_config_server_vault_scheme"] = vaultScheme
+			data["spring_cloud_config_server_vault_host"] = vaultHost
+			data["spring_cloud_config_server_vault_port"] = vaultPort
+			if vaultSettings.manageSecrets {
+				data["spring_cloud_vault_kv_backend"] = vaultSettings.secretsMount
+				data["spring_cloud_vault_kv_default_context"] = fmt.Sprintf("%s/application", vaultSettings.secretsPath)
+				data["spring_cloud_config_server_vault_backend"] = vaultSettings.secretsMount
+				data["spring_cloud_config_server_vault_kvVersion"] = "2"
+				data["spring_cloud_config_server_vault_defaultKey"] = fmt.Sprintf("%s/application", vaultSettings.secretsPath)
+			}
 
 			cm := &corev1.ConfigMap{
 				ObjectMeta: metav1.ObjectMeta{
 					Namespace: cr.Namespace,
 					Name:      cmName,
+					Labels:    lmLabels(service),
 				},
 				Data: data,
 			}
@@ -83,13 +102,15 @@ func (r *ReconcileALM) installConductor(cr *comv1alpha1.ALM, service serviceDepl
 
 		reqLogger.Info(fmt.Sprintf("Creating a new %s Statefulset", service.serviceName), "Namespace", cr.Namespace, "Name", statefulsetName)
 
+		vaultSettings := getVaultSettings(cr)
+
 		var volumes []corev1.Volume
 		volumes = append(volumes,
 			corev1.Volume{
 				Name: "vault-cert",
 				VolumeSource: corev1.VolumeSource{
 					Secret: &corev1.SecretVolumeSource{
-						SecretName: "vault-cert",
+						SecretName: vaultSettings.caSecret,
 					},
 				},
 			})
@@ -115,7 +136,7 @@ func (r *ReconcileALM) installConductor(cr *comv1alpha1.ALM, service serviceDepl
 					Name: "lm-keystore",
 					VolumeSource: corev1.VolumeSource{
 						Secret: &corev1.SecretVolumeSource{
-							SecretName: "lm-keystore",
+							SecretName: lmKeystoreSecretName(cr),
 						},
 					},
 				})
@@ -131,49 +152,46 @@ func (r *ReconcileALM) installConductor(cr *comv1alpha1.ALM, service serviceDepl
 				})
 		}
 
-		statefulset := buildStatefulset(cr.Namespace, statefulsetName, cr, service, volumeMounts, volumes,
-			[]corev1.EnvVar{
-				corev1.EnvVar{
-					Name:  "eureka_instance_hostname",
-					Value: "${HOSTNAME}.conductor",
-				},
-				corev1.EnvVar{
-					Name:  "numReplicas",
-					Value: strconv.Itoa(int(service.numReplicas)),
-				},
-				corev1.EnvVar{
-					Name:  "secure",
-					Value: strconv.FormatBool(cr.Spec.Secure),
-				},
-				corev1.EnvVar{
-					Name: "SPRING_CLOUD_CONFIG_SERVER_VAULT_TOKEN",
-					ValueFrom: &corev1.EnvVarSource{
-						SecretKeyRef: &corev1.SecretKeySelector{
-							LocalObjectReference: corev1.LocalObjectReference{
-								Name: "vault-token",
-							},
-							Key: "lmToken",
-						},
-					},
-				},
-				corev1.EnvVar{
-					Name: "SPRING_CLOUD_VAULT_TOKEN",
-					ValueFrom: &corev1.EnvVarSource{
-						SecretKeyRef: &corev1.SecretKeySelector{
-							LocalObjectReference: corev1.LocalObjectReference{
-								Name: "vault-token",
-							},
-							Key: "lmToken",
-						},
-					},
-				},
-			})
+		env := []corev1.EnvVar{
+			corev1.EnvVar{
+				Name:  "eureka_instance_hostname",
+				Value: fmt.Sprintf("${HOSTNAME}.%s", headlessServiceName(service.serviceName)),
+			},
+			corev1.EnvVar{
+				Name:  "numReplicas",
+				Value: strconv.Itoa(int(service.numReplicas)),
+			},
+			corev1.EnvVar{
+				Name:  "secure",
+				Value: strconv.FormatBool(cr.Spec.Secure),
+			},
+		}
+
+		if vaultSettings.kubernetesAuth {
+			env = append(env, vaultSettings.springKubernetesAuthEnv("SPRING_CLOUD_CONFIG_SERVER_VAULT", "SPRING_CLOUD_VAULT")...)
+		} else {
+			env = append(env, vaultSettings.tokenEnv("SPRING_CLOUD_CONFIG_SERVER_VAULT_TOKEN", "SPRING_CLOUD_VAULT_TOKEN")...)
+		}
+
+		statefulset, err := buildStatefulset(cr.Namespace, statefulsetName, cr, service, volumeMounts, volumes, env)
+		if err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to build a new %s Statefulset", service.serviceName), "Namespace", cr.Namespace, "Name", statefulsetName, "Error", err)
+			r.recorder.Event(cr, corev1.EventTypeWarning, "InvalidPodTemplate", err.Error())
+			return reconcile.Result{}, err
+		}
+		if vaultSettings.kubernetesAuth {
+			vaultSettings.applyKubernetesAuth(&statefulset.Spec.Template.Spec)
+		}
+
+		if _, err := r.applyConfigChecksum(cr, &statefulset.Spec.Template); err != nil {
+			return reconcile.Result{}, err
+		}
 
 		if err := controllerutil.SetControllerReference(cr, statefulset, r.scheme); err != nil {
 			return reconcile.Result{}, err
 		}
 
-		err = r.client.Create(context.TODO(), statefulset)
+		err = r.writeWorkload(cr, statefulset, service, true)
 		if err != nil {
 			reqLogger.Info(fmt.Sprintf("Failed to create a new %s Statefulset", service.serviceName), "Namespace", cr.Namespace, "Name", statefulsetName, "Error", err)
 			return reconcile.Result{}, err
@@ -0,0 +1,163 @@
+package alm
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"sort"
+
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// configChecksumAnnotation is set on the pod template of an LM service to a hash of the ConfigMaps and Secrets its pods
+// consume, so that the pods are replaced when any of them changes
+const configChecksumAnnotation = "com.accantosystems.stratoss/config-checksum"
+
+// podConfigSources returns the names of the ConfigMaps and Secrets the pods read environment variables or mount volumes
+// from, in name order
+func podConfigSources(podSpec *corev1.PodSpec) ([]string, []string) {
+	var configMaps, secrets []string
+	addConfigMap := func(name string) {
+		if name != "" && !containsString(configMaps, name) {
+			configMaps = append(configMaps, name)
+		}
+	}
+	addSecret := func(name string) {
+		if name != "" && !containsString(secrets, name) {
+			secrets = append(secrets, name)
+		}
+	}
+
+	for _, containers := range [][]corev1.Container{podSpec.InitContainers, podSpec.Containers} {
+		for _, container := range containers {
+			for _, envFrom := range container.EnvFrom {
+				if envFrom.ConfigMapRef != nil {
+					addConfigMap(envFrom.ConfigMapRef.Name)
+				}
+				if envFrom.SecretRef != nil {
+					addSecret(envFrom.SecretRef.Name)
+				}
+			}
+			for _, env := range container.Env {
+				if env.ValueFrom == nil {
+					continue
+				}
+				if env.ValueFrom.ConfigMapKeyRef != nil {
+					addConfigMap(env.ValueFrom.ConfigMapKeyRef.Name)
+				}
+				if env.ValueFrom.SecretKeyRef != nil {
+					addSecret(env.ValueFrom.SecretKeyRef.Name)
+				}
+			}
+		}
+	}
+
+	for _, volume := range podSpec.Volumes {
+		if volume.ConfigMap != nil {
+			addConfigMap(volume.ConfigMap.Name)
+		}
+		if volume.Secret != nil {
+			addSecret(volume.Secret.SecretName)
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.ConfigMap != nil {
+					addConfigMap(source.ConfigMap.Name)
+				}
+				if source.Secret != nil {
+					addSecret(source.Secret.Name)
+				}
+			}
+		}
+	}
+
+	sort.Strings(configMaps)
+	sort.Strings(secrets)
+	return configMaps, secrets
+}
+
+// hashData adds the keys and values of a ConfigMap or Secret to the hash, in key order
+func hashData(h hash.Hash, data map[string][]byte) {
+	var keys []string
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write(data[key])
+		h.Write([]byte{0})
+	}
+}
+
+// configChecksum hashes the content of the ConfigMaps and Secrets the pods consume. The certificate Secrets are left
+// out, as changes to them restart LM services only when certificateMonitoring.restartOnChange is set. ConfigMaps and
+// Secrets that do not exist are hashed by name, so that the pods are replaced once they are created.
+func (r *ReconcileALM) configChecksum(cr *comv1alpha1.ALM, podSpec *corev1.PodSpec) (string, error) {
+	configMaps, secrets := podConfigSources(podSpec)
+	h := fnv.New64a()
+
+	for _, name := range configMaps {
+		h.Write([]byte(fmt.Sprintf("configmap/%s\n", name)))
+
+		configMap := &corev1.ConfigMap{}
+		err := r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, configMap)
+		if err != nil && errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		data := make(map[string][]byte)
+		for key, value := range configMap.Data {
+			data[key] = []byte(value)
+		}
+		hashData(h, data)
+		hashData(h, configMap.BinaryData)
+	}
+
+	excluded := certificateSecretNames(cr)
+	for _, name := range secrets {
+		if containsString(excluded, name) {
+			continue
+		}
+		h.Write([]byte(fmt.Sprintf("secret/%s\n", name)))
+
+		secret := &corev1.Secret{}
+		err := r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, secret)
+		if err != nil && errors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		hashData(h, secret.Data)
+	}
+
+	return fmt.Sprintf("%x", h.Sum64()), nil
+}
+
+// applyConfigChecksum records the hash of the ConfigMaps and Secrets the pods consume on the pod template. It returns
+// true if the hash changed, in which case the pods are replaced.
+func (r *ReconcileALM) applyConfigChecksum(cr *comv1alpha1.ALM, template *corev1.PodTemplateSpec) (bool, error) {
+	checksum, err := r.configChecksum(cr, &template.Spec)
+	if err != nil {
+		return false, err
+	}
+	if template.Annotations[configChecksumAnnotation] == checksum {
+		return false, nil
+	}
+
+	if template.Annotations == nil {
+		template.Annotations = make(map[string]string)
+	}
+	template.Annotations[configChecksumAnnotation] = checksum
+
+	return true, nil
+}
@@ -0,0 +1,96 @@
+package alm
+
+import (
+	"hash/fnv"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestPodConfigSources(t *testing.T) {
+	podSpec := &corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "init", EnvFrom: []corev1.EnvFromSource{
+			{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "vault-token"}}},
+		}}},
+		Containers: []corev1.Container{{Name: "ishtar", Env: []corev1.EnvVar{
+			{Name: "PLAIN", Value: "value"},
+			{Name: "LOCALE", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "ishtar-config"}, Key: "locale"}}},
+			{Name: "PASSWORD", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "db-credentials"}, Key: "password"}}},
+		}}},
+		Volumes: []corev1.Volume{
+			{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "ishtar-config"}}}},
+			{Name: "certs", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "lm-certs"}}},
+			{Name: "projected", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{Sources: []corev1.VolumeProjection{
+				{ConfigMap: &corev1.ConfigMapProjection{LocalObjectReference: corev1.LocalObjectReference{Name: "a-config"}}},
+			}}}},
+		},
+	}
+
+	configMaps, secrets := podConfigSources(podSpec)
+	if want := []string{"a-config", "ishtar-config"}; !reflect.DeepEqual(configMaps, want) {
+		t.Errorf("ConfigMaps = %v, want %v", configMaps, want)
+	}
+	if want := []string{"db-credentials", "lm-certs", "vault-token"}; !reflect.DeepEqual(secrets, want) {
+		t.Errorf("Secrets = %v, want %v", secrets, want)
+	}
+}
+
+func TestHashData(t *testing.T) {
+	hashOf := func(data map[string][]byte) uint64 {
+		h := fnv.New64a()
+		hashData(h, data)
+		return h.Sum64()
+	}
+
+	tests := []struct {
+		name  string
+		a, b  map[string][]byte
+		equal bool
+	}{
+		{"same data", map[string][]byte{"a": []byte("1"), "b": []byte("2")}, map[string][]byte{"b": []byte("2"), "a": []byte("1")}, true},
+		{"changed value", map[string][]byte{"a": []byte("1")}, map[string][]byte{"a": []byte("2")}, false},
+		{"key and value boundary", map[string][]byte{"ab": []byte("c")}, map[string][]byte{"a": []byte("bc")}, false},
+	}
+	for _, test := range tests {
+		if equal := hashOf(test.a) == hashOf(test.b); equal != test.equal {
+			t.Errorf("%s: hashes equal = %v, want %v", test.name, equal, test.equal)
+		}
+	}
+}
+
+func TestConfigChecksum(t *testing.T) {
+	cr := almForTest()
+	podSpec := &corev1.PodSpec{Volumes: []corev1.Volume{
+		{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "ishtar-config"}}}},
+		{Name: "certs", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "lm-certs"}}},
+	}}
+	configMap := func(value string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "ishtar-config", Namespace: "lm"}, Data: map[string]string{"locale": value}}
+	}
+	certs := func(value string) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "lm-certs", Namespace: "lm"}, Data: map[string][]byte{"tls.crt": []byte(value)}}
+	}
+	checksum := func(objects ...runtime.Object) string {
+		r, _ := reconcilerForTest(t, cr, objects...)
+		sum, err := r.configChecksum(cr, podSpec)
+		if err != nil {
+			t.Fatalf("configChecksum() error = %v", err)
+		}
+		return sum
+	}
+
+	installed := checksum(configMap("en"), certs("a"))
+	if missing := checksum(certs("a")); missing == installed {
+		t.Errorf("configChecksum() = %s, want a missing ConfigMap to change the checksum once created", missing)
+	}
+	if changed := checksum(configMap("fr"), certs("a")); changed == installed {
+		t.Errorf("configChecksum() = %s, want a changed ConfigMap to change the checksum", changed)
+	}
+	// the certificate Secrets restart LM services only when certificateMonitoring.restartOnChange is set
+	if renewed := checksum(configMap("en"), certs("b")); renewed != installed {
+		t.Errorf("configChecksum() = %s, want %s with a changed certificate Secret", renewed, installed)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"strconv"
+	"strings"
 
 	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
 	batchv1 "k8s.io/api/batch/v1"
@@ -12,9 +13,50 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// configuratorStages lists the stages of the LM configurator, in the order it runs them
+var configuratorStages = []string{"kafkaTopics", "janusgraphSchema", "certificates", "ldap", "configImport"}
+
+// selectConfiguratorStages returns the configurator stages to run, in run order. Stages that
+// are not mentioned in the spec are run.
+func selectConfiguratorStages(stageSpecs []comv1alpha1.ConfiguratorStageSpec) ([]string, error) {
+	enabled := make(map[string]bool)
+	for _, stage := range configuratorStages {
+		enabled[stage] = true
+	}
+
+	for _, stageSpec := range stageSpecs {
+		if _, ok := enabled[stageSpec.Name]; !ok {
+			return nil, fmt.Errorf("Unknown configurator stage %s, must be one of %s", stageSpec.Name, strings.Join(configuratorStages, ", "))
+		}
+		enabled[stageSpec.Name] = stageSpec.Enabled
+	}
+
+	var stages []string
+	for _, stage := range configuratorStages {
+		if enabled[stage] {
+			stages = append(stages, stage)
+		}
+	}
+
+	return stages, nil
+}
+
+func removeStage(stages []string, name string) []string {
+	var remaining []string
+	for _, stage := range stages {
+		if stage != name {
+			remaining = append(remaining, stage)
+		}
+	}
+
+	return remaining
+}
+
 type janus struct {
 	CassandraHostname string
 	ESHostname        string
+	NumShards         int32
+	NumReplicas       int32
 }
 
 type SecurityConfig struct {
@@ -60,9 +102,12 @@ type configuratorConfig struct {
 }
 
 func buildConfiguratorCM(name string, cr *comv1alpha1.ALM, configuratorDeploymentInfo configuratorDeploymentInfo) (*corev1.ConfigMap, error) {
+	esSettings := getElasticsearchSettings(cr)
 	janus := janus{
-		ESHostname:        "foundation-elasticsearch-client:9200",
+		ESHostname:        esSettings.hostname(),
 		CassandraHostname: "foundation-cassandra",
+		NumShards:         esSettings.shards,
+		NumReplicas:       esSettings.replicas,
 	}
 
 	t, err := template.New("janus").Parse("alm:\n" +
@@ -74,8 +119,8 @@ func buildConfiguratorCM(name string, cr *comv1alpha1.ALM, configuratorDeploymen
 		"    index:\n" +
 		"      search:\n" +
 		"        hostname: \"{{.ESHostname}}\"\n" +
-		"        elasticsearch.create.ext.index.number_of_shards: 1\n" +
-		"        elasticsearch.create.ext.index.number_of_replicas: 0\n")
+		"        elasticsearch.create.ext.index.number_of_shards: {{.NumShards}}\n" +
+		"        elasticsearch.create.ext.index.number_of_replicas: {{.NumReplicas}}\n")
 	if err != nil {
 		return nil, err
 	}
@@ -110,177 +155,19 @@ func buildConfiguratorCM(name string, cr *comv1alpha1.ALM, configuratorDeploymen
 		return nil, err
 	}
 
-	type topicsConfig struct {
-		NumPartitions     int32
-		ReplicationFactor int32
-	}
-
-	topics := topicsConfig{
-		NumPartitions:     1,
-		ReplicationFactor: 1,
-	}
-
-	t, err = template.New("topics").Parse("topics:\n" +
-		"  alm__health:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"    config: \"cleanup.policy=compact\"\n" +
-		"  alm__metric:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"    config: \"cleanup.policy=compact\"\n" +
-		"  alm__metric-integrity:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"    config: \"cleanup.policy=compact\"\n" +
-		"  alm__policy:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"    config: \"cleanup.policy=compact\"\n" +
-		"  alm__policyAction:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  alm__policyStatusHeal:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  alm__policyStatusScale:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: 1{{.NumPartitions}}\n" +
-		"  alm__clock:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  alm__descriptorChange:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"    config: \"cleanup.policy=compact\"\n" +
-		"  alm__processStateChange:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  alm__processTasksStateChange:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  alm__stateChange:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  alm__serviceStateTransition:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  alm__taskUpdate:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  alm__load:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  alm__integrity:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  alm__integrityMissing:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  info:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  alm__clockticks5:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"    config: \"retention.ms=3600000\"\n" +
-		"  alm__clockticks10:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"    config: \"retention.ms=3600000\"\n" +
-		"  alm__clockticks15:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"    config: \"retention.ms=3600000\"\n" +
-		"  alm__clockticks30:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"    config: \"retention.ms=3600000\"\n" +
-		"  alm__clockticks60:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"    config: \"retention.ms=3600000\"\n" +
-		"  alm__clockticksother:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  alm__tick:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"    config: \"retention.ms=3600000\"\n" +
-		"  alm__clocktickTypes:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"    config: \"cleanup.policy=compact\"\n" +
-		"  alm__processRestart:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  alm__stateChange__ldu:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"    config: \"retention.ms=31536000000\"\n" +
-		"  alm__verification:\n" +
-		"    replication_factor: 1\n" +
-		"    partitions: 1  \n" +
-		"  lm_vim_infrastructure_task_events:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n" +
-		"  lm_vnfc_lifecycle_execution_events:\n" +
-		"    replication_factor: {{.ReplicationFactor}}\n" +
-		"    partitions: {{.NumPartitions}}\n")
+	topicSettings := getKafkaSettings(cr)
 
+	clientCredentialsYaml, err := clientCredentialsConfig("pass123")
 	if err != nil {
 		return nil, err
 	}
 
-	var topicsTpl bytes.Buffer
-	if err := t.Execute(&topicsTpl, topics); err != nil {
-		return nil, err
-	}
-
-	type clientCredentialsConfig struct {
-		LMClientID         string
-		LMClientSecret     string
-		LMGrantTypes       string
-		LMRoles            string
-		NimrodClientID     string
-		NimrodClientSecret string
-		NimrodGrantTypes   string
-		DokiClientID       string
-		DokiClientSecret   string
-		DokiGrantTypes     string
-		DokiRoles          string
-	}
-
-	clientCredentials := clientCredentialsConfig{
-		LMClientID:         "LmClient",
-		LMClientSecret:     "pass123",
-		LMGrantTypes:       "client_credentials",
-		LMRoles:            "SLMAdmin",
-		NimrodClientID:     "NimrodClient",
-		NimrodClientSecret: "pass123",
-		NimrodGrantTypes:   "password,refresh_token",
-		DokiClientID:       "DokiClient",
-		DokiClientSecret:   "pass123",
-		DokiGrantTypes:     "client_credentials",
-		DokiRoles:          "BehaviourScenarioExecute",
-	}
-
-	t, err = template.New("clientCredentials").Parse("    - clientId: {{.LMClientID}}\n" +
-		"      clientSecret: {{.LMClientSecret}}\n" +
-		"      grantTypes: {{.LMGrantTypes}}\n" +
-		"      roles: {{.LMRoles}}\n")
-	if err != nil {
-		return nil, err
-	}
-
-	var clientCredentialsTpl bytes.Buffer
-	if err := t.Execute(&clientCredentialsTpl, clientCredentials); err != nil {
-		return nil, err
-	}
+	uiHost := getNimrodIngressSettings(cr).host
+	apiHost := getIshtarIngressSettings(cr).host
 
 	config := configuratorConfig{
 		KafkaConfig:      kafkaTpl.String(),
-		TopicsConfig:     topicsTpl.String(),
+		TopicsConfig:     topicsConfig(topicSettings.partitions, topicSettings.replicationFactor),
 		JanusgraphConfig: janusTpl.String(),
 		SecurityConfig: SecurityConfig{
 			Enabled:                            strconv.FormatBool(cr.Spec.Secure),
@@ -296,21 +183,21 @@ func buildConfiguratorCM(name string, cr *comv1alpha1.ALM, configuratorDeploymen
 			SecurityLdapManagerPassword:        "lmadmin",
 			SecurityLdapDomain:                 "lm.com",
 			SecurityUIHostGenCert:              "true",
-			SecurityUIHostCommonName:           "ui.lm",
+			SecurityUIHostCommonName:           uiHost,
 			SecurityUIHostCertSecretName:       "nimrod-host-tls",
 			SecurityUINoHostGenCert:            "true",
 			SecurityUINoHostCertSecretName:     "nimrod-nohost-tls",
 			SecurityAPIHostGenCert:             "true",
-			SecurityAPIHostCommonName:          "app.lm",
+			SecurityAPIHostCommonName:          apiHost,
 			SecurityAPIHostCertSecretName:      "ishtar-host-tls",
 			SecurityAPINoHostGenCert:           "true",
-			SecurityAPINoHostCommonName:        "app.lm",
+			SecurityAPINoHostCommonName:        apiHost,
 			SecurityAPINoHostCertSecretName:    "ishtar-nohost-tls",
 			CassandraUsername:                  "",
 			CassandraPassword:                  "",
-			SecurityClientCredentialsConfig:    clientCredentialsTpl.String(),
+			SecurityClientCredentialsConfig:    clientCredentialsYaml,
 			LoggingDashboardEnabled:            "true",
-			LoggingDashboardEndpoint:           "http://ui.lm:31001",
+			LoggingDashboardEndpoint:           fmt.Sprintf("http://%s:31001", uiHost),
 			LoggingDashboardApplication:        "kibana",
 			KibanaIndex:                        "lm-logs",
 			KibanaConfigurationEndpoint:        "http://foundation-kibana:443",
@@ -321,6 +208,7 @@ func buildConfiguratorCM(name string, cr *comv1alpha1.ALM, configuratorDeploymen
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: cr.Namespace,
 			Name:      name,
+			Labels:    lmLabels(configuratorDeploymentInfo.serviceDeploymentInfo),
 		},
 		Data: map[string]string{
 			"kafka_config.yaml":                  config.KafkaConfig,
@@ -362,28 +250,74 @@ func buildConfiguratorCM(name string, cr *comv1alpha1.ALM, configuratorDeploymen
 	}, nil
 }
 
-func buildLmConfigImportCm(namespace string, name string) (*corev1.ConfigMap, error) {
+// clientCredentialsConfig renders the OAuth clients the configurator registers with Nimrod
+func clientCredentialsConfig(lmClientSecret string) (string, error) {
+	type clientCredentials struct {
+		LMClientID         string
+		LMClientSecret     string
+		LMGrantTypes       string
+		LMRoles            string
+		NimrodClientID     string
+		NimrodClientSecret string
+		NimrodGrantTypes   string
+		DokiClientID       string
+		DokiClientSecret   string
+		DokiGrantTypes     string
+		DokiRoles          string
+	}
+
+	credentials := clientCredentials{
+		LMClientID:         "LmClient",
+		LMClientSecret:     lmClientSecret,
+		LMGrantTypes:       "client_credentials",
+		LMRoles:            "SLMAdmin",
+		NimrodClientID:     "NimrodClient",
+		NimrodClientSecret: "pass123",
+		NimrodGrantTypes:   "password,refresh_token",
+		DokiClientID:       "DokiClient",
+		DokiClientSecret:   "pass123",
+		DokiGrantTypes:     "client_credentials",
+		DokiRoles:          "BehaviourScenarioExecute",
+	}
+
+	t, err := template.New("clientCredentials").Parse("    - clientId: {{.LMClientID}}\n" +
+		"      clientSecret: {{.LMClientSecret}}\n" +
+		"      grantTypes: {{.LMGrantTypes}}\n" +
+		"      roles: {{.LMRoles}}\n")
+	if err != nil {
+		return "", err
+	}
+
+	var clientCredentialsTpl bytes.Buffer
+	if err := t.Execute(&clientCredentialsTpl, credentials); err != nil {
+		return "", err
+	}
+
+	return clientCredentialsTpl.String(), nil
+}
+
+func buildLmConfigImportCm(namespace string, name string, esSettings elasticsearchSettings) (*corev1.ConfigMap, error) {
 	watchtowerCfg, watchtowerCfgErr := watchtowerConfig(1)
 	if watchtowerCfgErr != nil {
 		return nil, watchtowerCfgErr
 	}
 
-	galileoCfg, galileoCfgErr := galileoConfig("at_least_once", 1, 0, 0, 1)
+	galileoCfg, galileoCfgErr := galileoConfig("at_least_once", esSettings.shards, esSettings.replicas, 0, 1)
 	if galileoCfgErr != nil {
 		return nil, galileoCfgErr
 	}
 
-	talledegaCfg, talledegaCfgErr := talledegaConfig(1, 0, 1)
+	talledegaCfg, talledegaCfgErr := talledegaConfig(esSettings.shards, esSettings.replicas, 1)
 	if talledegaCfgErr != nil {
 		return nil, talledegaCfgErr
 	}
 
-	brentCfg, brentCfgErr := brentConfig(1, 0, 1)
+	brentCfg, brentCfgErr := brentConfig(esSettings.shards, esSettings.replicas, 1)
 	if brentCfgErr != nil {
 		return nil, brentCfgErr
 	}
 
-	apolloCfg, apolloCfgErr := apolloConfig(1, 0, 1)
+	apolloCfg, apolloCfgErr := apolloConfig(esSettings.shards, esSettings.replicas, 1)
 	if apolloCfgErr != nil {
 		return nil, apolloCfgErr
 	}
@@ -416,24 +350,102 @@ func buildLmConfigImportCm(namespace string, name string) (*corev1.ConfigMap, er
 }
 
 func buildJob(cr *comv1alpha1.ALM, configuratorDeploymentInfo configuratorDeploymentInfo, dockerRepo string, namespace string, name string,
-	lmConfiguratorCMName string, lmConfigImportCmName string) *batchv1.Job {
+	lmConfiguratorCMName string, lmConfigImportCmName string) (*batchv1.Job, error) {
 	dockerImage := fmt.Sprintf("%s/%s:%s", dockerRepo, configuratorDeploymentInfo.imageName, configuratorDeploymentInfo.imageVersion)
-	return &batchv1.Job{
+
+	env := []corev1.EnvVar{
+		{
+			Name: "NAMESPACE",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					FieldPath: "metadata.namespace",
+				},
+			},
+		},
+		{
+			Name:  "CONFIGURATOR_STAGES",
+			Value: strings.Join(configuratorDeploymentInfo.stages, ","),
+		},
+	}
+
+	vaultSettings := getVaultSettings(cr)
+	if vaultSettings.kubernetesAuth {
+		env = append(env,
+			corev1.EnvVar{Name: "VAULT_AUTH_METHOD", Value: "kubernetes"},
+			corev1.EnvVar{Name: "VAULT_ROLE", Value: vaultSettings.role},
+			corev1.EnvVar{Name: "VAULT_AUTH_PATH", Value: vaultSettings.authPath},
+			corev1.EnvVar{Name: "VAULT_SA_TOKEN_FILE", Value: vaultTokenFile})
+	} else {
+		env = append(env, vaultSettings.tokenEnv("VAULT_TOKEN")...)
+	}
+
+	if vaultSettings.manageSecrets {
+		// override the default credentials in the configurator ConfigMap with the ones stored in Vault
+		for _, key := range lmCredentialKeys {
+			env = append(env, corev1.EnvVar{
+				Name: key,
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: lmCredentialsSecretName(cr),
+						},
+						Key: key,
+					},
+				},
+			})
+		}
+
+		clientCredentialsYaml, err := clientCredentialsConfig("$(securityLmClientSecret)")
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, corev1.EnvVar{
+			Name:  "securityClientCredentials",
+			Value: clientCredentialsYaml,
+		})
+	}
+
+	if cr.Spec.Cassandra.ManageRole {
+		// override the empty credentials in the configurator ConfigMap with the ALM's Cassandra role
+		env = append(env,
+			corev1.EnvVar{
+				Name: "cassandraUsername",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: cassandraCredentialsSecretName(cr),
+						},
+						Key: "username",
+					},
+				},
+			},
+			corev1.EnvVar{
+				Name: "cassandraPassword",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: cassandraCredentialsSecretName(cr),
+						},
+						Key: "password",
+					},
+				},
+			})
+	}
+
+	job := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: namespace,
-			Labels: map[string]string{
-				"app": "lm-configurator",
-			},
+			Labels:    lmLabels(configuratorDeploymentInfo.serviceDeploymentInfo),
 		},
 		Spec: batchv1.JobSpec{
+			BackoffLimit:          int32Ptr(configuratorDeploymentInfo.backoffLimit),
+			ActiveDeadlineSeconds: int64Ptr(configuratorDeploymentInfo.activeDeadlineSeconds),
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      fmt.Sprintf("%s-%s", cr.Name, configuratorDeploymentInfo.serviceName),
 					Namespace: namespace,
-					Labels: map[string]string{
-						"app": configuratorDeploymentInfo.serviceName,
-					},
+					Labels:    lmLabels(configuratorDeploymentInfo.serviceDeploymentInfo),
 				},
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{
@@ -448,27 +460,7 @@ func buildJob(cr *comv1alpha1.ALM, configuratorDeploymentInfo configuratorDeploy
 									},
 								},
 							},
-							Env: []corev1.EnvVar{
-								{
-									Name: "NAMESPACE",
-									ValueFrom: &corev1.EnvVarSource{
-										FieldRef: &corev1.ObjectFieldSelector{
-											FieldPath: "metadata.namespace",
-										},
-									},
-								},
-								{
-									Name: "VAULT_TOKEN",
-									ValueFrom: &corev1.EnvVarSource{
-										SecretKeyRef: &corev1.SecretKeySelector{
-											LocalObjectReference: corev1.LocalObjectReference{
-												Name: "vault-token",
-											},
-											Key: "lmToken",
-										},
-									},
-								},
-							},
+							Env: env,
 							VolumeMounts: []corev1.VolumeMount{
 								{
 									Name:      "lm-configurator",
@@ -504,4 +496,12 @@ func buildJob(cr *comv1alpha1.ALM, configuratorDeploymentInfo configuratorDeploy
 			},
 		},
 	}
+
+	applyPodSecurity(&job.Spec.Template, configuratorDeploymentInfo.serviceDeploymentInfo)
+	applyTrustedCA(&job.Spec.Template.Spec, configuratorDeploymentInfo.serviceDeploymentInfo)
+	if vaultSettings.kubernetesAuth {
+		vaultSettings.applyKubernetesAuth(&job.Spec.Template.Spec)
+	}
+
+	return job, nil
 }
@@ -0,0 +1,270 @@
+package alm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func configuratorJobForTest() *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "awesome-lm-configurator", Namespace: "lm"},
+		Status: batchv1.JobStatus{
+			Conditions: []batchv1.JobCondition{
+				{Type: batchv1.JobComplete, Status: corev1.ConditionFalse},
+				{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded", Message: "Job has reached the specified backoff limit"},
+			},
+		},
+	}
+}
+
+func TestJobFailed(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions []batchv1.JobCondition
+		failed     bool
+	}{
+		{name: "no conditions"},
+		{name: "complete", conditions: []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}},
+		{name: "failed false", conditions: []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionFalse}}},
+		{name: "failed", conditions: configuratorJobForTest().Status.Conditions, failed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &batchv1.Job{Status: batchv1.JobStatus{Conditions: tt.conditions}}
+			condition := jobFailed(job)
+			if (condition != nil) != tt.failed {
+				t.Fatalf("jobFailed() = %v, want failed %v", condition, tt.failed)
+			}
+			if condition != nil && condition.Reason != "BackoffLimitExceeded" {
+				t.Errorf("jobFailed() = %+v, want the Failed condition", condition)
+			}
+		})
+	}
+}
+
+func TestRetryRequested(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		lastRetry   string
+		want        string
+		requested   bool
+	}{
+		{name: "no annotation"},
+		{name: "empty", annotations: map[string]string{retryConfiguratorAnnotation: ""}},
+		{name: "new value", annotations: map[string]string{retryConfiguratorAnnotation: "2"}, lastRetry: "1", want: "2", requested: true},
+		{name: "first retry", annotations: map[string]string{retryConfiguratorAnnotation: "1"}, want: "1", requested: true},
+		{name: "acted on", annotations: map[string]string{retryConfiguratorAnnotation: "1"}, lastRetry: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := almForTest()
+			cr.Annotations = tt.annotations
+			cr.Status.Configurator.LastRetry = tt.lastRetry
+
+			got, requested := retryRequested(cr)
+			if got != tt.want || requested != tt.requested {
+				t.Errorf("retryRequested() = %q, %v, want %q, %v", got, requested, tt.want, tt.requested)
+			}
+		})
+	}
+}
+
+func TestHandleConfiguratorFailure(t *testing.T) {
+	deleting := metav1.Now()
+	tests := []struct {
+		name          string
+		retry         string
+		status        comv1alpha1.ConfiguratorStatus
+		deleting      bool
+		wantRequeue   bool
+		wantPhase     string
+		wantMessage   string
+		wantLastRetry string
+		wantSkipped   []string
+		wantDeleted   bool
+		wantEvent     string
+	}{
+		{
+			name:        "new failure",
+			wantPhase:   configuratorPhaseFailed,
+			wantEvent:   "ConfiguratorFailed",
+			wantSkipped: []string{"ldap", "configImport"},
+			wantMessage: "BackoffLimitExceeded: Job has reached the specified backoff limit",
+		},
+		{
+			name:        "already reported",
+			status:      comv1alpha1.ConfiguratorStatus{Phase: configuratorPhaseFailed, JobName: "awesome-lm-configurator", Message: "reported"},
+			wantPhase:   configuratorPhaseFailed,
+			wantMessage: "reported",
+		},
+		{
+			name:          "retry",
+			retry:         "1",
+			status:        comv1alpha1.ConfiguratorStatus{Phase: configuratorPhaseFailed, JobName: "awesome-lm-configurator"},
+			wantRequeue:   true,
+			wantPhase:     configuratorPhaseRunning,
+			wantMessage:   "Retry 1 requested",
+			wantLastRetry: "1",
+			wantDeleted:   true,
+			wantEvent:     "ConfiguratorRetry",
+		},
+		{
+			name:          "retry acted on",
+			retry:         "1",
+			status:        comv1alpha1.ConfiguratorStatus{Phase: configuratorPhaseFailed, JobName: "awesome-lm-configurator", LastRetry: "1"},
+			wantPhase:     configuratorPhaseFailed,
+			wantLastRetry: "1",
+		},
+		{
+			name:          "being deleted",
+			retry:         "2",
+			status:        comv1alpha1.ConfiguratorStatus{Phase: configuratorPhaseRunning, JobName: "awesome-lm-configurator", LastRetry: "1"},
+			deleting:      true,
+			wantRequeue:   true,
+			wantPhase:     configuratorPhaseRunning,
+			wantLastRetry: "1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := almForTest()
+			if tt.retry != "" {
+				cr.Annotations = map[string]string{retryConfiguratorAnnotation: tt.retry}
+			}
+			cr.Status.Configurator = tt.status
+			job := configuratorJobForTest()
+			job.Spec.Template.Spec.Containers = []corev1.Container{{
+				Name: "lm-configurator",
+				Env:  []corev1.EnvVar{{Name: "CONFIGURATOR_STAGES", Value: "kafkaTopics,janusgraphSchema,certificates"}},
+			}}
+			r, recorder := reconcilerForTest(t, cr, job)
+			if tt.deleting {
+				job.DeletionTimestamp = &deleting
+			}
+
+			result, err := r.handleConfiguratorFailure(cr, job, jobFailed(job), configuratorDeploymentInfo{failureLogLines: 50}, log)
+			if err != nil {
+				t.Fatalf("handleConfiguratorFailure() error = %v", err)
+			}
+			if result.Requeue != tt.wantRequeue {
+				t.Errorf("result = %+v, want requeue %v", result, tt.wantRequeue)
+			}
+
+			status := cr.Status.Configurator
+			if status.Phase != tt.wantPhase || status.Message != tt.wantMessage || status.LastRetry != tt.wantLastRetry {
+				t.Errorf("status = %+v, want phase %s, message %q and last retry %q", status, tt.wantPhase, tt.wantMessage, tt.wantLastRetry)
+			}
+			if tt.wantSkipped != nil && strings.Join(status.SkippedStages, ",") != strings.Join(tt.wantSkipped, ",") {
+				t.Errorf("skipped = %v, want %v", status.SkippedStages, tt.wantSkipped)
+			}
+
+			err = r.client.Get(context.TODO(), types.NamespacedName{Name: job.Name, Namespace: job.Namespace}, &batchv1.Job{})
+			if deleted := errors.IsNotFound(err); deleted != tt.wantDeleted {
+				t.Errorf("Job deleted = %v, want %v", deleted, tt.wantDeleted)
+			}
+
+			switch {
+			case tt.wantEvent == "" && len(recorder.Events) > 0:
+				t.Errorf("event = %s, want none", <-recorder.Events)
+			case tt.wantEvent != "":
+				if len(recorder.Events) != 1 {
+					t.Fatalf("events = %d, want %s", len(recorder.Events), tt.wantEvent)
+				}
+				if event := <-recorder.Events; !strings.Contains(event, tt.wantEvent) {
+					t.Errorf("event = %s, want %s", event, tt.wantEvent)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactLog(t *testing.T) {
+	output := strings.Join([]string{
+		"Running stage ldap",
+		"cassandraPassword=abc123 connecting",
+		`{"clientSecret": "s3cr3t", "clientId": "LmClient"}`,
+		"Authorization: Bearer eyJhbGciOi.payload",
+		"Calling https://admin:pw@vault:8200/v1 and http://vault:8200/v1",
+		"vault token: s.Xyz",
+	}, "\n")
+
+	got := redactLog(output, 4096)
+	for _, secret := range []string{"abc123", "s3cr3t", "eyJhbGciOi", "admin:pw@", "s.Xyz"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("redactLog() = %s, want %s redacted", got, secret)
+		}
+	}
+	for _, kept := range []string{"Running stage ldap", `"clientId": "LmClient"`, "http://vault:8200/v1", "admin:<redacted>@vault"} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("redactLog() = %s, want %s kept", got, kept)
+		}
+	}
+
+	if got := redactLog("first line\nsecond line\nthird line", 16); got != "third line" {
+		t.Errorf("redactLog() = %q, want the whole last lines that fit", got)
+	}
+}
+
+func TestJobStages(t *testing.T) {
+	tests := []struct {
+		name string
+		env  []corev1.EnvVar
+		want []string
+	}{
+		{name: "selected", env: []corev1.EnvVar{{Name: "CONFIGURATOR_STAGES", Value: "kafkaTopics,ldap"}}, want: []string{"kafkaTopics", "ldap"}},
+		{name: "none selected", env: []corev1.EnvVar{{Name: "CONFIGURATOR_STAGES", Value: ""}}},
+		{name: "created before stages", env: []corev1.EnvVar{{Name: "NAMESPACE"}}, want: configuratorStages},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &batchv1.Job{}
+			job.Spec.Template.Spec.Containers = []corev1.Container{{Name: "lm-configurator", Env: tt.env}}
+			if got := jobStages(job); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("jobStages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	stages := jobStages(&batchv1.Job{})
+	stages[0] = "changed"
+	if configuratorStages[0] != "kafkaTopics" {
+		t.Errorf("configuratorStages = %v, want it left alone when the returned stages are changed", configuratorStages)
+	}
+}
+
+func TestPodCompletedStages(t *testing.T) {
+	terminated := func(name string, message string) corev1.ContainerStatus {
+		return corev1.ContainerStatus{
+			Name:  name,
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: message}},
+		}
+	}
+	tests := []struct {
+		name     string
+		statuses []corev1.ContainerStatus
+		want     []string
+	}{
+		{name: "completed", statuses: []corev1.ContainerStatus{terminated("lm-configurator", "kafkaTopics, janusgraphSchema\n")}, want: []string{"kafkaTopics", "janusgraphSchema"}},
+		{name: "unknown stages", statuses: []corev1.ContainerStatus{terminated("lm-configurator", "kafkaTopics,Error: connection refused")}, want: []string{"kafkaTopics"}},
+		{name: "no message", statuses: []corev1.ContainerStatus{terminated("lm-configurator", "")}},
+		{name: "other container", statuses: []corev1.ContainerStatus{terminated("istio-proxy", "kafkaTopics")}},
+		{name: "running", statuses: []corev1.ContainerStatus{{Name: "lm-configurator"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{Status: corev1.PodStatus{ContainerStatuses: tt.statuses}}
+			if got := podCompletedStages(pod); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("podCompletedStages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
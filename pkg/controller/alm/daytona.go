@@ -18,7 +18,6 @@ func (r *ReconcileALM) installDaytona(cr *comv1alpha1.ALM, service serviceDeploy
 	cmName := fmt.Sprintf("%s-%s-cm", cr.Name, service.serviceName)
 
 	// Check if this Deployment already exists
-	// deploymentName := fmt.Sprintf("%s-%s", cr.Name, service.serviceName)
 	deploymentName := service.serviceName
 	found, err := r.deploymentExists(cr, service)
 	if err != nil {
@@ -57,6 +56,7 @@ func (r *ReconcileALM) installDaytona(cr *comv1alpha1.ALM, service serviceDeploy
 				ObjectMeta: metav1.ObjectMeta{
 					Namespace: cr.Namespace,
 					Name:      cmName,
+					Labels:    lmLabels(service),
 				},
 				Data: data,
 			}
@@ -100,13 +100,22 @@ func (r *ReconcileALM) installDaytona(cr *comv1alpha1.ALM, service serviceDeploy
 				})
 		}
 
-		deployment := buildDeployment(cr.Namespace, deploymentName, cr, service, volumeMounts, volumes)
+		deployment, err := buildDeployment(cr.Namespace, deploymentName, cr, service, volumeMounts, volumes)
+		if err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to build a new %s Deployment", service.serviceName), "Namespace", cr.Namespace, "Name", deploymentName, "Error", err)
+			r.recorder.Event(cr, corev1.EventTypeWarning, "InvalidPodTemplate", err.Error())
+			return reconcile.Result{}, err
+		}
+
+		if _, err := r.applyConfigChecksum(cr, &deployment.Spec.Template); err != nil {
+			return reconcile.Result{}, err
+		}
 
 		if err := controllerutil.SetControllerReference(cr, deployment, r.scheme); err != nil {
 			return reconcile.Result{}, err
 		}
 
-		err = r.client.Create(context.TODO(), deployment)
+		err = r.writeWorkload(cr, deployment, service, true)
 		if err != nil {
 			reqLogger.Info(fmt.Sprintf("Failed to create a new %s Deployment", service.serviceName), "Namespace", cr.Namespace, "Name", deploymentName, "Error", err)
 			return reconcile.Result{}, err
@@ -0,0 +1,179 @@
+package alm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// PodDisruptionBudgets are served by policy/v1 from Kubernetes 1.21 and by policy/v1beta1 before 1.25
+var (
+	podDisruptionBudgetResource       = schema.GroupVersionResource{Group: "policy", Version: "v1", Resource: "poddisruptionbudgets"}
+	legacyPodDisruptionBudgetResource = schema.GroupVersionResource{Group: "policy", Version: "v1beta1", Resource: "poddisruptionbudgets"}
+)
+
+func podDisruptionBudgetName(serviceName string) string {
+	return fmt.Sprintf("%s-pdb", serviceName)
+}
+
+// podDisruptionBudgetSpec allows one replica of an LM service to be evicted at a time
+func podDisruptionBudgetSpec(service serviceDeploymentInfo) map[string]interface{} {
+	return map[string]interface{}{
+		"maxUnavailable": int64(1),
+		"selector": map[string]interface{}{
+			"matchLabels": stringMap(lmSelector(service)),
+		},
+	}
+}
+
+// podDisruptionBudgetNeeded returns true if an LM service may run more than one replica, so that its budget limits
+// evictions. An autoscaled service may be scaled beyond its minimum number of replicas, up to its maximum.
+func podDisruptionBudgetNeeded(service serviceDeploymentInfo) bool {
+	if autoscaled(service) {
+		return service.autoscaling.MaxReplicas > 1
+	}
+
+	return service.numReplicas > 1
+}
+
+// serverVersionAtLeast returns true if the cluster runs Kubernetes major.minor or later. Minor versions of some
+// providers carry a + suffix, such as 15+.
+func (r *ReconcileALM) serverVersionAtLeast(major int, minor int) (bool, error) {
+	version, err := r.kubeClient.Discovery().ServerVersion()
+	if err != nil {
+		return false, err
+	}
+
+	serverMajor, err := strconv.Atoi(strings.TrimSuffix(version.Major, "+"))
+	if err != nil {
+		return false, fmt.Errorf("Invalid Kubernetes major version %s: %s", version.Major, err)
+	}
+	serverMinor, err := strconv.Atoi(strings.TrimSuffix(version.Minor, "+"))
+	if err != nil {
+		return false, fmt.Errorf("Invalid Kubernetes minor version %s: %s", version.Minor, err)
+	}
+
+	return serverMajor > major || (serverMajor == major && serverMinor >= minor), nil
+}
+
+// podDisruptionBudgetResourceServed returns the newest PodDisruptionBudget API the cluster serves
+func (r *ReconcileALM) podDisruptionBudgetResourceServed() (schema.GroupVersionResource, error) {
+	served, err := r.servesResource(podDisruptionBudgetResource)
+	if err != nil {
+		return schema.GroupVersionResource{}, err
+	}
+	if served {
+		return podDisruptionBudgetResource, nil
+	}
+
+	return legacyPodDisruptionBudgetResource, nil
+}
+
+// podDisruptionBudget creates the PodDisruptionBudget of an LM service that may run more than one replica, so that
+// draining nodes cannot evict all of them at once, brings an existing one in line with the spec, and deletes it once
+// the service is down to a single replica
+func (r *ReconcileALM) podDisruptionBudget(cr *comv1alpha1.ALM, resource schema.GroupVersionResource, service serviceDeploymentInfo, reqLogger logr.Logger) error {
+	name := podDisruptionBudgetName(service.serviceName)
+	budgets := r.dynamicClient.Resource(resource).Namespace(cr.Namespace)
+	found, err := budgets.Get(name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+
+	if !podDisruptionBudgetNeeded(service) {
+		if !exists || !metav1.IsControlledBy(found, cr) {
+			return nil
+		}
+
+		reqLogger.Info(fmt.Sprintf("Deleting %s PodDisruptionBudget", service.serviceName), "Namespace", cr.Namespace, "Name", name)
+		err := budgets.Delete(name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	spec, err := normalise(podDisruptionBudgetSpec(service))
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		if !metav1.IsControlledBy(found, cr) || containsValues(found.Object["spec"], spec) {
+			return nil
+		}
+
+		// the spec of a policy/v1beta1 PodDisruptionBudget cannot be changed before Kubernetes 1.15, so it is
+		// recreated instead
+		updatable := true
+		if resource == legacyPodDisruptionBudgetResource {
+			if updatable, err = r.serverVersionAtLeast(1, 15); err != nil {
+				return err
+			}
+		}
+
+		if updatable {
+			reqLogger.Info(fmt.Sprintf("Updating %s PodDisruptionBudget", service.serviceName), "Namespace", cr.Namespace, "Name", name)
+			found.Object["spec"] = spec
+			labels := found.GetLabels()
+			addLabels(&labels, lmLabels(service))
+			found.SetLabels(labels)
+			if _, err := budgets.Update(found, metav1.UpdateOptions{}); err != nil {
+				reqLogger.Info(fmt.Sprintf("Failed to update %s PodDisruptionBudget", service.serviceName), "Namespace", cr.Namespace, "Name", name, "Error", err)
+				return err
+			}
+			return nil
+		}
+
+		reqLogger.Info(fmt.Sprintf("Deleting %s PodDisruptionBudget to recreate it", service.serviceName), "Namespace", cr.Namespace, "Name", name)
+		if err := budgets.Delete(name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	reqLogger.Info(fmt.Sprintf("Creating a new %s PodDisruptionBudget", service.serviceName), "Namespace", cr.Namespace, "Name", name)
+
+	desired := &unstructured.Unstructured{}
+	desired.SetAPIVersion(resource.GroupVersion().String())
+	desired.SetKind("PodDisruptionBudget")
+	desired.SetNamespace(cr.Namespace)
+	desired.SetName(name)
+	desired.SetLabels(lmLabels(service))
+	desired.Object["spec"] = spec
+	if err := controllerutil.SetControllerReference(cr, desired, r.scheme); err != nil {
+		return err
+	}
+
+	if _, err := budgets.Create(desired, metav1.CreateOptions{}); err != nil {
+		reqLogger.Info(fmt.Sprintf("Failed to create a new %s PodDisruptionBudget", service.serviceName), "Namespace", cr.Namespace, "Name", name, "Error", err)
+		return err
+	}
+
+	return nil
+}
+
+// podDisruptionBudgets keeps a PodDisruptionBudget for each LM service that may run more than one replica
+func (r *ReconcileALM) podDisruptionBudgets(cr *comv1alpha1.ALM, deploymentInfo deploymentInfo, reqLogger logr.Logger) error {
+	resource, err := r.podDisruptionBudgetResourceServed()
+	if err != nil {
+		return err
+	}
+
+	for _, service := range deploymentInfo.services() {
+		if err := r.podDisruptionBudget(cr, resource, service, reqLogger); err != nil {
+			reqLogger.Error(err, fmt.Sprintf("Failed to reconcile %s PodDisruptionBudget", service.serviceName), "Namespace", cr.Namespace)
+			return err
+		}
+	}
+
+	return nil
+}
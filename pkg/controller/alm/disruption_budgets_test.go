@@ -0,0 +1,62 @@
+package alm
+
+import (
+	"reflect"
+	"testing"
+
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+)
+
+func TestPodDisruptionBudgetSpec(t *testing.T) {
+	spec, err := normalise(podDisruptionBudgetSpec(serviceDeploymentInfo{serviceName: "ishtar", instance: "awesome"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"maxUnavailable": int64(1),
+		"selector": map[string]interface{}{
+			"matchLabels": map[string]interface{}{
+				nameLabel:     "ishtar",
+				instanceLabel: "awesome",
+			},
+		},
+	}
+	if !reflect.DeepEqual(spec, want) {
+		t.Errorf("podDisruptionBudgetSpec() = %v, want %v", spec, want)
+	}
+
+	// a budget created with the app selector of earlier versions is brought in line
+	legacy := map[string]interface{}{
+		"maxUnavailable": int64(1),
+		"selector": map[string]interface{}{
+			"matchLabels": map[string]interface{}{appLabel: "ishtar"},
+		},
+	}
+	if containsValues(legacy, spec) {
+		t.Errorf("containsValues() = true, want a budget with the app selector updated")
+	}
+}
+
+func TestPodDisruptionBudgetNeeded(t *testing.T) {
+	one := int32(1)
+	tests := []struct {
+		name    string
+		service serviceDeploymentInfo
+		want    bool
+	}{
+		{"single replica", serviceDeploymentInfo{serviceName: "ishtar", numReplicas: 1}, false},
+		{"replicas", serviceDeploymentInfo{serviceName: "ishtar", numReplicas: 2}, true},
+		{"autoscaled from one replica", serviceDeploymentInfo{serviceName: "ishtar", numReplicas: 1,
+			autoscaling: comv1alpha1.AutoscalingSpec{Enabled: true, MinReplicas: &one, MaxReplicas: 4}}, true},
+		{"autoscaled to one replica", serviceDeploymentInfo{serviceName: "ishtar", numReplicas: 1,
+			autoscaling: comv1alpha1.AutoscalingSpec{Enabled: true, MinReplicas: &one, MaxReplicas: 1}}, false},
+		{"StatefulSet", serviceDeploymentInfo{serviceName: "conductor", numReplicas: 1,
+			autoscaling: comv1alpha1.AutoscalingSpec{Enabled: true, MaxReplicas: 4}}, false},
+	}
+	for _, test := range tests {
+		if got := podDisruptionBudgetNeeded(test.service); got != test.want {
+			t.Errorf("%s: podDisruptionBudgetNeeded() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
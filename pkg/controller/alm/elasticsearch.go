@@ -0,0 +1,391 @@
+package alm
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	resty "github.com/go-resty/resty/v2"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// lmTemplateVersion is the version of LM's index templates, increase it when their mappings or settings change
+	lmTemplateVersion = 1
+	// lmLogsAlias is the alias Kibana and the log shippers write to, it is rolled over by the lm-logs lifecycle policy
+	lmLogsAlias = "lm-logs"
+)
+
+// lmJanusIndexPatterns match the indices JanusGraph creates for the LM services that use it
+var lmJanusIndexPatterns = []string{"janusgraph*", "apollo*", "galileo*", "brent*", "talledega*"}
+
+type elasticsearchSettings struct {
+	url               string
+	credentialsSecret string
+	caSecret          string
+	caKey             string
+	insecure          bool
+	shards            int32
+	replicas          int32
+	rolloverMaxSize   string
+	rolloverMaxAge    string
+	retention         string
+}
+
+func getElasticsearchSettings(cr *comv1alpha1.ALM) elasticsearchSettings {
+	settings := elasticsearchSettings{
+		url:               "http://foundation-elasticsearch-client:9200",
+		credentialsSecret: cr.Spec.Elasticsearch.CredentialsSecret,
+		caSecret:          cr.Spec.Elasticsearch.CASecret,
+		caKey:             "ca.crt",
+		insecure:          cr.Spec.Elasticsearch.InsecureSkipVerify,
+		shards:            1,
+		replicas:          0,
+		rolloverMaxSize:   "5gb",
+		rolloverMaxAge:    "1d",
+		retention:         "30d",
+	}
+
+	if strings.ToLower(cr.Spec.DeploymentType) == "ha" {
+		settings.shards = 3
+		settings.replicas = 1
+	}
+
+	if cr.Spec.Elasticsearch.URL != "" {
+		settings.url = strings.TrimSuffix(cr.Spec.Elasticsearch.URL, "/")
+	}
+	if cr.Spec.Elasticsearch.CAKey != "" {
+		settings.caKey = cr.Spec.Elasticsearch.CAKey
+	}
+	if cr.Spec.Elasticsearch.Shards > 0 {
+		settings.shards = cr.Spec.Elasticsearch.Shards
+	}
+	if cr.Spec.Elasticsearch.Replicas != nil {
+		settings.replicas = *cr.Spec.Elasticsearch.Replicas
+	}
+	if cr.Spec.Elasticsearch.RolloverMaxSize != "" {
+		settings.rolloverMaxSize = cr.Spec.Elasticsearch.RolloverMaxSize
+	}
+	if cr.Spec.Elasticsearch.RolloverMaxAge != "" {
+		settings.rolloverMaxAge = cr.Spec.Elasticsearch.RolloverMaxAge
+	}
+	if cr.Spec.Elasticsearch.Retention != "" {
+		settings.retention = cr.Spec.Elasticsearch.Retention
+	}
+
+	return settings
+}
+
+// hostname returns the host:port of the Elasticsearch endpoint, as expected by JanusGraph
+func (s elasticsearchSettings) hostname() string {
+	u, err := url.Parse(s.url)
+	if err != nil || u.Host == "" {
+		return "foundation-elasticsearch-client:9200"
+	}
+
+	return u.Host
+}
+
+type Elasticsearch struct {
+	restClient *resty.Client
+	url        string
+	username   string
+	password   string
+}
+
+func NewElasticsearch(client *resty.Client, url string, username string, password string) *Elasticsearch {
+	return &Elasticsearch{
+		restClient: client,
+		url:        url,
+		username:   username,
+		password:   password,
+	}
+}
+
+func (e *Elasticsearch) request() *resty.Request {
+	req := e.restClient.R().SetHeader("Content-Type", "application/json")
+	if e.username != "" {
+		req.SetBasicAuth(e.username, e.password)
+	}
+
+	return req
+}
+
+// exists returns true if a GET of the path succeeds and false if Elasticsearch responds with 404
+func (e *Elasticsearch) exists(path string) (bool, error) {
+	resp, err := e.request().Get(fmt.Sprintf("%s/%s", e.url, path))
+	if err != nil {
+		return false, err
+	}
+
+	switch resp.StatusCode() {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("GET %s returned %d: %s", path, resp.StatusCode(), resp)
+}
+
+func (e *Elasticsearch) put(path string, body interface{}) error {
+	resp, err := e.request().SetBody(body).Put(fmt.Sprintf("%s/%s", e.url, path))
+	if err != nil {
+		return err
+	}
+
+	if resp.IsError() {
+		return fmt.Errorf("PUT %s returned %d: %s", path, resp.StatusCode(), resp)
+	}
+
+	return nil
+}
+
+// elasticsearchObject is an index template or lifecycle policy, identified by its REST path
+type elasticsearchObject struct {
+	path string
+	body map[string]interface{}
+}
+
+// lmElasticsearchObjects returns the index templates and lifecycle policies LM needs. Policies come first so that
+// templates never refer to a policy that does not exist.
+func lmElasticsearchObjects(settings elasticsearchSettings) []elasticsearchObject {
+	return []elasticsearchObject{
+		{
+			path: "_ilm/policy/lm-logs",
+			body: map[string]interface{}{
+				"policy": map[string]interface{}{
+					"phases": map[string]interface{}{
+						"hot": map[string]interface{}{
+							"actions": map[string]interface{}{
+								"rollover": map[string]interface{}{
+									"max_size": settings.rolloverMaxSize,
+									"max_age":  settings.rolloverMaxAge,
+								},
+							},
+						},
+						"delete": map[string]interface{}{
+							"min_age": settings.retention,
+							"actions": map[string]interface{}{
+								"delete": map[string]interface{}{},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			path: "_template/lm-janus",
+			body: map[string]interface{}{
+				"index_patterns": lmJanusIndexPatterns,
+				"version":        lmTemplateVersion,
+				"order":          10,
+				"settings": map[string]interface{}{
+					"number_of_shards":   settings.shards,
+					"number_of_replicas": settings.replicas,
+				},
+			},
+		},
+		{
+			path: "_template/lm-logs",
+			body: map[string]interface{}{
+				"index_patterns": []string{lmLogsAlias + "-*"},
+				"version":        lmTemplateVersion,
+				"order":          10,
+				"settings": map[string]interface{}{
+					"number_of_shards":               settings.shards,
+					"number_of_replicas":             settings.replicas,
+					"index.lifecycle.name":           "lm-logs",
+					"index.lifecycle.rollover_alias": lmLogsAlias,
+				},
+			},
+		},
+	}
+}
+
+// elasticsearchHash identifies a set of templates and policies, so that changes to the spec can be detected
+// without comparing them with the normalised copies Elasticsearch returns
+func elasticsearchHash(objects []elasticsearchObject) (string, error) {
+	h := fnv.New64a()
+	for _, object := range objects {
+		body, err := json.Marshal(object.body)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(object.path))
+		h.Write(body)
+	}
+
+	return fmt.Sprintf("%x", h.Sum64()), nil
+}
+
+// reconcileElasticsearch installs LM's lifecycle policies and index templates that are missing or were installed
+// from a different spec, then bootstraps the lm-logs write index. It returns the hash of what is installed.
+func reconcileElasticsearch(es *Elasticsearch, settings elasticsearchSettings, appliedHash string, reqLogger logr.Logger) (string, error) {
+	objects := lmElasticsearchObjects(settings)
+	hash, err := elasticsearchHash(objects)
+	if err != nil {
+		return "", err
+	}
+
+	for _, object := range objects {
+		found, err := es.exists(object.path)
+		if err != nil {
+			return "", fmt.Errorf("Failed to get Elasticsearch %s: %s", object.path, err)
+		}
+
+		if found && hash == appliedHash {
+			continue
+		}
+
+		reqLogger.Info(fmt.Sprintf("Installing Elasticsearch %s", object.path), "Shards", settings.shards, "Replicas", settings.replicas)
+		if err := es.put(object.path, object.body); err != nil {
+			return "", fmt.Errorf("Failed to install Elasticsearch %s: %s", object.path, err)
+		}
+	}
+
+	if err := bootstrapLogsAlias(es, reqLogger); err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// bootstrapLogsAlias points the lm-logs alias at a first write index, which rollover needs, unless the alias exists.
+// An lm-logs index would be written to instead of the alias and never be rolled over, so it is reported.
+func bootstrapLogsAlias(es *Elasticsearch, reqLogger logr.Logger) error {
+	found, err := es.exists(fmt.Sprintf("_alias/%s", lmLogsAlias))
+	if err != nil {
+		return fmt.Errorf("Failed to get Elasticsearch alias %s: %s", lmLogsAlias, err)
+	}
+	if found {
+		return nil
+	}
+
+	found, err = es.exists(lmLogsAlias)
+	if err != nil {
+		return fmt.Errorf("Failed to get Elasticsearch index %s: %s", lmLogsAlias, err)
+	}
+	index := fmt.Sprintf("%s-000001", lmLogsAlias)
+	if found {
+		return fmt.Errorf("Elasticsearch index %s is not an alias so it cannot be rolled over, reindex it into %s and delete it", lmLogsAlias, index)
+	}
+
+	// the index is left behind if the logs were reindexed into it
+	found, err = es.exists(index)
+	if err != nil {
+		return fmt.Errorf("Failed to get Elasticsearch index %s: %s", index, err)
+	}
+	if found {
+		reqLogger.Info(fmt.Sprintf("Adding Elasticsearch alias %s", lmLogsAlias), "Index", index)
+		if err := es.put(fmt.Sprintf("%s/_alias/%s", index, lmLogsAlias), map[string]interface{}{"is_write_index": true}); err != nil {
+			return fmt.Errorf("Failed to add Elasticsearch alias %s to %s: %s", lmLogsAlias, index, err)
+		}
+		return nil
+	}
+
+	reqLogger.Info(fmt.Sprintf("Creating Elasticsearch index %s", index), "Alias", lmLogsAlias)
+	err = es.put(index, map[string]interface{}{
+		"aliases": map[string]interface{}{
+			lmLogsAlias: map[string]interface{}{
+				"is_write_index": true,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create Elasticsearch index %s: %s", index, err)
+	}
+
+	return nil
+}
+
+// elasticsearchRestClient returns a client that verifies an https endpoint against the CA in the CA Secret, or the
+// system CAs if there is none. The shared client, which does not verify it, is only used if insecureSkipVerify is set.
+func (r *ReconcileALM) elasticsearchRestClient(cr *comv1alpha1.ALM, settings elasticsearchSettings) (*resty.Client, error) {
+	if settings.insecure || strings.HasPrefix(settings.url, "http://") {
+		return r.restClient, nil
+	}
+
+	client := resty.New()
+	client.SetTimeout(2 * time.Minute)
+	if settings.caSecret == "" {
+		return client, nil
+	}
+
+	ca, err := r.secretValue(cr, settings.caSecret, settings.caKey)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(ca)) {
+		return nil, fmt.Errorf("Key %s of Secret %s is not a PEM encoded certificate", settings.caKey, settings.caSecret)
+	}
+	client.SetTLSClientConfig(&tls.Config{RootCAs: pool})
+
+	return client, nil
+}
+
+// elasticsearch reconciles LM's index templates and lifecycle policies and records the outcome in the ALM status
+func (r *ReconcileALM) elasticsearch(cr *comv1alpha1.ALM, reqLogger logr.Logger) error {
+	settings := getElasticsearchSettings(cr)
+
+	hash, err := r.reconcileElasticsearch(cr, settings, reqLogger)
+
+	status := comv1alpha1.ElasticsearchStatus{
+		IndicesReady: err == nil,
+		AppliedHash:  hash,
+	}
+	if err != nil {
+		// keep what was installed, so that it is not re-installed needlessly once Elasticsearch is fixed
+		status.AppliedHash = cr.Status.Elasticsearch.AppliedHash
+		status.Message = err.Error()
+	}
+	if reflect.DeepEqual(status, cr.Status.Elasticsearch) {
+		return err
+	}
+
+	if err != nil {
+		r.recorder.Event(cr, corev1.EventTypeWarning, "ElasticsearchFailed", err.Error())
+	}
+
+	cr.Status.Elasticsearch = status
+	if err := r.client.Status().Update(context.TODO(), cr); err != nil {
+		reqLogger.Error(err, "Failed to update ALM status.")
+		return err
+	}
+
+	return err
+}
+
+func (r *ReconcileALM) reconcileElasticsearch(cr *comv1alpha1.ALM, settings elasticsearchSettings, reqLogger logr.Logger) (string, error) {
+	username, password, err := r.secretCredentials(cr, settings.credentialsSecret)
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to read Elasticsearch credentials Secret %s", settings.credentialsSecret), "Namespace", cr.Namespace)
+		return "", err
+	}
+
+	client, err := r.elasticsearchRestClient(cr, settings)
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to read Elasticsearch CA Secret %s", settings.caSecret), "Namespace", cr.Namespace)
+		return "", err
+	}
+
+	es := NewElasticsearch(client, settings.url, username, password)
+	hash, err := reconcileElasticsearch(es, settings, cr.Status.Elasticsearch.AppliedHash, reqLogger)
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to reconcile Elasticsearch %s", settings.url))
+		return "", err
+	}
+
+	return hash, nil
+}
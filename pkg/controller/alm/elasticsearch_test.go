@@ -0,0 +1,128 @@
+package alm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+// stubElasticsearch answers GETs of the paths it holds and records PUTs, which add the path
+type stubElasticsearch struct {
+	mutex    sync.Mutex
+	existing map[string]bool
+	puts     []string
+}
+
+func (s *stubElasticsearch) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	switch req.Method {
+	case http.MethodGet:
+		if !s.existing[path] {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte("{}"))
+	case http.MethodPut:
+		s.puts = append(s.puts, path)
+		s.existing[path] = true
+		w.Write([]byte(`{"acknowledged": true}`))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func startStubElasticsearch(existing ...string) (*stubElasticsearch, *httptest.Server) {
+	stub := &stubElasticsearch{existing: make(map[string]bool)}
+	for _, path := range existing {
+		stub.existing[path] = true
+	}
+
+	return stub, httptest.NewServer(stub)
+}
+
+func TestReconcileElasticsearch(t *testing.T) {
+	settings := getElasticsearchSettings(almForTest())
+	objects := lmElasticsearchObjects(settings)
+	hash, err := elasticsearchHash(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var installed []string
+	for _, object := range objects {
+		installed = append(installed, object.path)
+	}
+	with := func(paths ...string) []string {
+		return append(append([]string{}, installed...), paths...)
+	}
+
+	tests := []struct {
+		name        string
+		existing    []string
+		appliedHash string
+		wantPuts    []string
+		wantErr     bool
+	}{
+		{"fresh install", nil, "", with("lm-logs-000001"), false},
+		{"installed", with("_alias/lm-logs"), hash, nil, false},
+		{"spec changed", with("_alias/lm-logs"), "changed", installed, false},
+		{"lm-logs index", with("lm-logs"), hash, nil, true},
+		{"reindexed into the write index", with("lm-logs-000001"), hash, []string{"lm-logs-000001/_alias/lm-logs"}, false},
+	}
+	for _, test := range tests {
+		stub, server := startStubElasticsearch(test.existing...)
+		es := NewElasticsearch(resty.New(), server.URL, "", "")
+
+		got, err := reconcileElasticsearch(es, settings, test.appliedHash, log)
+		server.Close()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: reconcileElasticsearch() error = %v, wantErr %v", test.name, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && got != hash {
+			t.Errorf("%s: reconcileElasticsearch() = %s, want %s", test.name, got, hash)
+		}
+		if !reflect.DeepEqual(stub.puts, test.wantPuts) {
+			t.Errorf("%s: PUT %v, want %v", test.name, stub.puts, test.wantPuts)
+		}
+	}
+}
+
+func TestElasticsearchBasicAuth(t *testing.T) {
+	var username, password string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		username, password, _ = req.BasicAuth()
+	}))
+	defer server.Close()
+
+	es := NewElasticsearch(resty.New(), server.URL, "elastic", "changeme")
+	if _, err := es.exists(lmLogsAlias); err != nil {
+		t.Fatalf("exists() error = %v", err)
+	}
+	if username != "elastic" || password != "changeme" {
+		t.Errorf("credentials = %s/%s, want elastic/changeme", username, password)
+	}
+}
+
+func TestElasticsearchRestClient(t *testing.T) {
+	shared := resty.New()
+	r := &ReconcileALM{restClient: shared}
+
+	cr := almForTest()
+	cr.Spec.Elasticsearch.URL = "https://elasticsearch:9200"
+	client, err := r.elasticsearchRestClient(cr, getElasticsearchSettings(cr))
+	if err != nil || client == shared {
+		t.Errorf("elasticsearchRestClient() = shared %v, %v, want a client verifying an https endpoint", client == shared, err)
+	}
+
+	cr.Spec.Elasticsearch.InsecureSkipVerify = true
+	if client, err := r.elasticsearchRestClient(cr, getElasticsearchSettings(cr)); err != nil || client != shared {
+		t.Errorf("elasticsearchRestClient() = shared %v, %v, want the shared client with insecureSkipVerify", client == shared, err)
+	}
+}
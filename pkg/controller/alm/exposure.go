@@ -0,0 +1,516 @@
+package alm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/go-logr/logr"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// exposure strategies, the APIs LM services can be exposed outside the cluster with
+const (
+	exposureIngress       = "Ingress"
+	exposureLegacyIngress = "LegacyIngress"
+	exposureRoute         = "Route"
+	exposureHTTPRoute     = "HTTPRoute"
+)
+
+var (
+	ingressResource   = schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"}
+	routeResource     = schema.GroupVersionResource{Group: "route.openshift.io", Version: "v1", Resource: "routes"}
+	httpRouteResource = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "httproutes"}
+)
+
+// exposureStrategy publishes an LM service outside the cluster with one of the exposure APIs
+type exposureStrategy interface {
+	// apply creates or updates the object exposing the service
+	apply(cr *comv1alpha1.ALM, settings ingressSettings, reqLogger logr.Logger) error
+	// remove deletes the object exposing the service, if the operator created it
+	remove(cr *comv1alpha1.ALM, settings ingressSettings, reqLogger logr.Logger) error
+}
+
+func (r *ReconcileALM) exposureStrategies() map[string]exposureStrategy {
+	return map[string]exposureStrategy{
+		exposureIngress:       &unstructuredExposure{r: r, resource: ingressResource, kind: "Ingress", build: buildNetworkingIngress},
+		exposureLegacyIngress: &legacyIngressExposure{r: r},
+		exposureRoute:         &unstructuredExposure{r: r, resource: routeResource, kind: "Route", build: r.buildRoute},
+		exposureHTTPRoute:     &unstructuredExposure{r: r, resource: httpRouteResource, kind: "HTTPRoute", build: buildHTTPRoute},
+	}
+}
+
+// servesResource returns true if the cluster serves the resource, according to the discovery API
+func (r *ReconcileALM) servesResource(resource schema.GroupVersionResource) (bool, error) {
+	resources, err := r.kubeClient.Discovery().ServerResourcesForGroupVersion(resource.GroupVersion().String())
+	if err != nil && errors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil || resources == nil {
+		return false, err
+	}
+
+	for _, apiResource := range resources.APIResources {
+		if apiResource.Name == resource.Resource {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// exposureStrategyName returns the strategy set in the spec or else detects one. Routes are preferred on OpenShift, then
+// HTTPRoutes if a Gateway is configured, then networking.k8s.io/v1 Ingresses.
+func (r *ReconcileALM) exposureStrategyName(cr *comv1alpha1.ALM) (string, error) {
+	if strategy := cr.Spec.Ingress.Strategy; strategy != "" {
+		if _, ok := r.exposureStrategies()[strategy]; !ok {
+			return "", fmt.Errorf("Unknown ingress strategy %s, must be one of %s, %s, %s or %s", strategy, exposureIngress, exposureLegacyIngress, exposureRoute, exposureHTTPRoute)
+		}
+		return strategy, nil
+	}
+
+	candidates := []struct {
+		strategy string
+		resource schema.GroupVersionResource
+		enabled  bool
+	}{
+		{exposureRoute, routeResource, true},
+		{exposureHTTPRoute, httpRouteResource, cr.Spec.Ingress.Gateway.Name != ""},
+		{exposureIngress, ingressResource, true},
+	}
+	for _, candidate := range candidates {
+		if !candidate.enabled {
+			continue
+		}
+
+		served, err := r.servesResource(candidate.resource)
+		if err != nil {
+			return "", err
+		}
+		if served {
+			return candidate.strategy, nil
+		}
+	}
+
+	return exposureLegacyIngress, nil
+}
+
+// ingress exposes an LM service with the chosen strategy, removing what the previous strategy created, or removes it if
+// it has been disabled
+func (r *ReconcileALM) ingress(cr *comv1alpha1.ALM, settings ingressSettings, previous string, name string, reqLogger logr.Logger) error {
+	strategies := r.exposureStrategies()
+
+	if !settings.enabled {
+		// remove what the operator last exposed the service with, Ingresses created before the status was recorded
+		// may only be served by one of the Ingress APIs
+		removed := []string{previous}
+		if _, ok := strategies[previous]; !ok {
+			removed = []string{exposureIngress, exposureLegacyIngress}
+		}
+		for _, strategy := range removed {
+			if err := strategies[strategy].remove(cr, settings, reqLogger); err != nil {
+				reqLogger.Error(err, fmt.Sprintf("Failed to remove disabled %s", settings.name), "Namespace", cr.Namespace)
+				return err
+			}
+		}
+		return nil
+	}
+
+	if strategy, ok := strategies[previous]; ok && previous != name && !sameIngress(previous, name) {
+		if err := strategy.remove(cr, settings, reqLogger); err != nil {
+			reqLogger.Error(err, fmt.Sprintf("Failed to remove %s %s", previous, settings.name), "Namespace", cr.Namespace)
+			return err
+		}
+	}
+
+	if err := strategies[name].apply(cr, settings, reqLogger); err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to expose %s with %s", settings.serviceName, name), "Namespace", cr.Namespace)
+		return err
+	}
+
+	return nil
+}
+
+// ingresses exposes the LM services published outside the cluster. The strategy last recorded in the ALM status is read
+// once, so that what it created is removed for every service, and the status is only updated once all of them are
+// exposed with the new one.
+func (r *ReconcileALM) ingresses(cr *comv1alpha1.ALM, reqLogger logr.Logger) error {
+	all := []ingressSettings{getIshtarIngressSettings(cr), getNimrodIngressSettings(cr), getBrentIngressSettings(cr)}
+
+	enabled := false
+	for _, settings := range all {
+		enabled = enabled || settings.enabled
+	}
+	name := cr.Status.Exposure
+	if enabled {
+		var err error
+		name, err = r.exposureStrategyName(cr)
+		if err != nil {
+			reqLogger.Error(err, "Failed to choose an ingress strategy", "Namespace", cr.Namespace)
+			return err
+		}
+	}
+
+	previous := cr.Status.Exposure
+	for _, settings := range all {
+		if err := r.ingress(cr, settings, previous, name, reqLogger); err != nil {
+			return err
+		}
+	}
+
+	if !enabled || cr.Status.Exposure == name {
+		return nil
+	}
+
+	cr.Status.Exposure = name
+	if err := r.client.Status().Update(context.TODO(), cr); err != nil {
+		reqLogger.Error(err, "Failed to update ALM status.")
+		return err
+	}
+
+	return nil
+}
+
+// sameIngress returns true if both strategies expose services with the same Ingress objects, served through different
+// API versions. Switching between them updates the Ingresses in place rather than replacing them.
+func sameIngress(strategy string, other string) bool {
+	ingresses := []string{exposureIngress, exposureLegacyIngress}
+	return containsString(ingresses, strategy) && containsString(ingresses, other)
+}
+
+// containsValues returns true if every value set in desired is also set in found, so that fields defaulted by the API
+// server or added by others do not count as differences
+func containsValues(found interface{}, desired interface{}) bool {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		f, ok := found.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range d {
+			if !containsValues(f[k], v) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		f, ok := found.([]interface{})
+		if !ok || len(f) != len(d) {
+			return false
+		}
+		for i := range d {
+			if !containsValues(f[i], d[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(found, desired)
+}
+
+func stringMap(m map[string]string) map[string]interface{} {
+	result := make(map[string]interface{})
+	for k, v := range m {
+		result[k] = v
+	}
+
+	return result
+}
+
+// mergeAnnotations sets the operator's annotations, keeping any added by others
+func mergeAnnotations(found map[string]string, desired map[string]string) map[string]string {
+	if found == nil {
+		found = make(map[string]string)
+	}
+	for k, v := range desired {
+		found[k] = v
+	}
+
+	return found
+}
+
+// normalise round trips an object through JSON, so that it compares equal to one read back from the API server
+func normalise(object map[string]interface{}) (map[string]interface{}, error) {
+	raw, err := utiljson.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+
+	var normalised map[string]interface{}
+	if err := utiljson.Unmarshal(raw, &normalised); err != nil {
+		return nil, err
+	}
+
+	return normalised, nil
+}
+
+// unstructuredExposure publishes LM services with an API whose types are not compiled into the operator
+type unstructuredExposure struct {
+	r        *ReconcileALM
+	resource schema.GroupVersionResource
+	kind     string
+	// build returns the spec of the object exposing the service
+	build func(cr *comv1alpha1.ALM, settings ingressSettings) (map[string]interface{}, error)
+}
+
+func (e *unstructuredExposure) apply(cr *comv1alpha1.ALM, settings ingressSettings, reqLogger logr.Logger) error {
+	spec, err := e.build(cr, settings)
+	if err != nil {
+		return err
+	}
+	spec, err = normalise(spec)
+	if err != nil {
+		return err
+	}
+	labels := exposureLabels(cr, settings.serviceName)
+	annotations := settings.annotations
+	if e.kind == "Ingress" {
+		annotations = ingressAnnotations(cr.Spec.Secure, settings)
+	}
+
+	resources := e.r.dynamicClient.Resource(e.resource).Namespace(cr.Namespace)
+	found, err := resources.Get(settings.name, metav1.GetOptions{})
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info(fmt.Sprintf("Creating a new %s %s", settings.name, e.kind), "Namespace", cr.Namespace, "Name", settings.name, "Host", settings.host)
+
+		desired := &unstructured.Unstructured{}
+		desired.SetAPIVersion(e.resource.GroupVersion().String())
+		desired.SetKind(e.kind)
+		desired.SetNamespace(cr.Namespace)
+		desired.SetName(settings.name)
+		desired.SetLabels(labels)
+		desired.SetAnnotations(annotations)
+		desired.Object["spec"] = spec
+		if err := controllerutil.SetControllerReference(cr, desired, e.r.scheme); err != nil {
+			return err
+		}
+
+		if _, err := resources.Create(desired, metav1.CreateOptions{}); err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to create a new %s %s", settings.name, e.kind), "Namespace", cr.Namespace, "Name", settings.name, "Error", err)
+			return err
+		}
+
+		reqLogger.Info(fmt.Sprintf("Created a new %s %s", settings.name, e.kind), "Namespace", cr.Namespace, "Name", settings.name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// objects created through an older API or before the ALM owned them are adopted
+	adopt := metav1.GetControllerOf(found) == nil
+	// the API server rejects Ingresses that set both the class annotation of extensions/v1beta1 and ingressClassName
+	_, classAnnotated := found.GetAnnotations()[ingressClassAnnotation]
+	dropClassAnnotation := e.kind == "Ingress" && settings.ingressClass != "" && classAnnotated
+	// a key inlined before inlineRouteCertificates was unset is removed, the spec check ignores fields no longer desired
+	dropRouteKey := e.kind == "Route" && routeKey(found.Object["spec"]) != "" && routeKey(spec) == ""
+	if !adopt && !dropClassAnnotation && !dropRouteKey && containsValues(found.Object["spec"], spec) && containsValues(stringMap(found.GetAnnotations()), stringMap(annotations)) &&
+		containsValues(stringMap(found.GetLabels()), stringMap(labels)) {
+		return nil
+	}
+
+	reqLogger.Info(fmt.Sprintf("Updating %s %s", settings.name, e.kind), "Namespace", cr.Namespace, "Name", settings.name, "Host", settings.host)
+	if adopt {
+		if err := controllerutil.SetControllerReference(cr, found, e.r.scheme); err != nil {
+			return err
+		}
+	}
+	found.Object["spec"] = spec
+	found.SetAnnotations(mergeAnnotations(found.GetAnnotations(), annotations))
+	foundLabels := found.GetLabels()
+	addLabels(&foundLabels, labels)
+	found.SetLabels(foundLabels)
+	if dropClassAnnotation {
+		annotations := found.GetAnnotations()
+		delete(annotations, ingressClassAnnotation)
+		found.SetAnnotations(annotations)
+	}
+	if _, err := resources.Update(found, metav1.UpdateOptions{}); err != nil {
+		reqLogger.Info(fmt.Sprintf("Failed to update %s %s", settings.name, e.kind), "Namespace", cr.Namespace, "Name", settings.name, "Error", err)
+		return err
+	}
+
+	return nil
+}
+
+func (e *unstructuredExposure) remove(cr *comv1alpha1.ALM, settings ingressSettings, reqLogger logr.Logger) error {
+	resources := e.r.dynamicClient.Resource(e.resource).Namespace(cr.Namespace)
+	found, err := resources.Get(settings.name, metav1.GetOptions{})
+	if err != nil && errors.IsNotFound(err) {
+		// also returned if the cluster does not serve the API at all
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !metav1.IsControlledBy(found, cr) {
+		return nil
+	}
+
+	reqLogger.Info(fmt.Sprintf("Deleting %s %s", settings.name, e.kind), "Namespace", cr.Namespace, "Name", settings.name)
+	return resources.Delete(settings.name, &metav1.DeleteOptions{})
+}
+
+// buildNetworkingIngress returns the spec of a networking.k8s.io/v1 Ingress
+func buildNetworkingIngress(cr *comv1alpha1.ALM, settings ingressSettings) (map[string]interface{}, error) {
+	spec := map[string]interface{}{
+		"rules": []interface{}{
+			map[string]interface{}{
+				"host": settings.host,
+				"http": map[string]interface{}{
+					"paths": []interface{}{
+						map[string]interface{}{
+							"path":     settings.path,
+							"pathType": "Prefix",
+							"backend": map[string]interface{}{
+								"service": map[string]interface{}{
+									"name": settings.serviceName,
+									"port": map[string]interface{}{"number": settings.port},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		"tls": []interface{}{
+			map[string]interface{}{
+				"hosts":      []interface{}{settings.host},
+				"secretName": settings.tlsSecret,
+			},
+		},
+	}
+	if settings.ingressClass != "" {
+		spec["ingressClassName"] = settings.ingressClass
+	}
+
+	return spec, nil
+}
+
+// buildRoute returns the spec of an OpenShift Route. The router terminates TLS with its default certificate and
+// re-encrypts traffic to services that serve HTTPS. The certificate and key in the TLS Secret are only copied into the
+// Route when inlineRouteCertificates is set, as the Route exposes the key to anyone who can read it.
+func (r *ReconcileALM) buildRoute(cr *comv1alpha1.ALM, settings ingressSettings) (map[string]interface{}, error) {
+	var certificate, lmCerts *corev1.Secret
+	var err error
+	if cr.Spec.Ingress.InlineRouteCertificates {
+		certificate, err = r.optionalSecret(cr, settings.tlsSecret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cr.Spec.Secure {
+		lmCerts, err = r.optionalSecret(cr, "lm-certs")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buildRouteSpec(cr, settings, certificate, lmCerts), nil
+}
+
+// buildRouteSpec returns the spec of a Route using the certificate and key of the TLS Secret, if not nil, and verifying
+// LM services with the CA of lm-certs, if not nil
+func buildRouteSpec(cr *comv1alpha1.ALM, settings ingressSettings, certificate *corev1.Secret, lmCerts *corev1.Secret) map[string]interface{} {
+	tls := map[string]interface{}{
+		"termination":                   "edge",
+		"insecureEdgeTerminationPolicy": "Redirect",
+	}
+	if certificate != nil {
+		tls["certificate"] = string(certificate.Data[corev1.TLSCertKey])
+		tls["key"] = string(certificate.Data[corev1.TLSPrivateKeyKey])
+	}
+
+	if cr.Spec.Secure {
+		tls["termination"] = "reencrypt"
+		// without a CA the router verifies LM's certificates with the service CA
+		if lmCerts != nil && len(lmCerts.Data["ca.crt"]) > 0 {
+			tls["destinationCACertificate"] = string(lmCerts.Data["ca.crt"])
+		}
+	}
+
+	return map[string]interface{}{
+		"host": settings.host,
+		"path": settings.path,
+		"to": map[string]interface{}{
+			"kind": "Service",
+			"name": settings.serviceName,
+		},
+		"port": map[string]interface{}{
+			"targetPort": "http",
+		},
+		"tls": tls,
+	}
+}
+
+// routeKey returns the private key inlined in the spec of a Route, if any
+func routeKey(spec interface{}) string {
+	object, ok := spec.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	key, _, _ := unstructured.NestedString(object, "tls", "key")
+
+	return key
+}
+
+// buildHTTPRoute returns the spec of a Gateway API HTTPRoute. TLS is terminated by the Gateway's listeners.
+func buildHTTPRoute(cr *comv1alpha1.ALM, settings ingressSettings) (map[string]interface{}, error) {
+	gateway := cr.Spec.Ingress.Gateway
+	if gateway.Name == "" {
+		return nil, fmt.Errorf("ingress.gateway.name must be set to expose LM services with HTTPRoutes")
+	}
+
+	parentRef := map[string]interface{}{
+		"name": gateway.Name,
+	}
+	if gateway.Namespace != "" {
+		parentRef["namespace"] = gateway.Namespace
+	}
+	if gateway.SectionName != "" {
+		parentRef["sectionName"] = gateway.SectionName
+	}
+
+	return map[string]interface{}{
+		"parentRefs": []interface{}{parentRef},
+		"hostnames":  []interface{}{settings.host},
+		"rules": []interface{}{
+			map[string]interface{}{
+				"matches": []interface{}{
+					map[string]interface{}{
+						"path": map[string]interface{}{
+							"type":  "PathPrefix",
+							"value": settings.path,
+						},
+					},
+				},
+				"backendRefs": []interface{}{
+					map[string]interface{}{
+						"name": settings.serviceName,
+						"port": settings.port,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// optionalSecret returns a Secret, or nil if it does not exist
+func (r *ReconcileALM) optionalSecret(cr *comv1alpha1.ALM, name string) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, secret)
+	if err != nil && errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
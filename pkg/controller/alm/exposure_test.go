@@ -0,0 +1,175 @@
+package alm
+
+import (
+	"reflect"
+	"testing"
+
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestContainsValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		found   interface{}
+		desired interface{}
+		want    bool
+	}{
+		{"equal values", "a", "a", true},
+		{"different values", "a", "b", false},
+		{"defaulted fields", map[string]interface{}{"a": "1", "b": "2"}, map[string]interface{}{"a": "1"}, true},
+		{"missing field", map[string]interface{}{"b": "2"}, map[string]interface{}{"a": "1"}, false},
+		{"nested maps", map[string]interface{}{"a": map[string]interface{}{"b": "1", "c": "2"}}, map[string]interface{}{"a": map[string]interface{}{"b": "1"}}, true},
+		{"lists of equal length", []interface{}{map[string]interface{}{"a": "1", "b": "2"}}, []interface{}{map[string]interface{}{"a": "1"}}, true},
+		{"lists of different length", []interface{}{"a", "b"}, []interface{}{"a"}, false},
+		{"map found as value", "a", map[string]interface{}{"a": "1"}, false},
+	}
+	for _, test := range tests {
+		if got := containsValues(test.found, test.desired); got != test.want {
+			t.Errorf("%s: containsValues() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMergeAnnotations(t *testing.T) {
+	tests := []struct {
+		name    string
+		found   map[string]string
+		desired map[string]string
+		want    map[string]string
+	}{
+		{"no annotations", nil, map[string]string{"a": "1"}, map[string]string{"a": "1"}},
+		{"annotations added by others are kept", map[string]string{"b": "2"}, map[string]string{"a": "1"}, map[string]string{"a": "1", "b": "2"}},
+		{"changed annotations are set", map[string]string{"a": "2"}, map[string]string{"a": "1"}, map[string]string{"a": "1"}},
+		{"nothing desired", map[string]string{"a": "1"}, nil, map[string]string{"a": "1"}},
+	}
+	for _, test := range tests {
+		if got := mergeAnnotations(test.found, test.desired); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: mergeAnnotations() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSameIngress(t *testing.T) {
+	tests := []struct {
+		strategy string
+		other    string
+		want     bool
+	}{
+		{exposureIngress, exposureLegacyIngress, true},
+		{exposureLegacyIngress, exposureIngress, true},
+		{exposureIngress, exposureRoute, false},
+		{exposureHTTPRoute, exposureRoute, false},
+		{"", exposureIngress, false},
+	}
+	for _, test := range tests {
+		if got := sameIngress(test.strategy, test.other); got != test.want {
+			t.Errorf("sameIngress(%q, %q) = %v, want %v", test.strategy, test.other, got, test.want)
+		}
+	}
+}
+
+func TestExposureStrategyName(t *testing.T) {
+	served := func(groupVersion string, resource string) *metav1.APIResourceList {
+		return &metav1.APIResourceList{GroupVersion: groupVersion, APIResources: []metav1.APIResource{{Name: resource}}}
+	}
+	route := served("route.openshift.io/v1", "routes")
+	httpRoute := served("gateway.networking.k8s.io/v1", "httproutes")
+	ingress := served("networking.k8s.io/v1", "ingresses")
+
+	tests := []struct {
+		name      string
+		ingress   comv1alpha1.IngressesSpec
+		resources []*metav1.APIResourceList
+		want      string
+		wantErr   bool
+	}{
+		{"set in the spec", comv1alpha1.IngressesSpec{Strategy: exposureHTTPRoute}, nil, exposureHTTPRoute, false},
+		{"unknown strategy", comv1alpha1.IngressesSpec{Strategy: "Gateway"}, nil, "", true},
+		{"OpenShift", comv1alpha1.IngressesSpec{}, []*metav1.APIResourceList{route, httpRoute, ingress}, exposureRoute, false},
+		{"Gateway API with a Gateway", comv1alpha1.IngressesSpec{Gateway: comv1alpha1.GatewayReference{Name: "lm"}}, []*metav1.APIResourceList{httpRoute, ingress}, exposureHTTPRoute, false},
+		{"Gateway API without a Gateway", comv1alpha1.IngressesSpec{}, []*metav1.APIResourceList{httpRoute, ingress}, exposureIngress, false},
+		{"networking.k8s.io/v1", comv1alpha1.IngressesSpec{}, []*metav1.APIResourceList{ingress}, exposureIngress, false},
+		{"no other API served", comv1alpha1.IngressesSpec{}, nil, exposureLegacyIngress, false},
+	}
+	for _, test := range tests {
+		kubeClient := fake.NewSimpleClientset()
+		kubeClient.Discovery().(*fakediscovery.FakeDiscovery).Resources = test.resources
+		r := &ReconcileALM{kubeClient: kubeClient}
+		cr := &comv1alpha1.ALM{Spec: comv1alpha1.ALMSpec{Ingress: test.ingress}}
+
+		got, err := r.exposureStrategyName(cr)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: exposureStrategyName() error = %v, wantErr %v", test.name, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: exposureStrategyName() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBuildRouteSpec(t *testing.T) {
+	certificate := &corev1.Secret{Data: map[string][]byte{corev1.TLSCertKey: []byte("cert"), corev1.TLSPrivateKeyKey: []byte("key")}}
+	lmCerts := &corev1.Secret{Data: map[string][]byte{"ca.crt": []byte("ca")}}
+	settings := ingressSettings{serviceName: "ishtar", host: "app.lm", path: "/"}
+
+	tests := []struct {
+		name        string
+		secure      bool
+		certificate *corev1.Secret
+		lmCerts     *corev1.Secret
+		want        map[string]interface{}
+	}{
+		{
+			name: "router certificate",
+			want: map[string]interface{}{"termination": "edge", "insecureEdgeTerminationPolicy": "Redirect"},
+		},
+		{
+			name:        "inlined certificate",
+			certificate: certificate,
+			want:        map[string]interface{}{"termination": "edge", "insecureEdgeTerminationPolicy": "Redirect", "certificate": "cert", "key": "key"},
+		},
+		{
+			name:    "re-encrypt with the LM CA",
+			secure:  true,
+			lmCerts: lmCerts,
+			want:    map[string]interface{}{"termination": "reencrypt", "insecureEdgeTerminationPolicy": "Redirect", "destinationCACertificate": "ca"},
+		},
+		{
+			name:   "re-encrypt with the service CA",
+			secure: true,
+			want:   map[string]interface{}{"termination": "reencrypt", "insecureEdgeTerminationPolicy": "Redirect"},
+		},
+	}
+	for _, test := range tests {
+		cr := &comv1alpha1.ALM{Spec: comv1alpha1.ALMSpec{Secure: test.secure}}
+		spec := buildRouteSpec(cr, settings, test.certificate, test.lmCerts)
+		if !reflect.DeepEqual(spec["tls"], test.want) {
+			t.Errorf("%s: tls = %v, want %v", test.name, spec["tls"], test.want)
+		}
+		if spec["host"] != "app.lm" || !reflect.DeepEqual(spec["to"], map[string]interface{}{"kind": "Service", "name": "ishtar"}) {
+			t.Errorf("%s: spec = %v, want a Route to ishtar on app.lm", test.name, spec)
+		}
+	}
+}
+
+func TestRouteKey(t *testing.T) {
+	tests := []struct {
+		name string
+		spec interface{}
+		want string
+	}{
+		{"inlined key", map[string]interface{}{"tls": map[string]interface{}{"key": "key"}}, "key"},
+		{"no key", map[string]interface{}{"tls": map[string]interface{}{"termination": "edge"}}, ""},
+		{"no spec", nil, ""},
+	}
+	for _, test := range tests {
+		if got := routeKey(test.spec); got != test.want {
+			t.Errorf("%s: routeKey() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -50,7 +50,7 @@ func galileoConfig(processingGuarantee string, numShards int32, numReplicas int3
 		"      storage.cql.replication-factor: {{.ReplicatorFactor}}\n" +
 		"      index:\n" +
 		"        search:\n" +
-		"          elasticsearch.create.ext.index.number_of_replicas: {{.NumStandbyReplicas}}\n" +
+		"          elasticsearch.create.ext.index.number_of_replicas: {{.NumReplicas}}\n" +
 		"          elasticsearch.create.ext.index.number_of_shards: {{.NumShards}}\n")
 
 	if err != nil {
@@ -65,11 +65,16 @@ func galileoConfig(processingGuarantee string, numShards int32, numReplicas int3
 }
 
 func (r *ReconcileALM) installGalileo(cr *comv1alpha1.ALM, service serviceDeploymentInfo, reqLogger logr.Logger) (reconcile.Result, error) {
+	// the StatefulSet's governing Service must exist for its pods to be given DNS names
+	if err := r.headlessService(cr, service, reqLogger); err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to create %s Service", headlessServiceName(service.serviceName)), "Namespace", cr.Namespace)
+		return reconcile.Result{}, err
+	}
+
 	// dockerImage := fmt.Sprintf("%s/%s:%s", cr.Spec.DockerRepo, serviceDeploymentInfo.imageName, serviceDeploymentInfo.imageVersion)
 	cmName := fmt.Sprintf("%s-%s-cm", cr.Name, service.serviceName)
 
 	// Check if this Statefulset already exists
-	// statefulsetName := fmt.Sprintf("%s-%s", cr.Name, service.serviceName)
 	statefulsetName := service.serviceName
 	found, err := r.statefulsetExists(cr, service)
 	if err != nil {
@@ -108,6 +113,7 @@ func (r *ReconcileALM) installGalileo(cr *comv1alpha1.ALM, service serviceDeploy
 				ObjectMeta: metav1.ObjectMeta{
 					Namespace: cr.Namespace,
 					Name:      cmName,
+					Labels:    lmLabels(service),
 				},
 				Data: data,
 			}
@@ -151,13 +157,22 @@ func (r *ReconcileALM) installGalileo(cr *comv1alpha1.ALM, service serviceDeploy
 				})
 		}
 
-		statefulset := buildStatefulset(cr.Namespace, statefulsetName, cr, service, volumeMounts, volumes, []corev1.EnvVar{})
+		statefulset, err := buildStatefulset(cr.Namespace, statefulsetName, cr, service, volumeMounts, volumes, []corev1.EnvVar{})
+		if err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to build a new %s Statefulset", service.serviceName), "Namespace", cr.Namespace, "Name", statefulsetName, "Error", err)
+			r.recorder.Event(cr, corev1.EventTypeWarning, "InvalidPodTemplate", err.Error())
+			return reconcile.Result{}, err
+		}
+
+		if _, err := r.applyConfigChecksum(cr, &statefulset.Spec.Template); err != nil {
+			return reconcile.Result{}, err
+		}
 
 		if err := controllerutil.SetControllerReference(cr, statefulset, r.scheme); err != nil {
 			return reconcile.Result{}, err
 		}
 
-		err = r.client.Create(context.TODO(), statefulset)
+		err = r.writeWorkload(cr, statefulset, service, true)
 		if err != nil {
 			reqLogger.Info(fmt.Sprintf("Failed to create a new %s Statefulset", service.serviceName), "Namespace", cr.Namespace, "Name", statefulsetName, "Error", err)
 			return reconcile.Result{}, err
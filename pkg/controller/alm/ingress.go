@@ -0,0 +1,175 @@
+package alm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-logr/logr"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// lmUIHost, lmAPIHost and lmBrentHost are the default hosts Nimrod, Ishtar and Brent are exposed on
+	lmUIHost    = "ui.lm"
+	lmAPIHost   = "app.lm"
+	lmBrentHost = "brent.lm"
+
+	// ingressClassAnnotation selects the ingress controller, extensions/v1beta1 Ingresses have no ingressClassName field
+	ingressClassAnnotation = "kubernetes.io/ingress.class"
+)
+
+type ingressSettings struct {
+	enabled      bool
+	name         string
+	serviceName  string
+	port         int
+	host         string
+	path         string
+	ingressClass string
+	tlsSecret    string
+	annotations  map[string]string
+}
+
+func getIngressSettings(spec comv1alpha1.IngressSpec, defaults ingressSettings) ingressSettings {
+	settings := defaults
+	settings.path = "/"
+
+	if spec.Enabled != nil {
+		settings.enabled = *spec.Enabled
+	}
+	if spec.Host != "" {
+		settings.host = spec.Host
+	}
+	if spec.Path != "" {
+		settings.path = spec.Path
+	}
+	if spec.TLSSecret != "" {
+		settings.tlsSecret = spec.TLSSecret
+	}
+	settings.ingressClass = spec.IngressClassName
+	settings.annotations = spec.Annotations
+
+	return settings
+}
+
+func getIshtarIngressSettings(cr *comv1alpha1.ALM) ingressSettings {
+	return getIngressSettings(cr.Spec.Ingress.Ishtar, ingressSettings{
+		enabled:     true,
+		name:        "ishtar-ingress",
+		serviceName: "ishtar",
+		port:        8280,
+		host:        lmAPIHost,
+		tlsSecret:   "ishtar-tls",
+	})
+}
+
+func getNimrodIngressSettings(cr *comv1alpha1.ALM) ingressSettings {
+	return getIngressSettings(cr.Spec.Ingress.Nimrod, ingressSettings{
+		enabled:     true,
+		name:        "nimrod-ingress",
+		serviceName: "nimrod",
+		port:        8290,
+		host:        lmUIHost,
+		tlsSecret:   "nimrod-tls",
+	})
+}
+
+func getBrentIngressSettings(cr *comv1alpha1.ALM) ingressSettings {
+	return getIngressSettings(cr.Spec.Ingress.Brent, ingressSettings{
+		enabled:     false,
+		name:        "brent-ingress",
+		serviceName: "brent",
+		port:        8291,
+		host:        lmBrentHost,
+		tlsSecret:   "brent-tls",
+	})
+}
+
+// ingressAnnotations returns the operator's default annotations, which target the nginx ingress controllers, overridden
+// by the annotations in the spec
+func ingressAnnotations(secure bool, settings ingressSettings) map[string]string {
+	annotations := make(map[string]string)
+	if settings.ingressClass == "" || strings.Contains(settings.ingressClass, "nginx") {
+		annotations["ingress.kubernetes.io/rewrite-target"] = "/"
+		annotations["nginx.org/websocket-services"] = settings.serviceName
+		if secure {
+			annotations["nginx.ingress.kubernetes.io/backend-protocol"] = "HTTPS"
+			annotations["ingress.kubernetes.io/secure-backends"] = "true"
+		}
+	}
+	for k, v := range settings.annotations {
+		annotations[k] = v
+	}
+
+	return annotations
+}
+
+// legacyIngressExposure publishes LM services with extensions/v1beta1 Ingresses, for clusters that serve no other API
+type legacyIngressExposure struct {
+	r *ReconcileALM
+}
+
+func (e *legacyIngressExposure) apply(cr *comv1alpha1.ALM, settings ingressSettings, reqLogger logr.Logger) error {
+	found := &extv1beta1.Ingress{}
+	err := e.r.client.Get(context.TODO(), types.NamespacedName{Name: settings.name, Namespace: cr.Namespace}, found)
+	ingress := buildIngress(cr.Spec.Secure, cr.Namespace, exposureLabels(cr, settings.serviceName), settings)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info(fmt.Sprintf("Creating a new %s Ingress", settings.name), "Namespace", cr.Namespace, "Name", settings.name, "Host", settings.host)
+
+		if err := controllerutil.SetControllerReference(cr, ingress, e.r.scheme); err != nil {
+			return err
+		}
+
+		if err := e.r.client.Create(context.TODO(), ingress); err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to create a new %s Ingress", settings.name), "Namespace", cr.Namespace, "Name", settings.name, "Error", err)
+			return err
+		}
+
+		reqLogger.Info(fmt.Sprintf("Created a new %s Ingress", settings.name), "Namespace", cr.Namespace, "Name", settings.name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if reflect.DeepEqual(found.Spec, ingress.Spec) && containsValues(stringMap(found.Annotations), stringMap(ingress.Annotations)) &&
+		containsValues(stringMap(found.Labels), stringMap(ingress.Labels)) {
+		return nil
+	}
+
+	reqLogger.Info(fmt.Sprintf("Updating %s Ingress", settings.name), "Namespace", cr.Namespace, "Name", settings.name, "Host", settings.host)
+	found.Spec = ingress.Spec
+	found.Annotations = mergeAnnotations(found.Annotations, ingress.Annotations)
+	addLabels(&found.Labels, ingress.Labels)
+	if err := e.r.client.Update(context.TODO(), found); err != nil {
+		reqLogger.Info(fmt.Sprintf("Failed to update %s Ingress", settings.name), "Namespace", cr.Namespace, "Name", settings.name, "Error", err)
+		return err
+	}
+
+	return nil
+}
+
+func (e *legacyIngressExposure) remove(cr *comv1alpha1.ALM, settings ingressSettings, reqLogger logr.Logger) error {
+	found := &extv1beta1.Ingress{}
+	err := e.r.client.Get(context.TODO(), types.NamespacedName{Name: settings.name, Namespace: cr.Namespace}, found)
+	if err != nil && (errors.IsNotFound(err) || meta.IsNoMatchError(err)) {
+		// extensions/v1beta1 is not served by Kubernetes 1.22 and later
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !metav1.IsControlledBy(found, cr) {
+		return nil
+	}
+
+	reqLogger.Info(fmt.Sprintf("Deleting %s Ingress", settings.name), "Namespace", cr.Namespace, "Name", settings.name)
+	return e.r.client.Delete(context.TODO(), found)
+}
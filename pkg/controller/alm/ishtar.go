@@ -240,7 +240,6 @@ func (r *ReconcileALM) installIshtar(cr *comv1alpha1.ALM, service serviceDeploym
 	cmName := fmt.Sprintf("%s-%s-cm", cr.Name, service.serviceName)
 
 	// Check if this Deployment already exists
-	// deploymentName := fmt.Sprintf("%s-%s", cr.Name, service.serviceName)
 	deploymentName := service.serviceName
 	found, err := r.deploymentExists(cr, service)
 	if err != nil {
@@ -279,6 +278,7 @@ func (r *ReconcileALM) installIshtar(cr *comv1alpha1.ALM, service serviceDeploym
 				ObjectMeta: metav1.ObjectMeta{
 					Namespace: cr.Namespace,
 					Name:      cmName,
+					Labels:    lmLabels(service),
 				},
 				Data: data,
 			}
@@ -318,7 +318,7 @@ func (r *ReconcileALM) installIshtar(cr *comv1alpha1.ALM, service serviceDeploym
 					Name: "lm-keystore",
 					VolumeSource: corev1.VolumeSource{
 						Secret: &corev1.SecretVolumeSource{
-							SecretName: "lm-keystore",
+							SecretName: lmKeystoreSecretName(cr),
 						},
 					},
 				},
@@ -346,36 +346,28 @@ func (r *ReconcileALM) installIshtar(cr *comv1alpha1.ALM, service serviceDeploym
 				})
 		}
 
-		deployment := buildDeployment(cr.Namespace, deploymentName, cr, service, volumeMounts, volumes)
-
-		if err := controllerutil.SetControllerReference(cr, deployment, r.scheme); err != nil {
+		deployment, err := buildDeployment(cr.Namespace, deploymentName, cr, service, volumeMounts, volumes)
+		if err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to build a new %s Deployment", service.serviceName), "Namespace", cr.Namespace, "Name", deploymentName, "Error", err)
+			r.recorder.Event(cr, corev1.EventTypeWarning, "InvalidPodTemplate", err.Error())
 			return reconcile.Result{}, err
 		}
 
-		err = r.client.Create(context.TODO(), deployment)
-		if err != nil {
-			reqLogger.Info(fmt.Sprintf("Failed to create a new %s Deployment", service.serviceName), "Namespace", cr.Namespace, "Name", deploymentName, "Error", err)
+		if _, err := r.applyConfigChecksum(cr, &deployment.Spec.Template); err != nil {
 			return reconcile.Result{}, err
 		}
 
-		reqLogger.Info(fmt.Sprintf("Created a new %s Deployment", service.serviceName), "Namespace", cr.Namespace, "Name", deploymentName)
-
-		// Created successfully - don't requeue
-
-		ingressName := "ishtar-ingress"
-		ingress := buildIngress(cr.Spec.Secure, cr.Namespace, ingressName, "app.lm", 8280, "ishtar", "ishtar-tls")
-
-		if err := controllerutil.SetControllerReference(cr, ingress, r.scheme); err != nil {
+		if err := controllerutil.SetControllerReference(cr, deployment, r.scheme); err != nil {
 			return reconcile.Result{}, err
 		}
 
-		err = r.client.Create(context.TODO(), ingress)
+		err = r.writeWorkload(cr, deployment, service, true)
 		if err != nil {
-			reqLogger.Info(fmt.Sprintf("Failed to create a new %s Ingress", ingressName), "Namespace", cr.Namespace, "Name", ingressName, "Error", err)
+			reqLogger.Info(fmt.Sprintf("Failed to create a new %s Deployment", service.serviceName), "Namespace", cr.Namespace, "Name", deploymentName, "Error", err)
 			return reconcile.Result{}, err
 		}
 
-		reqLogger.Info(fmt.Sprintf("Created a new %s Ingress", ingressName), "Namespace", cr.Namespace, "Name", ingressName)
+		reqLogger.Info(fmt.Sprintf("Created a new %s Deployment", service.serviceName), "Namespace", cr.Namespace, "Name", deploymentName)
 
 		// Created successfully - don't requeue and create service
 	} else if err != nil {
@@ -3,10 +3,11 @@ package alm
 import (
 	"context"
 	"fmt"
+	"reflect"
 
 	"github.com/go-logr/logr"
 	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
-	v1beta1 "k8s.io/api/apps/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	extv1beta1 "k8s.io/api/extensions/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -18,83 +19,238 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
-func (r *ReconcileALM) service(cr *comv1alpha1.ALM, serviceDeploymentInfo serviceDeploymentInfo, reqLogger logr.Logger) (reconcile.Result, error) {
-	reqLogger.Info(fmt.Sprintf("Creating service %s on port %d", serviceDeploymentInfo.serviceName, serviceDeploymentInfo.port), "Namespace", cr.Namespace, "Name", serviceDeploymentInfo.serviceName)
+// headlessServiceName is the headless Service governing a StatefulSet, which gives each of its pods a DNS name
+func headlessServiceName(serviceName string) string {
+	return fmt.Sprintf("%s-headless", serviceName)
+}
+
+// serviceType returns the type of an LM service's Service, ClusterIP unless set in the spec
+func serviceType(serviceDeploymentInfo serviceDeploymentInfo) (corev1.ServiceType, error) {
+	switch serviceType := corev1.ServiceType(serviceDeploymentInfo.serviceSpec.Type); serviceType {
+	case "":
+		return corev1.ServiceTypeClusterIP, nil
+	case corev1.ServiceTypeClusterIP, corev1.ServiceTypeNodePort, corev1.ServiceTypeLoadBalancer:
+		return serviceType, nil
+	default:
+		return "", fmt.Errorf("Unknown service type %s for %s, must be one of %s, %s or %s", serviceType, serviceDeploymentInfo.serviceName,
+			corev1.ServiceTypeClusterIP, corev1.ServiceTypeNodePort, corev1.ServiceTypeLoadBalancer)
+	}
+}
 
-	var port corev1.ServicePort
-	if serviceDeploymentInfo.nodePort <= 0 {
-		port = corev1.ServicePort{
+// servicePorts returns the http port of an LM service followed by the extra ports in the spec, with the defaults the API
+// server would otherwise fill in
+func servicePorts(serviceDeploymentInfo serviceDeploymentInfo, serviceType corev1.ServiceType) []corev1.ServicePort {
+	ports := []corev1.ServicePort{
+		{
 			Name:       "http",
 			Protocol:   corev1.ProtocolTCP,
 			Port:       serviceDeploymentInfo.port,
 			TargetPort: intstr.FromInt(serviceDeploymentInfo.targetPort),
+		},
+	}
+	if serviceDeploymentInfo.nodePort > 0 {
+		ports[0].NodePort = serviceDeploymentInfo.nodePort
+	}
+
+	for _, extraPort := range serviceDeploymentInfo.serviceSpec.ExtraPorts {
+		port := *extraPort.DeepCopy()
+		if port.Protocol == "" {
+			port.Protocol = corev1.ProtocolTCP
 		}
-	} else if serviceDeploymentInfo.nodePort > 0 {
-		port = corev1.ServicePort{
-			Name:       "http",
-			Protocol:   corev1.ProtocolTCP,
-			Port:       serviceDeploymentInfo.port,
-			TargetPort: intstr.FromInt(serviceDeploymentInfo.targetPort),
-			NodePort:   serviceDeploymentInfo.nodePort,
+		if port.TargetPort.Type == intstr.Int && port.TargetPort.IntVal == 0 {
+			port.TargetPort = intstr.FromInt(int(port.Port))
 		}
-	} else {
-		// nothing to do
+		ports = append(ports, port)
 	}
 
-	// serviceName := fmt.Sprintf("%s-%s-service", cr.Name, serviceDeploymentInfo.serviceName)
-	serviceName := serviceDeploymentInfo.serviceName
+	if serviceType == corev1.ServiceTypeClusterIP {
+		// node ports may only be set on NodePort and LoadBalancer Services
+		for i := range ports {
+			ports[i].NodePort = 0
+		}
+	}
 
-	// Check if this Service already exists
-	foundService := &corev1.Service{}
-	err := r.client.Get(context.TODO(), types.NamespacedName{Name: serviceName, Namespace: cr.Namespace}, foundService)
-	if err != nil && errors.IsNotFound(err) {
-		reqLogger.Info(fmt.Sprintf("Creating a new %s Service", serviceDeploymentInfo.serviceName), "Namespace", cr.Namespace, "Name", serviceName)
+	return ports
+}
 
-		service := &corev1.Service{
-			ObjectMeta: metav1.ObjectMeta{
-				Namespace: cr.Namespace,
-				Name:      serviceName,
-			},
-			Spec: corev1.ServiceSpec{
-				Ports: []corev1.ServicePort{port},
-				Selector: map[string]string{
-					"app": serviceDeploymentInfo.serviceName,
+func buildService(namespace string, serviceDeploymentInfo serviceDeploymentInfo) (*corev1.Service, error) {
+	serviceType, err := serviceType(serviceDeploymentInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        serviceDeploymentInfo.serviceName,
+			Labels:      lmLabels(serviceDeploymentInfo),
+			Annotations: serviceDeploymentInfo.serviceSpec.Annotations,
+		},
+		Spec: corev1.ServiceSpec{
+			Ports:    servicePorts(serviceDeploymentInfo, serviceType),
+			Selector: lmSelector(serviceDeploymentInfo),
+			Type:     serviceType,
+		},
+	}
+	if serviceType == corev1.ServiceTypeLoadBalancer {
+		service.Spec.LoadBalancerSourceRanges = serviceDeploymentInfo.serviceSpec.LoadBalancerSourceRanges
+	}
+
+	return service, nil
+}
+
+func buildHeadlessService(namespace string, serviceDeploymentInfo serviceDeploymentInfo) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      headlessServiceName(serviceDeploymentInfo.serviceName),
+			Labels:    lmLabels(serviceDeploymentInfo),
+		},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "http",
+					Protocol:   corev1.ProtocolTCP,
+					Port:       serviceDeploymentInfo.port,
+					TargetPort: intstr.FromInt(serviceDeploymentInfo.targetPort),
 				},
-				Type: "NodePort",
 			},
+			Selector: lmSelector(serviceDeploymentInfo),
+			// peers must be able to find each other before they are ready, to form a cluster
+			PublishNotReadyAddresses: true,
+		},
+	}
+}
+
+// keepNodePorts copies the node ports Kubernetes allocated to the found Service's ports to the same ports of the
+// desired Service, so that they do not change on every update
+func keepNodePorts(found *corev1.Service, desired *corev1.Service) {
+	if desired.Spec.Type == corev1.ServiceTypeClusterIP {
+		return
+	}
+
+	allocated := make(map[string]int32)
+	for _, port := range found.Spec.Ports {
+		allocated[port.Name] = port.NodePort
+	}
+	for i := range desired.Spec.Ports {
+		if desired.Spec.Ports[i].NodePort == 0 {
+			desired.Spec.Ports[i].NodePort = allocated[desired.Spec.Ports[i].Name]
 		}
+	}
+}
+
+func (r *ReconcileALM) service(cr *comv1alpha1.ALM, serviceDeploymentInfo serviceDeploymentInfo, reqLogger logr.Logger) (reconcile.Result, error) {
+	service, err := buildService(cr.Namespace, serviceDeploymentInfo)
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to build %s Service", serviceDeploymentInfo.serviceName), "Namespace", cr.Namespace)
+		return reconcile.Result{}, err
+	}
+
+	return reconcile.Result{}, r.applyService(cr, service, reqLogger)
+}
+
+// headlessService creates the headless Service governing an LM service's StatefulSet
+func (r *ReconcileALM) headlessService(cr *comv1alpha1.ALM, serviceDeploymentInfo serviceDeploymentInfo, reqLogger logr.Logger) error {
+	return r.applyService(cr, buildHeadlessService(cr.Namespace, serviceDeploymentInfo), reqLogger)
+}
+
+// applyService creates the Service or updates the type, ports and annotations of an existing one. Annotations added by
+// others, such as cloud controllers, are kept. Only the selector, labels and ports of headless Services are updated.
+func (r *ReconcileALM) applyService(cr *comv1alpha1.ALM, service *corev1.Service, reqLogger logr.Logger) error {
+	foundService := &corev1.Service{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: service.Name, Namespace: cr.Namespace}, foundService)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info(fmt.Sprintf("Creating a new %s Service", service.Name), "Namespace", cr.Namespace, "Name", service.Name, "Type", service.Spec.Type)
 
 		if err := controllerutil.SetControllerReference(cr, service, r.scheme); err != nil {
-			return reconcile.Result{}, err
+			return err
 		}
 
 		err = r.client.Create(context.TODO(), service)
 		if err != nil {
-			reqLogger.Info(fmt.Sprintf("Failed to create a new %s Service", serviceDeploymentInfo.serviceName), "Namespace", cr.Namespace, "Name", serviceName, "Error", err)
-			return reconcile.Result{}, err
+			reqLogger.Info(fmt.Sprintf("Failed to create a new %s Service", service.Name), "Namespace", cr.Namespace, "Name", service.Name, "Error", err)
+			return err
 		}
 
-		reqLogger.Info(fmt.Sprintf("Created a new %s Service", serviceDeploymentInfo.serviceName), "Namespace", cr.Namespace, "Name", serviceName)
-		// Conductor CM created successfully - drop through and don't requeue
-		// return reconcile.Result{}, nil
+		reqLogger.Info(fmt.Sprintf("Created a new %s Service", service.Name), "Namespace", cr.Namespace, "Name", service.Name)
+		return nil
 	} else if err != nil {
-		return reconcile.Result{}, err
+		return err
+	}
+	if belongsToOtherALM(cr, foundService) {
+		return r.nameConflict(cr, "Service", service.Name)
+	}
+
+	labelsChanged := !reflect.DeepEqual(foundService.Spec.Selector, service.Spec.Selector) ||
+		!containsValues(stringMap(foundService.Labels), stringMap(service.Labels))
+
+	if foundService.Spec.ClusterIP == corev1.ClusterIPNone {
+		// the cluster IP of a Service cannot be changed, the headless Services are created with it and their
+		// selector, labels and ports are updated
+		if !labelsChanged && reflect.DeepEqual(foundService.Spec.Ports, service.Spec.Ports) {
+			return nil
+		}
+
+		reqLogger.Info(fmt.Sprintf("Updating %s Service", service.Name), "Namespace", cr.Namespace, "Name", service.Name)
+		foundService.Spec.Selector = service.Spec.Selector
+		addLabels(&foundService.Labels, service.Labels)
+		foundService.Spec.Ports = service.Spec.Ports
+		if err := r.client.Update(context.TODO(), foundService); err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to update %s Service", service.Name), "Namespace", cr.Namespace, "Name", service.Name, "Error", err)
+			return err
+		}
+		return nil
 	}
 
-	return reconcile.Result{}, nil
+	keepNodePorts(foundService, service)
+	if !labelsChanged && foundService.Spec.Type == service.Spec.Type && reflect.DeepEqual(foundService.Spec.Ports, service.Spec.Ports) &&
+		reflect.DeepEqual(foundService.Spec.LoadBalancerSourceRanges, service.Spec.LoadBalancerSourceRanges) &&
+		containsValues(stringMap(foundService.Annotations), stringMap(service.Annotations)) {
+		return nil
+	}
+
+	reqLogger.Info(fmt.Sprintf("Updating %s Service", service.Name), "Namespace", cr.Namespace, "Name", service.Name, "Type", service.Spec.Type)
+	foundService.Spec.Selector = service.Spec.Selector
+	addLabels(&foundService.Labels, service.Labels)
+	foundService.Spec.Type = service.Spec.Type
+	foundService.Spec.Ports = service.Spec.Ports
+	foundService.Spec.LoadBalancerSourceRanges = service.Spec.LoadBalancerSourceRanges
+	if service.Spec.Type == corev1.ServiceTypeClusterIP {
+		// only valid for NodePort and LoadBalancer Services
+		foundService.Spec.ExternalTrafficPolicy = ""
+		foundService.Spec.HealthCheckNodePort = 0
+	}
+	foundService.Annotations = mergeAnnotations(foundService.Annotations, service.Annotations)
+	if err := r.client.Update(context.TODO(), foundService); err != nil {
+		reqLogger.Info(fmt.Sprintf("Failed to update %s Service", service.Name), "Namespace", cr.Namespace, "Name", service.Name, "Error", err)
+		return err
+	}
+
+	return nil
+}
+
+// nameConflict reports an object the ALM would create that already exists and belongs to another ALM. It is left alone
+// and the LM service is not installed, rather than two ALMs taking turns to overwrite it.
+func (r *ReconcileALM) nameConflict(cr *comv1alpha1.ALM, kind string, name string) error {
+	message := fmt.Sprintf("%s %s exists and belongs to another ALM in the namespace", kind, name)
+	r.recorder.Event(cr, corev1.EventTypeWarning, "NameConflict", message)
+	return fmt.Errorf("%s", message)
 }
 
 func (r *ReconcileALM) statefulsetExists(cr *comv1alpha1.ALM, service serviceDeploymentInfo) (bool, error) {
 	namespace := cr.Namespace
-	// name := fmt.Sprintf("%s-%s", cr.Name, service.serviceName)
 	name := service.serviceName
 
-	found := &v1beta1.StatefulSet{}
+	found := &appsv1.StatefulSet{}
 	err := r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, found)
 	if err != nil && errors.IsNotFound(err) {
 		return false, nil
 	} else if err != nil {
 		return false, err
+	} else if belongsToOtherALM(cr, found) {
+		return true, r.nameConflict(cr, "StatefulSet", name)
 	} else {
 		return true, nil
 	}
@@ -107,45 +263,41 @@ func (r *ReconcileALM) deploymentExists(cr *comv1alpha1.ALM, service serviceDepl
 func (r *ReconcileALM) deploymentByNameExists(cr *comv1alpha1.ALM, name string) (bool, error) {
 	namespace := cr.Namespace
 
-	found := &extv1beta1.Deployment{}
+	found := &appsv1.Deployment{}
 	err := r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, found)
 	if err != nil && errors.IsNotFound(err) {
 		return false, nil
 	} else if err != nil {
 		return false, err
+	} else if belongsToOtherALM(cr, found) {
+		return true, r.nameConflict(cr, "Deployment", name)
 	} else {
 		return true, nil
 	}
 }
 
 func buildDeployment(namespace string, statefulsetName string, cr *comv1alpha1.ALM, service serviceDeploymentInfo,
-	volumeMounts []corev1.VolumeMount, volumes []corev1.Volume) *extv1beta1.Deployment {
+	volumeMounts []corev1.VolumeMount, volumes []corev1.Volume) (*appsv1.Deployment, error) {
 	dockerImage := fmt.Sprintf("%s/%s:%s", cr.Spec.DockerRepo, service.imageName, service.imageVersion)
-	// deploymentName := fmt.Sprintf("%s-%s", cr.Name, service.serviceName)
 	deploymentName := service.serviceName
+	livenessProbe, readinessProbe := buildProbes(cr.Spec.Secure, service)
 
-	return &extv1beta1.Deployment{
+	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      deploymentName,
 			Namespace: cr.Namespace,
-			Labels: map[string]string{
-				"app": service.serviceName,
-			},
+			Labels:    lmLabels(service),
 		},
-		Spec: extv1beta1.DeploymentSpec{
+		Spec: appsv1.DeploymentSpec{
 			Replicas: int32Ptr(service.numReplicas),
 			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"app": service.serviceName,
-				},
+				MatchLabels: lmSelector(service),
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      fmt.Sprintf("%s-%s", cr.Name, service.serviceName),
 					Namespace: cr.Namespace,
-					Labels: map[string]string{
-						"app": service.serviceName,
-					},
+					Labels:    lmLabels(service),
 				},
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{
@@ -190,7 +342,9 @@ func buildDeployment(namespace string, statefulsetName string, cr *comv1alpha1.A
 									"memory": resource.MustParse(service.memoryRequests),
 								},
 							},
-							VolumeMounts: volumeMounts,
+							VolumeMounts:   volumeMounts,
+							LivenessProbe:  livenessProbe,
+							ReadinessProbe: readinessProbe,
 						},
 					},
 					Volumes: volumes,
@@ -198,10 +352,20 @@ func buildDeployment(namespace string, statefulsetName string, cr *comv1alpha1.A
 			},
 		},
 	}
+
+	applyScheduling(&deployment.Spec.Template.Spec, service)
+	applyPodSecurity(&deployment.Spec.Template, service)
+	if _, err := applyPodTemplate(&deployment.Spec.Template, service.podTemplate); err != nil {
+		return nil, fmt.Errorf("Failed to merge podTemplate for %s: %s", service.serviceName, err)
+	}
+	// after the merge, so that sidecars added by the pod template use the truststore as applySettings has them do
+	applyTrustedCA(&deployment.Spec.Template.Spec, service)
+
+	return deployment, nil
 }
 
 func buildStatefulset(namespace string, statefulsetName string, cr *comv1alpha1.ALM, service serviceDeploymentInfo,
-	volumeMounts []corev1.VolumeMount, volumes []corev1.Volume, additionalEnv []corev1.EnvVar) *v1beta1.StatefulSet {
+	volumeMounts []corev1.VolumeMount, volumes []corev1.Volume, additionalEnv []corev1.EnvVar) (*appsv1.StatefulSet, error) {
 	dockerImage := fmt.Sprintf("%s/%s:%s", cr.Spec.DockerRepo, service.imageName, service.imageVersion)
 
 	var env []corev1.EnvVar
@@ -223,29 +387,25 @@ func buildStatefulset(namespace string, statefulsetName string, cr *comv1alpha1.
 			},
 		})
 	env = append(env, additionalEnv...)
+	livenessProbe, readinessProbe := buildProbes(cr.Spec.Secure, service)
 
-	return &v1beta1.StatefulSet{
+	statefulSet := &appsv1.StatefulSet{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      statefulsetName,
 			Namespace: namespace,
-			Labels: map[string]string{
-				"app": service.serviceName,
-			},
+			Labels:    lmLabels(service),
 		},
-		Spec: v1beta1.StatefulSetSpec{
-			Replicas: int32Ptr(service.numReplicas),
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    int32Ptr(service.numReplicas),
+			ServiceName: headlessServiceName(service.serviceName),
 			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"app": service.serviceName,
-				},
+				MatchLabels: lmSelector(service),
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      fmt.Sprintf("%s-%s", cr.Name, service.serviceName),
 					Namespace: namespace,
-					Labels: map[string]string{
-						"app": service.serviceName,
-					},
+					Labels:    lmLabels(service),
 				},
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{
@@ -273,7 +433,9 @@ func buildStatefulset(namespace string, statefulsetName string, cr *comv1alpha1.
 									"memory": resource.MustParse(service.memoryRequests),
 								},
 							},
-							VolumeMounts: volumeMounts,
+							VolumeMounts:   volumeMounts,
+							LivenessProbe:  livenessProbe,
+							ReadinessProbe: readinessProbe,
 						},
 					},
 					Volumes: volumes,
@@ -281,35 +443,44 @@ func buildStatefulset(namespace string, statefulsetName string, cr *comv1alpha1.
 			},
 		},
 	}
+
+	applyScheduling(&statefulSet.Spec.Template.Spec, service)
+	applyStorage(statefulSet, service)
+	applyPodSecurity(&statefulSet.Spec.Template, service)
+	if _, err := applyPodTemplate(&statefulSet.Spec.Template, service.podTemplate); err != nil {
+		return nil, fmt.Errorf("Failed to merge podTemplate for %s: %s", service.serviceName, err)
+	}
+	// after the merge, so that sidecars added by the pod template use the truststore as applySettings has them do
+	applyTrustedCA(&statefulSet.Spec.Template.Spec, service)
+
+	return statefulSet, nil
 }
 
-func buildIngress(secure bool, namespace string, name string, ingressHost string, port int, serviceName string, externalCertSecretName string) *extv1beta1.Ingress {
-	annotations := make(map[string]string)
-	annotations["ingress.kubernetes.io/rewrite-target"] = "/"
-	annotations["nginx.org/websocket-services"] = serviceName
-	if secure {
-		annotations["nginx.ingress.kubernetes.io/backend-protocol"] = "HTTPS"
-		annotations["ingress.kubernetes.io/secure-backends"] = "true"
+func buildIngress(secure bool, namespace string, labels map[string]string, settings ingressSettings) *extv1beta1.Ingress {
+	annotations := ingressAnnotations(secure, settings)
+	if settings.ingressClass != "" {
+		annotations[ingressClassAnnotation] = settings.ingressClass
 	}
+
 	return &extv1beta1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        name,
+			Name:        settings.name,
 			Namespace:   namespace,
-			Labels:      map[string]string{},
+			Labels:      labels,
 			Annotations: annotations,
 		},
 		Spec: extv1beta1.IngressSpec{
 			Rules: []extv1beta1.IngressRule{
 				{
-					Host: ingressHost,
+					Host: settings.host,
 					IngressRuleValue: extv1beta1.IngressRuleValue{
 						HTTP: &extv1beta1.HTTPIngressRuleValue{
 							Paths: []extv1beta1.HTTPIngressPath{
 								{
-									Path: "/",
+									Path: settings.path,
 									Backend: extv1beta1.IngressBackend{
-										ServiceName: serviceName,
-										ServicePort: intstr.FromInt(port),
+										ServiceName: settings.serviceName,
+										ServicePort: intstr.FromInt(settings.port),
 									},
 								},
 							},
@@ -319,8 +490,8 @@ func buildIngress(secure bool, namespace string, name string, ingressHost string
 			},
 			TLS: []extv1beta1.IngressTLS{
 				{
-					Hosts:      []string{ingressHost},
-					SecretName: externalCertSecretName,
+					Hosts:      []string{settings.host},
+					SecretName: settings.tlsSecret,
 				},
 			},
 		},
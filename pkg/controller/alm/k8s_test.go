@@ -0,0 +1,64 @@
+package alm
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestApplyHeadlessServiceUpdatesPorts(t *testing.T) {
+	cr := almForTest()
+	service := serviceDeploymentInfo{serviceName: "conductor", instance: "awesome", port: 8761, targetPort: 8761}
+	old := service
+	old.port = 8080
+	old.targetPort = 8080
+	r, _ := reconcilerForTest(t, cr, buildHeadlessService("lm", old))
+
+	if err := r.applyService(cr, buildHeadlessService("lm", service), log); err != nil {
+		t.Fatalf("applyService() error = %v", err)
+	}
+
+	found := &corev1.Service{}
+	if err := r.client.Get(context.TODO(), types.NamespacedName{Name: headlessServiceName("conductor"), Namespace: "lm"}, found); err != nil {
+		t.Fatal(err)
+	}
+	if found.Spec.ClusterIP != corev1.ClusterIPNone {
+		t.Errorf("cluster IP = %q, want the Service left headless", found.Spec.ClusterIP)
+	}
+	if len(found.Spec.Ports) != 1 || found.Spec.Ports[0].Port != 8761 || found.Spec.Ports[0].TargetPort.IntValue() != 8761 {
+		t.Errorf("ports = %+v, want the desired port", found.Spec.Ports)
+	}
+}
+
+func TestApplyServiceOfAnotherALM(t *testing.T) {
+	cr := almForTest()
+	other := serviceDeploymentInfo{serviceName: "ishtar", instance: "other", port: 8280, targetPort: 8280}
+	existing, err := buildService("lm", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, recorder := reconcilerForTest(t, cr, existing)
+
+	service := other
+	service.instance = "awesome"
+	desired, err := buildService("lm", service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.applyService(cr, desired, log); err == nil {
+		t.Errorf("applyService() error = nil, want the other ALM's Service reported")
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("events = %d, want a NameConflict event", len(recorder.Events))
+	}
+
+	found := &corev1.Service{}
+	if err := r.client.Get(context.TODO(), types.NamespacedName{Name: "ishtar", Namespace: "lm"}, found); err != nil {
+		t.Fatal(err)
+	}
+	if found.Spec.Selector[instanceLabel] != "other" {
+		t.Errorf("selector = %v, want the other ALM's Service left alone", found.Spec.Selector)
+	}
+}
@@ -0,0 +1,283 @@
+package alm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/go-logr/logr"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// kafkaTopicsResyncPeriod is how often topics are checked for drift when the operator manages them
+	kafkaTopicsResyncPeriod = 10 * time.Minute
+)
+
+// lmTopic describes one of LM's Kafka topics. Topics with a fixed partition count or replication factor
+// ignore the values configured in the ALM spec.
+type lmTopic struct {
+	name              string
+	config            map[string]string
+	partitions        int32
+	replicationFactor int16
+}
+
+var (
+	compactConfig    = map[string]string{"cleanup.policy": "compact"}
+	oneHourConfig    = map[string]string{"retention.ms": "3600000"}
+	oneYearConfig    = map[string]string{"retention.ms": "31536000000"}
+	lmTopicCatalogue = []lmTopic{
+		{name: "alm__health", config: compactConfig},
+		{name: "alm__metric", config: compactConfig},
+		{name: "alm__metric-integrity", config: compactConfig},
+		{name: "alm__policy", config: compactConfig},
+		{name: "alm__policyAction"},
+		{name: "alm__policyStatusHeal"},
+		// earlier versions of the operator created it with 11 partitions, whatever the partitions in the spec
+		{name: "alm__policyStatusScale", partitions: 11},
+		{name: "alm__clock"},
+		{name: "alm__descriptorChange", config: compactConfig},
+		{name: "alm__processStateChange"},
+		{name: "alm__processTasksStateChange"},
+		{name: "alm__stateChange"},
+		{name: "alm__serviceStateTransition"},
+		{name: "alm__taskUpdate"},
+		{name: "alm__load"},
+		{name: "alm__integrity"},
+		{name: "alm__integrityMissing"},
+		{name: "info"},
+		{name: "alm__clockticks5", config: oneHourConfig},
+		{name: "alm__clockticks10", config: oneHourConfig},
+		{name: "alm__clockticks15", config: oneHourConfig},
+		{name: "alm__clockticks30", config: oneHourConfig},
+		{name: "alm__clockticks60", config: oneHourConfig},
+		{name: "alm__clockticksother"},
+		{name: "alm__tick", config: oneHourConfig},
+		{name: "alm__clocktickTypes", config: compactConfig},
+		{name: "alm__processRestart"},
+		{name: "alm__stateChange__ldu", config: oneYearConfig},
+		{name: "alm__verification", partitions: 1, replicationFactor: 1},
+		{name: "lm_vim_infrastructure_task_events"},
+		{name: "lm_vnfc_lifecycle_execution_events"},
+	}
+)
+
+// topicAdmin is the subset of the Kafka admin API used to reconcile LM's topics. It is satisfied by
+// sarama.ClusterAdmin and can be replaced with an in-memory implementation.
+type topicAdmin interface {
+	ListTopics() (map[string]sarama.TopicDetail, error)
+	CreateTopic(topic string, detail *sarama.TopicDetail, validateOnly bool) error
+	CreatePartitions(topic string, count int32, assignment [][]int32, validateOnly bool) error
+	AlterConfig(resourceType sarama.ConfigResourceType, name string, entries map[string]*string, validateOnly bool) error
+	Close() error
+}
+
+// newSaramaTopicAdmin connects a Kafka admin client to the given brokers
+func newSaramaTopicAdmin(brokers []string, version string) (topicAdmin, error) {
+	kafkaVersion, err := sarama.ParseKafkaVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	config := sarama.NewConfig()
+	config.ClientID = "lm-operator"
+	config.Version = kafkaVersion
+	return sarama.NewClusterAdmin(brokers, config)
+}
+
+type kafkaSettings struct {
+	brokers           []string
+	version           string
+	partitions        int32
+	replicationFactor int16
+}
+
+func getKafkaSettings(cr *comv1alpha1.ALM) kafkaSettings {
+	settings := kafkaSettings{
+		brokers:           []string{"foundation-kafka:9092"},
+		version:           "2.0.0",
+		partitions:        1,
+		replicationFactor: 1,
+	}
+
+	if len(cr.Spec.Kafka.Brokers) > 0 {
+		settings.brokers = cr.Spec.Kafka.Brokers
+	}
+	if cr.Spec.Kafka.Version != "" {
+		settings.version = cr.Spec.Kafka.Version
+	}
+	if cr.Spec.Kafka.Partitions > 0 {
+		settings.partitions = cr.Spec.Kafka.Partitions
+	}
+	if cr.Spec.Kafka.ReplicationFactor > 0 {
+		settings.replicationFactor = cr.Spec.Kafka.ReplicationFactor
+	}
+
+	return settings
+}
+
+// desired returns the partition count and replication factor of the topic
+func (t lmTopic) desired(partitions int32, replicationFactor int16) (int32, int16) {
+	if t.partitions > 0 {
+		partitions = t.partitions
+	}
+	if t.replicationFactor > 0 {
+		replicationFactor = t.replicationFactor
+	}
+
+	return partitions, replicationFactor
+}
+
+// topicsConfig renders the topic catalogue in the format expected by the configurator's topics.yaml
+func topicsConfig(partitions int32, replicationFactor int16) string {
+	var topicsYaml bytes.Buffer
+	topicsYaml.WriteString("topics:\n")
+	for _, topic := range lmTopicCatalogue {
+		topicPartitions, topicReplicationFactor := topic.desired(partitions, replicationFactor)
+		topicsYaml.WriteString(fmt.Sprintf("  %s:\n", topic.name))
+		topicsYaml.WriteString(fmt.Sprintf("    replication_factor: %d\n", topicReplicationFactor))
+		topicsYaml.WriteString(fmt.Sprintf("    partitions: %d\n", topicPartitions))
+		if len(topic.config) > 0 {
+			topicsYaml.WriteString(fmt.Sprintf("    config: \"%s\"\n", topicConfigString(topic.config)))
+		}
+	}
+
+	return topicsYaml.String()
+}
+
+func topicConfigString(config map[string]string) string {
+	var entries []string
+	for k, v := range config {
+		entries = append(entries, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(entries)
+
+	return strings.Join(entries, ",")
+}
+
+// reconcileKafkaTopics creates missing LM topics, adds partitions and updates topic configs. Differences it is
+// not allowed to fix, such as fewer partitions or a different replication factor, are reported as drift.
+func reconcileKafkaTopics(admin topicAdmin, settings kafkaSettings, reqLogger logr.Logger) ([]string, error) {
+	existing, err := admin.ListTopics()
+	if err != nil {
+		return nil, err
+	}
+
+	var drift []string
+	for _, topic := range lmTopicCatalogue {
+		partitions, replicationFactor := topic.desired(settings.partitions, settings.replicationFactor)
+
+		config := make(map[string]*string)
+		for k := range topic.config {
+			v := topic.config[k]
+			config[k] = &v
+		}
+
+		detail, ok := existing[topic.name]
+		if !ok {
+			reqLogger.Info(fmt.Sprintf("Creating Kafka topic %s", topic.name), "Partitions", partitions, "ReplicationFactor", replicationFactor)
+			err := admin.CreateTopic(topic.name, &sarama.TopicDetail{
+				NumPartitions:     partitions,
+				ReplicationFactor: replicationFactor,
+				ConfigEntries:     config,
+			}, false)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to create Kafka topic %s: %s", topic.name, err)
+			}
+			continue
+		}
+
+		if detail.NumPartitions < partitions {
+			reqLogger.Info(fmt.Sprintf("Increasing partitions of Kafka topic %s from %d to %d", topic.name, detail.NumPartitions, partitions))
+			if err := admin.CreatePartitions(topic.name, partitions, nil, false); err != nil {
+				return nil, fmt.Errorf("Failed to add partitions to Kafka topic %s: %s", topic.name, err)
+			}
+		} else if detail.NumPartitions > partitions {
+			drift = append(drift, fmt.Sprintf("topic %s has %d partitions, expected %d (partitions cannot be removed)", topic.name, detail.NumPartitions, partitions))
+		}
+
+		if detail.ReplicationFactor != replicationFactor {
+			drift = append(drift, fmt.Sprintf("topic %s has replication factor %d, expected %d (requires a partition reassignment)", topic.name, detail.ReplicationFactor, replicationFactor))
+		}
+
+		// AlterConfig replaces every dynamic config of the topic, so keep the ones LM does not manage
+		changed := false
+		entries := make(map[string]*string)
+		for k, v := range detail.ConfigEntries {
+			entries[k] = v
+		}
+		for k, v := range config {
+			if current, ok := entries[k]; !ok || current == nil || *current != *v {
+				entries[k] = v
+				changed = true
+			}
+		}
+
+		if changed {
+			reqLogger.Info(fmt.Sprintf("Updating config of Kafka topic %s", topic.name), "Config", topicConfigString(topic.config))
+			if err := admin.AlterConfig(sarama.TopicResource, topic.name, entries, false); err != nil {
+				return nil, fmt.Errorf("Failed to update config of Kafka topic %s: %s", topic.name, err)
+			}
+		}
+	}
+
+	return drift, nil
+}
+
+// kafkaTopics reconciles LM's Kafka topics and records the outcome in the ALM status
+func (r *ReconcileALM) kafkaTopics(cr *comv1alpha1.ALM, reqLogger logr.Logger) error {
+	settings := getKafkaSettings(cr)
+
+	drift, err := r.reconcileKafkaTopics(settings, reqLogger)
+
+	status := comv1alpha1.KafkaStatus{
+		TopicsReady: err == nil && len(drift) == 0,
+		Drift:       drift,
+	}
+	if err != nil {
+		// drift is not known while Kafka is unavailable
+		status.Drift = cr.Status.Kafka.Drift
+		status.Message = err.Error()
+	}
+	if reflect.DeepEqual(status, cr.Status.Kafka) {
+		return err
+	}
+
+	if err != nil {
+		r.recorder.Event(cr, corev1.EventTypeWarning, "KafkaFailed", err.Error())
+	} else if len(drift) > 0 {
+		r.recorder.Event(cr, corev1.EventTypeWarning, "KafkaTopicDrift", strings.Join(drift, "; "))
+	}
+
+	cr.Status.Kafka = status
+	if err := r.client.Status().Update(context.TODO(), cr); err != nil {
+		reqLogger.Error(err, "Failed to update ALM status.")
+		return err
+	}
+
+	return err
+}
+
+func (r *ReconcileALM) reconcileKafkaTopics(settings kafkaSettings, reqLogger logr.Logger) ([]string, error) {
+	admin, err := r.newTopicAdmin(settings.brokers, settings.version)
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to connect to Kafka brokers %s", strings.Join(settings.brokers, ",")))
+		return nil, fmt.Errorf("Failed to connect to Kafka brokers %s: %s", strings.Join(settings.brokers, ","), err)
+	}
+	defer admin.Close()
+
+	drift, err := reconcileKafkaTopics(admin, settings, reqLogger)
+	if err != nil {
+		reqLogger.Error(err, "Failed to reconcile Kafka topics")
+		return nil, err
+	}
+
+	return drift, nil
+}
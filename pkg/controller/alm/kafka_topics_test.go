@@ -0,0 +1,152 @@
+package alm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// reconcilerForTest returns a reconciler whose client holds the ALM and objects, and whose events are recorded
+func reconcilerForTest(t *testing.T, cr *comv1alpha1.ALM, objects ...runtime.Object) (*ReconcileALM, *record.FakeRecorder) {
+	s := runtime.NewScheme()
+	if err := scheme.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := comv1alpha1.SchemeBuilder.AddToScheme(s); err != nil {
+		t.Fatal(err)
+	}
+	recorder := record.NewFakeRecorder(10)
+
+	return &ReconcileALM{
+		client:   fake.NewFakeClientWithScheme(s, append(objects, cr)...),
+		recorder: recorder,
+		scheme:   s,
+	}, recorder
+}
+
+// memoryTopicAdmin is an in-memory stand-in for the brokers' admin API
+type memoryTopicAdmin struct {
+	topics map[string]sarama.TopicDetail
+	calls  []string
+}
+
+func (a *memoryTopicAdmin) ListTopics() (map[string]sarama.TopicDetail, error) {
+	topics := make(map[string]sarama.TopicDetail)
+	for name, detail := range a.topics {
+		topics[name] = detail
+	}
+
+	return topics, nil
+}
+
+func (a *memoryTopicAdmin) CreateTopic(topic string, detail *sarama.TopicDetail, validateOnly bool) error {
+	a.calls = append(a.calls, "create "+topic)
+	a.topics[topic] = *detail
+	return nil
+}
+
+func (a *memoryTopicAdmin) CreatePartitions(topic string, count int32, assignment [][]int32, validateOnly bool) error {
+	a.calls = append(a.calls, fmt.Sprintf("partitions %s %d", topic, count))
+	detail := a.topics[topic]
+	detail.NumPartitions = count
+	a.topics[topic] = detail
+	return nil
+}
+
+func (a *memoryTopicAdmin) AlterConfig(resourceType sarama.ConfigResourceType, name string, entries map[string]*string, validateOnly bool) error {
+	a.calls = append(a.calls, "config "+name)
+	detail := a.topics[name]
+	detail.ConfigEntries = entries
+	a.topics[name] = detail
+	return nil
+}
+
+func (a *memoryTopicAdmin) Close() error {
+	return nil
+}
+
+func TestReconcileKafkaTopics(t *testing.T) {
+	settings := getKafkaSettings(almForTest())
+	settings.partitions = 3
+
+	admin := &memoryTopicAdmin{topics: map[string]sarama.TopicDetail{
+		"alm__health":       {NumPartitions: 1, ReplicationFactor: 1},
+		"alm__clock":        {NumPartitions: 6, ReplicationFactor: 1},
+		"alm__verification": {NumPartitions: 1, ReplicationFactor: 3},
+	}}
+	drift, err := reconcileKafkaTopics(admin, settings, log)
+	if err != nil {
+		t.Fatalf("reconcileKafkaTopics() error = %v", err)
+	}
+	if len(admin.topics) != len(lmTopicCatalogue) {
+		t.Errorf("topics = %d, want the %d topics of the catalogue", len(admin.topics), len(lmTopicCatalogue))
+	}
+	if scale := admin.topics["alm__policyStatusScale"]; scale.NumPartitions != 11 {
+		t.Errorf("alm__policyStatusScale = %+v, want its fixed 11 partitions", scale)
+	}
+	health := admin.topics["alm__health"]
+	if health.NumPartitions != 3 || health.ConfigEntries["cleanup.policy"] == nil || *health.ConfigEntries["cleanup.policy"] != "compact" {
+		t.Errorf("alm__health = %+v, want 3 partitions and its config", health)
+	}
+	if len(drift) != 2 || !strings.Contains(drift[0], "alm__clock") || !strings.Contains(drift[1], "alm__verification") {
+		t.Errorf("drift = %v, want the partitions of alm__clock and the replication factor of alm__verification", drift)
+	}
+
+	admin.calls = nil
+	if _, err := reconcileKafkaTopics(admin, settings, log); err != nil || len(admin.calls) != 0 {
+		t.Errorf("reconcileKafkaTopics() = %v, %v, want reconciled topics left alone", admin.calls, err)
+	}
+}
+
+func TestKafkaTopicsUnavailable(t *testing.T) {
+	cr := almForTest()
+	cr.Spec.Kafka.ManageTopics = true
+	r, recorder := reconcilerForTest(t, cr)
+	r.newTopicAdmin = func(brokers []string, version string) (topicAdmin, error) {
+		return nil, fmt.Errorf("kafka: client has run out of available brokers to talk to")
+	}
+
+	if err := r.kafkaTopics(cr, log); err == nil {
+		t.Fatalf("kafkaTopics() error = nil, want the unavailable brokers reported")
+	}
+	if cr.Status.Kafka.TopicsReady || !strings.Contains(cr.Status.Kafka.Message, "foundation-kafka:9092") {
+		t.Errorf("status = %+v, want the error recorded", cr.Status.Kafka)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("events = %d, want KafkaFailed reported", len(recorder.Events))
+	}
+
+	// reported once
+	r.kafkaTopics(cr, log)
+	if len(recorder.Events) != 1 {
+		t.Errorf("events = %d, want KafkaFailed reported once", len(recorder.Events))
+	}
+
+	admin := &memoryTopicAdmin{topics: map[string]sarama.TopicDetail{}}
+	r.newTopicAdmin = func(brokers []string, version string) (topicAdmin, error) {
+		return admin, nil
+	}
+	if err := r.kafkaTopics(cr, log); err != nil || !cr.Status.Kafka.TopicsReady || cr.Status.Kafka.Message != "" {
+		t.Errorf("kafkaTopics() = %+v, %v, want the topics reconciled once Kafka is available", cr.Status.Kafka, err)
+	}
+}
+
+func TestTopicsConfig(t *testing.T) {
+	topics := topicsConfig(3, 2)
+	for _, want := range []string{
+		"  alm__health:\n    replication_factor: 2\n    partitions: 3\n",
+		"  alm__policyStatusScale:\n    replication_factor: 2\n    partitions: 11\n",
+		"  alm__verification:\n    replication_factor: 1\n    partitions: 1\n",
+	} {
+		if !strings.Contains(topics, want) {
+			t.Errorf("topics.yaml = %s, want it to contain %q", topics, want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package alm
+
+import (
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// the recommended Kubernetes labels, set on the objects the operator creates alongside the app label earlier versions
+// of the operator set
+const (
+	appLabel       = "app"
+	nameLabel      = "app.kubernetes.io/name"
+	instanceLabel  = "app.kubernetes.io/instance"
+	versionLabel   = "app.kubernetes.io/version"
+	componentLabel = "app.kubernetes.io/component"
+	partOfLabel    = "app.kubernetes.io/part-of"
+	managedByLabel = "app.kubernetes.io/managed-by"
+
+	lmPartOf    = "lm"
+	lmManagedBy = "lm-operator"
+)
+
+// lmComponent is the role of an LM service or the LM configurator within LM
+func lmComponent(serviceName string) string {
+	if serviceName == lmConfiguratorService {
+		return "configurator"
+	}
+
+	return "microservice"
+}
+
+// almLabels labels the objects shared by the LM services of an ALM, named as the instance
+func almLabels(cr *comv1alpha1.ALM) map[string]string {
+	return map[string]string{
+		instanceLabel:  cr.Name,
+		partOfLabel:    lmPartOf,
+		managedByLabel: lmManagedBy,
+	}
+}
+
+// lmLabels labels the objects of an LM service or the LM configurator. The version is left out if the image version
+// is not a valid label value.
+func lmLabels(service serviceDeploymentInfo) map[string]string {
+	labels := map[string]string{
+		appLabel:       service.serviceName,
+		nameLabel:      service.serviceName,
+		instanceLabel:  service.instance,
+		componentLabel: lmComponent(service.serviceName),
+		partOfLabel:    lmPartOf,
+		managedByLabel: lmManagedBy,
+	}
+	if service.imageVersion != "" && len(validation.IsValidLabelValue(service.imageVersion)) == 0 {
+		labels[versionLabel] = service.imageVersion
+	}
+
+	return labels
+}
+
+// exposureLabels labels the Ingress, Route or HTTPRoute publishing an LM service
+func exposureLabels(cr *comv1alpha1.ALM, serviceName string) map[string]string {
+	labels := almLabels(cr)
+	labels[nameLabel] = serviceName
+
+	return labels
+}
+
+// lmSelector selects the pods of an LM service or the LM configurator of a single ALM
+func lmSelector(service serviceDeploymentInfo) map[string]string {
+	return map[string]string{
+		nameLabel:     service.serviceName,
+		instanceLabel: service.instance,
+	}
+}
+
+// belongsToOtherALM returns true if an object is controlled by, or labelled as part of, another ALM. The LM services
+// find each other by the names of their Services, so those and their workloads are not named after the ALM and another
+// ALM in the namespace may already have created them. Objects with neither, created by an earlier version of the
+// operator, are taken to be the ALM's own.
+func belongsToOtherALM(cr *comv1alpha1.ALM, object metav1.Object) bool {
+	if owner := metav1.GetControllerOf(object); owner != nil && owner.UID != cr.UID {
+		return true
+	}
+	instance, labelled := object.GetLabels()[instanceLabel]
+
+	return labelled && instance != cr.Name
+}
+
+// addLabels adds the labels to an object's labels, returning true if any were missing or different
+func addLabels(labels *map[string]string, add map[string]string) bool {
+	changed := false
+	for key, value := range add {
+		if existing, ok := (*labels)[key]; ok && existing == value {
+			continue
+		}
+		if *labels == nil {
+			*labels = make(map[string]string)
+		}
+		(*labels)[key] = value
+		changed = true
+	}
+
+	return changed
+}
@@ -0,0 +1,72 @@
+package alm
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestAddLabels(t *testing.T) {
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		add         map[string]string
+		want        map[string]string
+		wantChanged bool
+	}{
+		{"nil labels", nil, map[string]string{appLabel: "ishtar"}, map[string]string{appLabel: "ishtar"}, true},
+		{"missing label", map[string]string{"team": "ops"}, map[string]string{appLabel: "ishtar"}, map[string]string{"team": "ops", appLabel: "ishtar"}, true},
+		{"different value", map[string]string{appLabel: "nimrod"}, map[string]string{appLabel: "ishtar"}, map[string]string{appLabel: "ishtar"}, true},
+		{"already set", map[string]string{appLabel: "ishtar", "team": "ops"}, map[string]string{appLabel: "ishtar"}, map[string]string{appLabel: "ishtar", "team": "ops"}, false},
+		{"nothing to add", nil, nil, nil, false},
+	}
+	for _, test := range tests {
+		labels := test.labels
+		if changed := addLabels(&labels, test.add); changed != test.wantChanged {
+			t.Errorf("%s: addLabels() = %v, want %v", test.name, changed, test.wantChanged)
+		}
+		if !reflect.DeepEqual(labels, test.want) {
+			t.Errorf("%s: labels = %v, want %v", test.name, labels, test.want)
+		}
+	}
+}
+
+func TestLMSelector(t *testing.T) {
+	service := serviceDeploymentInfo{serviceName: "ishtar", instance: "awesome"}
+	selector := lmSelector(service)
+	labels := lmLabels(service)
+	for key, value := range selector {
+		if labels[key] != value {
+			t.Errorf("label %s = %q, want the selector's %q", key, labels[key], value)
+		}
+	}
+	if selector[instanceLabel] != "awesome" {
+		t.Errorf("selector = %v, want it scoped to the ALM", selector)
+	}
+}
+
+func TestBelongsToOtherALM(t *testing.T) {
+	cr := almForTest()
+	controller := true
+	ownedBy := func(uid types.UID) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{APIVersion: "com.accantosystems.stratoss/v1alpha1", Kind: "ALM", Name: "other", UID: uid, Controller: &controller}}
+	}
+
+	tests := []struct {
+		name   string
+		object metav1.ObjectMeta
+		want   bool
+	}{
+		{"created by an earlier version", metav1.ObjectMeta{Labels: map[string]string{appLabel: "ishtar"}}, false},
+		{"owned by the ALM", metav1.ObjectMeta{OwnerReferences: ownedBy(cr.UID), Labels: map[string]string{instanceLabel: "awesome"}}, false},
+		{"owned by another ALM", metav1.ObjectMeta{OwnerReferences: ownedBy("d2b1c5f0-0000-4000-8000-000000000002")}, true},
+		{"labelled by another ALM", metav1.ObjectMeta{Labels: map[string]string{instanceLabel: "other"}}, true},
+	}
+	for _, test := range tests {
+		if got := belongsToOtherALM(cr, &test.object); got != test.want {
+			t.Errorf("%s: belongsToOtherALM() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
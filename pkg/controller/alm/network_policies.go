@@ -0,0 +1,428 @@
+package alm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+
+	"github.com/go-logr/logr"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// the names of the policies shared by the LM pods, prefixed with the name of the ALM
+	defaultDenyNetworkPolicySuffix = "lm-default-deny"
+	egressNetworkPolicySuffix      = "lm-egress"
+
+	// ports of the backing services the LM configurator reaches at fixed addresses
+	zookeeperPort = 2181
+	kibanaPort    = 443
+	dnsPort       = 53
+)
+
+func defaultDenyNetworkPolicyName(cr *comv1alpha1.ALM) string {
+	return fmt.Sprintf("%s-%s", cr.Name, defaultDenyNetworkPolicySuffix)
+}
+
+func egressNetworkPolicyName(cr *comv1alpha1.ALM) string {
+	return fmt.Sprintf("%s-%s", cr.Name, egressNetworkPolicySuffix)
+}
+
+func networkPolicyName(cr *comv1alpha1.ALM, serviceName string) string {
+	return fmt.Sprintf("%s-%s-network-policy", cr.Name, serviceName)
+}
+
+// legacyNetworkPolicyNames are the names earlier versions of the operator gave the policies, which were not scoped to
+// the ALM
+func legacyNetworkPolicyNames(deploymentInfo deploymentInfo) []string {
+	names := []string{defaultDenyNetworkPolicySuffix, egressNetworkPolicySuffix}
+	for _, service := range deploymentInfo.services() {
+		names = append(names, fmt.Sprintf("%s-network-policy", service.serviceName))
+	}
+
+	return names
+}
+
+// lmPodSelector selects the pods of the LM configurator and of every LM service of the ALM
+func lmPodSelector(cr *comv1alpha1.ALM) metav1.LabelSelector {
+	return metav1.LabelSelector{
+		MatchLabels: map[string]string{
+			instanceLabel: cr.Name,
+		},
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{
+				Key:      nameLabel,
+				Operator: metav1.LabelSelectorOpIn,
+				Values:   append([]string{lmConfiguratorService}, lmServices...),
+			},
+		},
+	}
+}
+
+// lmPeerSelector selects the same pods as lmPodSelector, as a peer of a rule
+func lmPeerSelector(cr *comv1alpha1.ALM) *metav1.LabelSelector {
+	selector := lmPodSelector(cr)
+	return &selector
+}
+
+func networkPolicyPort(protocol corev1.Protocol, port intstr.IntOrString) networkingv1.NetworkPolicyPort {
+	return networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &port}
+}
+
+// withProtocols returns the rules' ports with the protocol the API server defaults them to, so that the rules compare
+// equal to those read back
+func withProtocols(ports []networkingv1.NetworkPolicyPort) []networkingv1.NetworkPolicyPort {
+	for i := range ports {
+		if ports[i].Protocol == nil {
+			protocol := corev1.ProtocolTCP
+			ports[i].Protocol = &protocol
+		}
+	}
+
+	return ports
+}
+
+func extraIngressRules(settings comv1alpha1.NetworkPoliciesSpec) []networkingv1.NetworkPolicyIngressRule {
+	var rules []networkingv1.NetworkPolicyIngressRule
+	for _, rule := range settings.ExtraIngress {
+		rule = *rule.DeepCopy()
+		rule.Ports = withProtocols(rule.Ports)
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+func extraEgressRules(settings comv1alpha1.NetworkPoliciesSpec) []networkingv1.NetworkPolicyEgressRule {
+	var rules []networkingv1.NetworkPolicyEgressRule
+	for _, rule := range settings.ExtraEgress {
+		rule = *rule.DeepCopy()
+		rule.Ports = withProtocols(rule.Ports)
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// urlPort returns the port of a URL, defaulted from its scheme
+func urlPort(rawURL string) (int, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return 0, false
+	}
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			return 443, true
+		}
+		return 80, true
+	}
+	port, err := strconv.Atoi(u.Port())
+
+	return port, err == nil
+}
+
+// backendPorts returns the ports of Cassandra, Kafka and its ZooKeeper, Elasticsearch and Vault, as configured for the
+// ALM
+func backendPorts(cr *comv1alpha1.ALM) []int {
+	var ports []int
+	add := func(port int) {
+		for _, p := range ports {
+			if p == port {
+				return
+			}
+		}
+		ports = append(ports, port)
+	}
+
+	add(getCassandraSettings(cr).port)
+	for _, broker := range getKafkaSettings(cr).brokers {
+		if _, port, err := net.SplitHostPort(broker); err == nil {
+			if p, err := strconv.Atoi(port); err == nil {
+				add(p)
+			}
+		}
+	}
+	add(zookeeperPort)
+	if port, ok := urlPort(getElasticsearchSettings(cr).url); ok {
+		add(port)
+	}
+	if port, ok := urlPort(getVaultSettings(cr).address); ok {
+		add(port)
+	}
+
+	return ports
+}
+
+// kibanaPeers returns the peers Kibana runs as, those of the backing services unless set, or none if neither is set
+func kibanaPeers(settings comv1alpha1.NetworkPoliciesSpec) []networkingv1.NetworkPolicyPeer {
+	source := settings.KibanaPeers
+	if len(source) == 0 {
+		source = settings.BackendPeers
+	}
+
+	var peers []networkingv1.NetworkPolicyPeer
+	for _, peer := range source {
+		peers = append(peers, *peer.DeepCopy())
+	}
+
+	return peers
+}
+
+// exposedServices returns the LM services the ingress controller routes to
+func exposedServices(cr *comv1alpha1.ALM) map[string]bool {
+	exposed := make(map[string]bool)
+	for _, settings := range []ingressSettings{getIshtarIngressSettings(cr), getNimrodIngressSettings(cr), getBrentIngressSettings(cr)} {
+		if settings.enabled {
+			exposed[settings.serviceName] = true
+		}
+	}
+
+	return exposed
+}
+
+// servicePolicyPorts returns the pod ports an LM service is reached on through its Service
+func servicePolicyPorts(service serviceDeploymentInfo) []networkingv1.NetworkPolicyPort {
+	ports := []networkingv1.NetworkPolicyPort{networkPolicyPort(corev1.ProtocolTCP, intstr.FromInt(int(service.port)))}
+	for _, extra := range service.serviceSpec.ExtraPorts {
+		protocol := extra.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		target := extra.TargetPort
+		if target.Type == intstr.Int && target.IntVal == 0 {
+			target = intstr.FromInt(int(extra.Port))
+		}
+		ports = append(ports, networkPolicyPort(protocol, target))
+	}
+
+	return ports
+}
+
+// buildDefaultDenyNetworkPolicy denies all traffic to and from the LM pods that no other policy allows
+func buildDefaultDenyNetworkPolicy(cr *comv1alpha1.ALM) *networkingv1.NetworkPolicy {
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      defaultDenyNetworkPolicyName(cr),
+			Namespace: cr.Namespace,
+			Labels:    almLabels(cr),
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: lmPodSelector(cr),
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+		},
+	}
+}
+
+// buildEgressNetworkPolicy allows the LM pods to resolve names, to call each other and to reach the backing services
+func buildEgressNetworkPolicy(cr *comv1alpha1.ALM) *networkingv1.NetworkPolicy {
+	settings := cr.Spec.NetworkPolicies
+
+	var ports []networkingv1.NetworkPolicyPort
+	for _, port := range backendPorts(cr) {
+		ports = append(ports, networkPolicyPort(corev1.ProtocolTCP, intstr.FromInt(port)))
+	}
+	var backendPeers []networkingv1.NetworkPolicyPeer
+	for _, peer := range settings.BackendPeers {
+		backendPeers = append(backendPeers, *peer.DeepCopy())
+	}
+
+	egress := []networkingv1.NetworkPolicyEgressRule{
+		{
+			Ports: []networkingv1.NetworkPolicyPort{
+				networkPolicyPort(corev1.ProtocolUDP, intstr.FromInt(dnsPort)),
+				networkPolicyPort(corev1.ProtocolTCP, intstr.FromInt(dnsPort)),
+			},
+		},
+		{
+			To: []networkingv1.NetworkPolicyPeer{
+				{PodSelector: lmPeerSelector(cr)},
+			},
+		},
+		{
+			Ports: ports,
+			To:    backendPeers,
+		},
+	}
+	// Kibana is reached on the HTTPS port, which is only opened to the peers Kibana is known to run as
+	if peers := kibanaPeers(settings); len(peers) > 0 {
+		egress = append(egress, networkingv1.NetworkPolicyEgressRule{
+			Ports: []networkingv1.NetworkPolicyPort{networkPolicyPort(corev1.ProtocolTCP, intstr.FromInt(kibanaPort))},
+			To:    peers,
+		})
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      egressNetworkPolicyName(cr),
+			Namespace: cr.Namespace,
+			Labels:    almLabels(cr),
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: lmPodSelector(cr),
+			Egress:      append(egress, extraEgressRules(settings)...),
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+		},
+	}
+}
+
+// buildServiceNetworkPolicy allows traffic to an LM service from the other LM services, which find it through
+// conductor's Eureka registry, and from outside the namespace if it is exposed. Services exposed through an ingress are
+// reached from the ingress controller, NodePort and LoadBalancer Services from anywhere.
+func buildServiceNetworkPolicy(cr *comv1alpha1.ALM, service serviceDeploymentInfo) (*networkingv1.NetworkPolicy, error) {
+	settings := cr.Spec.NetworkPolicies
+
+	serviceType, err := serviceType(service)
+	if err != nil {
+		return nil, err
+	}
+
+	ingress := []networkingv1.NetworkPolicyIngressRule{
+		{
+			Ports: servicePolicyPorts(service),
+			From: []networkingv1.NetworkPolicyPeer{
+				{PodSelector: lmPeerSelector(cr)},
+			},
+		},
+	}
+	httpPort := []networkingv1.NetworkPolicyPort{networkPolicyPort(corev1.ProtocolTCP, intstr.FromInt(int(service.port)))}
+	if serviceType != corev1.ServiceTypeClusterIP {
+		ingress = append(ingress, networkingv1.NetworkPolicyIngressRule{Ports: servicePolicyPorts(service)})
+	} else if exposedServices(cr)[service.serviceName] {
+		var peers []networkingv1.NetworkPolicyPeer
+		for _, peer := range settings.IngressControllerPeers {
+			peers = append(peers, *peer.DeepCopy())
+		}
+		ingress = append(ingress, networkingv1.NetworkPolicyIngressRule{Ports: httpPort, From: peers})
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      networkPolicyName(cr, service.serviceName),
+			Namespace: cr.Namespace,
+			Labels:    lmLabels(service),
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: lmSelector(service),
+			},
+			Ingress:     append(ingress, extraIngressRules(settings)...),
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+		},
+	}, nil
+}
+
+// buildNetworkPolicies returns the NetworkPolicies of the LM pods, one per LM service in the deployment info
+func buildNetworkPolicies(cr *comv1alpha1.ALM, deploymentInfo deploymentInfo) ([]*networkingv1.NetworkPolicy, error) {
+	policies := []*networkingv1.NetworkPolicy{buildDefaultDenyNetworkPolicy(cr), buildEgressNetworkPolicy(cr)}
+	for _, service := range deploymentInfo.services() {
+		policy, err := buildServiceNetworkPolicy(cr, service)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+
+	return policies, nil
+}
+
+// networkPolicy creates a NetworkPolicy or brings one owned by the ALM in line with the spec
+func (r *ReconcileALM) networkPolicy(cr *comv1alpha1.ALM, desired *networkingv1.NetworkPolicy, reqLogger logr.Logger) error {
+	found := &networkingv1.NetworkPolicy{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: desired.Name, Namespace: cr.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		if err := controllerutil.SetControllerReference(cr, desired, r.scheme); err != nil {
+			return err
+		}
+
+		reqLogger.Info(fmt.Sprintf("Creating NetworkPolicy %s", desired.Name), "Namespace", cr.Namespace, "Name", desired.Name)
+		return r.client.Create(context.TODO(), desired)
+	} else if err != nil {
+		return err
+	}
+
+	if !metav1.IsControlledBy(found, cr) {
+		// the pods of the ALM would be left unrestricted, so the conflict is reported rather than ignored
+		message := fmt.Sprintf("NetworkPolicy %s exists and is not owned by the ALM, the LM pods are not restricted by it", desired.Name)
+		r.recorder.Event(cr, corev1.EventTypeWarning, "NetworkPolicyConflict", message)
+		return fmt.Errorf("%s", message)
+	}
+	labelsChanged := addLabels(&found.Labels, desired.Labels)
+	if !labelsChanged && reflect.DeepEqual(found.Spec, desired.Spec) {
+		return nil
+	}
+
+	reqLogger.Info(fmt.Sprintf("Updating NetworkPolicy %s", desired.Name), "Namespace", cr.Namespace, "Name", desired.Name)
+	found.Spec = desired.Spec
+	return r.client.Update(context.TODO(), found)
+}
+
+// removeNetworkPolicy deletes a NetworkPolicy owned by the ALM
+func (r *ReconcileALM) removeNetworkPolicy(cr *comv1alpha1.ALM, name string, reqLogger logr.Logger) error {
+	found := &networkingv1.NetworkPolicy{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, found)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !metav1.IsControlledBy(found, cr) {
+		return nil
+	}
+
+	reqLogger.Info(fmt.Sprintf("Deleting NetworkPolicy %s", name), "Namespace", cr.Namespace, "Name", name)
+	if err := r.client.Delete(context.TODO(), found); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// networkPolicies restricts the traffic of the LM pods to what LM needs when enabled in the spec, and otherwise
+// deletes the NetworkPolicies the operator created
+func (r *ReconcileALM) networkPolicies(cr *comv1alpha1.ALM, deploymentInfo deploymentInfo, reqLogger logr.Logger) error {
+	var policies []*networkingv1.NetworkPolicy
+	if cr.Spec.NetworkPolicies.Enabled {
+		var err error
+		policies, err = buildNetworkPolicies(cr, deploymentInfo)
+		if err != nil {
+			return err
+		}
+	}
+
+	desired := make(map[string]bool)
+	for _, policy := range policies {
+		desired[policy.Name] = true
+		if err := r.networkPolicy(cr, policy, reqLogger); err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to reconcile NetworkPolicy %s", policy.Name), "Namespace", cr.Namespace, "Name", policy.Name, "Error", err)
+			return err
+		}
+	}
+
+	// those named by earlier versions of the operator are replaced by the ones scoped to the ALM
+	names := []string{defaultDenyNetworkPolicyName(cr), egressNetworkPolicyName(cr)}
+	for _, service := range deploymentInfo.services() {
+		names = append(names, networkPolicyName(cr, service.serviceName))
+	}
+	for _, name := range append(names, legacyNetworkPolicyNames(deploymentInfo)...) {
+		if desired[name] {
+			continue
+		}
+		if err := r.removeNetworkPolicy(cr, name, reqLogger); err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to delete NetworkPolicy %s", name), "Namespace", cr.Namespace, "Name", name, "Error", err)
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package alm
+
+import (
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNetworkPolicyNames(t *testing.T) {
+	cr := almForTest()
+	for _, test := range []struct{ got, want string }{
+		{defaultDenyNetworkPolicyName(cr), "awesome-lm-default-deny"},
+		{egressNetworkPolicyName(cr), "awesome-lm-egress"},
+		{networkPolicyName(cr, "ishtar"), "awesome-ishtar-network-policy"},
+	} {
+		if test.got != test.want {
+			t.Errorf("name = %q, want %q", test.got, test.want)
+		}
+	}
+}
+
+func TestKibanaPeers(t *testing.T) {
+	backend := networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "foundation"}}}
+	kibana := networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: "10.1.0.0/16"}}
+
+	cr := almForTest()
+	if peers := kibanaPeers(cr.Spec.NetworkPolicies); len(peers) != 0 {
+		t.Errorf("kibanaPeers() = %+v, want none when no peers are set", peers)
+	}
+	cr.Spec.NetworkPolicies.BackendPeers = []networkingv1.NetworkPolicyPeer{backend}
+	if peers := kibanaPeers(cr.Spec.NetworkPolicies); len(peers) != 1 || peers[0].PodSelector == nil {
+		t.Errorf("kibanaPeers() = %+v, want the backend peers", peers)
+	}
+	cr.Spec.NetworkPolicies.KibanaPeers = []networkingv1.NetworkPolicyPeer{kibana}
+	if peers := kibanaPeers(cr.Spec.NetworkPolicies); len(peers) != 1 || peers[0].IPBlock == nil {
+		t.Errorf("kibanaPeers() = %+v, want the Kibana peers", peers)
+	}
+}
+
+// kibanaRule returns the egress rule opening the Kibana port, if any
+func kibanaRule(policy *networkingv1.NetworkPolicy) *networkingv1.NetworkPolicyEgressRule {
+	for i, rule := range policy.Spec.Egress {
+		for _, port := range rule.Ports {
+			if port.Port != nil && port.Port.IntValue() == kibanaPort {
+				return &policy.Spec.Egress[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestBuildEgressNetworkPolicy(t *testing.T) {
+	cr := almForTest()
+	policy := buildEgressNetworkPolicy(cr)
+	if policy.Name != "awesome-lm-egress" || policy.Namespace != "lm" {
+		t.Errorf("policy = %s/%s, want lm/awesome-lm-egress", policy.Namespace, policy.Name)
+	}
+	if policy.Spec.PodSelector.MatchLabels[instanceLabel] != "awesome" {
+		t.Errorf("pod selector = %+v, want the pods of the ALM", policy.Spec.PodSelector)
+	}
+	if rule := kibanaRule(policy); rule != nil {
+		t.Errorf("Kibana rule = %+v, want HTTPS egress not allowed without peers", rule)
+	}
+
+	cr.Spec.NetworkPolicies.KibanaPeers = []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.1.0.0/16"}}}
+	rule := kibanaRule(buildEgressNetworkPolicy(cr))
+	if rule == nil || len(rule.To) != 1 || rule.To[0].IPBlock.CIDR != "10.1.0.0/16" {
+		t.Errorf("Kibana rule = %+v, want HTTPS egress to the Kibana peers only", rule)
+	}
+}
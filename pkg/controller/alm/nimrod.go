@@ -46,7 +46,6 @@ func (r *ReconcileALM) installNimrod(cr *comv1alpha1.ALM, service nimrodServiceD
 	cmName := fmt.Sprintf("%s-%s-cm", cr.Name, service.serviceName)
 
 	// Check if this Deployment already exists
-	// deploymentName := fmt.Sprintf("%s-%s", cr.Name, service.serviceName)
 	deploymentName := service.serviceName
 	found, err := r.deploymentExists(cr, service.serviceDeploymentInfo)
 	if err != nil {
@@ -85,6 +84,7 @@ func (r *ReconcileALM) installNimrod(cr *comv1alpha1.ALM, service nimrodServiceD
 				ObjectMeta: metav1.ObjectMeta{
 					Namespace: cr.Namespace,
 					Name:      cmName,
+					Labels:    lmLabels(service.serviceDeploymentInfo),
 				},
 				Data: data,
 			}
@@ -124,7 +124,7 @@ func (r *ReconcileALM) installNimrod(cr *comv1alpha1.ALM, service nimrodServiceD
 					Name: "lm-keystore",
 					VolumeSource: corev1.VolumeSource{
 						Secret: &corev1.SecretVolumeSource{
-							SecretName: "lm-keystore",
+							SecretName: lmKeystoreSecretName(cr),
 						},
 					},
 				})
@@ -193,35 +193,29 @@ func (r *ReconcileALM) installNimrod(cr *comv1alpha1.ALM, service nimrodServiceD
 				})
 		}
 
-		deployment := buildDeployment(cr.Namespace, deploymentName, cr, service.serviceDeploymentInfo,
+		deployment, err := buildDeployment(cr.Namespace, deploymentName, cr, service.serviceDeploymentInfo,
 			volumeMounts, volumes)
-
-		if err := controllerutil.SetControllerReference(cr, deployment, r.scheme); err != nil {
+		if err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to build a new %s Deployment", service.serviceName), "Namespace", cr.Namespace, "Name", deploymentName, "Error", err)
+			r.recorder.Event(cr, corev1.EventTypeWarning, "InvalidPodTemplate", err.Error())
 			return reconcile.Result{}, err
 		}
 
-		err = r.client.Create(context.TODO(), deployment)
-		if err != nil {
-			reqLogger.Info(fmt.Sprintf("Failed to create a new %s Deployment", service.serviceName), "Namespace", cr.Namespace, "Name", deploymentName, "Error", err)
+		if _, err := r.applyConfigChecksum(cr, &deployment.Spec.Template); err != nil {
 			return reconcile.Result{}, err
 		}
 
-		reqLogger.Info(fmt.Sprintf("Created a new %s Deployment", service.serviceName), "Namespace", cr.Namespace, "Name", deploymentName)
-
-		ingressName := "nimrod-ingress"
-		ingress := buildIngress(cr.Spec.Secure, cr.Namespace, ingressName, "ui.lm", 8290, "nimrod", "nimrod-tls")
-
-		if err := controllerutil.SetControllerReference(cr, ingress, r.scheme); err != nil {
+		if err := controllerutil.SetControllerReference(cr, deployment, r.scheme); err != nil {
 			return reconcile.Result{}, err
 		}
 
-		err = r.client.Create(context.TODO(), ingress)
+		err = r.writeWorkload(cr, deployment, service.serviceDeploymentInfo, true)
 		if err != nil {
-			reqLogger.Info(fmt.Sprintf("Failed to create a new %s Ingress", service.serviceName), "Namespace", cr.Namespace, "Name", ingressName, "Error", err)
+			reqLogger.Info(fmt.Sprintf("Failed to create a new %s Deployment", service.serviceName), "Namespace", cr.Namespace, "Name", deploymentName, "Error", err)
 			return reconcile.Result{}, err
 		}
 
-		reqLogger.Info(fmt.Sprintf("Created a new %s Ingress", ingressName), "Namespace", cr.Namespace, "Name", ingressName)
+		reqLogger.Info(fmt.Sprintf("Created a new %s Deployment", service.serviceName), "Namespace", cr.Namespace, "Name", deploymentName)
 
 		// Created successfully - don't requeue and create service
 	} else if err != nil {
@@ -0,0 +1,283 @@
+package alm
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// seccompPodAnnotation selects the seccomp profile of a pod on clusters that predate the seccompProfile field, from
+	// which the API server sets the field when a pod is created. Later clusters ignore it.
+	seccompPodAnnotation  = "seccomp.security.alpha.kubernetes.io/pod"
+	seccompRuntimeDefault = "runtime/default"
+	// seccompProfileMinorVersion is the minor version of Kubernetes 1.x from which pods hold the seccompProfile field
+	seccompProfileMinorVersion = 19
+
+	// writableVolumePrefix names the emptyDir volumes mounted at the writable paths of a read only root filesystem
+	writableVolumePrefix = "writable-"
+
+	defaultPodUser = int64(1000)
+)
+
+// defaultWritablePaths are written to by every LM service
+var defaultWritablePaths = []string{"/tmp", "/var/lm/logs"}
+
+// lmWritablePaths are the paths written to by individual LM services
+var lmWritablePaths = map[string][]string{
+	"nimrod": {"/var/lm/themes", "/var/lm/locales"},
+}
+
+type podSecuritySettings struct {
+	restricted             bool
+	runAsUser              int64
+	runAsGroup             int64
+	fsGroup                int64
+	readOnlyRootFilesystem bool
+	writablePaths          []string
+	// the cluster holds the seccompProfile field, rather than the annotation
+	seccompProfile bool
+}
+
+// getPodSecuritySettings returns the security settings of an LM service's pods, fields set on the service overriding
+// those set for all of them. The restricted settings are opted into, as pods of an existing ALM would otherwise be
+// replaced running as another user with a read only root filesystem when the operator is upgraded.
+func getPodSecuritySettings(serviceName string, global comv1alpha1.PodSecuritySpec, spec comv1alpha1.PodSecuritySpec) podSecuritySettings {
+	settings := podSecuritySettings{
+		restricted:             false,
+		runAsUser:              defaultPodUser,
+		runAsGroup:             defaultPodUser,
+		fsGroup:                defaultPodUser,
+		readOnlyRootFilesystem: true,
+	}
+
+	for _, s := range []comv1alpha1.PodSecuritySpec{global, spec} {
+		if s.Restricted != nil {
+			settings.restricted = *s.Restricted
+		}
+		if s.RunAsUser != nil {
+			settings.runAsUser = *s.RunAsUser
+		}
+		if s.RunAsGroup != nil {
+			settings.runAsGroup = *s.RunAsGroup
+		}
+		if s.FSGroup != nil {
+			settings.fsGroup = *s.FSGroup
+		}
+		if s.ReadOnlyRootFilesystem != nil {
+			settings.readOnlyRootFilesystem = *s.ReadOnlyRootFilesystem
+		}
+	}
+
+	if settings.restricted && settings.readOnlyRootFilesystem {
+		for _, paths := range [][]string{defaultWritablePaths, lmWritablePaths[serviceName], global.WritablePaths, spec.WritablePaths} {
+			for _, path := range paths {
+				if !containsString(settings.writablePaths, path) {
+					settings.writablePaths = append(settings.writablePaths, path)
+				}
+			}
+		}
+	}
+
+	return settings
+}
+
+// buildSecurityContexts returns the pod and container security contexts meeting the restricted Pod Security Standard,
+// or empty ones matching what the API server stores for pods without them
+func buildSecurityContexts(settings podSecuritySettings) (*corev1.PodSecurityContext, *corev1.SecurityContext) {
+	if !settings.restricted {
+		return &corev1.PodSecurityContext{}, nil
+	}
+
+	runAsNonRoot := true
+	allowPrivilegeEscalation := false
+	readOnlyRootFilesystem := settings.readOnlyRootFilesystem
+
+	podSecurityContext := &corev1.PodSecurityContext{
+		RunAsNonRoot: &runAsNonRoot,
+		RunAsUser:    int64Ptr(settings.runAsUser),
+		RunAsGroup:   int64Ptr(settings.runAsGroup),
+		FSGroup:      int64Ptr(settings.fsGroup),
+	}
+	containerSecurityContext := &corev1.SecurityContext{
+		RunAsNonRoot:             &runAsNonRoot,
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+	}
+
+	return podSecurityContext, containerSecurityContext
+}
+
+var invalidVolumeNameChars = regexp.MustCompile("[^a-z0-9]+")
+
+// writableVolumeName derives the name of the emptyDir volume mounted at a writable path, such as writable-var-lm-logs
+func writableVolumeName(path string) string {
+	name := writableVolumePrefix + strings.Trim(invalidVolumeNameChars.ReplaceAllString(strings.ToLower(path), "-"), "-")
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+
+	return name
+}
+
+// applyWritablePaths mounts an emptyDir at each writable path not already mounted by the pod, such as the themes
+// unpacked by nimrod or a persistent volume, and removes those mounted at paths that are no longer writable
+func applyWritablePaths(podSpec *corev1.PodSpec, paths []string) bool {
+	changed := false
+	wanted := make(map[string]bool)
+
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+
+		mounted := make(map[string]bool)
+		for _, mount := range container.VolumeMounts {
+			if !strings.HasPrefix(mount.Name, writableVolumePrefix) {
+				mounted[mount.MountPath] = true
+			}
+		}
+		desired := make(map[string]string)
+		for _, path := range paths {
+			if !mounted[path] {
+				desired[writableVolumeName(path)] = path
+			}
+		}
+
+		var mounts []corev1.VolumeMount
+		kept := make(map[string]bool)
+		for _, mount := range container.VolumeMounts {
+			if strings.HasPrefix(mount.Name, writableVolumePrefix) {
+				if desired[mount.Name] != mount.MountPath || kept[mount.Name] {
+					changed = true
+					continue
+				}
+				kept[mount.Name] = true
+			}
+			mounts = append(mounts, mount)
+		}
+		for _, path := range paths {
+			name := writableVolumeName(path)
+			if desired[name] == path && !kept[name] {
+				kept[name] = true
+				mounts = append(mounts, corev1.VolumeMount{Name: name, MountPath: path})
+				changed = true
+			}
+		}
+		container.VolumeMounts = mounts
+
+		for name := range kept {
+			wanted[name] = true
+		}
+	}
+
+	var volumes []corev1.Volume
+	present := make(map[string]bool)
+	for _, volume := range podSpec.Volumes {
+		if strings.HasPrefix(volume.Name, writableVolumePrefix) {
+			if !wanted[volume.Name] {
+				changed = true
+				continue
+			}
+			present[volume.Name] = true
+		}
+		volumes = append(volumes, volume)
+	}
+	for _, path := range paths {
+		name := writableVolumeName(path)
+		if wanted[name] && !present[name] {
+			present[name] = true
+			volumes = append(volumes, corev1.Volume{
+				Name: name,
+				VolumeSource: corev1.VolumeSource{
+					EmptyDir: &corev1.EmptyDirVolumeSource{},
+				},
+			})
+			changed = true
+		}
+	}
+	podSpec.Volumes = volumes
+
+	return changed
+}
+
+// applyPodSecurity runs the pods of an LM service as its ServiceAccount with the security settings in the spec. It
+// returns true if the pod template changed.
+func applyPodSecurity(template *corev1.PodTemplateSpec, service serviceDeploymentInfo) bool {
+	changed := false
+	podSpec := &template.Spec
+
+	if podSpec.ServiceAccountName != service.serviceAccount.name {
+		podSpec.ServiceAccountName = service.serviceAccount.name
+		podSpec.DeprecatedServiceAccount = ""
+		changed = true
+	}
+	automount := service.serviceAccount.automount
+	if podSpec.AutomountServiceAccountToken == nil || *podSpec.AutomountServiceAccountToken != automount {
+		podSpec.AutomountServiceAccountToken = &automount
+		changed = true
+	}
+
+	podSecurityContext, containerSecurityContext := buildSecurityContexts(service.podSecurity)
+	if !reflect.DeepEqual(podSpec.SecurityContext, podSecurityContext) {
+		podSpec.SecurityContext = podSecurityContext
+		changed = true
+	}
+	for i := range podSpec.Containers {
+		if !reflect.DeepEqual(podSpec.Containers[i].SecurityContext, containerSecurityContext) {
+			podSpec.Containers[i].SecurityContext = containerSecurityContext.DeepCopy()
+			changed = true
+		}
+	}
+
+	// the seccompProfile field is set by setSeccompProfile, as the Kubernetes API the operator is built against
+	// cannot hold it
+	annotated := service.podSecurity.restricted && !service.podSecurity.seccompProfile
+	if annotated && template.Annotations[seccompPodAnnotation] != seccompRuntimeDefault {
+		if template.Annotations == nil {
+			template.Annotations = make(map[string]string)
+		}
+		template.Annotations[seccompPodAnnotation] = seccompRuntimeDefault
+		changed = true
+	} else if !annotated && template.Annotations[seccompPodAnnotation] == seccompRuntimeDefault {
+		delete(template.Annotations, seccompPodAnnotation)
+		changed = true
+	}
+
+	if applyWritablePaths(podSpec, service.podSecurity.writablePaths) {
+		changed = true
+	}
+
+	return changed
+}
+
+// setSeccompProfile sets the RuntimeDefault seccomp profile in the pod template of a Deployment, StatefulSet or Job
+// with restricted settings on clusters that hold the seccompProfile field, or removes the profile it set otherwise. It
+// returns true if anything changed.
+func setSeccompProfile(object *unstructured.Unstructured, settings podSecuritySettings) (bool, error) {
+	path := []string{"spec", "template", "spec", "securityContext", "seccompProfile"}
+	current, set, err := unstructured.NestedMap(object.Object, path...)
+	if err != nil {
+		return false, err
+	}
+
+	desired := map[string]interface{}{"type": "RuntimeDefault"}
+	if !settings.restricted || !settings.seccompProfile {
+		// a profile set by others is left alone, as with the annotation
+		if !set || !reflect.DeepEqual(current, desired) {
+			return false, nil
+		}
+		unstructured.RemoveNestedField(object.Object, path...)
+		return true, nil
+	}
+	if set && reflect.DeepEqual(current, desired) {
+		return false, nil
+	}
+
+	return true, unstructured.SetNestedMap(object.Object, desired, path...)
+}
@@ -0,0 +1,94 @@
+package alm
+
+import (
+	"reflect"
+	"testing"
+
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestGetPodSecuritySettings(t *testing.T) {
+	restricted, unrestricted, writable := true, false, false
+	user := int64(1001)
+
+	tests := []struct {
+		name   string
+		global comv1alpha1.PodSecuritySpec
+		spec   comv1alpha1.PodSecuritySpec
+		want   podSecuritySettings
+	}{
+		{"unset", comv1alpha1.PodSecuritySpec{}, comv1alpha1.PodSecuritySpec{},
+			podSecuritySettings{runAsUser: 1000, runAsGroup: 1000, fsGroup: 1000, readOnlyRootFilesystem: true}},
+		{"restricted", comv1alpha1.PodSecuritySpec{Restricted: &restricted}, comv1alpha1.PodSecuritySpec{},
+			podSecuritySettings{restricted: true, runAsUser: 1000, runAsGroup: 1000, fsGroup: 1000, readOnlyRootFilesystem: true,
+				writablePaths: []string{"/tmp", "/var/lm/logs", "/var/lm/themes", "/var/lm/locales"}}},
+		{"service overrides", comv1alpha1.PodSecuritySpec{Restricted: &restricted, RunAsUser: &user}, comv1alpha1.PodSecuritySpec{ReadOnlyRootFilesystem: &writable},
+			podSecuritySettings{restricted: true, runAsUser: 1001, runAsGroup: 1000, fsGroup: 1000}},
+		{"service opts out", comv1alpha1.PodSecuritySpec{Restricted: &restricted}, comv1alpha1.PodSecuritySpec{Restricted: &unrestricted},
+			podSecuritySettings{runAsUser: 1000, runAsGroup: 1000, fsGroup: 1000, readOnlyRootFilesystem: true}},
+	}
+	for _, test := range tests {
+		if got := getPodSecuritySettings("nimrod", test.global, test.spec); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: getPodSecuritySettings() = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSetSeccompProfile(t *testing.T) {
+	runtimeDefault := map[string]interface{}{"type": "RuntimeDefault"}
+	localhost := map[string]interface{}{"type": "Localhost", "localhostProfile": "lm.json"}
+	workload := func(profile map[string]interface{}) *unstructured.Unstructured {
+		object := &unstructured.Unstructured{Object: map[string]interface{}{}}
+		if profile != nil {
+			if err := unstructured.SetNestedMap(object.Object, profile, "spec", "template", "spec", "securityContext", "seccompProfile"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return object
+	}
+
+	tests := []struct {
+		name        string
+		current     map[string]interface{}
+		settings    podSecuritySettings
+		want        map[string]interface{}
+		wantChanged bool
+	}{
+		{"restricted", nil, podSecuritySettings{restricted: true, seccompProfile: true}, runtimeDefault, true},
+		{"already set", runtimeDefault, podSecuritySettings{restricted: true, seccompProfile: true}, runtimeDefault, false},
+		{"cluster without the field", nil, podSecuritySettings{restricted: true}, nil, false},
+		{"no longer restricted", runtimeDefault, podSecuritySettings{seccompProfile: true}, nil, true},
+		{"set by others", localhost, podSecuritySettings{seccompProfile: true}, localhost, false},
+	}
+	for _, test := range tests {
+		object := workload(test.current)
+		changed, err := setSeccompProfile(object, test.settings)
+		if err != nil || changed != test.wantChanged {
+			t.Errorf("%s: setSeccompProfile() = %v, %v, want %v", test.name, changed, err, test.wantChanged)
+		}
+		got, _, _ := unstructured.NestedMap(object.Object, "spec", "template", "spec", "securityContext", "seccompProfile")
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: seccompProfile = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestApplyPodSecuritySeccompAnnotation(t *testing.T) {
+	service := serviceDeploymentInfo{serviceName: "ishtar", podSecurity: podSecuritySettings{restricted: true}}
+	template := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "ishtar"}}}}
+
+	applyPodSecurity(template, service)
+	if template.Annotations[seccompPodAnnotation] != seccompRuntimeDefault {
+		t.Errorf("%s = %q, want the profile annotated on clusters without the field", seccompPodAnnotation, template.Annotations[seccompPodAnnotation])
+	}
+
+	service.podSecurity.seccompProfile = true
+	if !applyPodSecurity(template, service) {
+		t.Errorf("applyPodSecurity() = false, want the annotation removed")
+	}
+	if _, annotated := template.Annotations[seccompPodAnnotation]; annotated {
+		t.Errorf("%s left set on a cluster holding the seccompProfile field", seccompPodAnnotation)
+	}
+}
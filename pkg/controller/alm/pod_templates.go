@@ -0,0 +1,104 @@
+package alm
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// podTemplateAnnotation records the partial pod template last merged into an LM service's pod template, so that
+// entries removed from the spec are removed from the pods too
+const podTemplateAnnotation = "com.accantosystems.stratoss/pod-template"
+
+// getPodTemplatePatch combines the partial pod templates for all LM services and for a single one, the latter taking
+// precedence, and checks the result can be merged into an empty pod template. Whether it merges into an LM service's
+// own pod template is only known once that is built. It returns nil if neither is set.
+func getPodTemplatePatch(serviceName string, global *runtime.RawExtension, spec *runtime.RawExtension) ([]byte, error) {
+	var patch []byte
+	for _, raw := range []*runtime.RawExtension{global, spec} {
+		if raw == nil || len(raw.Raw) == 0 {
+			continue
+		}
+		if patch == nil {
+			patch = raw.Raw
+			continue
+		}
+
+		merged, err := strategicpatch.StrategicMergePatch(patch, raw.Raw, corev1.PodTemplateSpec{})
+		if err != nil {
+			return nil, fmt.Errorf("Invalid podTemplate for %s: %s", serviceName, err)
+		}
+		patch = merged
+	}
+
+	if patch != nil {
+		if _, err := strategicpatch.StrategicMergePatch([]byte("{}"), patch, corev1.PodTemplateSpec{}); err != nil {
+			return nil, fmt.Errorf("Invalid podTemplate for %s: %s", serviceName, err)
+		}
+	}
+
+	return patch, nil
+}
+
+// applyPodTemplate strategically merges the partial pod template in the spec into an LM service's pod template, the
+// way kubectl apply does: entries merged before but since removed from the spec are removed, and entries the operator
+// sets that the spec does not mention are left alone. It returns true if the pod template changed.
+func applyPodTemplate(template *corev1.PodTemplateSpec, patch []byte) (bool, error) {
+	lastApplied, applied := template.Annotations[podTemplateAnnotation]
+	if patch == nil && !applied {
+		return false, nil
+	}
+
+	original := []byte("{}")
+	if applied {
+		original = []byte(lastApplied)
+	}
+	modified := []byte("{}")
+	if patch != nil {
+		modified = patch
+	}
+
+	current, err := json.Marshal(template)
+	if err != nil {
+		return false, err
+	}
+	patchMeta, err := strategicpatch.NewPatchMetaFromStruct(corev1.PodTemplateSpec{})
+	if err != nil {
+		return false, err
+	}
+	diff, err := strategicpatch.CreateThreeWayMergePatch(original, modified, current, patchMeta, true)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	if string(diff) != "{}" {
+		merged, err := strategicpatch.StrategicMergePatch(current, diff, corev1.PodTemplateSpec{})
+		if err != nil {
+			return false, err
+		}
+		result := corev1.PodTemplateSpec{}
+		if err := json.Unmarshal(merged, &result); err != nil {
+			return false, err
+		}
+		*template = result
+		changed = true
+	}
+
+	if patch == nil {
+		delete(template.Annotations, podTemplateAnnotation)
+		return true, nil
+	}
+	if lastApplied != string(patch) {
+		if template.Annotations == nil {
+			template.Annotations = make(map[string]string)
+		}
+		template.Annotations[podTemplateAnnotation] = string(patch)
+		changed = true
+	}
+
+	return changed, nil
+}
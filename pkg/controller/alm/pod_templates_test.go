@@ -0,0 +1,137 @@
+package alm
+
+import (
+	"encoding/json"
+	"testing"
+
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// almForTest returns an ALM named awesome in the lm namespace
+func almForTest() *comv1alpha1.ALM {
+	return &comv1alpha1.ALM{
+		ObjectMeta: metav1.ObjectMeta{Name: "awesome", Namespace: "lm", UID: "d2b1c5f0-0000-4000-8000-000000000001"},
+		Spec:       comv1alpha1.ALMSpec{DockerRepo: "accanto"},
+	}
+}
+
+func rawPodTemplate(t *testing.T, template corev1.PodTemplateSpec) *runtime.RawExtension {
+	raw, err := json.Marshal(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &runtime.RawExtension{Raw: raw}
+}
+
+func TestGetPodTemplatePatch(t *testing.T) {
+	global := rawPodTemplate(t, corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "ishtar", Env: []corev1.EnvVar{{Name: "A", Value: "global"}}}},
+	}})
+	service := rawPodTemplate(t, corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "ishtar", Env: []corev1.EnvVar{{Name: "A", Value: "ishtar"}, {Name: "B", Value: "ishtar"}}}},
+	}})
+
+	patch, err := getPodTemplatePatch("ishtar", nil, nil)
+	if err != nil || patch != nil {
+		t.Errorf("getPodTemplatePatch() = %s, %v, want no patch when neither is set", patch, err)
+	}
+
+	patch, err = getPodTemplatePatch("ishtar", global, service)
+	if err != nil {
+		t.Fatalf("getPodTemplatePatch() error = %v", err)
+	}
+	merged := corev1.PodTemplateSpec{}
+	if err := json.Unmarshal(patch, &merged); err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Spec.Containers) != 1 {
+		t.Fatalf("containers = %+v, want ishtar merged by name", merged.Spec.Containers)
+	}
+	env := map[string]string{}
+	for _, envVar := range merged.Spec.Containers[0].Env {
+		env[envVar.Name] = envVar.Value
+	}
+	if env["A"] != "ishtar" || env["B"] != "ishtar" {
+		t.Errorf("env = %v, want the service's pod template to take precedence", env)
+	}
+
+	if _, err := getPodTemplatePatch("ishtar", &runtime.RawExtension{Raw: []byte(`{"spec": "containers"}`)}, nil); err == nil {
+		t.Errorf("getPodTemplatePatch() error = nil, want an invalid pod template reported")
+	}
+}
+
+func TestApplyPodTemplate(t *testing.T) {
+	template := &corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "ishtar", Image: "accanto/ishtar:2.0.0"}}}}
+	patch, err := json.Marshal(corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{
+			{Name: "ishtar", Env: []corev1.EnvVar{{Name: "JMX", Value: "true"}}},
+			{Name: "log-shipper", Image: "fluent-bit:1.0"},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := applyPodTemplate(template, patch)
+	if err != nil || !changed {
+		t.Fatalf("applyPodTemplate() = %v, %v, want the pod template merged", changed, err)
+	}
+	if len(template.Spec.Containers) != 2 || template.Spec.Containers[0].Image != "accanto/ishtar:2.0.0" || len(template.Spec.Containers[0].Env) != 1 {
+		t.Errorf("containers = %+v, want ishtar extended and the sidecar added", template.Spec.Containers)
+	}
+	if template.Annotations[podTemplateAnnotation] != string(patch) {
+		t.Errorf("%s = %q, want the merged pod template recorded", podTemplateAnnotation, template.Annotations[podTemplateAnnotation])
+	}
+
+	changed, err = applyPodTemplate(template, patch)
+	if err != nil || changed {
+		t.Errorf("applyPodTemplate() = %v, %v, want an already merged pod template left alone", changed, err)
+	}
+
+	changed, err = applyPodTemplate(template, nil)
+	if err != nil || !changed {
+		t.Fatalf("applyPodTemplate() = %v, %v, want the pod template removed", changed, err)
+	}
+	if len(template.Spec.Containers) != 1 || len(template.Spec.Containers[0].Env) != 0 {
+		t.Errorf("containers = %+v, want the merged entries removed", template.Spec.Containers)
+	}
+	if _, applied := template.Annotations[podTemplateAnnotation]; applied {
+		t.Errorf("%s left set", podTemplateAnnotation)
+	}
+}
+
+func TestBuildDeploymentAppliesTrustedCAToSidecars(t *testing.T) {
+	patch, err := json.Marshal(corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "log-shipper", Image: "fluent-bit:1.0"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := trustedCAService(true)
+	service.instance = "awesome"
+	service.imageName = "ishtar"
+	service.imageVersion = "2.0.0"
+	service.cpuRequests = "100m"
+	service.memoryRequests = "256Mi"
+	service.podTemplate = patch
+
+	deployment, err := buildDeployment("lm", "ishtar", almForTest(), service, nil, nil)
+	if err != nil {
+		t.Fatalf("buildDeployment() error = %v", err)
+	}
+
+	// built the same way applySettings updates it, so that installed services are not rolled straight away
+	workload := &lmWorkload{deployment: deployment}
+	if changed, err := workload.applySettings(almForTest(), service); err != nil || changed {
+		t.Errorf("applySettings() = %v, %v, want a freshly built Deployment left alone", changed, err)
+	}
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		if value, _ := envValue(container, truststoreOptionsEnv); value != truststoreOptions() {
+			t.Errorf("%s: %s = %q, want the truststore options", container.Name, truststoreOptionsEnv, value)
+		}
+	}
+}
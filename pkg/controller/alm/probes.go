@@ -0,0 +1,344 @@
+package alm
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// lmHealthPath is the Spring actuator health endpoint of the LM services, which also checks the backing services
+	lmHealthPath = "/management/health"
+	// lmInfoPath is the Spring actuator info endpoint of the LM services, which answers as long as the JVM does, so
+	// that an outage of a backing service does not restart every LM service
+	lmInfoPath = "/management/info"
+
+	// startupProbeMinorVersion is the minor version of Kubernetes 1.x from which startup probes are run by default
+	startupProbeMinorVersion = 18
+)
+
+// default probe settings, the startup probe allows 5 minutes for the JVM to start
+var (
+	defaultLivenessProbe  = comv1alpha1.ProbeSpec{Path: lmInfoPath, PeriodSeconds: 10, TimeoutSeconds: 5, FailureThreshold: 3}
+	defaultReadinessProbe = comv1alpha1.ProbeSpec{Path: lmHealthPath, PeriodSeconds: 10, TimeoutSeconds: 5, FailureThreshold: 3}
+	defaultStartupProbe   = comv1alpha1.ProbeSpec{Path: lmInfoPath, PeriodSeconds: 10, TimeoutSeconds: 5, FailureThreshold: 30}
+)
+
+var (
+	deploymentResource  = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	statefulSetResource = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"}
+)
+
+// probeSettings returns the probe in the spec with unset fields taken from the defaults
+func probeSettings(spec comv1alpha1.ProbeSpec, defaults comv1alpha1.ProbeSpec) comv1alpha1.ProbeSpec {
+	settings := defaults
+	settings.Enabled = spec.Enabled
+	if spec.Path != "" {
+		settings.Path = spec.Path
+	}
+	if spec.InitialDelaySeconds > 0 {
+		settings.InitialDelaySeconds = spec.InitialDelaySeconds
+	}
+	if spec.PeriodSeconds > 0 {
+		settings.PeriodSeconds = spec.PeriodSeconds
+	}
+	if spec.TimeoutSeconds > 0 {
+		settings.TimeoutSeconds = spec.TimeoutSeconds
+	}
+	if spec.FailureThreshold > 0 {
+		settings.FailureThreshold = spec.FailureThreshold
+	}
+
+	return settings
+}
+
+func probeEnabled(settings comv1alpha1.ProbeSpec) bool {
+	return settings.Enabled == nil || *settings.Enabled
+}
+
+func buildProbe(secure bool, settings comv1alpha1.ProbeSpec) *corev1.Probe {
+	scheme := corev1.URISchemeHTTP
+	if secure {
+		scheme = corev1.URISchemeHTTPS
+	}
+
+	return &corev1.Probe{
+		Handler: corev1.Handler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path:   settings.Path,
+				Port:   intstr.FromString("http"),
+				Scheme: scheme,
+			},
+		},
+		InitialDelaySeconds: settings.InitialDelaySeconds,
+		PeriodSeconds:       settings.PeriodSeconds,
+		TimeoutSeconds:      settings.TimeoutSeconds,
+		SuccessThreshold:    1,
+		FailureThreshold:    settings.FailureThreshold,
+	}
+}
+
+// buildProbes returns the liveness and readiness probes of an LM service, nil if disabled.
+//
+// On clusters that do not run startup probes, the time the startup probe would allow for the JVM to start delays the
+// liveness probe instead, unless the liveness probe sets its own delay. Readiness is checked from the start, so
+// services are routed to as soon as they are ready.
+func buildProbes(secure bool, service serviceDeploymentInfo) (*corev1.Probe, *corev1.Probe) {
+	liveness := probeSettings(service.probes.Liveness, defaultLivenessProbe)
+	readiness := probeSettings(service.probes.Readiness, defaultReadinessProbe)
+	startup := probeSettings(service.probes.Startup, defaultStartupProbe)
+
+	if !service.startupProbes && probeEnabled(startup) && service.probes.Liveness.InitialDelaySeconds == 0 {
+		liveness.InitialDelaySeconds = startup.InitialDelaySeconds + startup.PeriodSeconds*startup.FailureThreshold
+	}
+
+	var livenessProbe, readinessProbe *corev1.Probe
+	if probeEnabled(liveness) {
+		livenessProbe = buildProbe(secure, liveness)
+	}
+	if probeEnabled(readiness) {
+		readinessProbe = buildProbe(secure, readiness)
+	}
+
+	return livenessProbe, readinessProbe
+}
+
+// buildStartupProbe returns the startup probe of an LM service, which holds off the liveness probe until the JVM has
+// started, nil if disabled or the cluster does not run startup probes
+func buildStartupProbe(secure bool, service serviceDeploymentInfo) *corev1.Probe {
+	startup := probeSettings(service.probes.Startup, defaultStartupProbe)
+	if !service.startupProbes || !probeEnabled(startup) {
+		return nil
+	}
+
+	return buildProbe(secure, startup)
+}
+
+// detectServerFeatures has the LM services given startup probes if the cluster runs them, and the seccomp profile of
+// the LM services and configurator set in the seccompProfile field if the cluster holds it
+func (r *ReconcileALM) detectServerFeatures(deploymentInfo *deploymentInfo) error {
+	startupProbes, err := r.serverVersionAtLeast(1, startupProbeMinorVersion)
+	if err != nil {
+		return err
+	}
+	seccompProfile, err := r.serverVersionAtLeast(1, seccompProfileMinorVersion)
+	if err != nil {
+		return err
+	}
+
+	for _, service := range deploymentInfo.servicePointers() {
+		service.startupProbes = startupProbes
+		service.podSecurity.seccompProfile = seccompProfile
+	}
+	deploymentInfo.configurator.podSecurity.seccompProfile = seccompProfile
+
+	return nil
+}
+
+// setStartupProbe sets the startup probe of a container of a Deployment or StatefulSet, or removes it if probe is nil.
+// It returns true if anything changed.
+func setStartupProbe(workload *unstructured.Unstructured, containerName string, probe *corev1.Probe) (bool, error) {
+	var desired map[string]interface{}
+	if probe != nil {
+		var err error
+		if desired, err = runtime.DefaultUnstructuredConverter.ToUnstructured(probe); err != nil {
+			return false, err
+		}
+	}
+
+	containers, _, err := unstructured.NestedSlice(workload.Object, "spec", "template", "spec", "containers")
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for i := range containers {
+		container, ok := containers[i].(map[string]interface{})
+		if !ok || container["name"] != containerName {
+			continue
+		}
+
+		current, set := container["startupProbe"]
+		switch {
+		case desired == nil && set:
+			delete(container, "startupProbe")
+			changed = true
+		case desired != nil && (!set || !containsValues(current, desired)):
+			container["startupProbe"] = desired
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	return true, unstructured.SetNestedSlice(workload.Object, containers, "spec", "template", "spec", "containers")
+}
+
+// setNewerFields sets the fields of an LM service's Deployment or StatefulSet that the Kubernetes API the operator is
+// built against cannot hold: the startup probe and the seccomp profile. It returns true if anything changed.
+func setNewerFields(workload *unstructured.Unstructured, cr *comv1alpha1.ALM, service serviceDeploymentInfo) (bool, error) {
+	probeChanged, err := setStartupProbe(workload, service.serviceName, buildStartupProbe(cr.Spec.Secure, service))
+	if err != nil {
+		return false, err
+	}
+	seccompChanged, err := setSeccompProfile(workload, service.podSecurity)
+	if err != nil {
+		return false, err
+	}
+
+	return probeChanged || seccompChanged, nil
+}
+
+// writeWorkload creates or updates the Deployment or StatefulSet of an LM service. It is written through the dynamic
+// client, with the fields that the Kubernetes API the operator is built against cannot hold.
+func (r *ReconcileALM) writeWorkload(cr *comv1alpha1.ALM, object runtime.Object, service serviceDeploymentInfo, create bool) error {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(object)
+	if err != nil {
+		return err
+	}
+	workload := &unstructured.Unstructured{Object: content}
+
+	resource := deploymentResource
+	workload.SetKind("Deployment")
+	if _, ok := object.(*appsv1.StatefulSet); ok {
+		resource = statefulSetResource
+		workload.SetKind("StatefulSet")
+	}
+	workload.SetAPIVersion(resource.GroupVersion().String())
+
+	if _, err := setNewerFields(workload, cr, service); err != nil {
+		return err
+	}
+
+	workloads := r.dynamicClient.Resource(resource).Namespace(workload.GetNamespace())
+	if create {
+		_, err = workloads.Create(workload, metav1.CreateOptions{})
+	} else {
+		_, err = workloads.Update(workload, metav1.UpdateOptions{})
+	}
+
+	return err
+}
+
+// updateWorkload updates a Deployment or StatefulSet read through the typed API, such as when it is adopted or
+// restarted. It is written through the dynamic client with the startup probe and seccomp profile of the stored object,
+// which the typed object cannot hold, so that the update does not remove them and roll the pods a second time when
+// they are added back.
+func (r *ReconcileALM) updateWorkload(workload *lmWorkload) error {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(workload.object())
+	if err != nil {
+		return err
+	}
+	updated := &unstructured.Unstructured{Object: content}
+
+	resource := deploymentResource
+	updated.SetKind("Deployment")
+	if workload.statefulSet != nil {
+		resource = statefulSetResource
+		updated.SetKind("StatefulSet")
+	}
+	updated.SetAPIVersion(resource.GroupVersion().String())
+
+	workloads := r.dynamicClient.Resource(resource).Namespace(updated.GetNamespace())
+	stored, err := workloads.Get(updated.GetName(), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if err := keepNewerFields(stored, updated); err != nil {
+		return err
+	}
+
+	_, err = workloads.Update(updated, metav1.UpdateOptions{})
+	return err
+}
+
+// keepNewerFields copies the startup probes and seccomp profile of a stored Deployment or StatefulSet to the same
+// containers of its update
+func keepNewerFields(stored *unstructured.Unstructured, updated *unstructured.Unstructured) error {
+	probes := make(map[string]interface{})
+	storedContainers, _, err := unstructured.NestedSlice(stored.Object, "spec", "template", "spec", "containers")
+	if err != nil {
+		return err
+	}
+	for _, c := range storedContainers {
+		if container, ok := c.(map[string]interface{}); ok && container["startupProbe"] != nil {
+			probes[fmt.Sprintf("%v", container["name"])] = container["startupProbe"]
+		}
+	}
+
+	containers, _, err := unstructured.NestedSlice(updated.Object, "spec", "template", "spec", "containers")
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		container, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if probe, set := probes[fmt.Sprintf("%v", container["name"])]; set {
+			container["startupProbe"] = probe
+		}
+	}
+	if err := unstructured.SetNestedSlice(updated.Object, containers, "spec", "template", "spec", "containers"); err != nil {
+		return err
+	}
+
+	profile, set, err := unstructured.NestedMap(stored.Object, "spec", "template", "spec", "securityContext", "seccompProfile")
+	if err != nil || !set {
+		return err
+	}
+
+	return unstructured.SetNestedMap(updated.Object, profile, "spec", "template", "spec", "securityContext", "seccompProfile")
+}
+
+// newerFields brings the startup probe and seccomp profile of an LM service in line with the spec. Workloads updated by
+// others through an older Kubernetes API lose them, which are added back here.
+func (r *ReconcileALM) newerFields(cr *comv1alpha1.ALM, service serviceDeploymentInfo, reqLogger logr.Logger) error {
+	resource := deploymentResource
+	if containsString(lmStatefulServices, service.serviceName) {
+		resource = statefulSetResource
+	}
+	workloads := r.dynamicClient.Resource(resource).Namespace(cr.Namespace)
+	found, err := workloads.Get(service.serviceName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !metav1.IsControlledBy(found, cr) || found.GetDeletionTimestamp() != nil {
+		return nil
+	}
+
+	changed, err := setNewerFields(found, cr, service)
+	if err != nil || !changed {
+		return err
+	}
+
+	reqLogger.Info(fmt.Sprintf("Updating startup probe and seccomp profile of %s", service.serviceName), "Namespace", cr.Namespace, "Name", service.serviceName)
+	if _, err := workloads.Update(found, metav1.UpdateOptions{}); err != nil {
+		reqLogger.Info(fmt.Sprintf("Failed to update startup probe and seccomp profile of %s", service.serviceName), "Namespace", cr.Namespace, "Name", service.serviceName, "Error", err)
+		return err
+	}
+
+	return nil
+}
+
+// workloadsNewerFields brings the startup probes and seccomp profiles of the LM services in line with the spec
+func (r *ReconcileALM) workloadsNewerFields(cr *comv1alpha1.ALM, deploymentInfo deploymentInfo, reqLogger logr.Logger) error {
+	for _, service := range deploymentInfo.services() {
+		if err := r.newerFields(cr, service, reqLogger); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
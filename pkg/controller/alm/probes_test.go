@@ -0,0 +1,107 @@
+package alm
+
+import (
+	"testing"
+
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestBuildProbes(t *testing.T) {
+	disabled := false
+	tests := []struct {
+		name              string
+		service           serviceDeploymentInfo
+		wantLivenessDelay int32
+		wantStartup       bool
+	}{
+		{"startup probes", serviceDeploymentInfo{startupProbes: true}, 0, true},
+		{"no startup probes", serviceDeploymentInfo{}, 300, false},
+		{"own liveness delay", serviceDeploymentInfo{probes: comv1alpha1.ProbesSpec{Liveness: comv1alpha1.ProbeSpec{InitialDelaySeconds: 60}}}, 60, false},
+		{"startup disabled", serviceDeploymentInfo{startupProbes: true, probes: comv1alpha1.ProbesSpec{Startup: comv1alpha1.ProbeSpec{Enabled: &disabled}}}, 0, false},
+	}
+	for _, test := range tests {
+		liveness, readiness := buildProbes(false, test.service)
+		if liveness.InitialDelaySeconds != test.wantLivenessDelay {
+			t.Errorf("%s: liveness delay = %d, want %d", test.name, liveness.InitialDelaySeconds, test.wantLivenessDelay)
+		}
+		if liveness.HTTPGet.Path != lmInfoPath || readiness.HTTPGet.Path != lmHealthPath {
+			t.Errorf("%s: paths = %s and %s, want liveness on %s and readiness on %s", test.name, liveness.HTTPGet.Path, readiness.HTTPGet.Path, lmInfoPath, lmHealthPath)
+		}
+		if startup := buildStartupProbe(false, test.service); (startup != nil) != test.wantStartup {
+			t.Errorf("%s: startup probe = %+v, want %v", test.name, startup, test.wantStartup)
+		}
+	}
+}
+
+func probedWorkload() *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{"name": "ishtar"},
+						map[string]interface{}{"name": "log-shipper"},
+					},
+				},
+			},
+		},
+	}}
+}
+
+func TestSetStartupProbe(t *testing.T) {
+	service := serviceDeploymentInfo{serviceName: "ishtar", startupProbes: true}
+	workload := probedWorkload()
+
+	changed, err := setStartupProbe(workload, "ishtar", buildStartupProbe(true, service))
+	if err != nil || !changed {
+		t.Fatalf("setStartupProbe() = %v, %v, want the startup probe added", changed, err)
+	}
+	containers, _, _ := unstructured.NestedSlice(workload.Object, "spec", "template", "spec", "containers")
+	path, _, _ := unstructured.NestedString(containers[0].(map[string]interface{}), "startupProbe", "httpGet", "path")
+	threshold, _, _ := unstructured.NestedInt64(containers[0].(map[string]interface{}), "startupProbe", "failureThreshold")
+	if path != lmInfoPath || threshold != 30 {
+		t.Errorf("startup probe = %v, want %s checked 30 times", containers[0], lmInfoPath)
+	}
+	if _, set := containers[1].(map[string]interface{})["startupProbe"]; set {
+		t.Errorf("startup probe added to the sidecar")
+	}
+
+	if changed, err := setStartupProbe(workload, "ishtar", buildStartupProbe(true, service)); err != nil || changed {
+		t.Errorf("setStartupProbe() = %v, %v, want an unchanged startup probe left alone", changed, err)
+	}
+
+	if changed, err := setStartupProbe(workload, "ishtar", nil); err != nil || !changed {
+		t.Fatalf("setStartupProbe() = %v, %v, want the startup probe removed", changed, err)
+	}
+	containers, _, _ = unstructured.NestedSlice(workload.Object, "spec", "template", "spec", "containers")
+	if _, set := containers[0].(map[string]interface{})["startupProbe"]; set {
+		t.Errorf("startup probe left set")
+	}
+}
+
+func TestKeepNewerFields(t *testing.T) {
+	stored := probedWorkload()
+	if _, err := setStartupProbe(stored, "ishtar", buildStartupProbe(true, serviceDeploymentInfo{serviceName: "ishtar", startupProbes: true})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := setSeccompProfile(stored, podSecuritySettings{restricted: true, seccompProfile: true}); err != nil {
+		t.Fatal(err)
+	}
+	// read through the typed API, which drops both
+	updated := probedWorkload()
+
+	if err := keepNewerFields(stored, updated); err != nil {
+		t.Fatalf("keepNewerFields() error = %v", err)
+	}
+	containers, _, _ := unstructured.NestedSlice(updated.Object, "spec", "template", "spec", "containers")
+	if path, _, _ := unstructured.NestedString(containers[0].(map[string]interface{}), "startupProbe", "httpGet", "path"); path != lmInfoPath {
+		t.Errorf("startup probe = %v, want the stored one kept", containers[0])
+	}
+	if _, set := containers[1].(map[string]interface{})["startupProbe"]; set {
+		t.Errorf("startup probe added to the sidecar")
+	}
+	if profile, _, _ := unstructured.NestedString(updated.Object, "spec", "template", "spec", "securityContext", "seccompProfile", "type"); profile != "RuntimeDefault" {
+		t.Errorf("seccomp profile = %q, want the stored one kept", profile)
+	}
+}
@@ -0,0 +1,206 @@
+package alm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// configMapReferencesIndex and secretReferencesIndex index ALMs by the ConfigMaps and Secrets they refer to, so
+	// that changes to them can be mapped back to the ALMs
+	configMapReferencesIndex = "spec.configMapReferences"
+	secretReferencesIndex    = "spec.secretReferences"
+)
+
+// podTemplateSources returns the ConfigMaps and Secrets consumed by the partial pod templates in the spec. Invalid pod
+// templates are left out, they stop the ALM from being reconciled anyway.
+func podTemplateSources(cr *comv1alpha1.ALM) ([]string, []string) {
+	var configMaps, secrets []string
+	for _, raw := range []*runtime.RawExtension{cr.Spec.PodTemplate, cr.Spec.Conductor.PodTemplate, cr.Spec.Apollo.PodTemplate,
+		cr.Spec.Galileo.PodTemplate, cr.Spec.Talledega.PodTemplate, cr.Spec.Daytona.PodTemplate, cr.Spec.Relay.PodTemplate,
+		cr.Spec.Watchtower.PodTemplate, cr.Spec.Doki.PodTemplate, cr.Spec.Nimrod.PodTemplate, cr.Spec.Ishtar.PodTemplate,
+		cr.Spec.Brent.PodTemplate} {
+		if raw == nil || len(raw.Raw) == 0 {
+			continue
+		}
+
+		template := corev1.PodTemplateSpec{}
+		if err := json.Unmarshal(raw.Raw, &template); err != nil {
+			continue
+		}
+		templateConfigMaps, templateSecrets := podConfigSources(&template.Spec)
+		for _, name := range templateConfigMaps {
+			if !containsString(configMaps, name) {
+				configMaps = append(configMaps, name)
+			}
+		}
+		for _, name := range templateSecrets {
+			if !containsString(secrets, name) {
+				secrets = append(secrets, name)
+			}
+		}
+	}
+
+	return configMaps, secrets
+}
+
+// specReferences returns the ConfigMaps and Secrets named in the spec that the operator and LM configurator do not
+// create themselves: the Nimrod themes and locales, the trusted CAs and those consumed by the partial pod templates
+func specReferences(cr *comv1alpha1.ALM) ([]string, []string) {
+	configMaps, secrets := podTemplateSources(cr)
+	for _, name := range []string{cr.Spec.Nimrod.ThemesConfigMap, cr.Spec.Nimrod.LocalesConfigMap, cr.Spec.TrustedCA.ConfigMap} {
+		if name != "" && !containsString(configMaps, name) {
+			configMaps = append(configMaps, name)
+		}
+	}
+	if name := cr.Spec.TrustedCA.Secret; name != "" && !containsString(secrets, name) {
+		secrets = append(secrets, name)
+	}
+
+	// the certificate Secrets are created by the LM configurator or cert-manager
+	var external []string
+	for _, name := range secrets {
+		if !containsString(certificateSecretNames(cr), name) {
+			external = append(external, name)
+		}
+	}
+
+	return configMaps, external
+}
+
+// indexReferences indexes ALMs by the ConfigMaps and Secrets named in their spec, and by the certificate Secrets, which
+// the LM configurator or cert-manager create without making the ALM their owner
+func indexReferences(mgr manager.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(&comv1alpha1.ALM{}, configMapReferencesIndex, func(obj runtime.Object) []string {
+		configMaps, _ := specReferences(obj.(*comv1alpha1.ALM))
+		return configMaps
+	})
+	if err != nil {
+		return err
+	}
+
+	return mgr.GetFieldIndexer().IndexField(&comv1alpha1.ALM{}, secretReferencesIndex, func(obj runtime.Object) []string {
+		cr := obj.(*comv1alpha1.ALM)
+		_, secrets := specReferences(cr)
+		return append(secrets, certificateSecretNames(cr)...)
+	})
+}
+
+// enqueueReferencingALMs requeues the ALMs in the namespace of a ConfigMap or Secret that refer to it
+func enqueueReferencingALMs(c client.Client, index string) handler.EventHandler {
+	return &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(object handler.MapObject) []reconcile.Request {
+			alms := &comv1alpha1.ALMList{}
+			err := c.List(context.TODO(), client.InNamespace(object.Meta.GetNamespace()).MatchingField(index, object.Meta.GetName()), alms)
+			if err != nil {
+				log.Error(err, "Failed to list ALMs referring to changed object", "Namespace", object.Meta.GetNamespace(), "Name", object.Meta.GetName())
+				return nil
+			}
+
+			var requests []reconcile.Request
+			for _, alm := range alms.Items {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: alm.Name, Namespace: alm.Namespace}})
+			}
+			return requests
+		}),
+	}
+}
+
+// missingReferences returns the ConfigMaps and Secrets named in the spec that do not exist
+func (r *ReconcileALM) missingReferences(cr *comv1alpha1.ALM) ([]string, error) {
+	configMaps, secrets := specReferences(cr)
+
+	var missing []string
+	for _, name := range configMaps {
+		err := r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, &corev1.ConfigMap{})
+		if err != nil && errors.IsNotFound(err) {
+			missing = append(missing, fmt.Sprintf("ConfigMap %s", name))
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range secrets {
+		err := r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, &corev1.Secret{})
+		if err != nil && errors.IsNotFound(err) {
+			missing = append(missing, fmt.Sprintf("Secret %s", name))
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return missing, nil
+}
+
+// setCondition records a condition in the ALM status, keeping its transition time while its status is unchanged. It
+// returns true if the condition changed.
+func setCondition(status *comv1alpha1.ALMStatus, condition comv1alpha1.ALMCondition) bool {
+	for i, existing := range status.Conditions {
+		if existing.Type != condition.Type {
+			continue
+		}
+		if existing.Status == condition.Status && existing.Reason == condition.Reason && existing.Message == condition.Message {
+			return false
+		}
+
+		condition.LastTransitionTime = existing.LastTransitionTime
+		if existing.Status != condition.Status {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		status.Conditions[i] = condition
+		return true
+	}
+
+	condition.LastTransitionTime = metav1.Now()
+	status.Conditions = append(status.Conditions, condition)
+	return true
+}
+
+// references checks that the ConfigMaps and Secrets named in the spec exist and reports those that do not in the
+// ReferencesResolved condition and as an event. It returns false if any are missing, in which case LM services are
+// not installed or updated, as their pods would not start.
+func (r *ReconcileALM) references(cr *comv1alpha1.ALM, reqLogger logr.Logger) (bool, error) {
+	missing, err := r.missingReferences(cr)
+	if err != nil {
+		return false, err
+	}
+
+	condition := comv1alpha1.ALMCondition{
+		Type:   comv1alpha1.ALMReferencesResolved,
+		Status: corev1.ConditionTrue,
+		Reason: "ReferencesFound",
+	}
+	if len(missing) > 0 {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "MissingReferences"
+		condition.Message = fmt.Sprintf("%s not found", strings.Join(missing, ", "))
+		reqLogger.Info(fmt.Sprintf("Waiting for %s", strings.Join(missing, ", ")), "Namespace", cr.Namespace)
+	}
+
+	if !setCondition(&cr.Status, condition) {
+		return len(missing) == 0, nil
+	}
+
+	if len(missing) > 0 {
+		r.recorder.Event(cr, corev1.EventTypeWarning, condition.Reason, condition.Message)
+	}
+	if err := r.client.Status().Update(context.TODO(), cr); err != nil {
+		reqLogger.Error(err, "Failed to update ALM status.")
+		return false, err
+	}
+
+	return len(missing) == 0, nil
+}
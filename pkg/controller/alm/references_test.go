@@ -0,0 +1,65 @@
+package alm
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSpecReferences(t *testing.T) {
+	cr := almForTest()
+	cr.Spec.Nimrod.ThemesConfigMap = "nimrod-themes"
+	cr.Spec.TrustedCA.Secret = "corporate-ca"
+	cr.Spec.Ishtar.PodTemplate = rawPodTemplate(t, corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "ishtar", EnvFrom: []corev1.EnvFromSource{
+			{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "nimrod-themes"}}},
+			{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "db-credentials"}}},
+			{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "lm-certs"}}},
+		}}},
+	}})
+
+	configMaps, secrets := specReferences(cr)
+	if want := []string{"nimrod-themes"}; !reflect.DeepEqual(configMaps, want) {
+		t.Errorf("ConfigMaps = %v, want %v", configMaps, want)
+	}
+	// the certificate Secrets are created by the LM configurator or cert-manager
+	if want := []string{"db-credentials", "corporate-ca"}; !reflect.DeepEqual(secrets, want) {
+		t.Errorf("Secrets = %v, want %v", secrets, want)
+	}
+}
+
+func TestSetCondition(t *testing.T) {
+	then := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	resolved := comv1alpha1.ALMCondition{Type: comv1alpha1.ALMReferencesResolved, Status: corev1.ConditionTrue, Reason: "ReferencesFound", LastTransitionTime: then}
+	missing := comv1alpha1.ALMCondition{Type: comv1alpha1.ALMReferencesResolved, Status: corev1.ConditionFalse, Reason: "MissingReferences", Message: "Secret a not found", LastTransitionTime: then}
+
+	tests := []struct {
+		name           string
+		existing       []comv1alpha1.ALMCondition
+		condition      comv1alpha1.ALMCondition
+		wantChanged    bool
+		wantTransition bool
+	}{
+		{"new condition", nil, resolved, true, true},
+		{"unchanged", []comv1alpha1.ALMCondition{resolved}, resolved, false, false},
+		{"status changed", []comv1alpha1.ALMCondition{resolved}, missing, true, true},
+		{"message changed", []comv1alpha1.ALMCondition{missing}, comv1alpha1.ALMCondition{Type: missing.Type, Status: missing.Status, Reason: missing.Reason, Message: "Secret b not found"}, true, false},
+	}
+	for _, test := range tests {
+		status := &comv1alpha1.ALMStatus{Conditions: append([]comv1alpha1.ALMCondition(nil), test.existing...)}
+		if changed := setCondition(status, test.condition); changed != test.wantChanged {
+			t.Errorf("%s: setCondition() = %v, want %v", test.name, changed, test.wantChanged)
+		}
+		if len(status.Conditions) != 1 {
+			t.Errorf("%s: conditions = %+v, want one", test.name, status.Conditions)
+			continue
+		}
+		if transitioned := !status.Conditions[0].LastTransitionTime.Equal(&then); transitioned != test.wantTransition {
+			t.Errorf("%s: transition time = %v, want it moved %v", test.name, status.Conditions[0].LastTransitionTime, test.wantTransition)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package alm
+
+import (
+	"reflect"
+
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// topology keys the replicas of an LM service are spread across, zones are labelled with the beta label before
+// Kubernetes 1.17
+var (
+	nodeTopologyKeys = []string{"kubernetes.io/hostname"}
+	zoneTopologyKeys = []string{"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+)
+
+// getSchedulingSettings returns the scheduling of an LM service, each field set for the service overriding the one set
+// for all LM services
+func getSchedulingSettings(global comv1alpha1.SchedulingSpec, service comv1alpha1.SchedulingSpec) comv1alpha1.SchedulingSpec {
+	settings := *global.DeepCopy()
+	if len(service.NodeSelector) > 0 {
+		settings.NodeSelector = service.NodeSelector
+	}
+	if len(service.Tolerations) > 0 {
+		settings.Tolerations = service.Tolerations
+	}
+	if service.Affinity != nil {
+		settings.Affinity = service.Affinity
+	}
+	if service.PriorityClassName != "" {
+		settings.PriorityClassName = service.PriorityClassName
+	}
+
+	return settings
+}
+
+// defaultAffinity prefers to schedule the replicas of an LM service on different nodes and, with a lower weight, in
+// different zones. The Kubernetes API the operator is built against predates topology spread constraints, so the
+// spread is expressed as pod anti-affinity.
+func defaultAffinity(service serviceDeploymentInfo) *corev1.Affinity {
+	selector := &metav1.LabelSelector{
+		MatchLabels: lmSelector(service),
+	}
+
+	var terms []corev1.WeightedPodAffinityTerm
+	for _, key := range nodeTopologyKeys {
+		terms = append(terms, corev1.WeightedPodAffinityTerm{
+			Weight:          100,
+			PodAffinityTerm: corev1.PodAffinityTerm{LabelSelector: selector, TopologyKey: key},
+		})
+	}
+	for _, key := range zoneTopologyKeys {
+		terms = append(terms, corev1.WeightedPodAffinityTerm{
+			Weight:          50,
+			PodAffinityTerm: corev1.PodAffinityTerm{LabelSelector: selector, TopologyKey: key},
+		})
+	}
+
+	return &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: terms,
+		},
+	}
+}
+
+// applyScheduling sets the scheduling of an LM service on its pod spec and returns true if anything changed
+func applyScheduling(podSpec *corev1.PodSpec, service serviceDeploymentInfo) bool {
+	settings := service.scheduling
+
+	affinity := settings.Affinity
+	if affinity == nil {
+		affinity = defaultAffinity(service)
+	}
+	nodeSelector := settings.NodeSelector
+	if len(nodeSelector) == 0 {
+		nodeSelector = nil
+	}
+	tolerations := settings.Tolerations
+	if len(tolerations) == 0 {
+		tolerations = nil
+	}
+
+	changed := false
+	if !reflect.DeepEqual(podSpec.NodeSelector, nodeSelector) {
+		podSpec.NodeSelector = nodeSelector
+		changed = true
+	}
+	if !reflect.DeepEqual(podSpec.Tolerations, tolerations) {
+		podSpec.Tolerations = tolerations
+		changed = true
+	}
+	if !reflect.DeepEqual(podSpec.Affinity, affinity) {
+		podSpec.Affinity = affinity
+		changed = true
+	}
+	if podSpec.PriorityClassName != settings.PriorityClassName {
+		podSpec.PriorityClassName = settings.PriorityClassName
+		changed = true
+	}
+
+	return changed
+}
@@ -0,0 +1,190 @@
+package alm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/go-logr/logr"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// lmConfiguratorService is the name the LM configurator's ServiceAccount and settings are known by
+const lmConfiguratorService = "lm-configurator"
+
+type serviceAccountSettings struct {
+	create      bool
+	name        string
+	automount   bool
+	annotations map[string]string
+}
+
+// serviceAccountSpec returns the ServiceAccount in the spec of the LM configurator or an LM service
+func serviceAccountSpec(cr *comv1alpha1.ALM, serviceName string) comv1alpha1.ServiceAccountSpec {
+	switch serviceName {
+	case lmConfiguratorService:
+		return cr.Spec.Configurator.ServiceAccount
+	case "conductor":
+		return cr.Spec.Conductor.ServiceAccount
+	case "apollo":
+		return cr.Spec.Apollo.ServiceAccount
+	case "galileo":
+		return cr.Spec.Galileo.ServiceAccount
+	case "talledega":
+		return cr.Spec.Talledega.ServiceAccount
+	case "daytona":
+		return cr.Spec.Daytona.ServiceAccount
+	case "relay":
+		return cr.Spec.Relay.ServiceAccount
+	case "watchtower":
+		return cr.Spec.Watchtower.ServiceAccount
+	case "doki":
+		return cr.Spec.Doki.ServiceAccount
+	case "nimrod":
+		return cr.Spec.Nimrod.ServiceAccount
+	case "ishtar":
+		return cr.Spec.Ishtar.ServiceAccount
+	case "brent":
+		return cr.Spec.Brent.ServiceAccount
+	}
+
+	return comv1alpha1.ServiceAccountSpec{}
+}
+
+// getServiceAccountSettings returns the ServiceAccount the pods of the LM configurator or an LM service run as. Each
+// has its own, named <ALM name>-<service>, which mounts no API token as none of them call the Kubernetes API.
+func getServiceAccountSettings(cr *comv1alpha1.ALM, serviceName string) serviceAccountSettings {
+	spec := serviceAccountSpec(cr, serviceName)
+	settings := serviceAccountSettings{
+		create:      spec.Create == nil || *spec.Create,
+		name:        fmt.Sprintf("%s-%s", cr.Name, serviceName),
+		automount:   spec.AutomountServiceAccountToken != nil && *spec.AutomountServiceAccountToken,
+		annotations: spec.Annotations,
+	}
+	if spec.Name != "" {
+		settings.name = spec.Name
+	}
+
+	return settings
+}
+
+func buildServiceAccount(cr *comv1alpha1.ALM, serviceName string, settings serviceAccountSettings) *corev1.ServiceAccount {
+	automount := settings.automount
+	labels := almLabels(cr)
+	labels[appLabel] = serviceName
+	labels[nameLabel] = serviceName
+	labels[componentLabel] = lmComponent(serviceName)
+
+	return &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        settings.name,
+			Namespace:   cr.Namespace,
+			Labels:      labels,
+			Annotations: settings.annotations,
+		},
+		AutomountServiceAccountToken: &automount,
+	}
+}
+
+// serviceAccounts creates the ServiceAccounts of the LM configurator and LM services, and keeps the annotations and
+// token automounting of those owned by the ALM in line with the spec. ServiceAccounts the operator is not asked to
+// create must already exist.
+func (r *ReconcileALM) serviceAccounts(cr *comv1alpha1.ALM, reqLogger logr.Logger) error {
+	for _, serviceName := range append([]string{lmConfiguratorService}, lmServices...) {
+		settings := getServiceAccountSettings(cr, serviceName)
+		if !settings.create {
+			continue
+		}
+
+		desired := buildServiceAccount(cr, serviceName, settings)
+		found := &corev1.ServiceAccount{}
+		err := r.client.Get(context.TODO(), types.NamespacedName{Name: settings.name, Namespace: cr.Namespace}, found)
+		if err != nil && errors.IsNotFound(err) {
+			if err := controllerutil.SetControllerReference(cr, desired, r.scheme); err != nil {
+				return err
+			}
+
+			reqLogger.Info(fmt.Sprintf("Creating a new %s ServiceAccount", serviceName), "Namespace", cr.Namespace, "Name", settings.name)
+			if err := r.client.Create(context.TODO(), desired); err != nil {
+				reqLogger.Info(fmt.Sprintf("Failed to create a new %s ServiceAccount", serviceName), "Namespace", cr.Namespace, "Name", settings.name, "Error", err)
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if !metav1.IsControlledBy(found, cr) {
+			continue
+		}
+
+		labelsChanged := addLabels(&found.Labels, desired.Labels)
+		if !labelsChanged && reflect.DeepEqual(found.AutomountServiceAccountToken, desired.AutomountServiceAccountToken) &&
+			containsValues(stringMap(found.Annotations), stringMap(settings.annotations)) {
+			continue
+		}
+
+		reqLogger.Info(fmt.Sprintf("Updating %s ServiceAccount", serviceName), "Namespace", cr.Namespace, "Name", settings.name)
+		found.Annotations = mergeAnnotations(found.Annotations, settings.annotations)
+		found.AutomountServiceAccountToken = desired.AutomountServiceAccountToken
+		if err := r.client.Update(context.TODO(), found); err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to update %s ServiceAccount", serviceName), "Namespace", cr.Namespace, "Name", settings.name, "Error", err)
+			return err
+		}
+	}
+
+	return r.removeLegacyServiceAccount(cr, reqLogger)
+}
+
+// legacyServiceAccountName is the ServiceAccount earlier versions of the operator created for conductor and the
+// configurator to authenticate with Vault
+func legacyServiceAccountName(cr *comv1alpha1.ALM) string {
+	return fmt.Sprintf("%s-lm", cr.Name)
+}
+
+// removeLegacyServiceAccount deletes the ServiceAccount earlier versions of the operator created, once no pod runs as it
+// any more. It is kept if the spec names it as the ServiceAccount of a service.
+func (r *ReconcileALM) removeLegacyServiceAccount(cr *comv1alpha1.ALM, reqLogger logr.Logger) error {
+	name := legacyServiceAccountName(cr)
+	for _, serviceName := range append([]string{lmConfiguratorService}, lmServices...) {
+		if getServiceAccountSettings(cr, serviceName).name == name {
+			return nil
+		}
+	}
+
+	found := &corev1.ServiceAccount{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !metav1.IsControlledBy(found, cr) {
+		return nil
+	}
+
+	// pods still being replaced keep their token until they are gone
+	pods := &corev1.PodList{}
+	if err := r.client.List(context.TODO(), client.InNamespace(cr.Namespace), pods); err != nil {
+		return err
+	}
+	for _, pod := range pods.Items {
+		if pod.Spec.ServiceAccountName == name {
+			return nil
+		}
+	}
+
+	reqLogger.Info(fmt.Sprintf("Deleting ServiceAccount %s, replaced by the ServiceAccounts of each service", name), "Namespace", cr.Namespace, "Name", name)
+	if err := r.client.Delete(context.TODO(), found); err != nil && !errors.IsNotFound(err) {
+		reqLogger.Info(fmt.Sprintf("Failed to delete ServiceAccount %s", name), "Namespace", cr.Namespace, "Name", name, "Error", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package alm
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRemoveLegacyServiceAccount(t *testing.T) {
+	cr := almForTest()
+	controller := true
+	legacy := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "awesome-lm", Namespace: "lm",
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: "com.accantosystems.stratoss/v1alpha1", Kind: "ALM", Name: cr.Name, UID: cr.UID, Controller: &controller}}}}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "conductor-0", Namespace: "lm"}, Spec: corev1.PodSpec{ServiceAccountName: "awesome-lm"}}
+	r, _ := reconcilerForTest(t, cr, legacy, pod)
+	key := types.NamespacedName{Name: "awesome-lm", Namespace: "lm"}
+
+	if err := r.removeLegacyServiceAccount(cr, log); err != nil {
+		t.Fatalf("removeLegacyServiceAccount() error = %v", err)
+	}
+	if err := r.client.Get(context.TODO(), key, &corev1.ServiceAccount{}); err != nil {
+		t.Errorf("get ServiceAccount error = %v, want it kept while a pod runs as it", err)
+	}
+
+	if err := r.client.Delete(context.TODO(), pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.removeLegacyServiceAccount(cr, log); err != nil {
+		t.Fatalf("removeLegacyServiceAccount() error = %v", err)
+	}
+	if err := r.client.Get(context.TODO(), key, &corev1.ServiceAccount{}); !errors.IsNotFound(err) {
+		t.Errorf("get ServiceAccount error = %v, want it deleted", err)
+	}
+}
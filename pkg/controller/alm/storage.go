@@ -0,0 +1,228 @@
+package alm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// lmDataVolume is the name of the volume claim template of LM services with persistent storage
+	lmDataVolume = "data"
+
+	defaultStorageSize      = "10Gi"
+	defaultStorageMountPath = "/var/lm/logs"
+
+	// expansionFailedAnnotation records the size a claim could not be expanded to, so that it is only reported once
+	expansionFailedAnnotation = "com.accantosystems.stratoss/expansion-failed"
+)
+
+type storageSettings struct {
+	enabled          bool
+	storageClassName *string
+	size             resource.Quantity
+	mountPath        string
+}
+
+// getStorageSettings returns the persistent storage of an LM service. Only LM services run as StatefulSets have it.
+func getStorageSettings(serviceName string, spec comv1alpha1.StorageSpec) (storageSettings, error) {
+	settings := storageSettings{
+		enabled:   spec.Enabled && containsString(lmStatefulServices, serviceName),
+		mountPath: defaultStorageMountPath,
+	}
+	if spec.StorageClassName != "" {
+		settings.storageClassName = &spec.StorageClassName
+	}
+	if spec.MountPath != "" {
+		settings.mountPath = spec.MountPath
+	}
+
+	size := defaultStorageSize
+	if spec.Size != "" {
+		size = spec.Size
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return settings, fmt.Errorf("Invalid storage size %s for %s: %s", size, serviceName, err)
+	}
+	settings.size = quantity
+
+	return settings, nil
+}
+
+// validateStorage rejects persistent storage enabled for LM services that run as Deployments, which cannot have it
+func validateStorage(cr *comv1alpha1.ALM) error {
+	specs := []struct {
+		serviceName string
+		spec        comv1alpha1.StorageSpec
+	}{
+		{"apollo", cr.Spec.Apollo.Storage}, {"talledega", cr.Spec.Talledega.Storage}, {"daytona", cr.Spec.Daytona.Storage},
+		{"relay", cr.Spec.Relay.Storage}, {"watchtower", cr.Spec.Watchtower.Storage}, {"doki", cr.Spec.Doki.Storage},
+		{"nimrod", cr.Spec.Nimrod.Storage}, {"ishtar", cr.Spec.Ishtar.Storage}, {"brent", cr.Spec.Brent.Storage},
+	}
+
+	var unsupported []string
+	for _, s := range specs {
+		if s.spec.Enabled {
+			unsupported = append(unsupported, s.serviceName)
+		}
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("Persistent storage is enabled for %s, which run as Deployments, only %s can have it",
+			strings.Join(unsupported, ", "), strings.Join(lmStatefulServices, " and "))
+	}
+
+	return nil
+}
+
+func buildVolumeClaimTemplate(service serviceDeploymentInfo) corev1.PersistentVolumeClaim {
+	return corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   lmDataVolume,
+			Labels: lmLabels(service),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: service.storage.storageClassName,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: service.storage.size,
+				},
+			},
+		},
+	}
+}
+
+// applyStorage adds the volume claim template of an LM service with persistent storage to its StatefulSet
+func applyStorage(statefulSet *appsv1.StatefulSet, service serviceDeploymentInfo) {
+	if !service.storage.enabled {
+		return
+	}
+
+	statefulSet.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{buildVolumeClaimTemplate(service)}
+	containers := statefulSet.Spec.Template.Spec.Containers
+	for i := range containers {
+		containers[i].VolumeMounts = append(containers[i].VolumeMounts, corev1.VolumeMount{
+			Name:      lmDataVolume,
+			MountPath: service.storage.mountPath,
+		})
+	}
+}
+
+// storageChanged returns true if the StatefulSet's volume claim template or where it is mounted no longer match the
+// spec. Volume claim templates cannot be changed, so the StatefulSet has to be recreated. Changes to the size are also
+// made to the existing claims by resizeClaims, the template gives the size to claims of pods added later.
+func storageChanged(statefulSet *appsv1.StatefulSet, service serviceDeploymentInfo) bool {
+	var template *corev1.PersistentVolumeClaim
+	for i := range statefulSet.Spec.VolumeClaimTemplates {
+		if statefulSet.Spec.VolumeClaimTemplates[i].Name == lmDataVolume {
+			template = &statefulSet.Spec.VolumeClaimTemplates[i]
+		}
+	}
+	if template == nil || !service.storage.enabled {
+		return (template == nil) == service.storage.enabled
+	}
+
+	if service.storage.storageClassName != nil && (template.Spec.StorageClassName == nil || *template.Spec.StorageClassName != *service.storage.storageClassName) {
+		return true
+	}
+	if size := template.Spec.Resources.Requests[corev1.ResourceStorage]; size.Cmp(service.storage.size) != 0 {
+		return true
+	}
+
+	for _, container := range statefulSet.Spec.Template.Spec.Containers {
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == lmDataVolume && mount.MountPath != service.storage.mountPath {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// serviceClaims returns the PersistentVolumeClaims created from the volume claim template of an LM service's
+// StatefulSet. Claims created before LM objects carried the instance label are matched by the app label alone.
+func (r *ReconcileALM) serviceClaims(cr *comv1alpha1.ALM, service serviceDeploymentInfo) ([]*corev1.PersistentVolumeClaim, error) {
+	instanceClaims := &corev1.PersistentVolumeClaimList{}
+	err := r.client.List(context.TODO(), client.InNamespace(cr.Namespace).MatchingLabels(map[string]string{appLabel: service.serviceName, instanceLabel: service.instance}), instanceClaims)
+	if err != nil {
+		return nil, err
+	}
+	appClaims := &corev1.PersistentVolumeClaimList{}
+	err = r.client.List(context.TODO(), client.InNamespace(cr.Namespace).MatchingLabels(map[string]string{appLabel: service.serviceName}), appClaims)
+	if err != nil {
+		return nil, err
+	}
+
+	// claims created from the template are named <template>-<StatefulSet>-<ordinal>
+	prefix := fmt.Sprintf("%s-%s-", lmDataVolume, service.serviceName)
+	var claims []*corev1.PersistentVolumeClaim
+	for i := range instanceClaims.Items {
+		if strings.HasPrefix(instanceClaims.Items[i].Name, prefix) {
+			claims = append(claims, &instanceClaims.Items[i])
+		}
+	}
+	for i := range appClaims.Items {
+		if _, labelled := appClaims.Items[i].Labels[instanceLabel]; !labelled && strings.HasPrefix(appClaims.Items[i].Name, prefix) {
+			claims = append(claims, &appClaims.Items[i])
+		}
+	}
+
+	return claims, nil
+}
+
+// resizeClaims expands the PersistentVolumeClaims of an LM service's StatefulSet to the size in the spec. Kubernetes
+// rejects the change unless the claim's storage class allows volume expansion, which is reported on the ALM once for
+// each size. Claims are never shrunk.
+func (r *ReconcileALM) resizeClaims(cr *comv1alpha1.ALM, service serviceDeploymentInfo, reqLogger logr.Logger) error {
+	if !service.storage.enabled {
+		return nil
+	}
+
+	claims, err := r.serviceClaims(cr, service)
+	if err != nil {
+		return err
+	}
+
+	for _, claim := range claims {
+		size := claim.Spec.Resources.Requests[corev1.ResourceStorage]
+		if size.Cmp(service.storage.size) >= 0 {
+			continue
+		}
+
+		reqLogger.Info(fmt.Sprintf("Expanding PersistentVolumeClaim %s from %s to %s", claim.Name, size.String(), service.storage.size.String()), "Namespace", cr.Namespace, "Name", claim.Name)
+		expanded := claim.DeepCopy()
+		expanded.Spec.Resources.Requests[corev1.ResourceStorage] = service.storage.size
+		delete(expanded.Annotations, expansionFailedAnnotation)
+		err := r.client.Update(context.TODO(), expanded)
+		if err == nil {
+			continue
+		}
+
+		reqLogger.Info(fmt.Sprintf("Failed to expand PersistentVolumeClaim %s", claim.Name), "Namespace", cr.Namespace, "Name", claim.Name, "Error", err)
+		if claim.Annotations[expansionFailedAnnotation] == service.storage.size.String() {
+			continue
+		}
+		r.recorder.Event(cr, corev1.EventTypeWarning, "StorageExpansionFailed",
+			fmt.Sprintf("Failed to expand PersistentVolumeClaim %s to %s, check that its storage class allows volume expansion: %s", claim.Name, service.storage.size.String(), err))
+		if claim.Annotations == nil {
+			claim.Annotations = make(map[string]string)
+		}
+		claim.Annotations[expansionFailedAnnotation] = service.storage.size.String()
+		if err := r.client.Update(context.TODO(), claim); err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to annotate PersistentVolumeClaim %s", claim.Name), "Namespace", cr.Namespace, "Name", claim.Name, "Error", err)
+			return err
+		}
+	}
+
+	return nil
+}
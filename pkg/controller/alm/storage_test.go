@@ -0,0 +1,169 @@
+package alm
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// rejectingExpansionClient rejects changes to the size of claims, as Kubernetes does without allowVolumeExpansion
+type rejectingExpansionClient struct {
+	client.Client
+}
+
+func (c rejectingExpansionClient) Update(ctx context.Context, obj runtime.Object) error {
+	if claim, ok := obj.(*corev1.PersistentVolumeClaim); ok {
+		current := &corev1.PersistentVolumeClaim{}
+		if err := c.Client.Get(ctx, types.NamespacedName{Name: claim.Name, Namespace: claim.Namespace}, current); err != nil {
+			return err
+		}
+		if current.Spec.Resources.Requests.Storage().Cmp(*claim.Spec.Resources.Requests.Storage()) != 0 {
+			return fmt.Errorf("only dynamically provisioned pvc can be resized and the storageclass that provisions the pvc must support resize")
+		}
+	}
+
+	return c.Client.Update(ctx, obj)
+}
+
+func storageService(t *testing.T, size string) serviceDeploymentInfo {
+	storage, err := getStorageSettings("conductor", comv1alpha1.StorageSpec{Enabled: true, Size: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return serviceDeploymentInfo{serviceName: "conductor", instance: "awesome", storage: storage}
+}
+
+func storageClaim(name string, labels map[string]string, size string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "lm", Labels: labels},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+			},
+		},
+	}
+}
+
+func claimSize(t *testing.T, r *ReconcileALM, name string) string {
+	claim := &corev1.PersistentVolumeClaim{}
+	if err := r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: "lm"}, claim); err != nil {
+		t.Fatal(err)
+	}
+	size := claim.Spec.Resources.Requests[corev1.ResourceStorage]
+
+	return size.String()
+}
+
+func TestResizeClaims(t *testing.T) {
+	cr := almForTest()
+	r, recorder := reconcilerForTest(t, cr,
+		storageClaim("data-conductor-0", map[string]string{appLabel: "conductor"}, "10Gi"),
+		storageClaim("data-conductor-1", map[string]string{appLabel: "conductor"}, "30Gi"),
+	)
+
+	if err := r.resizeClaims(cr, storageService(t, "20Gi"), log); err != nil {
+		t.Fatalf("resizeClaims() error = %v", err)
+	}
+	if size := claimSize(t, r, "data-conductor-0"); size != "20Gi" {
+		t.Errorf("data-conductor-0 = %s, want it expanded to 20Gi", size)
+	}
+	if size := claimSize(t, r, "data-conductor-1"); size != "30Gi" {
+		t.Errorf("data-conductor-1 = %s, want it never shrunk", size)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("events = %d, want none", len(recorder.Events))
+	}
+}
+
+func TestResizeClaimsReportsFailureOnce(t *testing.T) {
+	cr := almForTest()
+	r, recorder := reconcilerForTest(t, cr, storageClaim("data-conductor-0", map[string]string{appLabel: "conductor"}, "10Gi"))
+	r.client = rejectingExpansionClient{r.client}
+
+	for i := 0; i < 2; i++ {
+		if err := r.resizeClaims(cr, storageService(t, "20Gi"), log); err != nil {
+			t.Fatalf("resizeClaims() error = %v", err)
+		}
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("events = %d, want StorageExpansionFailed reported once", len(recorder.Events))
+	}
+
+	// a different size is reported again
+	if err := r.resizeClaims(cr, storageService(t, "40Gi"), log); err != nil {
+		t.Fatalf("resizeClaims() error = %v", err)
+	}
+	if len(recorder.Events) != 2 {
+		t.Errorf("events = %d, want StorageExpansionFailed reported for the new size", len(recorder.Events))
+	}
+}
+
+func TestServiceClaims(t *testing.T) {
+	cr := almForTest()
+	r, _ := reconcilerForTest(t, cr,
+		storageClaim("data-conductor-0", map[string]string{appLabel: "conductor", instanceLabel: "awesome"}, "10Gi"),
+		storageClaim("data-conductor-1", map[string]string{appLabel: "conductor"}, "10Gi"),
+		storageClaim("data-conductor-2", map[string]string{appLabel: "conductor", instanceLabel: "other"}, "10Gi"),
+		storageClaim("logs-conductor-0", map[string]string{appLabel: "conductor", instanceLabel: "awesome"}, "10Gi"),
+	)
+
+	claims, err := r.serviceClaims(cr, storageService(t, "20Gi"))
+	if err != nil {
+		t.Fatalf("serviceClaims() error = %v", err)
+	}
+	var names []string
+	for _, claim := range claims {
+		names = append(names, claim.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "data-conductor-0" || names[1] != "data-conductor-1" {
+		t.Errorf("claims = %v, want the ALM's claim and the unlabelled one", names)
+	}
+}
+
+func TestValidateStorage(t *testing.T) {
+	cr := almForTest()
+	cr.Spec.Conductor.Storage.Enabled = true
+	if err := validateStorage(cr); err != nil {
+		t.Errorf("validateStorage() error = %v, want storage allowed for conductor", err)
+	}
+
+	cr.Spec.Talledega.Storage.Enabled = true
+	if err := validateStorage(cr); err == nil {
+		t.Errorf("validateStorage() error = nil, want storage for talledega rejected")
+	}
+}
+
+func TestStorageChanged(t *testing.T) {
+	service := storageService(t, "20Gi")
+	statefulSet := &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{{Name: "conductor"}},
+	}}}}
+	applyStorage(statefulSet, service)
+
+	tests := []struct {
+		name    string
+		service serviceDeploymentInfo
+		want    bool
+	}{
+		{"unchanged", service, false},
+		{"expanded", storageService(t, "30Gi"), true},
+		{"disabled", serviceDeploymentInfo{serviceName: "conductor"}, true},
+	}
+	for _, test := range tests {
+		if got := storageChanged(statefulSet, test.service); got != test.want {
+			t.Errorf("%s: storageChanged() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package alm
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	trustedCAVolume      = "trusted-ca"
+	trustedCADir         = "/var/lm/trusted-ca"
+	trustedCAFile        = "ca.crt"
+	truststoreVolume     = "truststore"
+	truststoreDir        = "/var/lm/truststore"
+	truststoreFile       = "truststore.jks"
+	truststoreContainer  = "truststore"
+	truststoreOptionsEnv = "JAVA_TOOL_OPTIONS"
+
+	// truststorePassword is the password of the JVM's own cacerts the truststore is copied from. The truststore holds
+	// only public certificates, the password just guards it against changes.
+	truststorePassword = "changeit"
+)
+
+// truststoreScript copies the JVM's cacerts, wherever the JRE of the image keeps them, and imports each certificate of
+// the trusted CA bundle into the copy. The JRE is found from JAVA_HOME or else the java on the path. It fails if there
+// are no cacerts to copy, as keytool would otherwise create a truststore trusting only the trusted CAs.
+var truststoreScript = fmt.Sprintf(`set -e
+java_home="$JAVA_HOME"
+if [ -z "$java_home" ] && command -v java >/dev/null 2>&1; then
+  java_home=$(dirname "$(dirname "$(readlink -f "$(command -v java)")")")
+fi
+keytool=keytool
+if [ -x "$java_home/bin/keytool" ]; then keytool="$java_home/bin/keytool"; fi
+copied=
+for cacerts in "$java_home/lib/security/cacerts" "$java_home/jre/lib/security/cacerts"; do
+  if [ -z "$copied" ] && [ -f "$cacerts" ]; then cp "$cacerts" %[2]s/%[3]s; chmod u+w %[2]s/%[3]s; copied=true; fi
+done
+if [ -z "$copied" ]; then
+  echo "No JVM cacerts found under JAVA_HOME or the java on the path, cannot build the truststore" >&2
+  exit 1
+fi
+awk '/-----BEGIN CERTIFICATE-----/ { n++ } n { print > ("%[2]s/trusted-ca-" n ".pem") }' %[1]s/%[4]s
+for cert in %[2]s/trusted-ca-*.pem; do
+  [ -f "$cert" ] || continue
+  alias=$(basename "$cert" .pem)
+  "$keytool" -importcert -noprompt -alias "$alias" -file "$cert" -keystore %[2]s/%[3]s -storepass %[5]s
+  rm "$cert"
+done
+`, trustedCADir, truststoreDir, truststoreFile, trustedCAFile, truststorePassword)
+
+type trustedCASettings struct {
+	enabled   bool
+	configMap string
+	secret    string
+	key       string
+}
+
+// getTrustedCASettings returns the ConfigMap or Secret holding the PEM encoded certificates of the CAs the LM JVMs
+// trust, in addition to those the JVM trusts itself
+func getTrustedCASettings(spec comv1alpha1.TrustedCASpec) (trustedCASettings, error) {
+	if spec.ConfigMap != "" && spec.Secret != "" {
+		return trustedCASettings{}, fmt.Errorf("Invalid trustedCA, only one of configMap or secret may be set")
+	}
+
+	settings := trustedCASettings{
+		enabled:   spec.ConfigMap != "" || spec.Secret != "",
+		configMap: spec.ConfigMap,
+		secret:    spec.Secret,
+		key:       spec.Key,
+	}
+	if settings.key == "" {
+		settings.key = trustedCAFile
+	}
+
+	return settings, nil
+}
+
+// truststoreOptions are the JVM options selecting the truststore
+func truststoreOptions() string {
+	return fmt.Sprintf("-Djavax.net.ssl.trustStore=%s/%s -Djavax.net.ssl.trustStorePassword=%s", truststoreDir, truststoreFile, truststorePassword)
+}
+
+func buildTrustedCAVolumes(settings trustedCASettings) []corev1.Volume {
+	items := []corev1.KeyToPath{{Key: settings.key, Path: trustedCAFile}}
+	source := corev1.VolumeSource{}
+	if settings.secret != "" {
+		source.Secret = &corev1.SecretVolumeSource{
+			SecretName:  settings.secret,
+			Items:       items,
+			DefaultMode: int32Ptr(corev1.SecretVolumeSourceDefaultMode),
+		}
+	} else {
+		source.ConfigMap = &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: settings.configMap},
+			Items:                items,
+			DefaultMode:          int32Ptr(corev1.ConfigMapVolumeSourceDefaultMode),
+		}
+	}
+
+	return []corev1.Volume{
+		{
+			Name:         trustedCAVolume,
+			VolumeSource: source,
+		},
+		{
+			Name: truststoreVolume,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		},
+	}
+}
+
+// buildTruststoreContainer returns the init container building the truststore with the keytool of the LM service's
+// image, pulled and run the same way as the LM service
+func buildTruststoreContainer(image string, imagePullPolicy corev1.PullPolicy, securityContext *corev1.SecurityContext) corev1.Container {
+	return corev1.Container{
+		Name:            truststoreContainer,
+		Image:           image,
+		ImagePullPolicy: imagePullPolicy,
+		Command:         []string{"/bin/sh", "-c", truststoreScript},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      trustedCAVolume,
+				MountPath: trustedCADir,
+				ReadOnly:  true,
+			},
+			{
+				Name:      truststoreVolume,
+				MountPath: truststoreDir,
+			},
+		},
+		SecurityContext:          securityContext,
+		TerminationMessagePath:   corev1.TerminationMessagePathDefault,
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+	}
+}
+
+// applyTrustedCA builds a truststore holding the trusted CAs in the spec with an init container, and has the JVMs of
+// the pod's containers use it. The init container, volumes, mounts and options are removed once trustedCA is unset.
+// It returns true if the pod template changed.
+func applyTrustedCA(podSpec *corev1.PodSpec, service serviceDeploymentInfo) bool {
+	changed := false
+	settings := service.trustedCA
+
+	var image string
+	var imagePullPolicy corev1.PullPolicy
+	for _, container := range podSpec.Containers {
+		if container.Name == service.serviceName {
+			image = container.Image
+			imagePullPolicy = container.ImagePullPolicy
+		}
+	}
+	if settings.enabled && image == "" {
+		return false
+	}
+
+	// the init container
+	var initContainers []corev1.Container
+	for _, container := range podSpec.InitContainers {
+		if container.Name != truststoreContainer {
+			initContainers = append(initContainers, container)
+			continue
+		}
+		if !settings.enabled {
+			changed = true
+		}
+	}
+	if settings.enabled {
+		_, securityContext := buildSecurityContexts(service.podSecurity)
+		desired := buildTruststoreContainer(image, imagePullPolicy, securityContext)
+		found := false
+		for _, container := range podSpec.InitContainers {
+			if container.Name == truststoreContainer {
+				found = true
+				if !reflect.DeepEqual(container, desired) {
+					changed = true
+				}
+			}
+		}
+		if !found {
+			changed = true
+		}
+		// the truststore is built before any other init container runs
+		initContainers = append([]corev1.Container{desired}, initContainers...)
+	}
+	podSpec.InitContainers = initContainers
+
+	// the volumes
+	var desiredVolumes []corev1.Volume
+	if settings.enabled {
+		desiredVolumes = buildTrustedCAVolumes(settings)
+	}
+	var volumes []corev1.Volume
+	for _, volume := range podSpec.Volumes {
+		if volume.Name != trustedCAVolume && volume.Name != truststoreVolume {
+			volumes = append(volumes, volume)
+			continue
+		}
+		kept := false
+		for i, desired := range desiredVolumes {
+			if desired.Name == volume.Name {
+				if !reflect.DeepEqual(volume, desired) {
+					changed = true
+				}
+				volumes = append(volumes, desired)
+				desiredVolumes = append(desiredVolumes[:i], desiredVolumes[i+1:]...)
+				kept = true
+				break
+			}
+		}
+		if !kept {
+			changed = true
+		}
+	}
+	if len(desiredVolumes) > 0 {
+		volumes = append(volumes, desiredVolumes...)
+		changed = true
+	}
+	podSpec.Volumes = volumes
+
+	// the mounts and JVM options of the containers
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+
+		mounted := false
+		var mounts []corev1.VolumeMount
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == truststoreVolume {
+				if !settings.enabled || mounted {
+					changed = true
+					continue
+				}
+				mounted = true
+			}
+			mounts = append(mounts, mount)
+		}
+		if settings.enabled && !mounted {
+			mounts = append(mounts, corev1.VolumeMount{Name: truststoreVolume, MountPath: truststoreDir, ReadOnly: true})
+			changed = true
+		}
+		container.VolumeMounts = mounts
+
+		// the options are added to any the container sets itself, or the pod template in the spec sets for it
+		set := false
+		var env []corev1.EnvVar
+		for _, envVar := range container.Env {
+			if envVar.Name != truststoreOptionsEnv {
+				env = append(env, envVar)
+				continue
+			}
+			set = true
+			if envVar.ValueFrom != nil {
+				if settings.enabled {
+					envVar = corev1.EnvVar{Name: truststoreOptionsEnv, Value: truststoreOptions()}
+					changed = true
+				}
+				env = append(env, envVar)
+				continue
+			}
+
+			value := strings.TrimSpace(strings.Replace(envVar.Value, truststoreOptions(), "", -1))
+			if settings.enabled {
+				value = strings.TrimSpace(value + " " + truststoreOptions())
+			}
+			if value == "" {
+				changed = true
+				continue
+			}
+			if value != envVar.Value {
+				envVar.Value = value
+				changed = true
+			}
+			env = append(env, envVar)
+		}
+		if settings.enabled && !set {
+			env = append(env, corev1.EnvVar{Name: truststoreOptionsEnv, Value: truststoreOptions()})
+			changed = true
+		}
+		container.Env = env
+	}
+
+	return changed
+}
@@ -0,0 +1,125 @@
+package alm
+
+import (
+	"testing"
+
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+)
+
+func TestGetTrustedCASettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    comv1alpha1.TrustedCASpec
+		want    trustedCASettings
+		wantErr bool
+	}{
+		{"unset", comv1alpha1.TrustedCASpec{}, trustedCASettings{key: trustedCAFile}, false},
+		{"ConfigMap", comv1alpha1.TrustedCASpec{ConfigMap: "corporate-ca"}, trustedCASettings{enabled: true, configMap: "corporate-ca", key: trustedCAFile}, false},
+		{"Secret with a key", comv1alpha1.TrustedCASpec{Secret: "corporate-ca", Key: "bundle.pem"}, trustedCASettings{enabled: true, secret: "corporate-ca", key: "bundle.pem"}, false},
+		{"ConfigMap and Secret", comv1alpha1.TrustedCASpec{ConfigMap: "corporate-ca", Secret: "corporate-ca"}, trustedCASettings{}, true},
+	}
+	for _, test := range tests {
+		got, err := getTrustedCASettings(test.spec)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: getTrustedCASettings() error = %v, wantErr %v", test.name, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: getTrustedCASettings() = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func trustedCAService(enabled bool) serviceDeploymentInfo {
+	service := serviceDeploymentInfo{serviceName: "ishtar"}
+	if enabled {
+		service.trustedCA = trustedCASettings{enabled: true, configMap: "corporate-ca", key: trustedCAFile}
+	}
+
+	return service
+}
+
+func trustedCAPodSpec(env ...corev1.EnvVar) *corev1.PodSpec {
+	return &corev1.PodSpec{
+		Containers: []corev1.Container{
+			{Name: "ishtar", Image: "accanto/ishtar:2.0.0", Env: env},
+			{Name: "log-shipper", Image: "fluent-bit:1.0"},
+		},
+	}
+}
+
+func envValue(container corev1.Container, name string) (string, bool) {
+	for _, envVar := range container.Env {
+		if envVar.Name == name {
+			return envVar.Value, true
+		}
+	}
+
+	return "", false
+}
+
+func TestApplyTrustedCA(t *testing.T) {
+	podSpec := trustedCAPodSpec()
+	if !applyTrustedCA(podSpec, trustedCAService(true)) {
+		t.Fatalf("applyTrustedCA() = false, want true when the truststore is added")
+	}
+
+	if len(podSpec.InitContainers) != 1 || podSpec.InitContainers[0].Name != truststoreContainer || podSpec.InitContainers[0].Image != "accanto/ishtar:2.0.0" {
+		t.Errorf("init containers = %+v, want the truststore container with the service's image", podSpec.InitContainers)
+	}
+	if len(podSpec.Volumes) != 2 {
+		t.Errorf("volumes = %+v, want the trusted CA and truststore volumes", podSpec.Volumes)
+	}
+	// sidecars use the truststore as well
+	for _, container := range podSpec.Containers {
+		if value, _ := envValue(container, truststoreOptionsEnv); value != truststoreOptions() {
+			t.Errorf("%s: %s = %q, want %q", container.Name, truststoreOptionsEnv, value, truststoreOptions())
+		}
+		if len(container.VolumeMounts) != 1 || container.VolumeMounts[0].Name != truststoreVolume {
+			t.Errorf("%s: mounts = %+v, want the truststore", container.Name, container.VolumeMounts)
+		}
+	}
+
+	before := podSpec.DeepCopy()
+	if applyTrustedCA(podSpec, trustedCAService(true)) || !apiequality.Semantic.DeepEqual(before, podSpec) {
+		t.Errorf("applyTrustedCA() changed a pod spec it had already set up")
+	}
+
+	if !applyTrustedCA(podSpec, trustedCAService(false)) {
+		t.Fatalf("applyTrustedCA() = false, want true when the truststore is removed")
+	}
+	if !apiequality.Semantic.DeepEqual(podSpec, trustedCAPodSpec()) {
+		t.Errorf("pod spec = %+v, want the truststore removed", podSpec)
+	}
+}
+
+func TestApplyTrustedCAKeepsJavaToolOptions(t *testing.T) {
+	own := "-Xmx512m"
+	podSpec := trustedCAPodSpec(corev1.EnvVar{Name: truststoreOptionsEnv, Value: own})
+
+	applyTrustedCA(podSpec, trustedCAService(true))
+	want := own + " " + truststoreOptions()
+	if value, _ := envValue(podSpec.Containers[0], truststoreOptionsEnv); value != want {
+		t.Errorf("%s = %q, want %q", truststoreOptionsEnv, value, want)
+	}
+	if applyTrustedCA(podSpec, trustedCAService(true)) {
+		t.Errorf("applyTrustedCA() = true, want the options appended only once")
+	}
+
+	applyTrustedCA(podSpec, trustedCAService(false))
+	if value, _ := envValue(podSpec.Containers[0], truststoreOptionsEnv); value != own {
+		t.Errorf("%s = %q, want the container's own %q", truststoreOptionsEnv, value, own)
+	}
+	if _, set := envValue(podSpec.Containers[1], truststoreOptionsEnv); set {
+		t.Errorf("%s left set on the sidecar", truststoreOptionsEnv)
+	}
+}
+
+func TestApplyTrustedCAWithoutServiceContainer(t *testing.T) {
+	podSpec := &corev1.PodSpec{Containers: []corev1.Container{{Name: "other"}}}
+	if applyTrustedCA(podSpec, trustedCAService(true)) {
+		t.Errorf("applyTrustedCA() = true, want the pod spec left alone without the service's image")
+	}
+}
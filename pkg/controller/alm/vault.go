@@ -0,0 +1,439 @@
+package alm
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	resty "github.com/go-resty/resty/v2"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// vaultTokenAudience is the audience of the projected service account tokens LM pods log in to Vault with
+	vaultTokenAudience = "vault"
+	vaultTokenDir      = "/var/run/secrets/vault"
+	vaultTokenFile     = vaultTokenDir + "/token"
+)
+
+type vaultSettings struct {
+	kubernetesAuth  bool
+	address         string
+	authPath        string
+	role            string
+	policies        []string
+	kubernetesHost  string
+	serviceAccounts []string
+	adminSecret     string
+	tokenSecret     string
+	tokenKey        string
+	caSecret        string
+	caKey           string
+	insecure        bool
+	manageSecrets   bool
+	secretsMount    string
+	secretsPath     string
+}
+
+func getVaultSettings(cr *comv1alpha1.ALM) vaultSettings {
+	settings := vaultSettings{
+		kubernetesAuth:  cr.Spec.Vault.KubernetesAuth,
+		address:         "https://vault:8200",
+		authPath:        "kubernetes",
+		role:            fmt.Sprintf("%s-lm", cr.Name),
+		policies:        []string{"lm"},
+		kubernetesHost:  "https://kubernetes.default.svc",
+		serviceAccounts: []string{getServiceAccountSettings(cr, "conductor").name, getServiceAccountSettings(cr, lmConfiguratorService).name},
+		adminSecret:     cr.Spec.Vault.AdminSecret,
+		tokenSecret:     "vault-token",
+		tokenKey:        "lmToken",
+		caSecret:        "vault-cert",
+		caKey:           "ca.crt",
+		insecure:        cr.Spec.Vault.InsecureSkipVerify,
+		manageSecrets:   cr.Spec.Vault.ManageSecrets,
+		secretsMount:    "secret",
+		secretsPath:     "lm",
+	}
+
+	if cr.Spec.Vault.Address != "" {
+		settings.address = strings.TrimSuffix(cr.Spec.Vault.Address, "/")
+	}
+	if cr.Spec.Vault.AuthPath != "" {
+		settings.authPath = strings.Trim(cr.Spec.Vault.AuthPath, "/")
+	}
+	if cr.Spec.Vault.Role != "" {
+		settings.role = cr.Spec.Vault.Role
+	}
+	if len(cr.Spec.Vault.Policies) > 0 {
+		settings.policies = cr.Spec.Vault.Policies
+	}
+	if cr.Spec.Vault.KubernetesHost != "" {
+		settings.kubernetesHost = cr.Spec.Vault.KubernetesHost
+	}
+	if cr.Spec.Vault.TokenSecret != "" {
+		settings.tokenSecret = cr.Spec.Vault.TokenSecret
+	}
+	if cr.Spec.Vault.TokenKey != "" {
+		settings.tokenKey = cr.Spec.Vault.TokenKey
+	}
+	if cr.Spec.Vault.CASecret != "" {
+		settings.caSecret = cr.Spec.Vault.CASecret
+	}
+	if cr.Spec.Vault.CAKey != "" {
+		settings.caKey = cr.Spec.Vault.CAKey
+	}
+	if cr.Spec.Vault.SecretsMount != "" {
+		settings.secretsMount = strings.Trim(cr.Spec.Vault.SecretsMount, "/")
+	}
+	if cr.Spec.Vault.SecretsPath != "" {
+		settings.secretsPath = strings.Trim(cr.Spec.Vault.SecretsPath, "/")
+	}
+
+	return settings
+}
+
+// endpoint returns the scheme, host and port of the Vault address
+func (s vaultSettings) endpoint() (string, string, string) {
+	u, err := url.Parse(s.address)
+	if err != nil || u.Hostname() == "" {
+		return "https", "vault", "8200"
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "8200"
+	}
+
+	return u.Scheme, u.Hostname(), port
+}
+
+// tokenEnv returns environment variables holding the static LM token, one for each name
+func (s vaultSettings) tokenEnv(names ...string) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	for _, name := range names {
+		env = append(env, corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: s.tokenSecret,
+					},
+					Key: s.tokenKey,
+				},
+			},
+		})
+	}
+
+	return env
+}
+
+// springKubernetesAuthEnv returns environment variables that switch each Spring Vault client, identified by its
+// property prefix, to Kubernetes auth
+func (s vaultSettings) springKubernetesAuthEnv(prefixes ...string) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	for _, prefix := range prefixes {
+		env = append(env,
+			corev1.EnvVar{Name: prefix + "_AUTHENTICATION", Value: "KUBERNETES"},
+			corev1.EnvVar{Name: prefix + "_KUBERNETES_ROLE", Value: s.role},
+			corev1.EnvVar{Name: prefix + "_KUBERNETES_KUBERNETES_PATH", Value: s.authPath},
+			corev1.EnvVar{Name: prefix + "_KUBERNETES_SERVICE_ACCOUNT_TOKEN_FILE", Value: vaultTokenFile})
+	}
+
+	return env
+}
+
+// applyKubernetesAuth mounts a projected token of the pod's ServiceAccount it can log in to Vault with
+func (s vaultSettings) applyKubernetesAuth(podSpec *corev1.PodSpec) {
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: "vault-token",
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          vaultTokenAudience,
+							ExpirationSeconds: int64Ptr(3600),
+							Path:              "token",
+						},
+					},
+				},
+			},
+		},
+	})
+
+	for i := range podSpec.Containers {
+		podSpec.Containers[i].VolumeMounts = append(podSpec.Containers[i].VolumeMounts, corev1.VolumeMount{
+			Name:      "vault-token",
+			MountPath: vaultTokenDir,
+			ReadOnly:  true,
+		})
+	}
+}
+
+type Vault struct {
+	restClient *resty.Client
+	address    string
+	token      string
+}
+
+func NewVault(client *resty.Client, address string, token string) *Vault {
+	return &Vault{
+		restClient: client,
+		address:    address,
+		token:      token,
+	}
+}
+
+func (v *Vault) request() *resty.Request {
+	req := v.restClient.R().SetHeader("Content-Type", "application/json")
+	if v.token != "" {
+		req.SetHeader("X-Vault-Token", v.token)
+	}
+
+	return req
+}
+
+// health returns an error unless Vault is initialized and unsealed
+func (v *Vault) health() error {
+	resp, err := v.request().Get(fmt.Sprintf("%s/v1/sys/health", v.address))
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode() {
+	case http.StatusOK, http.StatusTooManyRequests:
+		// active or standby
+		return nil
+	case http.StatusNotImplemented:
+		return fmt.Errorf("Vault %s is not initialized", v.address)
+	case http.StatusServiceUnavailable:
+		return fmt.Errorf("Vault %s is sealed", v.address)
+	}
+
+	return fmt.Errorf("Vault %s health check returned %d: %s", v.address, resp.StatusCode(), resp)
+}
+
+// read returns the data at a path, or nil if there is nothing there
+func (v *Vault) read(path string) (map[string]interface{}, error) {
+	resp, err := v.request().Get(fmt.Sprintf("%s/v1/%s", v.address, path))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode() == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("GET %s returned %d: %s", path, resp.StatusCode(), resp)
+	}
+
+	result := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, err
+	}
+
+	return result.Data, nil
+}
+
+func (v *Vault) write(path string, body interface{}) error {
+	resp, err := v.request().SetBody(body).Post(fmt.Sprintf("%s/v1/%s", v.address, path))
+	if err != nil {
+		return err
+	}
+
+	if resp.IsError() {
+		return fmt.Errorf("POST %s returned %d: %s", path, resp.StatusCode(), resp)
+	}
+
+	return nil
+}
+
+// configureKubernetesAuth enables the Kubernetes auth method if it is not mounted yet, points it at the
+// Kubernetes API if it has no config and binds the LM role to the ServiceAccounts of conductor and the LM configurator
+func configureKubernetesAuth(vault *Vault, settings vaultSettings, namespace string, reqLogger logr.Logger) error {
+	mounts, err := vault.read("sys/auth")
+	if err != nil {
+		return fmt.Errorf("Failed to list Vault auth methods: %s", err)
+	}
+
+	if _, ok := mounts[settings.authPath+"/"]; !ok {
+		reqLogger.Info(fmt.Sprintf("Enabling Vault Kubernetes auth at %s", settings.authPath))
+		if err := vault.write(fmt.Sprintf("sys/auth/%s", settings.authPath), map[string]interface{}{"type": "kubernetes"}); err != nil {
+			return fmt.Errorf("Failed to enable Vault Kubernetes auth at %s: %s", settings.authPath, err)
+		}
+	}
+
+	config, err := vault.read(fmt.Sprintf("auth/%s/config", settings.authPath))
+	if err != nil {
+		return fmt.Errorf("Failed to read Vault Kubernetes auth config: %s", err)
+	}
+	if config == nil || config["kubernetes_host"] == nil || config["kubernetes_host"] == "" {
+		reqLogger.Info(fmt.Sprintf("Configuring Vault Kubernetes auth at %s", settings.authPath), "KubernetesHost", settings.kubernetesHost)
+		if err := vault.write(fmt.Sprintf("auth/%s/config", settings.authPath), map[string]interface{}{"kubernetes_host": settings.kubernetesHost}); err != nil {
+			return fmt.Errorf("Failed to configure Vault Kubernetes auth at %s: %s", settings.authPath, err)
+		}
+	}
+
+	rolePath := fmt.Sprintf("auth/%s/role/%s", settings.authPath, settings.role)
+	role := map[string]interface{}{
+		"bound_service_account_names":      settings.serviceAccounts,
+		"bound_service_account_namespaces": []string{namespace},
+		"policies":                         settings.policies,
+		"audience":                         vaultTokenAudience,
+		"ttl":                              "1h",
+	}
+
+	current, err := vault.read(rolePath)
+	if err != nil {
+		return fmt.Errorf("Failed to read Vault role %s: %s", settings.role, err)
+	}
+	if current == nil || !roleMatches(current, settings, namespace) {
+		reqLogger.Info(fmt.Sprintf("Writing Vault role %s", settings.role), "ServiceAccounts", strings.Join(settings.serviceAccounts, ","), "Policies", strings.Join(settings.policies, ","))
+		if err := vault.write(rolePath, role); err != nil {
+			return fmt.Errorf("Failed to write Vault role %s: %s", settings.role, err)
+		}
+	}
+
+	return nil
+}
+
+// roleMatches compares the bindings and policies of a Vault role with the settings
+func roleMatches(role map[string]interface{}, settings vaultSettings, namespace string) bool {
+	return sameStrings(role["bound_service_account_names"], settings.serviceAccounts) &&
+		sameStrings(role["bound_service_account_namespaces"], []string{namespace}) &&
+		(sameStrings(role["policies"], settings.policies) || sameStrings(role["token_policies"], settings.policies))
+}
+
+func sameStrings(value interface{}, expected []string) bool {
+	values, ok := value.([]interface{})
+	if !ok || len(values) != len(expected) {
+		return false
+	}
+
+	actual := make([]string, len(values))
+	for i, v := range values {
+		actual[i] = fmt.Sprintf("%v", v)
+	}
+	sorted := append([]string{}, expected...)
+	sort.Strings(actual)
+	sort.Strings(sorted)
+
+	return reflect.DeepEqual(actual, sorted)
+}
+
+// vaultRestClient returns a client that trusts the CA in the Vault CA Secret. Without a CA Secret, Vault's certificate
+// is only left unverified, by the shared client, if insecureSkipVerify is set, as the admin token is sent to it.
+func (r *ReconcileALM) vaultRestClient(cr *comv1alpha1.ALM, settings vaultSettings) (*resty.Client, error) {
+	ca, err := r.secretValue(cr, settings.caSecret, settings.caKey)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if ca == "" {
+		if scheme, _, _ := settings.endpoint(); scheme == "http" || settings.insecure {
+			return r.restClient, nil
+		}
+		return nil, fmt.Errorf("Key %s of Secret %s does not hold Vault's CA certificate, set vault.insecureSkipVerify to call Vault without verifying its certificate", settings.caKey, settings.caSecret)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(ca)) {
+		return nil, fmt.Errorf("Key %s of Secret %s is not a PEM encoded certificate", settings.caKey, settings.caSecret)
+	}
+
+	client := resty.New()
+	client.SetTLSClientConfig(&tls.Config{RootCAs: pool})
+	client.SetTimeout(2 * time.Minute)
+	return client, nil
+}
+
+// vault prepares Kubernetes auth for LM pods: it checks Vault is reachable and,
+// given an admin token, configures the auth method and role. The outcome is recorded in the ALM status.
+func (r *ReconcileALM) vault(cr *comv1alpha1.ALM, reqLogger logr.Logger) error {
+	settings := getVaultSettings(cr)
+
+	err := r.configureVault(cr, settings, reqLogger)
+
+	status := cr.Status.Vault
+	status.KubernetesAuthReady = err == nil
+	status.Role = settings.role
+	status.AuthMessage = ""
+	if err != nil {
+		status.AuthMessage = err.Error()
+	}
+
+	return r.setVaultStatus(cr, status, "VaultFailed", err, reqLogger)
+}
+
+// setVaultStatus records the Vault status, reporting err as an event with the reason if the status has changed
+func (r *ReconcileALM) setVaultStatus(cr *comv1alpha1.ALM, status comv1alpha1.VaultStatus, reason string, err error, reqLogger logr.Logger) error {
+	if reflect.DeepEqual(status, cr.Status.Vault) {
+		return err
+	}
+
+	if err != nil {
+		r.recorder.Event(cr, corev1.EventTypeWarning, reason, err.Error())
+	}
+
+	cr.Status.Vault = status
+	if err := r.client.Status().Update(context.TODO(), cr); err != nil {
+		reqLogger.Error(err, "Failed to update ALM status.")
+		return err
+	}
+
+	return err
+}
+
+func (r *ReconcileALM) configureVault(cr *comv1alpha1.ALM, settings vaultSettings, reqLogger logr.Logger) error {
+	vault, adminToken, err := r.vaultAdmin(cr, settings, reqLogger)
+	if err != nil {
+		return err
+	}
+
+	if adminToken == "" {
+		// the auth method and role are managed outside the operator
+		return nil
+	}
+
+	if err := configureKubernetesAuth(vault, settings, cr.Namespace, reqLogger); err != nil {
+		reqLogger.Error(err, "Failed to configure Vault Kubernetes auth")
+		return err
+	}
+
+	return nil
+}
+
+// vaultAdmin returns a Vault client logged in with the admin token, if there is one, after checking Vault is available
+func (r *ReconcileALM) vaultAdmin(cr *comv1alpha1.ALM, settings vaultSettings, reqLogger logr.Logger) (*Vault, string, error) {
+	adminToken, err := r.secretValue(cr, settings.adminSecret, "token")
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to read Vault admin Secret %s", settings.adminSecret), "Namespace", cr.Namespace)
+		return nil, "", err
+	}
+
+	client, err := r.vaultRestClient(cr, settings)
+	if err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Failed to read Vault CA Secret %s", settings.caSecret), "Namespace", cr.Namespace)
+		return nil, "", err
+	}
+
+	vault := NewVault(client, settings.address, adminToken)
+	if err := vault.health(); err != nil {
+		reqLogger.Error(err, fmt.Sprintf("Vault %s is not available", settings.address))
+		return nil, "", err
+	}
+
+	return vault, adminToken, nil
+}
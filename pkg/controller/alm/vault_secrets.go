@@ -0,0 +1,245 @@
+package alm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// rotateCredentialsAnnotation regenerates the LM credentials when set on the ALM to a value that has not been acted on before
+const rotateCredentialsAnnotation = "com.accantosystems.stratoss/rotate-lm-credentials"
+
+// lmCredentialKeys are the generated LM credentials, named after the configurator settings they replace
+var lmCredentialKeys = []string{"securityLmClientSecret", "securityNimrodClientSecret", "securityDokiClientSecret", "securityKeyStorePassword"}
+
+// lmCredentialsSecretName is the Secret holding the generated LM credentials
+func lmCredentialsSecretName(cr *comv1alpha1.ALM) string {
+	return fmt.Sprintf("%s-lm-credentials", cr.Name)
+}
+
+// lmVaultPolicy allows LM to read its secrets
+func lmVaultPolicy(settings vaultSettings) string {
+	return fmt.Sprintf("path \"%[1]s/data/%[2]s\" {\n  capabilities = [\"read\"]\n}\n\n"+
+		"path \"%[1]s/data/%[2]s/*\" {\n  capabilities = [\"read\"]\n}\n\n"+
+		"path \"%[1]s/metadata/%[2]s/*\" {\n  capabilities = [\"read\", \"list\"]\n}\n", settings.secretsMount, settings.secretsPath)
+}
+
+// readKV returns the data of a KV version 2 secret, or nil if it does not exist
+func (v *Vault) readKV(mount string, path string) (map[string]interface{}, error) {
+	secret, err := v.read(fmt.Sprintf("%s/data/%s", mount, path))
+	if err != nil || secret == nil {
+		return nil, err
+	}
+
+	data, _ := secret["data"].(map[string]interface{})
+	return data, nil
+}
+
+func (v *Vault) writeKV(mount string, path string, data map[string]interface{}) error {
+	return v.write(fmt.Sprintf("%s/data/%s", mount, path), map[string]interface{}{"data": data})
+}
+
+// bootstrapVaultSecrets enables LM's KV secret engine and writes LM's policy and credentials where they are missing
+// or different. Keys under the LM application path that the operator does not manage are kept.
+func bootstrapVaultSecrets(vault *Vault, settings vaultSettings, credentials map[string]string, reqLogger logr.Logger) error {
+	mounts, err := vault.read("sys/mounts")
+	if err != nil {
+		return fmt.Errorf("Failed to list Vault secret engines: %s", err)
+	}
+
+	if mount, ok := mounts[settings.secretsMount+"/"]; !ok {
+		reqLogger.Info(fmt.Sprintf("Enabling Vault KV secret engine at %s", settings.secretsMount))
+		err := vault.write(fmt.Sprintf("sys/mounts/%s", settings.secretsMount), map[string]interface{}{
+			"type":    "kv",
+			"options": map[string]interface{}{"version": "2"},
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to enable Vault KV secret engine at %s: %s", settings.secretsMount, err)
+		}
+	} else if !kvVersion2(mount) {
+		return fmt.Errorf("Vault secret engine %s is not a KV version 2 engine", settings.secretsMount)
+	}
+
+	policyName := settings.policies[0]
+	policy, err := vault.read(fmt.Sprintf("sys/policies/acl/%s", policyName))
+	if err != nil {
+		return fmt.Errorf("Failed to read Vault policy %s: %s", policyName, err)
+	}
+	if policy == nil || policy["policy"] != lmVaultPolicy(settings) {
+		reqLogger.Info(fmt.Sprintf("Writing Vault policy %s", policyName))
+		if err := vault.write(fmt.Sprintf("sys/policies/acl/%s", policyName), map[string]interface{}{"policy": lmVaultPolicy(settings)}); err != nil {
+			return fmt.Errorf("Failed to write Vault policy %s: %s", policyName, err)
+		}
+	}
+
+	path := fmt.Sprintf("%s/application", settings.secretsPath)
+	data, err := vault.readKV(settings.secretsMount, path)
+	if err != nil {
+		return fmt.Errorf("Failed to read Vault secret %s/%s: %s", settings.secretsMount, path, err)
+	}
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+
+	changed := false
+	for k, v := range credentials {
+		if data[k] != v {
+			data[k] = v
+			changed = true
+		}
+	}
+
+	if changed {
+		reqLogger.Info(fmt.Sprintf("Writing LM credentials to Vault secret %s/%s", settings.secretsMount, path))
+		if err := vault.writeKV(settings.secretsMount, path, data); err != nil {
+			return fmt.Errorf("Failed to write Vault secret %s/%s: %s", settings.secretsMount, path, err)
+		}
+	}
+
+	return nil
+}
+
+func kvVersion2(mount interface{}) bool {
+	m, ok := mount.(map[string]interface{})
+	if !ok || m["type"] != "kv" {
+		return false
+	}
+
+	options, _ := m["options"].(map[string]interface{})
+	return options != nil && options["version"] == "2"
+}
+
+// generateLMCredentials returns a new password for each LM credential
+func generateLMCredentials() (map[string][]byte, error) {
+	credentials := make(map[string][]byte)
+	for _, key := range lmCredentialKeys {
+		password, err := generatePassword()
+		if err != nil {
+			return nil, err
+		}
+		credentials[key] = []byte(password)
+	}
+
+	return credentials, nil
+}
+
+// lmCredentials returns the generated LM credentials, creating the Secret that holds them if necessary and
+// regenerating them if rotate is set
+func (r *ReconcileALM) lmCredentials(cr *comv1alpha1.ALM, rotate bool, reqLogger logr.Logger) (map[string]string, error) {
+	secretName := lmCredentialsSecretName(cr)
+	secret := &corev1.Secret{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: secretName, Namespace: cr.Namespace}, secret)
+	if err != nil && errors.IsNotFound(err) {
+		reqLogger.Info("Creating a new LM credentials Secret", "Namespace", cr.Namespace, "Name", secretName)
+
+		data, err := generateLMCredentials()
+		if err != nil {
+			return nil, err
+		}
+
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: cr.Namespace,
+				Name:      secretName,
+				Labels:    almLabels(cr),
+			},
+			Data: data,
+		}
+
+		if err := controllerutil.SetControllerReference(cr, secret, r.scheme); err != nil {
+			return nil, err
+		}
+
+		if err := r.client.Create(context.TODO(), secret); err != nil {
+			reqLogger.Info("Failed to create a new LM credentials Secret", "Namespace", cr.Namespace, "Name", secretName, "Error", err)
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if rotate {
+		reqLogger.Info("Rotating LM credentials", "Namespace", cr.Namespace, "Name", secretName)
+
+		data, err := generateLMCredentials()
+		if err != nil {
+			return nil, err
+		}
+
+		secret.Data = data
+		if err := r.client.Update(context.TODO(), secret); err != nil {
+			reqLogger.Info("Failed to update LM credentials Secret", "Namespace", cr.Namespace, "Name", secretName, "Error", err)
+			return nil, err
+		}
+	}
+
+	credentials := make(map[string]string)
+	for _, key := range lmCredentialKeys {
+		credentials[key] = string(secret.Data[key])
+	}
+
+	return credentials, nil
+}
+
+// rotationRequested returns the value of the rotate annotation if it has not been acted on yet
+func rotationRequested(cr *comv1alpha1.ALM) (string, bool) {
+	rotation, ok := cr.Annotations[rotateCredentialsAnnotation]
+	if !ok || rotation == "" || rotation == cr.Status.Vault.LastRotation {
+		return "", false
+	}
+
+	return rotation, true
+}
+
+// vaultSecrets makes sure LM's secret engine, policy and credentials exist in Vault and rotates the credentials
+// when requested. The outcome is recorded in the ALM status.
+func (r *ReconcileALM) vaultSecrets(cr *comv1alpha1.ALM, reqLogger logr.Logger) error {
+	settings := getVaultSettings(cr)
+	rotation, rotate := rotationRequested(cr)
+
+	err := r.bootstrapVault(cr, settings, rotate, reqLogger)
+
+	status := cr.Status.Vault
+	status.SecretsReady = err == nil
+	status.SecretsMessage = ""
+	if err != nil {
+		status.SecretsMessage = err.Error()
+	} else if rotate {
+		status.LastRotation = rotation
+		r.recorder.Event(cr, corev1.EventTypeNormal, "LMCredentialsRotated",
+			fmt.Sprintf("Rotated LM credentials (%s), re-run the LM configurator and restart LM services to use them", rotation))
+	}
+
+	return r.setVaultStatus(cr, status, "VaultSecretsFailed", err, reqLogger)
+}
+
+func (r *ReconcileALM) bootstrapVault(cr *comv1alpha1.ALM, settings vaultSettings, rotate bool, reqLogger logr.Logger) error {
+	vault, adminToken, err := r.vaultAdmin(cr, settings, reqLogger)
+	if err != nil {
+		return err
+	}
+
+	if adminToken == "" {
+		err := fmt.Errorf("vault.adminSecret must be set to manage LM's Vault secrets")
+		reqLogger.Error(err, "Failed to bootstrap Vault")
+		return err
+	}
+
+	credentials, err := r.lmCredentials(cr, rotate, reqLogger)
+	if err != nil {
+		reqLogger.Error(err, "Failed to get LM credentials")
+		return err
+	}
+
+	if err := bootstrapVaultSecrets(vault, settings, credentials, reqLogger); err != nil {
+		reqLogger.Error(err, "Failed to bootstrap Vault")
+		return err
+	}
+
+	return nil
+}
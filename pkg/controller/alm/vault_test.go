@@ -0,0 +1,47 @@
+package alm
+
+import (
+	"testing"
+
+	resty "github.com/go-resty/resty/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestVaultRestClient(t *testing.T) {
+	invalidCA := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "vault-cert", Namespace: "lm"},
+		Data:       map[string][]byte{"ca.crt": []byte("not a certificate")},
+	}
+	tests := []struct {
+		name     string
+		address  string
+		insecure bool
+		objects  []runtime.Object
+		shared   bool
+		wantErr  bool
+	}{
+		{"no CA Secret", "", false, nil, false, true},
+		{"no CA Secret, insecureSkipVerify", "", true, nil, true, false},
+		{"no CA Secret, http", "http://vault:8200", false, nil, true, false},
+		{"invalid CA", "", true, []runtime.Object{invalidCA}, false, true},
+	}
+	for _, test := range tests {
+		cr := almForTest()
+		cr.Spec.Vault.Address = test.address
+		cr.Spec.Vault.InsecureSkipVerify = test.insecure
+		shared := resty.New()
+		r := &ReconcileALM{client: fake.NewFakeClient(test.objects...), restClient: shared}
+
+		client, err := r.vaultRestClient(cr, getVaultSettings(cr))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: vaultRestClient() error = %v, wantErr %v", test.name, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && (client == shared) != test.shared {
+			t.Errorf("%s: vaultRestClient() returned the shared client = %v, want %v", test.name, client == shared, test.shared)
+		}
+	}
+}
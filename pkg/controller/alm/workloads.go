@@ -0,0 +1,477 @@
+package alm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/go-logr/logr"
+	comv1alpha1 "github.com/orgs/accanto-systems/lm-operator/pkg/apis/com/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// lmServices are the LM services in the order they are installed, which is also the order they are restarted in
+var lmServices = []string{"conductor", "apollo", "galileo", "talledega", "daytona", "relay", "watchtower", "doki", "nimrod", "ishtar", "brent"}
+
+// lmStatefulServices are the LM services run as StatefulSets, each governed by a headless Service
+var lmStatefulServices = []string{"conductor", "galileo"}
+
+// lmWorkload is the Deployment or StatefulSet running an LM service
+type lmWorkload struct {
+	deployment  *appsv1.Deployment
+	statefulSet *appsv1.StatefulSet
+}
+
+func (w *lmWorkload) object() runtime.Object {
+	if w.statefulSet != nil {
+		return w.statefulSet
+	}
+
+	return w.deployment
+}
+
+func (w *lmWorkload) template() *corev1.PodTemplateSpec {
+	if w.statefulSet != nil {
+		return &w.statefulSet.Spec.Template
+	}
+
+	return &w.deployment.Spec.Template
+}
+
+// mountsSecret returns true if the pods mount any of the Secrets
+func (w *lmWorkload) mountsSecret(secretNames []string) bool {
+	for _, volume := range w.template().Spec.Volumes {
+		var mounted []string
+		if volume.Secret != nil {
+			mounted = append(mounted, volume.Secret.SecretName)
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil {
+					mounted = append(mounted, source.Secret.Name)
+				}
+			}
+		}
+
+		for _, name := range mounted {
+			if containsString(secretNames, name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// restart changes the pod template so that the pods are replaced with ones stamped with revision
+func (w *lmWorkload) restart(revision string) {
+	template := w.template()
+	if template.Annotations == nil {
+		template.Annotations = make(map[string]string)
+	}
+	template.Annotations[certificatesRevisionAnnotation] = revision
+}
+
+// container returns the container running the LM service in the pod template, or nil if there is none
+func (w *lmWorkload) container(name string) *corev1.Container {
+	containers := w.template().Spec.Containers
+	for i := range containers {
+		if containers[i].Name == name {
+			return &containers[i]
+		}
+	}
+
+	return nil
+}
+
+// applySettings brings the parts of the pod template that can be changed in the spec after the service is installed in
+// line with it. It returns true if anything changed, in which case the pods are replaced.
+func (w *lmWorkload) applySettings(cr *comv1alpha1.ALM, service serviceDeploymentInfo) (bool, error) {
+	changed := false
+	before := w.template().DeepCopy()
+
+	container := w.container(service.serviceName)
+	if container == nil {
+		return false, nil
+	}
+
+	livenessProbe, readinessProbe := buildProbes(cr.Spec.Secure, service)
+	if !reflect.DeepEqual(container.LivenessProbe, livenessProbe) {
+		container.LivenessProbe = livenessProbe
+		changed = true
+	}
+	if !reflect.DeepEqual(container.ReadinessProbe, readinessProbe) {
+		container.ReadinessProbe = readinessProbe
+		changed = true
+	}
+
+	if applyScheduling(&w.template().Spec, service) {
+		changed = true
+	}
+	if applyPodSecurity(w.template(), service) {
+		changed = true
+	}
+
+	// conductor configures its peers from the number of replicas
+	for i := range container.Env {
+		if container.Env[i].Name == "numReplicas" && container.Env[i].Value != strconv.Itoa(int(service.numReplicas)) {
+			container.Env[i].Value = strconv.Itoa(int(service.numReplicas))
+			changed = true
+		}
+	}
+
+	// merged after the settings above, as the pod template in the spec may override any of them
+	merged, err := applyPodTemplate(w.template(), service.podTemplate)
+	if err != nil {
+		return false, fmt.Errorf("Failed to merge podTemplate for %s: %s", service.serviceName, err)
+	}
+	// the truststore is set up in every container, including sidecars added by the pod template, the same way the
+	// workload is built at install
+	trusted := applyTrustedCA(&w.template().Spec, service)
+
+	// settings overridden by the pod template in the spec are reset above and merged again, leaving the pods as they are
+	return (changed || merged || trusted) && !apiequality.Semantic.DeepEqual(before, w.template()), nil
+}
+
+// replicas returns the number of replicas in the spec of the workload, which Kubernetes defaults to 1
+func (w *lmWorkload) replicas() int32 {
+	var replicas *int32
+	if w.statefulSet != nil {
+		replicas = w.statefulSet.Spec.Replicas
+	} else {
+		replicas = w.deployment.Spec.Replicas
+	}
+	if replicas == nil {
+		return 1
+	}
+
+	return *replicas
+}
+
+// scale sets the number of replicas of the LM service, unless it is autoscaled. StatefulSets are scaled one replica at
+// a time, each step waiting for the previous one to roll out, so that services such as galileo rebalance their Kafka
+// Streams partitions a step at a time. It returns whether the replicas changed and whether more steps are pending.
+func (w *lmWorkload) scale(service serviceDeploymentInfo) (bool, bool) {
+	if autoscaled(service) {
+		return false, false
+	}
+
+	current := w.replicas()
+	desired := service.numReplicas
+	if current == desired {
+		return false, false
+	}
+
+	if w.deployment != nil {
+		w.deployment.Spec.Replicas = int32Ptr(desired)
+		return true, false
+	}
+
+	if !w.rolledOut() {
+		return false, true
+	}
+
+	next := current + 1
+	if desired < current {
+		next = current - 1
+	}
+	w.statefulSet.Spec.Replicas = int32Ptr(next)
+
+	return true, next != desired
+}
+
+// rolledOut returns true once every pod is running the current pod template and is ready
+func (w *lmWorkload) rolledOut() bool {
+	if w.statefulSet != nil {
+		s := w.statefulSet
+		replicas := int32(1)
+		if s.Spec.Replicas != nil {
+			replicas = *s.Spec.Replicas
+		}
+		return s.Status.ObservedGeneration >= s.Generation &&
+			s.Status.UpdateRevision == s.Status.CurrentRevision && s.Status.ReadyReplicas == replicas
+	}
+
+	d := w.deployment
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+	return d.Status.ObservedGeneration >= d.Generation && d.Status.Replicas == replicas &&
+		d.Status.UpdatedReplicas == replicas && d.Status.AvailableReplicas == replicas
+}
+
+// workload returns the Deployment or StatefulSet of an LM service, or nil if it has not been created
+func (r *ReconcileALM) workload(cr *comv1alpha1.ALM, name string) (*lmWorkload, error) {
+	deployment := &appsv1.Deployment{}
+	err := r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, deployment)
+	if err == nil {
+		return &lmWorkload{deployment: deployment}, nil
+	} else if !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	statefulSet := &appsv1.StatefulSet{}
+	err = r.client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: cr.Namespace}, statefulSet)
+	if err == nil {
+		return &lmWorkload{statefulSet: statefulSet}, nil
+	} else if !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (w *lmWorkload) meta() metav1.Object {
+	if w.statefulSet != nil {
+		return w.statefulSet
+	}
+
+	return w.deployment
+}
+
+func (w *lmWorkload) selector() *metav1.LabelSelector {
+	if w.statefulSet != nil {
+		return w.statefulSet.Spec.Selector
+	}
+
+	return w.deployment.Spec.Selector
+}
+
+// instanceScoped returns true if the workload selects only the pods of the ALM. Earlier versions of the operator
+// selected pods by the app label alone.
+func (w *lmWorkload) instanceScoped(cr *comv1alpha1.ALM) bool {
+	selector := w.selector()
+	return selector != nil && selector.MatchLabels[instanceLabel] == cr.Name
+}
+
+// relabel adds the labels of the instance-scoped selector to the pods of a workload created by an earlier version of
+// the operator, and to the ReplicaSets of a Deployment, so that the workload recreated with the new selector adopts
+// them. The pods keep running and, as the Services select them by the same labels, keep receiving traffic.
+func (r *ReconcileALM) relabel(cr *comv1alpha1.ALM, workload *lmWorkload, reqLogger logr.Logger) error {
+	name := workload.meta().GetName()
+	labels := lmSelector(serviceDeploymentInfo{serviceName: name, instance: cr.Name})
+	selector := workload.selector()
+	if selector == nil || len(selector.MatchLabels) == 0 {
+		return nil
+	}
+	listOptions := client.InNamespace(cr.Namespace).MatchingLabels(selector.MatchLabels)
+
+	// the pods of a Deployment are controlled by its ReplicaSets
+	owners := []metav1.Object{workload.meta()}
+	if workload.deployment != nil {
+		replicaSets := &appsv1.ReplicaSetList{}
+		if err := r.client.List(context.TODO(), listOptions, replicaSets); err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to list ReplicaSets of %s", name), "Namespace", cr.Namespace, "Name", name, "Error", err)
+			return err
+		}
+		owners = nil
+		for i := range replicaSets.Items {
+			replicaSet := &replicaSets.Items[i]
+			if !metav1.IsControlledBy(replicaSet, workload.deployment) {
+				continue
+			}
+			owners = append(owners, replicaSet)
+			if !addLabels(&replicaSet.Labels, labels) {
+				continue
+			}
+			if err := r.client.Update(context.TODO(), replicaSet); err != nil {
+				reqLogger.Info(fmt.Sprintf("Failed to relabel ReplicaSet %s", replicaSet.Name), "Namespace", cr.Namespace, "Name", replicaSet.Name, "Error", err)
+				return err
+			}
+		}
+	}
+
+	pods := &corev1.PodList{}
+	if err := r.client.List(context.TODO(), listOptions, pods); err != nil {
+		reqLogger.Info(fmt.Sprintf("Failed to list pods of %s", name), "Namespace", cr.Namespace, "Name", name, "Error", err)
+		return err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		controlled := false
+		for _, owner := range owners {
+			if metav1.IsControlledBy(pod, owner) {
+				controlled = true
+			}
+		}
+		if !controlled || !addLabels(&pod.Labels, labels) {
+			continue
+		}
+		if err := r.client.Update(context.TODO(), pod); err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to relabel pod %s", pod.Name), "Namespace", cr.Namespace, "Name", pod.Name, "Error", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrate brings a Deployment or StatefulSet created by an earlier version of the operator, through the
+// extensions/v1beta1 or apps/v1beta1 APIs or without an owner, in line with the apps/v1 objects the operator now
+// creates. None of the changes touch the pod template, so no pods are restarted. It returns true if anything changed.
+func (w *lmWorkload) migrate(cr *comv1alpha1.ALM, r *ReconcileALM) (bool, error) {
+	changed := false
+
+	if metav1.GetControllerOf(w.meta()) == nil {
+		if err := controllerutil.SetControllerReference(cr, w.meta(), r.scheme); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	// apps/v1beta1 defaulted StatefulSets to OnDelete, which leaves pods running an old template until they are deleted
+	if w.statefulSet != nil && w.statefulSet.Spec.UpdateStrategy.Type != appsv1.RollingUpdateStatefulSetStrategyType {
+		w.statefulSet.Spec.UpdateStrategy = appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType}
+		changed = true
+	}
+
+	return changed, nil
+}
+
+// adoptWorkloads migrates the LM services' Deployments and StatefulSets that were created by an earlier version of the
+// operator. Objects controlled by something other than the ALM, or labelled as part of another ALM, are left alone.
+func (r *ReconcileALM) adoptWorkloads(cr *comv1alpha1.ALM, reqLogger logr.Logger) error {
+	for _, name := range lmServices {
+		workload, err := r.workload(cr, name)
+		if err != nil {
+			reqLogger.Error(err, fmt.Sprintf("Failed to get %s", name), "Namespace", cr.Namespace)
+			return err
+		}
+		if workload == nil {
+			continue
+		}
+		if belongsToOtherALM(cr, workload.meta()) {
+			continue
+		}
+		if workload.meta().GetDeletionTimestamp() != nil {
+			continue
+		}
+
+		if !workload.instanceScoped(cr) {
+			// the selector of a Deployment or StatefulSet cannot be changed, so its pods are relabelled and it is deleted
+			// leaving them running. It is recreated with the instance-scoped selector, adopting the pods and rolling them
+			// to its template.
+			reqLogger.Info(fmt.Sprintf("Recreating %s with instance-scoped selector", name), "Namespace", cr.Namespace, "Name", name)
+			if err := r.relabel(cr, workload, reqLogger); err != nil {
+				return err
+			}
+			if err := r.recreateWorkload(cr, workload, reqLogger); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if workload.statefulSet != nil && workload.statefulSet.Spec.ServiceName != headlessServiceName(name) {
+			// the governing Service of a StatefulSet cannot be changed, so it is deleted leaving its pods running and
+			// recreated, adopting the pods, with its headless Service
+			reqLogger.Info(fmt.Sprintf("Recreating %s StatefulSet with governing Service %s", name, headlessServiceName(name)), "Namespace", cr.Namespace, "Name", name)
+			if err := r.recreateWorkload(cr, workload, reqLogger); err != nil {
+				return err
+			}
+			continue
+		}
+
+		changed, err := workload.migrate(cr, r)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+
+		reqLogger.Info(fmt.Sprintf("Adopting %s", name), "Namespace", cr.Namespace, "Name", name)
+		if err := r.updateWorkload(workload); err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to adopt %s", name), "Namespace", cr.Namespace, "Name", name, "Error", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recreateWorkload deletes a Deployment or StatefulSet leaving its ReplicaSets, pods and claims in place, to be recreated
+// with fields that cannot be updated. The new workload adopts them and rolls the pods to its template.
+func (r *ReconcileALM) recreateWorkload(cr *comv1alpha1.ALM, workload *lmWorkload, reqLogger logr.Logger) error {
+	name := workload.meta().GetName()
+	if err := r.client.Delete(context.TODO(), workload.object(), client.PropagationPolicy(metav1.DeletePropagationOrphan)); err != nil && !errors.IsNotFound(err) {
+		reqLogger.Info(fmt.Sprintf("Failed to delete %s", name), "Namespace", cr.Namespace, "Name", name, "Error", err)
+		return err
+	}
+
+	return nil
+}
+
+// updateWorkloads applies changes to the spec to the Deployments and StatefulSets of the installed LM services. It
+// returns true if a service is still being scaled or its StatefulSet is being recreated.
+func (r *ReconcileALM) updateWorkloads(cr *comv1alpha1.ALM, deploymentInfo deploymentInfo, reqLogger logr.Logger) (bool, error) {
+	scaling := false
+	for _, service := range deploymentInfo.services() {
+		workload, err := r.workload(cr, service.serviceName)
+		if err != nil {
+			return scaling, err
+		}
+		if workload == nil || !metav1.IsControlledBy(workload.meta(), cr) {
+			continue
+		}
+		if workload.meta().GetDeletionTimestamp() != nil {
+			// being recreated, picked up by the next reconcile once it is gone
+			scaling = true
+			continue
+		}
+
+		if workload.statefulSet != nil && storageChanged(workload.statefulSet, service) {
+			// picked up by the next reconcile, which installs the StatefulSet again
+			reqLogger.Info(fmt.Sprintf("Recreating %s StatefulSet with changed storage", service.serviceName), "Namespace", cr.Namespace, "Name", service.serviceName)
+			if err := r.recreateWorkload(cr, workload, reqLogger); err != nil {
+				return scaling, err
+			}
+			scaling = true
+			continue
+		}
+		if err := r.resizeClaims(cr, service, reqLogger); err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to list PersistentVolumeClaims of %s", service.serviceName), "Namespace", cr.Namespace, "Name", service.serviceName, "Error", err)
+			return scaling, err
+		}
+
+		changed, err := workload.applySettings(cr, service)
+		if err != nil {
+			r.recorder.Event(cr, corev1.EventTypeWarning, "InvalidPodTemplate", err.Error())
+			return scaling, err
+		}
+		// hashed after the settings are applied, as they decide which ConfigMaps and Secrets the pods consume
+		reconfigured, err := r.applyConfigChecksum(cr, workload.template())
+		if err != nil {
+			return scaling, err
+		}
+		from := workload.replicas()
+		scaled, pending := workload.scale(service)
+		scaling = scaling || pending
+		if !changed && !reconfigured && !scaled {
+			continue
+		}
+
+		if scaled {
+			reqLogger.Info(fmt.Sprintf("Scaling %s from %d to %d replicas", service.serviceName, from, workload.replicas()), "Namespace", cr.Namespace, "Name", service.serviceName)
+		} else if !changed {
+			reqLogger.Info(fmt.Sprintf("Restarting %s to pick up changed configuration", service.serviceName), "Namespace", cr.Namespace, "Name", service.serviceName)
+		} else {
+			reqLogger.Info(fmt.Sprintf("Updating %s", service.serviceName), "Namespace", cr.Namespace, "Name", service.serviceName)
+		}
+		if err := r.writeWorkload(cr, workload.object(), service, false); err != nil {
+			reqLogger.Info(fmt.Sprintf("Failed to update %s", service.serviceName), "Namespace", cr.Namespace, "Name", service.serviceName, "Error", err)
+			return scaling, err
+		}
+	}
+
+	return scaling, nil
+}